@@ -1,6 +1,9 @@
 package main
 
 import (
+    "context"
+    "errors"
+    "fmt"
     "net/http"
     "os"
     "time"
@@ -10,8 +13,12 @@ import (
     "github.com/rs/cors"
     "isp-saas.com/platform/internal/handlers"
     "isp-saas.com/platform/internal/middleware"
+    "isp-saas.com/platform/internal/scheduler"
     "isp-saas.com/platform/pkg/database"
+    "isp-saas.com/platform/pkg/license"
     "isp-saas.com/platform/pkg/logger"
+    "isp-saas.com/platform/pkg/mailer"
+    "isp-saas.com/platform/pkg/payments"
     "isp-saas.com/platform/pkg/redis"
 )
 
@@ -19,6 +26,17 @@ func main() {
     godotenv.Load()
 
     log := logger.New()
+
+    // `license-keygen` prints a new license signing key and exits
+    if len(os.Args) > 1 && os.Args[1] == "license-keygen" {
+        signer, err := license.Generate()
+        if err != nil {
+            log.Fatal("Failed to generate license signing key", "error", err)
+        }
+        fmt.Printf("LICENSE_SIGNING_KEY=%s\n\n# Key ID %s\n%s", signer.PrivateKeyBase64(), signer.KeyID(), signer.PublicKeyPEM())
+        return
+    }
+
     log.Info("Starting ISP SaaS Platform API v1.2.0...")
 
     // Connect to database
@@ -29,6 +47,13 @@ func main() {
     defer db.Close()
     log.Info("Database connected successfully")
 
+    if len(os.Args) > 1 && os.Args[1] == "migrate" {
+        if err := runMigrate(db, os.Args[2:]); err != nil {
+            log.Fatal("Migration failed", "error", err)
+        }
+        return
+    }
+
     // Connect to Redis
     redisClient, err := redis.Connect()
     if err != nil {
@@ -39,14 +64,59 @@ func main() {
         defer redisClient.Close()
     }
 
-    // Run migrations
-    if err := db.RunMigrations("./migrations"); err != nil {
-        log.Fatal("Failed to run migrations", "error", err)
+    // Migrations are applied with `migrate up`; AUTO_MIGRATE=true applies
+    // them at startup instead. Either way the API refuses to serve an
+    // outdated schema.
+    migrator := db.Migrator(migrationsPath())
+    if os.Getenv("AUTO_MIGRATE") == "true" {
+        if _, err := migrator.Up(); err != nil {
+            log.Fatal("Failed to run migrations", "error", err)
+        }
+        log.Info("Migrations completed")
+    } else if err := migrator.Check(); err != nil {
+        log.Fatal("Database schema is not up to date, run `migrate up`", "error", err)
+    }
+
+    // Licenses are signed with their own Ed25519 key. Without one configured
+    // a temporary key is used, and licenses stop verifying offline once the
+    // API restarts.
+    licenseSigner, err := license.FromEnv()
+    if errors.Is(err, license.ErrNoSigningKey) {
+        log.Warn("LICENSE_SIGNING_KEY is not set, signing licenses with a temporary key; create one with `license-keygen`")
+        licenseSigner, err = license.Generate()
+    }
+    if err != nil {
+        log.Fatal("Failed to load license signing key", "error", err)
+    }
+    log.Info("License signing key loaded", "key_id", licenseSigner.KeyID())
+
+    // The log mailer writes password reset and verification links to the
+    // log, which is only meant for development
+    mail, err := mailer.New()
+    if err != nil {
+        log.Fatal("Invalid mail configuration", "error", err)
+    }
+    if _, ok := mail.(*mailer.LogMailer); ok && os.Getenv("APP_ENV") != "development" {
+        log.Warn("MAIL_DRIVER is log: emails are written to the log instead of being sent; set MAIL_DRIVER=smtp, or APP_ENV=development to silence this")
     }
-    log.Info("Migrations completed")
 
     // Initialize handlers
-    h := handlers.New(db, log)
+    h := handlers.New(db, log, mail, payments.FromEnv(), licenseSigner, redisClient)
+
+    // Background jobs. Every replica runs the scheduler and a shared lock
+    // picks one of them per run; SCHEDULER_ENABLED=false leaves only the
+    // manual trigger on this replica.
+    sched := scheduler.New(db.DB, scheduler.NewLocker(redisClient, db.DB, scheduler.Instance(), log), log)
+    for _, job := range h.Jobs() {
+        if err := sched.Register(job); err != nil {
+            log.Fatal("Failed to register job", "error", err)
+        }
+    }
+    h.SetScheduler(sched)
+    if os.Getenv("SCHEDULER_ENABLED") != "false" {
+        sched.Start(context.Background())
+        log.Info("Scheduler started")
+    }
 
     // Create router
     r := mux.NewRouter()
@@ -61,98 +131,51 @@ func main() {
     r.HandleFunc("/api/health", h.HealthCheck).Methods("GET")
     r.HandleFunc("/api/auth/login", h.Login).Methods("POST")
     r.HandleFunc("/api/auth/register", h.Register).Methods("POST")
+    r.HandleFunc("/api/auth/refresh", h.RefreshToken).Methods("POST")
+    r.HandleFunc("/api/auth/forgot-password", h.ForgotPassword).Methods("POST")
+    r.HandleFunc("/api/auth/reset-password", h.ResetPassword).Methods("POST")
+    r.HandleFunc("/api/auth/verify-email", h.VerifyEmail).Methods("POST")
+    r.HandleFunc("/api/auth/resend-verification", h.ResendVerification).Methods("POST")
     r.HandleFunc("/api/plans", h.GetPlans).Methods("GET")
     r.HandleFunc("/api/plans/{id}", h.GetPlan).Methods("GET")
+    r.HandleFunc("/api/plans/{id}/prices", h.GetPlanPrices).Methods("GET")
+    r.HandleFunc("/api/license-modules", h.GetLicenseModules).Methods("GET")
+    r.HandleFunc("/api/currencies", h.GetCurrencies).Methods("GET")
+
+    // Key that signs license files, for agents to verify them offline
+    r.HandleFunc("/api/licenses/public-key", h.GetLicensePublicKey).Methods("GET")
+
+    // Payment gateway callbacks (authenticated by the provider's signature)
+    r.HandleFunc("/api/webhooks/payments/{provider}", h.PaymentWebhook).Methods("POST")
 
-    // Agent routes
-    r.HandleFunc("/api/licenses/validate", h.ValidateLicense).Methods("POST")
-    r.HandleFunc("/api/telemetry", h.SubmitTelemetry).Methods("POST")
-    r.HandleFunc("/api/logs", h.CreateSystemLog).Methods("POST")
-    r.HandleFunc("/api/sites/report", h.ReportCachedSite).Methods("POST")
+    // Agent routes (authenticated with per-ISP API keys)
+    agentAuth := middleware.NewAgentAuth(db)
+    r.Handle("/api/licenses/validate", agentAuth.Require(middleware.PermStatus)(http.HandlerFunc(h.ValidateLicense))).Methods("POST")
+    r.Handle("/api/telemetry", agentAuth.Require(middleware.PermTelemetry)(http.HandlerFunc(h.SubmitTelemetry))).Methods("POST")
+    r.Handle("/api/logs", agentAuth.Require(middleware.PermLogs)(http.HandlerFunc(h.CreateSystemLog))).Methods("POST")
+    r.Handle("/api/sites/report", agentAuth.Require(middleware.PermSites)(http.HandlerFunc(h.ReportCachedSite))).Methods("POST")
+
+    auth := middleware.NewAuth(db)
+
+    // Two-factor login completion and enrollment (also reachable with an mfa_pending token)
+    r.Handle("/api/auth/mfa/verify", auth.MFAMiddleware(http.HandlerFunc(h.VerifyMFA))).Methods("POST")
+    r.Handle("/api/auth/mfa/enroll", auth.MFAMiddleware(http.HandlerFunc(h.EnrollMFA))).Methods("POST")
+    r.Handle("/api/auth/mfa/confirm", auth.MFAMiddleware(http.HandlerFunc(h.ConfirmMFA))).Methods("POST")
 
     // ============== PROTECTED ROUTES ==============
     api := r.PathPrefix("/api").Subrouter()
-    api.Use(middleware.AuthMiddleware)
-
-    // Auth
-    api.HandleFunc("/auth/refresh", h.RefreshToken).Methods("POST")
-
-    // Dashboard
-    api.HandleFunc("/dashboard/stats", h.GetDashboardStats).Methods("GET")
-
-    // Top Sites & Apps
-    api.HandleFunc("/sites/top", h.GetTopSites).Methods("GET")
-    api.HandleFunc("/apps/top", h.GetTopApps).Methods("GET")
-    api.HandleFunc("/apps/categories", h.GetAppCategories).Methods("GET")
-
-    // Users
-    api.HandleFunc("/users", h.GetUsers).Methods("GET")
-    api.HandleFunc("/users/{id}", h.GetUser).Methods("GET")
-    api.HandleFunc("/users/{id}", h.UpdateUser).Methods("PUT")
-    api.HandleFunc("/users/{id}", h.DeleteUser).Methods("DELETE")
-
-    // Distributors
-    api.HandleFunc("/distributors", h.GetDistributors).Methods("GET")
-    api.HandleFunc("/distributors", h.CreateDistributor).Methods("POST")
-    api.HandleFunc("/distributors/{id}", h.GetDistributor).Methods("GET")
-    api.HandleFunc("/distributors/{id}", h.UpdateDistributor).Methods("PUT")
-    api.HandleFunc("/distributors/{id}/isps", h.GetDistributorISPs).Methods("GET")
-
-    // ISPs
-    api.HandleFunc("/isps", h.GetISPs).Methods("GET")
-    api.HandleFunc("/isps", h.CreateISP).Methods("POST")
-    api.HandleFunc("/isps/{id}", h.GetISP).Methods("GET")
-    api.HandleFunc("/isps/{id}", h.UpdateISP).Methods("PUT")
-    api.HandleFunc("/isps/{id}", h.DeleteISP).Methods("DELETE")
-    api.HandleFunc("/isps/{id}/suspend", h.SuspendISP).Methods("POST")
-    api.HandleFunc("/isps/{id}/activate", h.ActivateISP).Methods("POST")
-    api.HandleFunc("/isps/{id}/telemetry", h.GetISPTelemetry).Methods("GET")
-    api.HandleFunc("/isps/{id}/dashboard", h.GetISPDashboard).Methods("GET")
-    api.HandleFunc("/isps/{id}/commercial", h.GetISPCommercialStats).Methods("GET")
-    api.HandleFunc("/isps/{id}/commercial/config", h.UpdateISPCommercialConfig).Methods("PUT")
-
-    // Licenses
-    api.HandleFunc("/licenses", h.GetLicenses).Methods("GET")
-    api.HandleFunc("/licenses", h.CreateLicense).Methods("POST")
-    api.HandleFunc("/licenses/{id}", h.GetLicense).Methods("GET")
-    api.HandleFunc("/licenses/{id}/revoke", h.RevokeLicense).Methods("POST")
-
-    // Telemetry
-    api.HandleFunc("/telemetry/stats", h.GetTelemetryStats).Methods("GET")
-    api.HandleFunc("/telemetry/history", h.GetTelemetryHistory).Methods("GET")
-
-    // Billing
-    api.HandleFunc("/invoices", h.GetInvoices).Methods("GET")
-    api.HandleFunc("/invoices", h.CreateInvoice).Methods("POST")
-    api.HandleFunc("/invoices/{id}/pay", h.MarkInvoicePaid).Methods("POST")
-    api.HandleFunc("/invoices/{id}/pdf", h.GenerateInvoicePDF).Methods("GET")
-    api.HandleFunc("/invoices/check-overdue", h.CheckOverdueInvoices).Methods("POST")
-
-    // System Logs
-    api.HandleFunc("/logs", h.GetSystemLogs).Methods("GET")
-    api.HandleFunc("/logs/stats", h.GetLogStats).Methods("GET")
-    api.HandleFunc("/logs/cleanup", h.DeleteOldLogs).Methods("DELETE")
-
-    // Settings
-    api.HandleFunc("/settings", h.GetSettings).Methods("GET")
-    api.HandleFunc("/settings/get", h.GetSetting).Methods("GET")
-    api.HandleFunc("/settings/update", h.UpdateSetting).Methods("PUT")
-
-
-	// Agent Versions (admin only)
-	api.HandleFunc("/agent/versions", h.GetAgentVersions).Methods("GET")
-	api.HandleFunc("/agent/versions", h.CreateAgentVersion).Methods("POST")
-
-	// Agent Versions (public endpoint for agents to check updates)
-	r.HandleFunc("/api/agent/version/latest", h.GetLatestAgentVersion).Methods("GET")
-	
-	// Protected Agent Version Management (admin only)
-    // CORS
+    api.Use(auth.Middleware)
+
+    registerProtectedRoutes(api, protectedRoutes(h))
+
+    // Agent Versions (public endpoint for agents to check updates)
+    r.HandleFunc("/api/agent/version/latest", h.GetLatestAgentVersion).Methods("GET")
+
     // CORS - Restricted to specific origins
     c := cors.New(cors.Options{
         AllowedOrigins:   []string{"http://64.23.151.140", "http://localhost:8080"},
         AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-        AllowedHeaders:   []string{"Authorization", "Content-Type"},
+        AllowedHeaders:   []string{"Authorization", "Content-Type", "X-API-Key"},
         AllowCredentials: true,
         MaxAge:           300,
     })
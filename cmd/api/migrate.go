@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"isp-saas.com/platform/pkg/database"
+)
+
+const migrateUsage = "usage: migrate up | down [steps] | status"
+
+func migrationsPath() string {
+	if path := os.Getenv("MIGRATIONS_PATH"); path != "" {
+		return path
+	}
+	return "./migrations"
+}
+
+// runMigrate implements the `migrate` subcommand
+func runMigrate(db *database.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	m := db.Migrator(migrationsPath())
+
+	switch args[0] {
+	case "up":
+		n, err := m.Up()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d migration(s) applied\n", n)
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return errors.New("steps must be a positive number")
+			}
+		}
+		n, err := m.Down(steps)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d migration(s) reverted\n", n)
+
+	case "status":
+		migrations, err := m.Status()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tSTATE\tAPPLIED AT\tDOWN")
+		for _, mig := range migrations {
+			appliedAt := "-"
+			if mig.AppliedAt != nil {
+				appliedAt = mig.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			down := "no"
+			if mig.DownSQL != "" {
+				down = "yes"
+			}
+			fmt.Fprintf(tw, "%03d\t%s\t%s\t%s\t%s\n", mig.Version, mig.Name, mig.State, appliedAt, down)
+		}
+		tw.Flush()
+
+	default:
+		return errors.New(migrateUsage)
+	}
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"isp-saas.com/platform/internal/handlers"
+	"isp-saas.com/platform/internal/middleware"
+	"isp-saas.com/platform/internal/rbac"
+)
+
+// route is a protected API endpoint and the permission needed to call it
+type route struct {
+	method     string
+	path       string
+	permission rbac.Permission
+	handler    http.HandlerFunc
+}
+
+// protectedRoutes lists every authenticated endpoint under /api. Paths are
+// relative to the /api subrouter.
+func protectedRoutes(h *handlers.Handler) []route {
+	return []route{
+		// Auth
+		{"POST", "/auth/logout", rbac.AccountSelf, h.Logout},
+		{"POST", "/auth/logout-all", rbac.AccountSelf, h.LogoutAll},
+		{"GET", "/auth/sessions", rbac.AccountSelf, h.GetSessions},
+		{"GET", "/notifications", rbac.AccountSelf, h.GetNotifications},
+		{"POST", "/notifications/{id}/read", rbac.AccountSelf, h.MarkNotificationRead},
+		{"POST", "/auth/mfa/disable", rbac.AccountSelf, h.DisableMFA},
+		{"POST", "/auth/mfa/recovery-codes", rbac.AccountSelf, h.RegenerateRecoveryCodes},
+
+		// Dashboard
+		{"GET", "/dashboard/stats", rbac.DashboardRead, h.GetDashboardStats},
+
+		// Top Sites & Apps
+		{"GET", "/sites/top", rbac.TelemetryRead, h.GetTopSites},
+		{"GET", "/apps/top", rbac.TelemetryRead, h.GetTopApps},
+		{"GET", "/apps/categories", rbac.TelemetryRead, h.GetAppCategories},
+
+		// Users (GET/PUT by id also allow the caller's own account)
+		{"GET", "/users", rbac.UserRead, h.GetUsers},
+		{"GET", "/users/{id}", rbac.AccountSelf, h.GetUser},
+		{"PUT", "/users/{id}", rbac.AccountSelf, h.UpdateUser},
+		{"DELETE", "/users/{id}", rbac.UserWrite, h.DeleteUser},
+
+		// Distributors
+		{"GET", "/distributors", rbac.DistributorManage, h.GetDistributors},
+		{"POST", "/distributors", rbac.DistributorManage, h.CreateDistributor},
+		{"GET", "/distributors/{id}", rbac.DistributorRead, h.GetDistributor},
+		{"PUT", "/distributors/{id}", rbac.DistributorManage, h.UpdateDistributor},
+		{"GET", "/distributors/{id}/isps", rbac.DistributorRead, h.GetDistributorISPs},
+		{"GET", "/distributors/{id}/branding", rbac.DistributorRead, h.GetDistributorBranding},
+		{"GET", "/distributors/{id}/branding/logo", rbac.DistributorRead, h.GetDistributorLogo},
+		{"PUT", "/distributors/{id}/branding", rbac.DistributorBranding, h.UpdateDistributorBranding},
+		{"DELETE", "/distributors/{id}/branding", rbac.DistributorBranding, h.DeleteDistributorBranding},
+
+		// Commissions ("me" is registered before the {id} route it would match)
+		{"GET", "/distributors/me/earnings", rbac.DistributorRead, h.GetMyEarnings},
+		{"GET", "/distributors/{id}/earnings", rbac.DistributorRead, h.GetDistributorEarnings},
+		{"GET", "/commission-payouts", rbac.DistributorManage, h.GetCommissionPayouts},
+		{"GET", "/commission-payouts/{id}", rbac.DistributorRead, h.GetCommissionPayout},
+		{"POST", "/commission-payouts/{id}/paid-out", rbac.DistributorManage, h.MarkPayoutPaidOut},
+
+		// ISPs
+		{"GET", "/isps", rbac.ISPRead, h.GetISPs},
+		{"POST", "/isps", rbac.ISPWrite, h.CreateISP},
+		{"GET", "/isps/{id}", rbac.ISPRead, h.GetISP},
+		{"PUT", "/isps/{id}", rbac.ISPWrite, h.UpdateISP},
+		{"DELETE", "/isps/{id}", rbac.ISPDelete, h.DeleteISP},
+		{"POST", "/isps/{id}/suspend", rbac.ISPSuspend, h.SuspendISP},
+		{"POST", "/isps/{id}/activate", rbac.ISPSuspend, h.ActivateISP},
+		{"POST", "/isps/{id}/plan", rbac.ISPWrite, h.ChangeISPPlan},
+		{"DELETE", "/isps/{id}/plan", rbac.ISPWrite, h.CancelScheduledPlanChange},
+		{"GET", "/isps/{id}/plan-changes", rbac.ISPRead, h.GetISPPlanChanges},
+		{"GET", "/isps/{id}/telemetry", rbac.TelemetryRead, h.GetISPTelemetry},
+		{"GET", "/isps/{id}/dashboard", rbac.TelemetryRead, h.GetISPDashboard},
+		{"GET", "/isps/{id}/commercial", rbac.TelemetryRead, h.GetISPCommercialStats},
+		{"PUT", "/isps/{id}/commercial/config", rbac.ISPWrite, h.UpdateISPCommercialConfig},
+
+		// Agent API keys
+		{"GET", "/isps/{id}/api-keys", rbac.APIKeyManage, h.GetISPAPIKeys},
+		{"POST", "/isps/{id}/api-keys", rbac.APIKeyManage, h.CreateAPIKey},
+		{"POST", "/api-keys/{id}/rotate", rbac.APIKeyManage, h.RotateAPIKey},
+		{"DELETE", "/api-keys/{id}", rbac.APIKeyManage, h.RevokeAPIKey},
+
+		// Licenses
+		{"GET", "/licenses", rbac.LicenseRead, h.GetLicenses},
+		{"POST", "/licenses", rbac.LicenseWrite, h.CreateLicense},
+		{"GET", "/licenses/{id}", rbac.LicenseRead, h.GetLicense},
+		{"GET", "/licenses/{id}/file", rbac.LicenseRead, h.GetLicenseFile},
+		{"GET", "/licenses/{id}/validations", rbac.LicenseRead, h.GetLicenseValidations},
+		{"POST", "/licenses/{id}/revoke", rbac.LicenseRevoke, h.RevokeLicense},
+		{"POST", "/licenses/{id}/renew", rbac.LicenseWrite, h.RenewLicense},
+		{"POST", "/licenses/{id}/extend", rbac.LicenseWrite, h.ExtendLicense},
+		{"GET", "/isps/{id}/hwid-transfers", rbac.ISPRead, h.GetISPHWIDTransfers},
+		{"POST", "/isps/{id}/hwid-transfers", rbac.HWIDTransferRequest, h.RequestHWIDTransfer},
+		{"DELETE", "/isps/{id}/hwid-transfers", rbac.HWIDTransferRequest, h.CancelHWIDTransfer},
+		{"GET", "/isps/{id}/hwid-history", rbac.ISPRead, h.GetISPHWIDHistory},
+		{"GET", "/hwid-transfers", rbac.HWIDTransferReview, h.GetHWIDTransfers},
+		{"POST", "/hwid-transfers/{id}/approve", rbac.HWIDTransferReview, h.ApproveHWIDTransfer},
+		{"POST", "/hwid-transfers/{id}/reject", rbac.HWIDTransferReview, h.RejectHWIDTransfer},
+
+		// Telemetry
+		{"GET", "/telemetry/stats", rbac.TelemetryRead, h.GetTelemetryStats},
+		{"GET", "/telemetry/history", rbac.TelemetryRead, h.GetTelemetryHistory},
+
+		// Billing
+		{"GET", "/invoices", rbac.InvoiceRead, h.GetInvoices},
+		{"POST", "/invoices", rbac.InvoiceWrite, h.CreateInvoice},
+		{"GET", "/invoices/{id}", rbac.InvoiceRead, h.GetInvoice},
+		{"POST", "/invoices/{id}/pay", rbac.InvoiceWrite, h.MarkInvoicePaid},
+		{"GET", "/invoices/{id}/payments", rbac.InvoiceRead, h.GetInvoicePayments},
+		{"POST", "/invoices/{id}/payments", rbac.InvoiceWrite, h.RecordPayment},
+		{"POST", "/invoices/{id}/checkout", rbac.InvoicePay, h.CreateCheckoutSession},
+		{"POST", "/invoices/{id}/cancel", rbac.InvoiceWrite, h.CancelInvoice},
+		{"GET", "/invoices/{id}/credit-notes", rbac.InvoiceRead, h.GetInvoiceCreditNotes},
+		{"POST", "/invoices/{id}/credit-notes", rbac.InvoiceWrite, h.CreateCreditNote},
+		{"GET", "/invoices/{id}/pdf", rbac.InvoiceRead, h.GenerateInvoicePDF},
+		{"POST", "/invoices/check-overdue", rbac.InvoiceWrite, h.CheckOverdueInvoices},
+		{"POST", "/billing/run", rbac.InvoiceWrite, h.RunBilling},
+		{"GET", "/isps/{id}/balance", rbac.InvoiceRead, h.GetISPBalance},
+		{"GET", "/isps/{id}/statement", rbac.InvoiceRead, h.GetISPStatement},
+		{"GET", "/isps/{id}/usage", rbac.InvoiceRead, h.GetISPUsage},
+		{"PUT", "/plans/{id}/overage", rbac.PlanWrite, h.UpdatePlanOverage},
+		{"PUT", "/plans/{id}/prices/{currency}", rbac.PlanWrite, h.SetPlanPrice},
+		{"DELETE", "/plans/{id}/prices/{currency}", rbac.PlanWrite, h.DeletePlanPrice},
+		{"PUT", "/plans/{id}/modules", rbac.PlanWrite, h.SetPlanModules},
+		{"POST", "/license-modules", rbac.PlanWrite, h.CreateLicenseModule},
+		{"PUT", "/license-modules/{key}", rbac.PlanWrite, h.UpdateLicenseModule},
+		{"GET", "/exchange-rates", rbac.SettingRead, h.GetExchangeRates},
+		{"POST", "/exchange-rates", rbac.SettingWrite, h.CreateExchangeRate},
+		{"GET", "/tax-rates", rbac.SettingRead, h.GetTaxRates},
+		{"POST", "/tax-rates", rbac.SettingWrite, h.CreateTaxRate},
+		{"PUT", "/tax-rates/{id}", rbac.SettingWrite, h.UpdateTaxRate},
+		{"DELETE", "/tax-rates/{id}", rbac.SettingWrite, h.DeleteTaxRate},
+
+		// System Logs
+		{"GET", "/logs", rbac.LogRead, h.GetSystemLogs},
+		{"GET", "/logs/stats", rbac.LogRead, h.GetLogStats},
+		{"DELETE", "/logs/cleanup", rbac.LogWrite, h.DeleteOldLogs},
+
+		// Background jobs
+		{"GET", "/jobs", rbac.JobRead, h.GetJobs},
+		{"GET", "/jobs/{name}/runs", rbac.JobRead, h.GetJobRuns},
+		{"POST", "/jobs/{name}/run", rbac.JobRun, h.TriggerJob},
+
+		// Audit trail
+		{"GET", "/audit", rbac.AuditRead, h.GetAuditLogs},
+		{"GET", "/audit/export", rbac.AuditRead, h.ExportAuditLogs},
+
+		// Settings
+		{"GET", "/settings", rbac.SettingRead, h.GetSettings},
+		{"GET", "/settings/get", rbac.SettingRead, h.GetSetting},
+		{"PUT", "/settings/update", rbac.SettingWrite, h.UpdateSetting},
+
+		// Agent Versions
+		{"GET", "/agent/versions", rbac.AgentVersionRead, h.GetAgentVersions},
+		{"POST", "/agent/versions", rbac.AgentVersionWrite, h.CreateAgentVersion},
+	}
+}
+
+// registerProtectedRoutes mounts routes on the authenticated subrouter, each
+// behind a check for its declared permission.
+func registerProtectedRoutes(api *mux.Router, routes []route) {
+	for _, rt := range routes {
+		api.Handle(rt.path, middleware.RequirePermission(rt.permission)(rt.handler)).Methods(rt.method)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"isp-saas.com/platform/internal/handlers"
+	"isp-saas.com/platform/internal/middleware"
+	"isp-saas.com/platform/internal/rbac"
+	"isp-saas.com/platform/pkg/payments"
+)
+
+const (
+	admin       = rbac.RoleAdmin
+	distributor = rbac.RoleDistributor
+	isp         = rbac.RoleISP
+)
+
+// expectedAccess is the authorization matrix: which roles may reach each
+// protected route. Any route added to protectedRoutes must be listed here.
+var expectedAccess = map[string][]string{
+	"POST /auth/logout":             {admin, distributor, isp},
+	"POST /auth/logout-all":         {admin, distributor, isp},
+	"GET /auth/sessions":            {admin, distributor, isp},
+	"GET /notifications":            {admin, distributor, isp},
+	"POST /notifications/{id}/read": {admin, distributor, isp},
+	"POST /auth/mfa/disable":        {admin, distributor, isp},
+	"POST /auth/mfa/recovery-codes": {admin, distributor, isp},
+
+	"GET /dashboard/stats": {admin, distributor},
+
+	"GET /sites/top":       {admin, distributor, isp},
+	"GET /apps/top":        {admin, distributor, isp},
+	"GET /apps/categories": {admin, distributor, isp},
+
+	"GET /users":         {admin},
+	"GET /users/{id}":    {admin, distributor, isp},
+	"PUT /users/{id}":    {admin, distributor, isp},
+	"DELETE /users/{id}": {admin},
+
+	"GET /distributors":                      {admin},
+	"POST /distributors":                     {admin},
+	"GET /distributors/{id}":                 {admin, distributor},
+	"PUT /distributors/{id}":                 {admin},
+	"GET /distributors/{id}/isps":            {admin, distributor},
+	"GET /distributors/{id}/branding":        {admin, distributor},
+	"GET /distributors/{id}/branding/logo":   {admin, distributor},
+	"PUT /distributors/{id}/branding":        {admin, distributor},
+	"DELETE /distributors/{id}/branding":     {admin, distributor},
+	"GET /distributors/me/earnings":          {admin, distributor},
+	"GET /distributors/{id}/earnings":        {admin, distributor},
+	"GET /commission-payouts":                {admin},
+	"GET /commission-payouts/{id}":           {admin, distributor},
+	"POST /commission-payouts/{id}/paid-out": {admin},
+
+	"GET /isps":                        {admin, distributor, isp},
+	"POST /isps":                       {admin, distributor},
+	"GET /isps/{id}":                   {admin, distributor, isp},
+	"PUT /isps/{id}":                   {admin, distributor},
+	"DELETE /isps/{id}":                {admin},
+	"POST /isps/{id}/suspend":          {admin},
+	"POST /isps/{id}/activate":         {admin},
+	"POST /isps/{id}/plan":             {admin, distributor},
+	"DELETE /isps/{id}/plan":           {admin, distributor},
+	"GET /isps/{id}/plan-changes":      {admin, distributor, isp},
+	"GET /isps/{id}/telemetry":         {admin, distributor, isp},
+	"GET /isps/{id}/dashboard":         {admin, distributor, isp},
+	"GET /isps/{id}/commercial":        {admin, distributor, isp},
+	"PUT /isps/{id}/commercial/config": {admin, distributor},
+	"GET /isps/{id}/api-keys":          {admin},
+	"POST /isps/{id}/api-keys":         {admin},
+	"POST /api-keys/{id}/rotate":       {admin},
+	"DELETE /api-keys/{id}":            {admin},
+
+	"GET /licenses":                     {admin, distributor},
+	"POST /licenses":                    {admin},
+	"GET /licenses/{id}":                {admin, distributor},
+	"GET /licenses/{id}/file":           {admin, distributor},
+	"GET /licenses/{id}/validations":    {admin, distributor},
+	"POST /licenses/{id}/revoke":        {admin},
+	"POST /licenses/{id}/renew":         {admin},
+	"POST /licenses/{id}/extend":        {admin},
+	"GET /isps/{id}/hwid-transfers":     {admin, distributor, isp},
+	"POST /isps/{id}/hwid-transfers":    {admin, distributor, isp},
+	"DELETE /isps/{id}/hwid-transfers":  {admin, distributor, isp},
+	"GET /isps/{id}/hwid-history":       {admin, distributor, isp},
+	"GET /hwid-transfers":               {admin},
+	"POST /hwid-transfers/{id}/approve": {admin},
+	"POST /hwid-transfers/{id}/reject":  {admin},
+
+	"GET /telemetry/stats":   {admin, distributor, isp},
+	"GET /telemetry/history": {admin, distributor, isp},
+
+	"GET /invoices":                        {admin, distributor, isp},
+	"POST /invoices":                       {admin},
+	"GET /invoices/{id}":                   {admin, distributor, isp},
+	"POST /invoices/{id}/pay":              {admin},
+	"GET /invoices/{id}/payments":          {admin, distributor, isp},
+	"POST /invoices/{id}/payments":         {admin},
+	"POST /invoices/{id}/checkout":         {admin, distributor, isp},
+	"POST /invoices/{id}/cancel":           {admin},
+	"GET /invoices/{id}/credit-notes":      {admin, distributor, isp},
+	"POST /invoices/{id}/credit-notes":     {admin},
+	"GET /invoices/{id}/pdf":               {admin, distributor, isp},
+	"POST /invoices/check-overdue":         {admin},
+	"POST /billing/run":                    {admin},
+	"GET /isps/{id}/balance":               {admin, distributor, isp},
+	"GET /isps/{id}/statement":             {admin, distributor, isp},
+	"GET /isps/{id}/usage":                 {admin, distributor, isp},
+	"PUT /plans/{id}/overage":              {admin},
+	"PUT /plans/{id}/prices/{currency}":    {admin},
+	"DELETE /plans/{id}/prices/{currency}": {admin},
+	"PUT /plans/{id}/modules":              {admin},
+	"POST /license-modules":                {admin},
+	"PUT /license-modules/{key}":           {admin},
+	"GET /exchange-rates":                  {admin},
+	"POST /exchange-rates":                 {admin},
+	"GET /tax-rates":                       {admin},
+	"POST /tax-rates":                      {admin},
+	"PUT /tax-rates/{id}":                  {admin},
+	"DELETE /tax-rates/{id}":               {admin},
+
+	"GET /logs":             {admin},
+	"GET /logs/stats":       {admin},
+	"DELETE /logs/cleanup":  {admin},
+	"GET /jobs":             {admin},
+	"GET /jobs/{name}/runs": {admin},
+	"POST /jobs/{name}/run": {admin},
+
+	"GET /audit":        {admin},
+	"GET /audit/export": {admin},
+
+	"GET /settings":        {admin},
+	"GET /settings/get":    {admin},
+	"PUT /settings/update": {admin},
+
+	"GET /agent/versions":  {admin},
+	"POST /agent/versions": {admin},
+}
+
+func routeKey(rt route) string {
+	return rt.method + " " + rt.path
+}
+
+func TestEveryRouteHasExpectedAccess(t *testing.T) {
+	seen := map[string]bool{}
+	for _, rt := range protectedRoutes(handlers.New(nil, nil, nil, payments.Config{}, nil, nil)) {
+		key := routeKey(rt)
+		if seen[key] {
+			t.Errorf("route %s registered twice", key)
+		}
+		seen[key] = true
+
+		if _, ok := expectedAccess[key]; !ok {
+			t.Errorf("route %s is missing from the access matrix", key)
+		}
+		if rt.permission == "" {
+			t.Errorf("route %s has no permission", key)
+		}
+	}
+
+	for key := range expectedAccess {
+		if !seen[key] {
+			t.Errorf("access matrix lists %s but no such route is registered", key)
+		}
+	}
+}
+
+func TestRouteAccessMatrix(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	routes := protectedRoutes(handlers.New(nil, nil, nil, payments.Config{}, nil, nil))
+	stubbed := make([]route, len(routes))
+	for i, rt := range routes {
+		rt.handler = ok
+		stubbed[i] = rt
+	}
+
+	router := mux.NewRouter()
+	api := router.PathPrefix("/api").Subrouter()
+	api.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if role := r.Header.Get("X-Test-Role"); role != "" {
+				claims := &middleware.Claims{UserID: 1, Role: role, SessionID: 1}
+				r = r.WithContext(context.WithValue(r.Context(), middleware.UserContextKey, claims))
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	registerProtectedRoutes(api, stubbed)
+
+	for _, rt := range stubbed {
+		key := routeKey(rt)
+		allowed := map[string]bool{}
+		for _, role := range expectedAccess[key] {
+			allowed[role] = true
+		}
+
+		path := "/api" + strings.ReplaceAll(rt.path, "{id}", "1")
+
+		for _, role := range append([]string{""}, rbac.Roles...) {
+			req := httptest.NewRequest(rt.method, path, nil)
+			if role != "" {
+				req.Header.Set("X-Test-Role", role)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			want := http.StatusForbidden
+			switch {
+			case role == "":
+				want = http.StatusUnauthorized
+			case allowed[role]:
+				want = http.StatusOK
+			}
+
+			if rec.Code != want {
+				t.Errorf("%s as %q: got status %d, want %d", key, role, rec.Code, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package billing
+
+import (
+	"database/sql/driver"
+	"errors"
+	"math"
+	"strings"
+)
+
+// ExchangeRate is how many units of one currency a unit of another is worth,
+// in hundred-millionths, e.g. 17.25 is 1725000000
+type ExchangeRate int64
+
+// ErrInexactAmount is an amount in a currency's minor units that is not a
+// whole number of cents
+var ErrInexactAmount = errors.New("amount does not convert exactly to cents")
+
+// minorUnitExponents lists the currencies whose smallest unit is not the
+// cent, as payment gateways count them: zero-decimal currencies are charged
+// in whole units and three-decimal ones in thousandths
+var minorUnitExponents = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "JPY": 0, "KMF": 0, "KRW": 0, "MGA": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "JOD": 3, "KWD": 3, "OMR": 3, "TND": 3,
+}
+
+const (
+	exchangeRateScale = 8
+
+	// ExchangeRateOne converts a currency to itself
+	ExchangeRateOne ExchangeRate = 100000000
+)
+
+// ParseExchangeRate parses a rate such as "17.25" with up to eight decimals
+func ParseExchangeRate(s string) (ExchangeRate, error) {
+	v, err := parseFixed(s, exchangeRateScale)
+	return ExchangeRate(v), err
+}
+
+func (r ExchangeRate) String() string {
+	return formatFixed(int64(r), exchangeRateScale, true)
+}
+
+// Inverse is the rate for converting back, rounded to eight decimals
+func (r ExchangeRate) Inverse() ExchangeRate {
+	if r == 0 {
+		return 0
+	}
+	return ExchangeRate(mulDivRound(int64(ExchangeRateOne), int64(ExchangeRateOne), int64(r)))
+}
+
+func (r ExchangeRate) MarshalJSON() ([]byte, error) { return []byte(r.String()), nil }
+
+func (r *ExchangeRate) UnmarshalJSON(b []byte) error {
+	v, err := unmarshalFixed(b, exchangeRateScale)
+	*r = ExchangeRate(v)
+	return err
+}
+
+func (r *ExchangeRate) Scan(src interface{}) error {
+	v, err := scanFixed(src, exchangeRateScale)
+	*r = ExchangeRate(v)
+	return err
+}
+
+func (r ExchangeRate) Value() (driver.Value, error) { return r.String(), nil }
+
+// Convert is m in another currency at rate r, rounded to the cent
+func (m Money) Convert(r ExchangeRate) Money {
+	return Money(mulDivRound(int64(m), int64(r), int64(ExchangeRateOne)))
+}
+
+// MinorUnitExponent is the number of decimals of currency's smallest unit
+func MinorUnitExponent(currency string) int {
+	if e, ok := minorUnitExponents[strings.ToUpper(currency)]; ok {
+		return e
+	}
+	return moneyScale
+}
+
+// MinorUnits is m counted in currency's smallest unit, as gateways take
+// amounts. A fraction of that unit cannot be charged, so it is rounded up.
+func (m Money) MinorUnits(currency string) int64 {
+	e := MinorUnitExponent(currency)
+	if e >= moneyScale {
+		return int64(m) * pow10(e-moneyScale)
+	}
+	d := pow10(moneyScale - e)
+	n := int64(m) / d
+	if int64(m)%d > 0 {
+		n++
+	}
+	return n
+}
+
+// MoneyFromMinorUnits is n of currency's smallest unit as Money. It fails
+// with ErrInexactAmount when n has a fraction of a cent or is out of range.
+func MoneyFromMinorUnits(n int64, currency string) (Money, error) {
+	e := MinorUnitExponent(currency)
+	if e > moneyScale {
+		d := pow10(e - moneyScale)
+		if n%d != 0 {
+			return 0, ErrInexactAmount
+		}
+		return Money(n / d), nil
+	}
+	f := pow10(moneyScale - e)
+	if n > math.MaxInt64/f || n < math.MinInt64/f {
+		return 0, ErrInexactAmount
+	}
+	return Money(n * f), nil
+}
@@ -0,0 +1,99 @@
+package billing
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMinorUnits(t *testing.T) {
+	tests := []struct {
+		amount   Money
+		currency string
+		want     int64
+	}{
+		{1999, "USD", 1999},
+		{1999, "usd", 1999},
+		{1500000, "CLP", 15000},
+		{1500001, "CLP", 15001},
+		{1500099, "PYG", 15001},
+		{-1500050, "CLP", -15000},
+		{1234, "KWD", 12340},
+	}
+	for _, tt := range tests {
+		if got := tt.amount.MinorUnits(tt.currency); got != tt.want {
+			t.Errorf("%s %s: MinorUnits = %d, want %d", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestMoneyFromMinorUnits(t *testing.T) {
+	tests := []struct {
+		n        int64
+		currency string
+		want     Money
+		err      error
+	}{
+		{1999, "USD", 1999, nil},
+		{15000, "CLP", 1500000, nil},
+		{15000, "pyg", 1500000, nil},
+		{12340, "KWD", 1234, nil},
+		{12345, "KWD", 0, ErrInexactAmount},
+		{1 << 62, "CLP", 0, ErrInexactAmount},
+	}
+	for _, tt := range tests {
+		got, err := MoneyFromMinorUnits(tt.n, tt.currency)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("MoneyFromMinorUnits(%d, %s) = %s, %v; want %s, %v", tt.n, tt.currency, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestExchangeRateConvert(t *testing.T) {
+	rate, err := ParseExchangeRate("17.25")
+	if err != nil || rate != 1725000000 {
+		t.Fatalf("ParseExchangeRate(17.25) = %d, %v", rate, err)
+	}
+
+	tests := []struct {
+		amount Money
+		rate   ExchangeRate
+		want   Money
+	}{
+		{10000, rate, 172500},
+		{10000, ExchangeRateOne, 10000},
+		{1, ExchangeRateOne / 2, 1},
+		{-1, ExchangeRateOne / 2, -1},
+		{3, 33333333, 1},
+		{-172500, rate.Inverse(), -10000},
+	}
+	for _, tt := range tests {
+		if got := tt.amount.Convert(tt.rate); got != tt.want {
+			t.Errorf("%s at %s = %s, want %s", tt.amount, tt.rate, got, tt.want)
+		}
+	}
+}
+
+func TestExchangeRateInverse(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"1", "1"},
+		{"2", "0.5"},
+		{"17.25", "0.05797101"},
+		{"0.05797101", "17.25000134"},
+		{"3", "0.33333333"},
+		{"0.00000003", "33333333.33333333"},
+	}
+	for _, tt := range tests {
+		r, err := ParseExchangeRate(tt.in)
+		if err != nil {
+			t.Fatalf("ParseExchangeRate(%q): %v", tt.in, err)
+		}
+		if got := r.Inverse().String(); got != tt.want {
+			t.Errorf("%s: Inverse = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+	if got := ExchangeRate(0).Inverse(); got != 0 {
+		t.Errorf("Inverse of 0 = %s, want 0", got)
+	}
+}
@@ -0,0 +1,82 @@
+package billing
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dunning step kinds
+const (
+	StepReminder = "reminder"
+	StepSuspend  = "suspend"
+)
+
+// DunningStep is one action of the dunning schedule, taken Offset days after
+// an invoice's due date (negative offsets come before it)
+type DunningStep struct {
+	Kind   string
+	Offset int
+}
+
+// Key identifies the step in the dunning log, e.g. "reminder-3", "suspend"
+func (s DunningStep) Key() string {
+	if s.Kind == StepSuspend {
+		return StepSuspend
+	}
+	return fmt.Sprintf("%s%+d", s.Kind, s.Offset)
+}
+
+// DunningPolicy is the reminder schedule plus the suspension deadline. A
+// negative SuspendAfterDays disables suspension.
+type DunningPolicy struct {
+	ReminderOffsets  []int
+	SuspendAfterDays int
+}
+
+// ParseReminderOffsets parses a comma-separated list of day offsets relative
+// to the due date, e.g. "-3,1,5"
+func ParseReminderOffsets(s string) ([]int, error) {
+	var offsets []int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reminder offset %q", part)
+		}
+		offsets = append(offsets, n)
+	}
+	sort.Ints(offsets)
+	return offsets, nil
+}
+
+// Steps lists the schedule in the order the steps fall due
+func (p DunningPolicy) Steps() []DunningStep {
+	var steps []DunningStep
+	for _, offset := range p.ReminderOffsets {
+		steps = append(steps, DunningStep{Kind: StepReminder, Offset: offset})
+	}
+	if p.SuspendAfterDays >= 0 {
+		steps = append(steps, DunningStep{Kind: StepSuspend, Offset: p.SuspendAfterDays})
+	}
+	sort.SliceStable(steps, func(i, j int) bool { return steps[i].Offset < steps[j].Offset })
+	return steps
+}
+
+// StepsDue returns the steps whose day has come by today for an invoice due
+// on dueDate
+func (p DunningPolicy) StepsDue(dueDate, today time.Time) []DunningStep {
+	dueDate, today = Date(dueDate), Date(today)
+	var due []DunningStep
+	for _, step := range p.Steps() {
+		if !dueDate.AddDate(0, 0, step.Offset).After(today) {
+			due = append(due, step)
+		}
+	}
+	return due
+}
@@ -0,0 +1,85 @@
+package billing
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStepsDue(t *testing.T) {
+	policy := DunningPolicy{ReminderOffsets: []int{-3, 1, 5}, SuspendAfterDays: 7}
+	due := day(2026, 3, 10)
+
+	tests := []struct {
+		today time.Time
+		want  string
+	}{
+		{day(2026, 3, 6), ""},
+		{day(2026, 3, 7), "reminder-3"},
+		{day(2026, 3, 10), "reminder-3"},
+		{day(2026, 3, 11), "reminder-3 reminder+1"},
+		{day(2026, 3, 15), "reminder-3 reminder+1 reminder+5"},
+		{day(2026, 3, 16), "reminder-3 reminder+1 reminder+5"},
+		{day(2026, 3, 17), "reminder-3 reminder+1 reminder+5 suspend"},
+		{time.Date(2026, 3, 17, 0, 0, 1, 0, time.UTC), "reminder-3 reminder+1 reminder+5 suspend"},
+		{day(2026, 4, 30), "reminder-3 reminder+1 reminder+5 suspend"},
+	}
+	for _, tt := range tests {
+		if got := stepKeys(policy.StepsDue(due, tt.today)); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.today.Format(time.RFC3339), got, tt.want)
+		}
+	}
+}
+
+func TestDunningSteps(t *testing.T) {
+	tests := []struct {
+		policy DunningPolicy
+		want   string
+	}{
+		{DunningPolicy{ReminderOffsets: []int{-3, 1, 5}, SuspendAfterDays: 7}, "reminder-3 reminder+1 reminder+5 suspend"},
+		// Suspension can come before the last reminder, and on the same day
+		// the reminder is sent first
+		{DunningPolicy{ReminderOffsets: []int{1, 5}, SuspendAfterDays: 3}, "reminder+1 suspend reminder+5"},
+		{DunningPolicy{ReminderOffsets: []int{0}, SuspendAfterDays: 0}, "reminder+0 suspend"},
+		// A negative deadline disables suspension
+		{DunningPolicy{ReminderOffsets: []int{-3, 1}, SuspendAfterDays: -1}, "reminder-3 reminder+1"},
+		{DunningPolicy{SuspendAfterDays: 7}, "suspend"},
+	}
+	for _, tt := range tests {
+		if got := stepKeys(tt.policy.Steps()); got != tt.want {
+			t.Errorf("%+v: got %q, want %q", tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestParseReminderOffsets(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []int
+	}{
+		{"-3,1,5", []int{-3, 1, 5}},
+		{" 5, -3 ,1,", []int{-3, 1, 5}},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		got, err := ParseReminderOffsets(tt.in)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseReminderOffsets(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{"-3,x", "1.5", "+"} {
+		if _, err := ParseReminderOffsets(in); err == nil {
+			t.Errorf("ParseReminderOffsets(%q) succeeded, want error", in)
+		}
+	}
+}
+
+func stepKeys(steps []DunningStep) string {
+	keys := make([]string, len(steps))
+	for i, s := range steps {
+		keys[i] = s.Key()
+	}
+	return strings.Join(keys, " ")
+}
@@ -0,0 +1,273 @@
+package billing
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Money is an amount in cents. Invoice arithmetic is done in Money rather
+// than float64 so sums and tax never pick up binary rounding errors. It reads
+// and writes NUMERIC columns and JSON numbers as exact decimals.
+type Money int64
+
+// Quantity is an item quantity in thousandths, e.g. 1.5 GB is 1500
+type Quantity int64
+
+// Rate is a percentage in ten-thousandths of a percent, e.g. 19.5% is 195000
+type Rate int64
+
+const (
+	moneyScale    = 2
+	quantityScale = 3
+	rateScale     = 4
+
+	// QuantityOne is a quantity of exactly 1
+	QuantityOne Quantity = 1000
+	// RatePercentUnit is a rate of exactly 1%
+	RatePercentUnit Rate = 10000
+)
+
+var ErrInvalidDecimal = errors.New("invalid decimal value")
+
+// ParseMoney parses a decimal amount such as "12.5" or "-3.99"
+func ParseMoney(s string) (Money, error) {
+	v, err := parseFixed(s, moneyScale)
+	return Money(v), err
+}
+
+// String formats the amount with exactly two decimals
+func (m Money) String() string {
+	return formatFixed(int64(m), moneyScale, false)
+}
+
+// Times is the price of q units at m each, rounded to the cent
+func (m Money) Times(q Quantity) Money {
+	return Money(mulDivRound(int64(m), int64(q), pow10(quantityScale)))
+}
+
+// Share is the num/den part of m, rounded to the cent
+func (m Money) Share(num, den int) Money {
+	return Money(mulDivRound(int64(m), int64(num), int64(den)))
+}
+
+// Percent is r percent of m, rounded to the cent
+func (m Money) Percent(r Rate) Money {
+	return Money(mulDivRound(int64(m), int64(r), 100*pow10(rateScale)))
+}
+
+func (m Money) MarshalJSON() ([]byte, error) { return []byte(m.String()), nil }
+
+func (m *Money) UnmarshalJSON(b []byte) error {
+	v, err := unmarshalFixed(b, moneyScale)
+	*m = Money(v)
+	return err
+}
+
+func (m *Money) Scan(src interface{}) error {
+	v, err := scanFixed(src, moneyScale)
+	*m = Money(v)
+	return err
+}
+
+func (m Money) Value() (driver.Value, error) { return m.String(), nil }
+
+// ParseQuantity parses a decimal quantity with up to three decimals
+func ParseQuantity(s string) (Quantity, error) {
+	v, err := parseFixed(s, quantityScale)
+	return Quantity(v), err
+}
+
+func (q Quantity) String() string {
+	return formatFixed(int64(q), quantityScale, true)
+}
+
+func (q Quantity) MarshalJSON() ([]byte, error) { return []byte(q.String()), nil }
+
+func (q *Quantity) UnmarshalJSON(b []byte) error {
+	v, err := unmarshalFixed(b, quantityScale)
+	*q = Quantity(v)
+	return err
+}
+
+func (q *Quantity) Scan(src interface{}) error {
+	v, err := scanFixed(src, quantityScale)
+	*q = Quantity(v)
+	return err
+}
+
+func (q Quantity) Value() (driver.Value, error) { return q.String(), nil }
+
+// ParseRate parses a percentage such as "19.5" with up to four decimals
+func ParseRate(s string) (Rate, error) {
+	v, err := parseFixed(s, rateScale)
+	return Rate(v), err
+}
+
+func (r Rate) String() string {
+	return formatFixed(int64(r), rateScale, true)
+}
+
+func (r Rate) MarshalJSON() ([]byte, error) { return []byte(r.String()), nil }
+
+func (r *Rate) UnmarshalJSON(b []byte) error {
+	v, err := unmarshalFixed(b, rateScale)
+	*r = Rate(v)
+	return err
+}
+
+func (r *Rate) Scan(src interface{}) error {
+	v, err := scanFixed(src, rateScale)
+	*r = Rate(v)
+	return err
+}
+
+func (r Rate) Value() (driver.Value, error) { return r.String(), nil }
+
+// Totals is the server-side breakdown of an invoice
+type Totals struct {
+	Subtotal Money
+	Tax      Money
+	Total    Money
+}
+
+// ComputeTotals sums line amounts and applies rate to the subtotal. Tax is
+// rounded once on the subtotal rather than per line.
+func ComputeTotals(lines []Money, rate Rate) Totals {
+	var t Totals
+	for _, amount := range lines {
+		t.Subtotal += amount
+	}
+	t.Tax = t.Subtotal.Percent(rate)
+	t.Total = t.Subtotal + t.Tax
+	return t
+}
+
+// InvoiceNumber formats the seq-th invoice issued in year, e.g.
+// INV-2026-000123
+func InvoiceNumber(year, seq int) string {
+	return fmt.Sprintf("INV-%04d-%06d", year, seq)
+}
+
+// CreditNoteNumber formats the seq-th credit note issued in year, e.g.
+// CN-2026-000007
+func CreditNoteNumber(year, seq int) string {
+	return fmt.Sprintf("CN-%04d-%06d", year, seq)
+}
+
+// parseFixed parses a plain decimal into an integer scaled by 10^scale.
+// Digits beyond scale are accepted only if they are zeros, since dropping
+// them would silently change the value.
+func parseFixed(s string, scale int) (int64, error) {
+	s = strings.TrimSpace(s)
+	neg := false
+	switch {
+	case strings.HasPrefix(s, "-"):
+		neg, s = true, s[1:]
+	case strings.HasPrefix(s, "+"):
+		s = s[1:]
+	}
+
+	intPart, fracPart, _ := strings.Cut(s, ".")
+	if intPart == "" && fracPart == "" || !allDigits(intPart) || !allDigits(fracPart) {
+		return 0, ErrInvalidDecimal
+	}
+	if len(fracPart) > scale {
+		if strings.Trim(fracPart[scale:], "0") != "" {
+			return 0, fmt.Errorf("%w: more than %d decimals", ErrInvalidDecimal, scale)
+		}
+		fracPart = fracPart[:scale]
+	}
+	fracPart += strings.Repeat("0", scale-len(fracPart))
+
+	v, err := strconv.ParseInt(intPart+fracPart, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: out of range", ErrInvalidDecimal)
+	}
+	if neg {
+		v = -v
+	}
+	return v, nil
+}
+
+func formatFixed(v int64, scale int, trim bool) string {
+	sign := ""
+	u := uint64(v)
+	if v < 0 {
+		sign, u = "-", uint64(-v)
+	}
+	digits := strconv.FormatUint(u, 10)
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+	intPart, fracPart := digits[:len(digits)-scale], digits[len(digits)-scale:]
+	if trim {
+		fracPart = strings.TrimRight(fracPart, "0")
+	}
+	if fracPart == "" {
+		return sign + intPart
+	}
+	return sign + intPart + "." + fracPart
+}
+
+// unmarshalFixed accepts a JSON number or a quoted decimal string
+func unmarshalFixed(b []byte, scale int) (int64, error) {
+	s := string(b)
+	if s == "null" {
+		return 0, nil
+	}
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	return parseFixed(s, scale)
+}
+
+func scanFixed(src interface{}, scale int) (int64, error) {
+	switch v := src.(type) {
+	case nil:
+		return 0, nil
+	case []byte:
+		return parseFixed(string(v), scale)
+	case string:
+		return parseFixed(v, scale)
+	case int64:
+		return v * pow10(scale), nil
+	}
+	return 0, fmt.Errorf("cannot scan %T into a decimal", src)
+}
+
+// mulDivRound computes a*b/d rounded half away from zero, without overflowing
+// on the intermediate product
+func mulDivRound(a, b, d int64) int64 {
+	n := new(big.Int).Mul(big.NewInt(a), big.NewInt(b))
+	den := big.NewInt(d)
+	q, rem := new(big.Int).QuoRem(n, den, new(big.Int))
+	if rem.Sign() != 0 && new(big.Int).Abs(new(big.Int).Mul(rem, big.NewInt(2))).Cmp(den) >= 0 {
+		if n.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q.Int64()
+}
+
+func pow10(n int) int64 {
+	p := int64(1)
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
+
+func allDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,180 @@
+package billing
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Money
+	}{
+		{"12.5", 1250},
+		{"-3.99", -399},
+		{"+7", 700},
+		{".5", 50},
+		{"5.", 500},
+		{" 0.05 ", 5},
+		{"1.230", 123},
+		{"-0.00", 0},
+		{"92233720368547758.07", math.MaxInt64},
+	}
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseMoney(%q) = %d, %v; want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseMoneyInvalid(t *testing.T) {
+	for _, in := range []string{"", "-", ".", "1,50", "1.5.0", "abc", "1e3", "--1", "0.005", "12.345", "92233720368547758.08"} {
+		if _, err := ParseMoney(in); !errors.Is(err, ErrInvalidDecimal) {
+			t.Errorf("ParseMoney(%q): got %v, want ErrInvalidDecimal", in, err)
+		}
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		in   Money
+		want string
+	}{
+		{0, "0.00"},
+		{5, "0.05"},
+		{-5, "-0.05"},
+		{1250, "12.50"},
+		{-123456, "-1234.56"},
+		{math.MaxInt64, "92233720368547758.07"},
+	}
+	for _, tt := range tests {
+		if got := tt.in.String(); got != tt.want {
+			t.Errorf("Money(%d).String() = %q, want %q", int64(tt.in), got, tt.want)
+		}
+	}
+}
+
+func TestMoneyUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Money
+	}{
+		{`19.99`, 1999},
+		{`"19.99"`, 1999},
+		{`-4`, -400},
+		{`null`, 0},
+	}
+	for _, tt := range tests {
+		var m Money
+		if err := m.UnmarshalJSON([]byte(tt.in)); err != nil || m != tt.want {
+			t.Errorf("UnmarshalJSON(%s) = %d, %v; want %d", tt.in, m, err, tt.want)
+		}
+	}
+
+	var m Money
+	if err := m.UnmarshalJSON([]byte(`19.999`)); !errors.Is(err, ErrInvalidDecimal) {
+		t.Errorf("UnmarshalJSON(19.999): got %v, want ErrInvalidDecimal", err)
+	}
+}
+
+func TestMulDivRound(t *testing.T) {
+	tests := []struct {
+		a, b, d int64
+		want    int64
+	}{
+		{6, 1, 3, 2},
+		{7, 1, 3, 2},
+		{8, 1, 3, 3},
+		// Halves round away from zero in both directions
+		{5, 1, 2, 3},
+		{-5, 1, 2, -3},
+		{1, 1, 2, 1},
+		{-1, 1, 2, -1},
+		{-7, 1, 3, -2},
+		{-8, 1, 3, -3},
+		{5, -1, 2, -3},
+		// The intermediate product does not overflow
+		{math.MaxInt64, 10, 10, math.MaxInt64},
+		{math.MaxInt64 / 2, 4, 2, math.MaxInt64 - 1},
+	}
+	for _, tt := range tests {
+		if got := mulDivRound(tt.a, tt.b, tt.d); got != tt.want {
+			t.Errorf("mulDivRound(%d, %d, %d) = %d, want %d", tt.a, tt.b, tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestMoneyArithmetic(t *testing.T) {
+	tests := []struct {
+		name string
+		got  Money
+		want Money
+	}{
+		{"1.5 x 3.33", Money(333).Times(1500), 500},
+		{"-1.5 x 3.33", Money(-333).Times(1500), -500},
+		{"0.001 x 10.00", Money(1000).Times(1), 1},
+		{"19% of 10.05", Money(1005).Percent(19 * RatePercentUnit), 191},
+		{"19% of -10.05", Money(-1005).Percent(19 * RatePercentUnit), -191},
+		{"12.5% of 0.04", Money(4).Percent(125000), 1},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestComputeTotals(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []Money
+		rate  Rate
+		want  Totals
+	}{
+		{"no tax", []Money{1000, 2550}, 0, Totals{3550, 0, 3550}},
+		{"credit line", []Money{1000, 2550, -500}, 19 * RatePercentUnit, Totals{3050, 580, 3630}},
+		// Tax is rounded once on the subtotal: 10% of 0.15 is 0.015, not
+		// three lines of 0.005 rounded up to 0.01 each
+		{"rounded once", []Money{5, 5, 5}, 10 * RatePercentUnit, Totals{15, 2, 17}},
+		{"negative total", []Money{-1001}, 10 * RatePercentUnit, Totals{-1001, -100, -1101}},
+		{"empty", nil, 19 * RatePercentUnit, Totals{}},
+	}
+	for _, tt := range tests {
+		if got := ComputeTotals(tt.lines, tt.rate); got != tt.want {
+			t.Errorf("%s: ComputeTotals = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseRateAndQuantity(t *testing.T) {
+	if r, err := ParseRate("19.5"); err != nil || r != 195000 {
+		t.Errorf("ParseRate(19.5) = %d, %v", r, err)
+	}
+	if _, err := ParseRate("19.12345"); !errors.Is(err, ErrInvalidDecimal) {
+		t.Errorf("ParseRate(19.12345): got %v, want ErrInvalidDecimal", err)
+	}
+	if q, err := ParseQuantity("1.5"); err != nil || q != 1500 || q.String() != "1.5" {
+		t.Errorf("ParseQuantity(1.5) = %d (%s), %v", q, q, err)
+	}
+}
+
+func TestMoneyShare(t *testing.T) {
+	tests := []struct {
+		amount   Money
+		num, den int
+		want     Money
+	}{
+		{10000, 1, 3, 3333},
+		{10000, 2, 3, 6667},
+		{10000, 31, 31, 10000},
+		{10000, 0, 30, 0},
+		{-5, 1, 2, -3},
+	}
+	for _, tt := range tests {
+		if got := tt.amount.Share(tt.num, tt.den); got != tt.want {
+			t.Errorf("%d/%d of %s = %s, want %s", tt.num, tt.den, tt.amount, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Package billing holds the calendar and money rules shared by invoicing
+// code: billing periods anchored on an ISP's start date, proration of plan
+// changes, and exact decimal amounts for invoice totals and tax.
+package billing
+
+import "time"
+
+// Period is one monthly billing cycle. End is the last day included.
+type Period struct {
+	Start time.Time
+	End   time.Time
+}
+
+// Label is the month the period starts in, e.g. "2026-03"
+func (p Period) Label() string {
+	return p.Start.Format("2006-01")
+}
+
+// Days is the number of days the period covers
+func (p Period) Days() int {
+	return int(p.End.Sub(p.Start).Hours()/24) + 1
+}
+
+// Contains reports whether day falls inside the period
+func (p Period) Contains(day time.Time) bool {
+	day = Date(day)
+	return !day.Before(p.Start) && !day.After(p.End)
+}
+
+// Proration splits a billing period at a plan change. Credit is what the old
+// plan costs for the rest of the period, Charge what the new one does.
+type Proration struct {
+	From       time.Time
+	Days       int
+	PeriodDays int
+	Credit     Money
+	Charge     Money
+}
+
+// Net is what the change adds to the bill; negative when it is a credit
+func (pr Proration) Net() Money {
+	return pr.Charge - pr.Credit
+}
+
+// Prorate prices a switch from oldPrice to newPrice (both per period) taking
+// effect on from, which is included in the new plan's share
+func (p Period) Prorate(from time.Time, oldPrice, newPrice Money) Proration {
+	from = Date(from)
+	days := int(p.End.Sub(from).Hours()/24) + 1
+	switch {
+	case days < 0:
+		days = 0
+	case days > p.Days():
+		days = p.Days()
+	}
+	return Proration{
+		From:       from,
+		Days:       days,
+		PeriodDays: p.Days(),
+		Credit:     oldPrice.Share(days, p.Days()),
+		Charge:     newPrice.Share(days, p.Days()),
+	}
+}
+
+// Date truncates t to midnight UTC of its calendar day
+func Date(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// ParseMonth parses a "YYYY-MM" period label
+func ParseMonth(s string) (time.Time, error) {
+	return time.Parse("2006-01", s)
+}
+
+// PeriodStarting returns the cycle of an ISP anchored on anchor that starts in
+// the given month. The anniversary day is clamped to the month's length, so an
+// ISP that started on the 31st is billed on the 30th in April.
+func PeriodStarting(anchor time.Time, year int, month time.Month) Period {
+	start := anniversary(anchor, year, month)
+	ny, nm := year, month+1
+	if nm > time.December {
+		ny, nm = ny+1, time.January
+	}
+	next := anniversary(anchor, ny, nm)
+	return Period{Start: start, End: next.AddDate(0, 0, -1)}
+}
+
+// PeriodContaining returns the cycle that day falls in
+func PeriodContaining(anchor, day time.Time) Period {
+	day = Date(day)
+	p := PeriodStarting(anchor, day.Year(), day.Month())
+	if day.Before(p.Start) {
+		prev := time.Date(day.Year(), day.Month(), 0, 0, 0, 0, 0, time.UTC)
+		p = PeriodStarting(anchor, prev.Year(), prev.Month())
+	}
+	return p
+}
+
+func anniversary(anchor time.Time, year int, month time.Month) time.Time {
+	day := anchor.Day()
+	if last := daysIn(year, month); day > last {
+		day = last
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func daysIn(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
@@ -0,0 +1,106 @@
+package billing
+
+import (
+	"testing"
+	"time"
+)
+
+func day(y int, m time.Month, d int) time.Time {
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+func TestPeriodStarting(t *testing.T) {
+	anchor := day(2025, time.October, 31)
+
+	tests := []struct {
+		year  int
+		month time.Month
+		want  Period
+	}{
+		{2026, time.January, Period{day(2026, 1, 31), day(2026, 2, 27)}},
+		{2026, time.February, Period{day(2026, 2, 28), day(2026, 3, 30)}},
+		{2026, time.March, Period{day(2026, 3, 31), day(2026, 4, 29)}},
+		{2026, time.April, Period{day(2026, 4, 30), day(2026, 5, 30)}},
+		{2026, time.December, Period{day(2026, 12, 31), day(2027, 1, 30)}},
+		{2028, time.February, Period{day(2028, 2, 29), day(2028, 3, 30)}},
+	}
+	for _, tt := range tests {
+		got := PeriodStarting(anchor, tt.year, tt.month)
+		if !got.Start.Equal(tt.want.Start) || !got.End.Equal(tt.want.End) {
+			t.Errorf("%d-%02d: got %s..%s, want %s..%s", tt.year, tt.month,
+				got.Start.Format("2006-01-02"), got.End.Format("2006-01-02"),
+				tt.want.Start.Format("2006-01-02"), tt.want.End.Format("2006-01-02"))
+		}
+	}
+
+	if p := PeriodStarting(day(2026, 1, 15), 2026, time.February); p.Label() != "2026-02" || p.Days() != 28 {
+		t.Errorf("anchor on the 15th: got %s with %d days", p.Label(), p.Days())
+	}
+}
+
+func TestPeriodContaining(t *testing.T) {
+	anchor := day(2025, time.October, 31)
+
+	tests := []struct {
+		day  time.Time
+		want time.Time
+	}{
+		{day(2026, 2, 27), day(2026, 1, 31)},
+		{day(2026, 2, 28), day(2026, 2, 28)},
+		{day(2026, 3, 15), day(2026, 2, 28)},
+		{day(2026, 3, 30), day(2026, 2, 28)},
+		{day(2026, 3, 31), day(2026, 3, 31)},
+		{day(2026, 4, 29), day(2026, 3, 31)},
+		{day(2026, 4, 30), day(2026, 4, 30)},
+		{day(2027, 1, 1), day(2026, 12, 31)},
+		// The time of day does not matter
+		{time.Date(2026, 4, 30, 23, 59, 59, 0, time.UTC), day(2026, 4, 30)},
+	}
+	for _, tt := range tests {
+		got := PeriodContaining(anchor, tt.day)
+		if !got.Start.Equal(tt.want) {
+			t.Errorf("%s: period starts %s, want %s", tt.day.Format(time.RFC3339),
+				got.Start.Format("2006-01-02"), tt.want.Format("2006-01-02"))
+		}
+		if !got.Contains(tt.day) {
+			t.Errorf("%s: period %s..%s does not contain it", tt.day.Format(time.RFC3339),
+				got.Start.Format("2006-01-02"), got.End.Format("2006-01-02"))
+		}
+	}
+}
+
+func TestProrate(t *testing.T) {
+	period := Period{day(2026, 4, 1), day(2026, 4, 30)}
+	oldPrice, newPrice := Money(300000), Money(600000)
+
+	tests := []struct {
+		name   string
+		from   time.Time
+		days   int
+		credit Money
+		charge Money
+	}{
+		{"first day", day(2026, 4, 1), 30, 300000, 600000},
+		{"last day", day(2026, 4, 30), 1, 10000, 20000},
+		{"mid period", time.Date(2026, 4, 16, 15, 4, 5, 0, time.UTC), 15, 150000, 300000},
+		{"before the period", day(2026, 3, 20), 30, 300000, 600000},
+		{"after the period", day(2026, 5, 2), 0, 0, 0},
+	}
+	for _, tt := range tests {
+		got := period.Prorate(tt.from, oldPrice, newPrice)
+		if got.Days != tt.days || got.PeriodDays != 30 || got.Credit != tt.credit || got.Charge != tt.charge {
+			t.Errorf("%s: got %d/%d days, credit %s, charge %s; want %d days, credit %s, charge %s",
+				tt.name, got.Days, got.PeriodDays, got.Credit, got.Charge, tt.days, tt.credit, tt.charge)
+		}
+		if got.Net() != tt.charge-tt.credit {
+			t.Errorf("%s: Net = %s, want %s", tt.name, got.Net(), tt.charge-tt.credit)
+		}
+	}
+
+	// A downgrade on the last day of a 31-day period credits one day at the
+	// old price, rounded to the cent
+	march := Period{day(2026, 3, 1), day(2026, 3, 31)}
+	if pr := march.Prorate(day(2026, 3, 31), 10000, 0); pr.Credit != 323 || pr.Net() != -323 {
+		t.Errorf("downgrade: credit %s, net %s; want 3.23, -3.23", pr.Credit, pr.Net())
+	}
+}
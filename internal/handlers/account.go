@@ -0,0 +1,269 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"isp-saas.com/platform/pkg/mailer"
+)
+
+const (
+	tokenPurposePasswordReset     = "password_reset"
+	tokenPurposeEmailVerification = "email_verification"
+
+	passwordResetTTL     = time.Hour
+	emailVerificationTTL = 48 * time.Hour
+)
+
+var errUserTokenInvalid = errors.New("invalid or expired token")
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+// ForgotPassword mails a password reset link. It always answers the same way
+// so the endpoint cannot be used to discover which emails are registered.
+func (h *Handler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Email is required"})
+		return
+	}
+
+	var userID int
+	var email string
+	err := h.db.QueryRow(
+		"SELECT id, email FROM users WHERE email = $1 AND is_active = true",
+		strings.TrimSpace(req.Email),
+	).Scan(&userID, &email)
+
+	if err == nil {
+		token, err := h.issueUserToken(userID, tokenPurposePasswordReset, passwordResetTTL)
+		if err != nil {
+			h.logger.Error("Failed to create password reset token", "user_id", userID, "error", err)
+		} else {
+			err = h.mailer.Send(mailer.Message{
+				To:      email,
+				Subject: "Reset your ISP SaaS Platform password",
+				Body: fmt.Sprintf("A password reset was requested for your account.\n\n"+
+					"Open the link below within %d minutes to choose a new password:\n\n%s/reset-password?token=%s\n\n"+
+					"If you did not request this, you can ignore this email.\n",
+					int(passwordResetTTL.Minutes()), appURL(), token),
+			})
+			if err != nil {
+				h.logger.Error("Failed to send password reset email", "user_id", userID, "error", err)
+			} else {
+				h.logger.Info("Password reset requested", "user_id", userID)
+			}
+		}
+	}
+
+	h.sendJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "If the email is registered, a reset link has been sent",
+	})
+}
+
+// ResetPassword sets a new password using a token from ForgotPassword and
+// signs the user out of every existing session.
+func (h *Handler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
+		return
+	}
+
+	if req.Token == "" {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Token is required"})
+		return
+	}
+
+	if err := ValidatePassword(req.Password); err != nil {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to process password"})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	userID, err := consumeUserToken(tx, req.Token, tokenPurposePasswordReset)
+	if err != nil {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid or expired reset token"})
+		return
+	}
+
+	// A reset link proves control of the mailbox, so it also verifies it
+	_, err = tx.Exec(`
+		UPDATE users SET password_hash = $1,
+		       email_verified = true, email_verified_at = COALESCE(email_verified_at, NOW()),
+		       updated_at = NOW()
+		WHERE id = $2
+	`, string(hashedPassword), userID)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to reset password"})
+		return
+	}
+
+	tx.Exec(`
+		UPDATE sessions SET revoked_at = NOW(), revoked_reason = 'password_reset'
+		WHERE user_id = $1 AND revoked_at IS NULL
+	`, userID)
+
+	if err := tx.Commit(); err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to reset password"})
+		return
+	}
+
+	h.auditAs(r, userID, "user.password_reset", "user", userID, nil, nil)
+	h.logger.Info("Password reset completed", "user_id", userID)
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Password has been reset. Please log in."})
+}
+
+func (h *Handler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Token is required"})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	userID, err := consumeUserToken(tx, req.Token, tokenPurposeEmailVerification)
+	if err != nil {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid or expired verification token"})
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE users SET email_verified = true, email_verified_at = NOW(), updated_at = NOW() WHERE id = $1
+	`, userID)
+	if err != nil || tx.Commit() != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to verify email"})
+		return
+	}
+
+	h.logger.Info("Email verified", "user_id", userID)
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Email verified successfully"})
+}
+
+// ResendVerification mails a fresh verification link to an unverified account
+func (h *Handler) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	var req ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Email is required"})
+		return
+	}
+
+	var userID int
+	var email string
+	err := h.db.QueryRow(`
+		SELECT id, email FROM users WHERE email = $1 AND is_active = true AND email_verified = false
+	`, strings.TrimSpace(req.Email)).Scan(&userID, &email)
+	if err == nil {
+		if err := h.sendVerificationEmail(userID, email); err != nil {
+			h.logger.Error("Failed to send verification email", "user_id", userID, "error", err)
+		}
+	}
+
+	h.sendJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "If the account is awaiting verification, a new link has been sent",
+	})
+}
+
+func (h *Handler) sendVerificationEmail(userID int, email string) error {
+	token, err := h.issueUserToken(userID, tokenPurposeEmailVerification, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	return h.mailer.Send(mailer.Message{
+		To:      email,
+		Subject: "Verify your ISP SaaS Platform account",
+		Body: fmt.Sprintf("Welcome to ISP SaaS Platform.\n\n"+
+			"Confirm your email address by opening the link below:\n\n%s/verify-email?token=%s\n\n"+
+			"The link expires in %d hours.\n",
+			appURL(), token, int(emailVerificationTTL.Hours())),
+	})
+}
+
+// issueUserToken creates a single-use token for the given purpose, replacing
+// any earlier unused token of the same kind.
+func (h *Handler) issueUserToken(userID int, purpose string, ttl time.Duration) (string, error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE user_tokens SET used_at = NOW()
+		WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL
+	`, userID, purpose)
+	if err != nil {
+		return "", err
+	}
+
+	token := generateRandomKey(32)
+	_, err = tx.Exec(`
+		INSERT INTO user_tokens (user_id, purpose, token_hash, expires_at) VALUES ($1, $2, $3, $4)
+	`, userID, purpose, hashToken(token), time.Now().Add(ttl))
+	if err != nil {
+		return "", err
+	}
+
+	return token, tx.Commit()
+}
+
+// consumeUserToken marks a token as used and returns its owner
+func consumeUserToken(tx *sql.Tx, token, purpose string) (int, error) {
+	var userID int
+	err := tx.QueryRow(`
+		UPDATE user_tokens SET used_at = NOW()
+		WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id
+	`, hashToken(token), purpose).Scan(&userID)
+	if err != nil {
+		return 0, errUserTokenInvalid
+	}
+	return userID, nil
+}
+
+func appURL() string {
+	url := os.Getenv("APP_URL")
+	if url == "" {
+		url = "http://localhost:8080"
+	}
+	return strings.TrimRight(url, "/")
+}
@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"net/http"
 	"time"
+
+	"isp-saas.com/platform/internal/middleware"
 )
 
 type AgentVersion struct {
@@ -79,7 +81,7 @@ func (h *Handler) CreateAgentVersion(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	userID := r.Context().Value("user_id").(int)
+	claims := middleware.GetUserFromContext(r)
 	
 	query := `
 		INSERT INTO agent_versions (version, download_url, checksum, release_notes, is_stable)
@@ -99,8 +101,9 @@ func (h *Handler) CreateAgentVersion(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
+	h.audit(r, "agent_version.create", "agent_version", versionID, nil, h.auditSnapshot("agent_versions", versionID))
 	h.logger.Info("Agent version created", map[string]interface{}{
-		"by":         userID,
+		"by":         claims.UserID,
 		"version_id": versionID,
 		"version":    req.Version,
 	})
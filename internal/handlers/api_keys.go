@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"isp-saas.com/platform/internal/middleware"
+)
+
+type APIKeyResponse struct {
+	ID          int      `json:"id"`
+	ISPID       int      `json:"isp_id"`
+	Name        string   `json:"name"`
+	KeyPrefix   string   `json:"key_prefix"`
+	Permissions []string `json:"permissions"`
+	LastUsed    *string  `json:"last_used"`
+	ExpiresAt   *string  `json:"expires_at"`
+	IsActive    bool     `json:"is_active"`
+	RevokedAt   *string  `json:"revoked_at,omitempty"`
+	CreatedAt   string   `json:"created_at"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+	DaysValid   int      `json:"days_valid"`
+}
+
+// GetISPAPIKeys lists the agent API keys issued for an ISP (admin only)
+func (h *Handler) GetISPAPIKeys(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ispID := vars["id"]
+
+	rows, err := h.db.Query(`
+		SELECT id, isp_id, COALESCE(name, ''), COALESCE(key_prefix, ''), COALESCE(permissions, '[]'),
+		       last_used, expires_at, is_active, revoked_at, created_at
+		FROM api_keys WHERE isp_id = $1
+		ORDER BY created_at DESC
+	`, ispID)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	keys := []APIKeyResponse{}
+	for rows.Next() {
+		var k APIKeyResponse
+		var permissionsJSON []byte
+		if err := rows.Scan(&k.ID, &k.ISPID, &k.Name, &k.KeyPrefix, &permissionsJSON,
+			&k.LastUsed, &k.ExpiresAt, &k.IsActive, &k.RevokedAt, &k.CreatedAt); err != nil {
+			continue
+		}
+		json.Unmarshal(permissionsJSON, &k.Permissions)
+		keys = append(keys, k)
+	}
+
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Data: keys})
+}
+
+// CreateAPIKey issues a new agent API key for an ISP. The raw key is only
+// returned once; the database stores its hash.
+func (h *Handler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ispID := vars["id"]
+
+	claims := middleware.GetUserFromContext(r)
+
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
+		return
+	}
+
+	if len(req.Permissions) == 0 {
+		req.Permissions = middleware.AgentPermissions
+	}
+	if !validAgentPermissions(req.Permissions) {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid permission"})
+		return
+	}
+	if req.Name == "" {
+		req.Name = "agent"
+	}
+
+	var expiresAt *time.Time
+	if req.DaysValid > 0 {
+		t := time.Now().AddDate(0, 0, req.DaysValid)
+		expiresAt = &t
+	}
+
+	var exists bool
+	h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM isps WHERE id = $1)", ispID).Scan(&exists)
+	if !exists {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "ISP not found"})
+		return
+	}
+
+	key := generateAPIKey()
+	permissionsJSON, _ := json.Marshal(req.Permissions)
+
+	var keyID int
+	err := h.db.QueryRow(`
+		INSERT INTO api_keys (isp_id, key_hash, key_prefix, name, permissions, expires_at, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id
+	`, ispID, middleware.HashAPIKey(key), key[:11], req.Name, permissionsJSON, expiresAt, claims.UserID).Scan(&keyID)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to create API key"})
+		return
+	}
+
+	h.audit(r, "api_key.create", "api_key", keyID, nil, h.auditSnapshot("api_keys", keyID))
+	h.logger.Info("API key created", "key_id", keyID, "isp_id", ispID, "by", claims.UserID)
+	h.sendJSON(w, http.StatusCreated, Response{
+		Success: true,
+		Message: "API key created. Store it now, it will not be shown again.",
+		Data: map[string]interface{}{
+			"id":          keyID,
+			"api_key":     key,
+			"permissions": req.Permissions,
+			"expires_at":  expiresAt,
+		},
+	})
+}
+
+// RotateAPIKey revokes an API key and issues a replacement with the same
+// name, permissions and expiry.
+func (h *Handler) RotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	claims := middleware.GetUserFromContext(r)
+	before := h.auditSnapshot("api_keys", id)
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var ispID int
+	var name string
+	var permissionsJSON []byte
+	var expiresAt sql.NullTime
+	err = tx.QueryRow(`
+		UPDATE api_keys SET is_active = false, revoked_at = NOW()
+		WHERE id = $1 AND is_active = true
+		RETURNING isp_id, COALESCE(name, ''), COALESCE(permissions, '[]'), expires_at
+	`, id).Scan(&ispID, &name, &permissionsJSON, &expiresAt)
+	if err != nil {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Active API key not found"})
+		return
+	}
+
+	key := generateAPIKey()
+
+	var keyID int
+	err = tx.QueryRow(`
+		INSERT INTO api_keys (isp_id, key_hash, key_prefix, name, permissions, expires_at, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id
+	`, ispID, middleware.HashAPIKey(key), key[:11], name, permissionsJSON, expiresAt, claims.UserID).Scan(&keyID)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to rotate API key"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to rotate API key"})
+		return
+	}
+
+	h.audit(r, "api_key.rotate", "api_key", id, before, h.auditSnapshot("api_keys", id))
+	h.audit(r, "api_key.create", "api_key", keyID, nil, h.auditSnapshot("api_keys", keyID))
+	h.logger.Info("API key rotated", "old_key_id", id, "key_id", keyID, "isp_id", ispID, "by", claims.UserID)
+	h.sendJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "API key rotated. Store it now, it will not be shown again.",
+		Data: map[string]interface{}{
+			"id":      keyID,
+			"api_key": key,
+		},
+	})
+}
+
+// RevokeAPIKey permanently disables an agent API key
+func (h *Handler) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	claims := middleware.GetUserFromContext(r)
+	before := h.auditSnapshot("api_keys", id)
+
+	result, err := h.db.Exec(`
+		UPDATE api_keys SET is_active = false, revoked_at = NOW()
+		WHERE id = $1 AND is_active = true
+	`, id)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to revoke API key"})
+		return
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Active API key not found"})
+		return
+	}
+
+	h.audit(r, "api_key.revoke", "api_key", id, before, h.auditSnapshot("api_keys", id))
+	h.logger.Info("API key revoked", "key_id", id, "by", claims.UserID)
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "API key revoked successfully"})
+}
+
+func validAgentPermissions(permissions []string) bool {
+	for _, p := range permissions {
+		found := false
+		for _, allowed := range middleware.AgentPermissions {
+			if p == allowed {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func generateAPIKey() string {
+	return "isk_" + generateRandomKey(24)
+}
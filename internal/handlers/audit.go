@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"isp-saas.com/platform/internal/middleware"
+)
+
+// auditRedactedFields are masked in entity snapshots so secrets never end up
+// in audit_logs
+var auditRedactedFields = []string{"password_hash", "mfa_secret", "mfa_pending_secret", "key_hash", "token"}
+
+type AuditLogResponse struct {
+	ID         int             `json:"id"`
+	UserID     *int            `json:"user_id"`
+	UserEmail  *string         `json:"user_email"`
+	Action     string          `json:"action"`
+	EntityType *string         `json:"entity_type"`
+	EntityID   *int            `json:"entity_id"`
+	OldValues  json.RawMessage `json:"old_values"`
+	NewValues  json.RawMessage `json:"new_values"`
+	IPAddress  *string         `json:"ip_address"`
+	UserAgent  *string         `json:"user_agent"`
+	CreatedAt  string          `json:"created_at"`
+}
+
+// audit records a mutation made by the authenticated caller. before and after
+// are the entity's state around the change; pass nil for a side that does not
+// exist. A failed write is logged but never fails the request.
+func (h *Handler) audit(r *http.Request, action, entityType string, entityID interface{}, before, after interface{}) {
+	var actorID interface{}
+	if claims := middleware.GetUserFromContext(r); claims != nil {
+		actorID = claims.UserID
+	}
+	h.auditAs(r, actorID, action, entityType, entityID, before, after)
+}
+
+// auditAs is audit for unauthenticated endpoints, where the actor is known
+// from the request body or token rather than from the session. Background
+// jobs pass a nil request and actor.
+func (h *Handler) auditAs(r *http.Request, actorID interface{}, action, entityType string, entityID interface{}, before, after interface{}) {
+	var ip, userAgent interface{}
+	if r != nil {
+		ip, userAgent = clientIP(r), r.UserAgent()
+	}
+	_, err := h.db.Exec(`
+		INSERT INTO audit_logs (user_id, action, entity_type, entity_id, old_values, new_values, ip_address, user_agent)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, actorID, action, entityType, entityID, auditJSON(before), auditJSON(after), ip, userAgent)
+	if err != nil {
+		h.logger.Error("Failed to write audit log", "action", action, "entity_type", entityType, "entity_id", entityID, "error", err)
+	}
+}
+
+// auditSnapshot returns the current row of table with the given id as JSON,
+// or nil if there is no such row. table must be a constant, never user input.
+func (h *Handler) auditSnapshot(table string, id interface{}) json.RawMessage {
+	var raw []byte
+	err := h.db.QueryRow("SELECT row_to_json(t) FROM "+table+" t WHERE t.id = $1", id).Scan(&raw)
+	if err != nil {
+		return nil
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil
+	}
+	for _, f := range auditRedactedFields {
+		if _, ok := fields[f]; ok {
+			fields[f] = "[redacted]"
+		}
+	}
+
+	snapshot, _ := json.Marshal(fields)
+	return snapshot
+}
+
+// auditJSON converts a snapshot into a JSONB parameter, keeping nil as NULL
+func auditJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case json.RawMessage:
+		if len(v) == 0 {
+			return nil
+		}
+		return []byte(v)
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// GetAuditLogs lists audit entries, newest first. Filters: user_id,
+// entity_type, entity_id, action, from, to (RFC 3339 or YYYY-MM-DD), limit
+// and offset.
+func (h *Handler) GetAuditLogs(w http.ResponseWriter, r *http.Request) {
+	limit, offset := 100, 0
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+	if o, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && o > 0 {
+		offset = o
+	}
+
+	where, args, err := auditFilters(r)
+	if err != nil {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	args = append(args, limit, offset)
+	query := auditSelect + where + fmt.Sprintf(" ORDER BY a.created_at DESC, a.id DESC LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+
+	logs, err := h.queryAuditLogs(query, args)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Data: logs})
+}
+
+// ExportAuditLogs streams the audit entries matching the GetAuditLogs filters
+// as CSV, oldest first
+func (h *Handler) ExportAuditLogs(w http.ResponseWriter, r *http.Request) {
+	where, args, err := auditFilters(r)
+	if err != nil {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	logs, err := h.queryAuditLogs(auditSelect+where+" ORDER BY a.created_at, a.id", args)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+
+	filename := fmt.Sprintf("audit-%s.csv", time.Now().UTC().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "created_at", "user_id", "user_email", "action", "entity_type", "entity_id",
+		"ip_address", "user_agent", "old_values", "new_values"})
+	for _, a := range logs {
+		cw.Write([]string{
+			strconv.Itoa(a.ID), a.CreatedAt, intOrEmpty(a.UserID), stringOrEmpty(a.UserEmail), a.Action,
+			stringOrEmpty(a.EntityType), intOrEmpty(a.EntityID), stringOrEmpty(a.IPAddress),
+			stringOrEmpty(a.UserAgent), string(a.OldValues), string(a.NewValues),
+		})
+	}
+	cw.Flush()
+
+	claims := middleware.GetUserFromContext(r)
+	h.logger.Info("Audit log exported", "rows", len(logs), "by", claims.UserID)
+}
+
+const auditSelect = `
+	SELECT a.id, a.user_id, u.email, a.action, a.entity_type, a.entity_id,
+	       a.old_values, a.new_values, HOST(a.ip_address), a.user_agent, a.created_at
+	FROM audit_logs a
+	LEFT JOIN users u ON a.user_id = u.id
+	WHERE 1=1`
+
+func auditFilters(r *http.Request) (string, []interface{}, error) {
+	q := r.URL.Query()
+	where := ""
+	args := []interface{}{}
+
+	for _, f := range []struct{ param, column string }{
+		{"user_id", "a.user_id"},
+		{"entity_type", "a.entity_type"},
+		{"entity_id", "a.entity_id"},
+		{"action", "a.action"},
+	} {
+		v := q.Get(f.param)
+		if v == "" {
+			continue
+		}
+		if f.param == "user_id" || f.param == "entity_id" {
+			if _, err := strconv.Atoi(v); err != nil {
+				return "", nil, fmt.Errorf("Invalid %s", f.param)
+			}
+		}
+		args = append(args, v)
+		where += fmt.Sprintf(" AND %s = $%d", f.column, len(args))
+	}
+
+	for _, f := range []struct{ param, op string }{{"from", ">="}, {"to", "<="}} {
+		v := q.Get(f.param)
+		if v == "" {
+			continue
+		}
+		t, err := parseAuditTime(v, f.param == "to")
+		if err != nil {
+			return "", nil, fmt.Errorf("Invalid %s: use RFC 3339 or YYYY-MM-DD", f.param)
+		}
+		args = append(args, t)
+		where += fmt.Sprintf(" AND a.created_at %s $%d", f.op, len(args))
+	}
+
+	return where, args, nil
+}
+
+// parseAuditTime accepts a timestamp or a bare date. A bare "to" date covers
+// the whole day.
+func parseAuditTime(v string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
+
+func (h *Handler) queryAuditLogs(query string, args []interface{}) ([]AuditLogResponse, error) {
+	rows, err := h.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	logs := []AuditLogResponse{}
+	for rows.Next() {
+		var a AuditLogResponse
+		var oldValues, newValues []byte
+		if err := rows.Scan(&a.ID, &a.UserID, &a.UserEmail, &a.Action, &a.EntityType, &a.EntityID,
+			&oldValues, &newValues, &a.IPAddress, &a.UserAgent, &a.CreatedAt); err != nil {
+			continue
+		}
+		a.OldValues = nullableJSON(oldValues)
+		a.NewValues = nullableJSON(newValues)
+		logs = append(logs, a)
+	}
+	return logs, rows.Err()
+}
+
+func nullableJSON(b []byte) json.RawMessage {
+	if len(b) == 0 {
+		return json.RawMessage("null")
+	}
+	return json.RawMessage(b)
+}
+
+func intOrEmpty(v *int) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.Itoa(*v)
+}
+
+func stringOrEmpty(v *string) string {
+	if v == nil {
+		return ""
+	}
+	return *v
+}
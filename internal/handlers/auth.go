@@ -11,6 +11,7 @@ import (
     "github.com/golang-jwt/jwt/v5"
     "golang.org/x/crypto/bcrypt"
     "isp-saas.com/platform/internal/middleware"
+    "isp-saas.com/platform/internal/rbac"
 )
 
 type LoginRequest struct {
@@ -39,11 +40,11 @@ func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
 
     var userID int
     var email, passwordHash, role, fullName string
-    var isActive bool
+    var isActive, emailVerified, mfaEnabled bool
     err := h.db.QueryRow(
-        "SELECT id, email, password_hash, role, COALESCE(full_name, ''), is_active FROM users WHERE email = $1",
+        "SELECT id, email, password_hash, role, COALESCE(full_name, ''), is_active, email_verified, mfa_enabled FROM users WHERE email = $1",
         req.Email,
-    ).Scan(&userID, &email, &passwordHash, &role, &fullName, &isActive)
+    ).Scan(&userID, &email, &passwordHash, &role, &fullName, &isActive, &emailVerified, &mfaEnabled)
 
     if err != nil {
         h.logger.Warn("Login failed - user not found", "email", req.Email)
@@ -62,27 +63,58 @@ func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    token, err := generateJWT(userID, email, role)
+    if !emailVerified {
+        h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Email address has not been verified"})
+        return
+    }
+
+    // Second step: the password was correct but a TOTP code is still needed,
+    // either to verify an enrolled user or to enroll one for whom MFA is mandatory
+    if mfaEnabled || h.mfaRequiredForRole(role) {
+        mfaToken, err := generateMFAPendingToken(userID, email, role)
+        if err != nil {
+            h.logger.Error("Failed to generate MFA token", "error", err)
+            h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to generate token"})
+            return
+        }
+
+        message := "Two-factor authentication code required"
+        if !mfaEnabled {
+            message = "Two-factor authentication must be set up before logging in"
+        }
+        h.sendJSON(w, http.StatusOK, Response{
+            Success: true,
+            Message: message,
+            Data: map[string]interface{}{
+                "mfa_required":            mfaEnabled,
+                "mfa_enrollment_required": !mfaEnabled,
+                "mfa_token":               mfaToken,
+                "expires_in":              int(mfaPendingTTL.Seconds()),
+            },
+        })
+        return
+    }
+
+    tokens, err := h.startSession(r, userID, email, role)
     if err != nil {
-        h.logger.Error("Failed to generate JWT", "error", err)
+        h.logger.Error("Failed to start session", "error", err)
         h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to generate token"})
         return
     }
 
-    h.logger.Info("User logged in", "user_id", userID, "email", email)
+    h.logger.Info("User logged in", "user_id", userID, "email", email, "session_id", tokens.SessionID)
 
+    data := tokens.data()
+    data["user"] = map[string]interface{}{
+        "id":        userID,
+        "email":     email,
+        "role":      role,
+        "full_name": fullName,
+    }
     h.sendJSON(w, http.StatusOK, Response{
         Success: true,
         Message: "Login successful",
-        Data: map[string]interface{}{
-            "token": token,
-            "user": map[string]interface{}{
-                "id":        userID,
-                "email":     email,
-                "role":      role,
-                "full_name": fullName,
-            },
-        },
+        Data:    data,
     })
 }
 
@@ -98,19 +130,18 @@ func (h *Handler) Register(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    if len(req.Password) < 8 {
-        h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Password must be at least 8 characters"})
-
     // Validate password strength
     if err := ValidatePassword(req.Password); err != nil {
         h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: err.Error()})
         return
     }
-        req.Role = "isp"
-    }
 
-    validRoles := map[string]bool{"admin": true, "distributor": true, "isp": true}
-    if !validRoles[req.Role] {
+    // Self-registration only creates ISP accounts; admins and distributors
+    // are provisioned by an admin
+    if req.Role == "" {
+        req.Role = rbac.RoleISP
+    }
+    if req.Role != rbac.RoleISP {
         h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid role"})
         return
     }
@@ -132,57 +163,74 @@ func (h *Handler) Register(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    token, _ := generateJWT(userID, req.Email, req.Role)
+    if err := h.sendVerificationEmail(userID, req.Email); err != nil {
+        h.logger.Error("Failed to send verification email", "user_id", userID, "error", err)
+    }
 
+    h.auditAs(r, userID, "user.register", "user", userID, nil, h.auditSnapshot("users", userID))
     h.logger.Info("User registered", "user_id", userID, "email", req.Email, "role", req.Role)
 
     h.sendJSON(w, http.StatusCreated, Response{
         Success: true,
-        Message: "User registered successfully",
+        Message: "User registered successfully. Check your email to verify your account.",
         Data: map[string]interface{}{
-            "token":   token,
             "user_id": userID,
         },
     })
 }
 
+// RefreshToken exchanges a refresh token for a new access token. The refresh
+// token is single-use: a new one is returned with every call.
 func (h *Handler) RefreshToken(w http.ResponseWriter, r *http.Request) {
-    claims := middleware.GetUserFromContext(r)
-    if claims == nil {
-        h.sendJSON(w, http.StatusUnauthorized, Response{Success: false, Error: "Invalid token"})
+    var req RefreshTokenRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+        h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Refresh token is required"})
         return
     }
 
-    token, err := generateJWT(claims.UserID, claims.Email, claims.Role)
-    if err != nil {
+    tokens, err := h.rotateRefreshToken(req.RefreshToken)
+    switch err {
+    case nil:
+    case errRefreshTokenInvalid, errRefreshTokenReused:
+        h.sendJSON(w, http.StatusUnauthorized, Response{Success: false, Error: "Invalid refresh token"})
+        return
+    case errAccountDisabled:
+        h.sendJSON(w, http.StatusUnauthorized, Response{Success: false, Error: "Account is disabled"})
+        return
+    default:
+        h.logger.Error("Failed to refresh token", "error", err)
         h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to refresh token"})
         return
     }
 
     h.sendJSON(w, http.StatusOK, Response{
         Success: true,
-        Data:    map[string]string{"token": token},
+        Data:    tokens.data(),
     })
 }
 
-func generateJWT(userID int, email, role string) (string, error) {
+func jwtSecret() string {
     secret := os.Getenv("JWT_SECRET")
     if secret == "" {
         secret = "your-super-secret-key-change-in-production"
     }
+    return secret
+}
 
+func generateJWT(userID int, email, role string, sessionID int) (string, error) {
     claims := middleware.Claims{
-        UserID: userID,
-        Email:  email,
-        Role:   role,
+        UserID:    userID,
+        Email:     email,
+        Role:      role,
+        SessionID: sessionID,
         RegisteredClaims: jwt.RegisteredClaims{
-            ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+            ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessTokenTTL)),
             IssuedAt:  jwt.NewNumericDate(time.Now()),
         },
     }
 
     token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-    return token.SignedString([]byte(secret))
+    return token.SignedString([]byte(jwtSecret()))
 }
 
 func generateRandomKey(length int) string {
@@ -2,50 +2,107 @@ package handlers
 
 import (
     "encoding/json"
-    "fmt"
+    "errors"
     "net/http"
+    "strconv"
     "strings"
     "time"
 
     "github.com/gorilla/mux"
+    "isp-saas.com/platform/internal/billing"
     "isp-saas.com/platform/internal/middleware"
 )
 
 type PlanResponse struct {
-    ID             int      `json:"id"`
-    Name           string   `json:"name"`
-    Description    string   `json:"description"`
-    PriceMonthly   float64  `json:"price_monthly"`
-    BandwidthLimit *int     `json:"bandwidth_limit_mbps"`
-    CacheSizeGB    *int     `json:"cache_size_gb"`
-    MaxConnections *int     `json:"max_connections"`
-    Features       []string `json:"features"`
-    IsActive       bool     `json:"is_active"`
+    ID                      int           `json:"id"`
+    Name                    string        `json:"name"`
+    Description             string        `json:"description"`
+    PriceMonthly            float64       `json:"price_monthly"`
+    Currency                string        `json:"currency"`
+    BandwidthLimit          *int          `json:"bandwidth_limit_mbps"`
+    CacheSizeGB             *int          `json:"cache_size_gb"`
+    MaxConnections          *int          `json:"max_connections"`
+    Features                []string      `json:"features"`
+    // License modules the plan entitles its ISPs to
+    Modules                 []string      `json:"modules"`
+    IsActive                bool          `json:"is_active"`
+    // Price per unit above the limits; 0 means overage is not billed
+    CacheOveragePerGB       billing.Money `json:"cache_overage_per_gb"`
+    BandwidthOveragePerMbps billing.Money `json:"bandwidth_overage_per_mbps"`
+}
+
+type PlanOverageRequest struct {
+    CacheOveragePerGB       billing.Money `json:"cache_overage_per_gb"`
+    BandwidthOveragePerMbps billing.Money `json:"bandwidth_overage_per_mbps"`
 }
 
 type InvoiceResponse struct {
-    ID        int     `json:"id"`
-    ISPID     int     `json:"isp_id"`
-    ISPName   string  `json:"isp_name,omitempty"`
-    Amount    float64 `json:"amount"`
-    Status    string  `json:"status"`
-    DueDate   string  `json:"due_date"`
-    PaidAt    *string `json:"paid_at"`
-    CreatedAt string  `json:"created_at"`
+    ID                 int                   `json:"id"`
+    InvoiceNumber      string                `json:"invoice_number"`
+    ISPID              int                   `json:"isp_id"`
+    ISPName            string                `json:"isp_name,omitempty"`
+    Subtotal           billing.Money         `json:"subtotal"`
+    TaxName            string                `json:"tax_name,omitempty"`
+    TaxRate            billing.Rate          `json:"tax_rate"`
+    TaxAmount          billing.Money         `json:"tax_amount"`
+    Amount             billing.Money         `json:"amount"`
+    AmountCredited     billing.Money         `json:"amount_credited"`
+    AmountPaid         billing.Money         `json:"amount_paid"`
+    BalanceDue         billing.Money         `json:"balance_due"`
+    Status             string                `json:"status"`
+    DueDate            string                `json:"due_date"`
+    PaidAt             *string               `json:"paid_at"`
+    CancelledAt        *string               `json:"cancelled_at,omitempty"`
+    CancellationReason *string               `json:"cancellation_reason,omitempty"`
+    PlanID             *int                  `json:"plan_id"`
+    PeriodStart        *string               `json:"period_start"`
+    PeriodEnd          *string               `json:"period_end"`
+    // Amounts are in Currency; ExchangeRate converts them to BaseCurrency as
+    // of ExchangeRateDate
+    Currency           string                `json:"currency"`
+    BaseCurrency       string                `json:"base_currency"`
+    ExchangeRate       billing.ExchangeRate  `json:"exchange_rate"`
+    ExchangeRateDate   *string               `json:"exchange_rate_date"`
+    CreatedAt          string                `json:"created_at"`
+    Items              []InvoiceItemResponse `json:"items,omitempty"`
 }
 
+// CreateInvoiceRequest takes either line items or, for a single-line invoice,
+// just an amount. Tax is added on top according to the ISP's tax rate.
 type CreateInvoiceRequest struct {
-    ISPID   int     `json:"isp_id"`
-    Amount  float64 `json:"amount"`
-    DueDays int     `json:"due_days"`
+    ISPID   int                  `json:"isp_id"`
+    Amount  billing.Money        `json:"amount"`
+    Items   []InvoiceItemRequest `json:"items"`
+    DueDays int                  `json:"due_days"`
 }
 
+type InvoiceItemRequest struct {
+    Description string           `json:"description"`
+    Quantity    billing.Quantity `json:"quantity"`
+    UnitPrice   billing.Money    `json:"unit_price"`
+}
+
+// planSelect reads plans priced in the currency given as $1, or in their own
+// currency when $1 is empty
+const planSelect = `
+        SELECT p.id, p.name, COALESCE(p.description, ''), pb.price_monthly, pb.currency, p.bandwidth_limit_mbps,
+               p.cache_size_gb, p.max_connections, p.features, p.is_active, pb.cache_overage_per_gb,
+               pb.bandwidth_overage_per_mbps,
+               COALESCE((SELECT jsonb_agg(pm.module_key ORDER BY pm.module_key) FROM plan_modules pm WHERE pm.plan_id = p.id), '[]')
+        FROM plans p
+        JOIN plan_price_book pb ON pb.plan_id = p.id AND pb.currency = COALESCE(NULLIF($1, ''), p.currency)
+`
+
+// GetPlans lists the active plans. With ?currency= it lists the plans sold
+// in that currency, at their price in it.
 func (h *Handler) GetPlans(w http.ResponseWriter, r *http.Request) {
-    rows, err := h.db.Query(`
-        SELECT id, name, COALESCE(description, ''), price_monthly, bandwidth_limit_mbps, 
-               cache_size_gb, max_connections, features, is_active
-        FROM plans WHERE is_active = true ORDER BY price_monthly
-    `)
+    currency, ok := normalizeCurrency(r.URL.Query().Get("currency"))
+    if !ok {
+        h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "currency must be a three-letter ISO 4217 code"})
+        return
+    }
+
+    rows, err := h.db.Query(planSelect+" WHERE p.is_active = true ORDER BY pb.price_monthly", currency)
     if err != nil {
         h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
         return
@@ -55,10 +112,11 @@ func (h *Handler) GetPlans(w http.ResponseWriter, r *http.Request) {
     var plans []PlanResponse
     for rows.Next() {
         var p PlanResponse
-        var featuresJSON []byte
-        rows.Scan(&p.ID, &p.Name, &p.Description, &p.PriceMonthly, &p.BandwidthLimit, 
-            &p.CacheSizeGB, &p.MaxConnections, &featuresJSON, &p.IsActive)
+        var featuresJSON, modulesJSON []byte
+        rows.Scan(&p.ID, &p.Name, &p.Description, &p.PriceMonthly, &p.Currency, &p.BandwidthLimit,
+            &p.CacheSizeGB, &p.MaxConnections, &featuresJSON, &p.IsActive, &p.CacheOveragePerGB, &p.BandwidthOveragePerMbps, &modulesJSON)
         json.Unmarshal(featuresJSON, &p.Features)
+        json.Unmarshal(modulesJSON, &p.Modules)
         plans = append(plans, p)
     }
 
@@ -69,62 +127,76 @@ func (h *Handler) GetPlan(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     id := vars["id"]
 
+    currency, ok := normalizeCurrency(r.URL.Query().Get("currency"))
+    if !ok {
+        h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "currency must be a three-letter ISO 4217 code"})
+        return
+    }
+
     var p PlanResponse
-    var featuresJSON []byte
-    err := h.db.QueryRow(`
-        SELECT id, name, COALESCE(description, ''), price_monthly, bandwidth_limit_mbps,
-               cache_size_gb, max_connections, features, is_active
-        FROM plans WHERE id = $1
-    `, id).Scan(&p.ID, &p.Name, &p.Description, &p.PriceMonthly, &p.BandwidthLimit,
-        &p.CacheSizeGB, &p.MaxConnections, &featuresJSON, &p.IsActive)
+    var featuresJSON, modulesJSON []byte
+    err := h.db.QueryRow(planSelect+" WHERE p.id = $2", currency, id).Scan(&p.ID, &p.Name, &p.Description,
+        &p.PriceMonthly, &p.Currency, &p.BandwidthLimit, &p.CacheSizeGB, &p.MaxConnections, &featuresJSON, &p.IsActive, &p.CacheOveragePerGB, &p.BandwidthOveragePerMbps, &modulesJSON)
 
     if err != nil {
         h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Plan not found"})
         return
     }
     json.Unmarshal(featuresJSON, &p.Features)
+    json.Unmarshal(modulesJSON, &p.Modules)
 
     h.sendJSON(w, http.StatusOK, Response{Success: true, Data: p})
 }
 
+// UpdatePlanOverage sets the prices, in the plan's own currency, a plan
+// charges for usage above its cache size and bandwidth limits
+func (h *Handler) UpdatePlanOverage(w http.ResponseWriter, r *http.Request) {
+    id := mux.Vars(r)["id"]
+
+    var req PlanOverageRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
+        return
+    }
+    if req.CacheOveragePerGB < 0 || req.BandwidthOveragePerMbps < 0 {
+        h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Overage prices cannot be negative"})
+        return
+    }
+
+    before := h.auditSnapshot("plans", id)
+    result, err := h.db.Exec(`
+        UPDATE plans SET cache_overage_per_gb = $1, bandwidth_overage_per_mbps = $2 WHERE id = $3
+    `, req.CacheOveragePerGB, req.BandwidthOveragePerMbps, id)
+    if err != nil {
+        h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to update plan"})
+        return
+    }
+    if n, _ := result.RowsAffected(); n == 0 {
+        h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Plan not found"})
+        return
+    }
+
+    h.audit(r, "plan.update", "plan", id, before, h.auditSnapshot("plans", id))
+    h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Overage pricing updated"})
+}
+
 func (h *Handler) GetInvoices(w http.ResponseWriter, r *http.Request) {
     claims := middleware.GetUserFromContext(r)
-    
-    var query string
-    var args []interface{}
-
-    if claims.Role == "admin" || claims.Role == "distributor" {
-        query = `
-            SELECT inv.id, inv.isp_id, i.name as isp_name, inv.amount, inv.status, 
-                   inv.due_date, inv.paid_at, inv.created_at
-            FROM invoices inv
-            JOIN isps i ON inv.isp_id = i.id
-            ORDER BY inv.created_at DESC
-        `
-    } else {
-        query = `
-            SELECT inv.id, inv.isp_id, i.name as isp_name, inv.amount, inv.status,
-                   inv.due_date, inv.paid_at, inv.created_at
-            FROM invoices inv
-            JOIN isps i ON inv.isp_id = i.id
-            WHERE i.user_id = $1
-            ORDER BY inv.created_at DESC
-        `
-        args = []interface{}{claims.UserID}
-    }
+    scope, args := tenantScope(claims, "i", 1)
 
-    rows, err := h.db.Query(query, args...)
+    rows, err := h.db.Query(invoiceSelect+" WHERE "+scope+" ORDER BY inv.created_at DESC", args...)
     if err != nil {
         h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
         return
     }
     defer rows.Close()
 
-    var invoices []InvoiceResponse
+    invoices := []InvoiceResponse{}
     for rows.Next() {
         var inv InvoiceResponse
-        rows.Scan(&inv.ID, &inv.ISPID, &inv.ISPName, &inv.Amount, &inv.Status,
-            &inv.DueDate, &inv.PaidAt, &inv.CreatedAt)
+        if err := scanInvoice(rows, &inv); err != nil {
+            continue
+        }
         invoices = append(invoices, inv)
     }
 
@@ -132,212 +204,167 @@ func (h *Handler) GetInvoices(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) CreateInvoice(w http.ResponseWriter, r *http.Request) {
-    claims := middleware.GetUserFromContext(r)
-    if claims.Role != "admin" {
-        h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Admin access required"})
-        return
-    }
-
     var req CreateInvoiceRequest
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
         h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
         return
     }
 
-    if req.ISPID == 0 || req.Amount <= 0 {
-        h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "ISP ID and amount are required"})
+    if len(req.Items) == 0 && req.Amount > 0 {
+        req.Items = []InvoiceItemRequest{{Description: "ISP cache service", Quantity: billing.QuantityOne, UnitPrice: req.Amount}}
+    }
+    if req.ISPID == 0 || len(req.Items) == 0 {
+        h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "ISP ID and amount or items are required"})
         return
     }
 
+    lines := make([]invoiceLine, 0, len(req.Items))
+    for _, it := range req.Items {
+        if it.Quantity == 0 {
+            it.Quantity = billing.QuantityOne
+        }
+        if strings.TrimSpace(it.Description) == "" || it.Quantity < 0 || it.UnitPrice < 0 {
+            h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Each item needs a description, a positive quantity and a unit price"})
+            return
+        }
+        lines = append(lines, invoiceLine{
+            Description: strings.TrimSpace(it.Description),
+            Quantity:    it.Quantity,
+            UnitPrice:   it.UnitPrice,
+            ItemType:    itemManual,
+        })
+    }
+
     if req.DueDays == 0 {
         req.DueDays = 30
     }
 
     dueDate := time.Now().AddDate(0, 0, req.DueDays)
 
-    var invoiceID int
-    err := h.db.QueryRow(`
-        INSERT INTO invoices (isp_id, amount, due_date) VALUES ($1, $2, $3) RETURNING id
-    `, req.ISPID, req.Amount, dueDate).Scan(&invoiceID)
+    tx, err := h.db.Begin()
+    if err != nil {
+        h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to create invoice"})
+        return
+    }
+    defer tx.Rollback()
 
+    inv, err := createInvoice(tx, invoiceDraft{ISPID: req.ISPID, DueDate: dueDate, Lines: lines})
+    if err == nil {
+        err = tx.Commit()
+    }
+    if errors.Is(err, errNoExchangeRate) {
+        h.sendJSON(w, http.StatusConflict, Response{Success: false, Error: "No exchange rate from the ISP's currency to the base currency"})
+        return
+    }
     if err != nil {
+        h.logger.Error("Failed to create invoice", "isp_id", req.ISPID, "error", err)
         h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to create invoice"})
         return
     }
 
-    h.logger.Info("Invoice created", "invoice_id", invoiceID, "isp_id", req.ISPID, "amount", req.Amount)
+    h.issueInvoiceDocument(inv.ID)
+    h.audit(r, "invoice.create", "invoice", inv.ID, nil, h.auditSnapshot("invoices", inv.ID))
+    h.logger.Info("Invoice created", "invoice_id", inv.ID, "invoice_number", inv.Number, "isp_id", req.ISPID, "total", inv.Total)
     h.sendJSON(w, http.StatusCreated, Response{
         Success: true,
         Message: "Invoice created successfully",
         Data: map[string]interface{}{
-            "id":       invoiceID,
-            "due_date": dueDate.Format("2006-01-02"),
+            "id":             inv.ID,
+            "invoice_number": inv.Number,
+            "subtotal":       inv.Subtotal,
+            "tax_amount":     inv.Tax,
+            "amount":         inv.Total,
+            "currency":       inv.Currency,
+            "credit_applied": inv.CreditApplied,
+            "due_date":       dueDate.Format("2006-01-02"),
         },
     })
 }
 
+// MarkInvoicePaid settles an invoice by recording a manual payment for
+// whatever is still due
 func (h *Handler) MarkInvoicePaid(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     id := vars["id"]
 
     claims := middleware.GetUserFromContext(r)
-    if claims.Role != "admin" {
-        h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Admin access required"})
+    inv, err := h.findInvoice(claims, id)
+    if err != nil {
+        h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Invoice not found"})
+        return
+    }
+    if inv.BalanceDue <= 0 {
+        h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Invoice is already paid"})
         return
     }
 
-    _, err := h.db.Exec(`UPDATE invoices SET status = 'paid', paid_at = NOW() WHERE id = $1`, id)
+    before := h.auditSnapshot("invoices", inv.ID)
 
-    if err != nil {
-        h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to update invoice"})
+    paymentID, bal, err := h.applyPayment(newPayment{
+        InvoiceID:  inv.ID,
+        Amount:     inv.BalanceDue,
+        Method:     "manual",
+        RecordedBy: claims.UserID,
+    })
+    if h.sendPaymentError(w, err) {
         return
     }
 
-    h.logger.Info("Invoice marked as paid", "invoice_id", id, "by", claims.UserID)
+    h.paymentApplied(r, claims.UserID, paymentID, bal)
+    h.audit(r, "invoice.mark_paid", "invoice", inv.ID, before, h.auditSnapshot("invoices", inv.ID))
+    h.logger.Info("Invoice marked as paid", "invoice_id", inv.ID, "payment_id", paymentID, "by", claims.UserID)
     h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Invoice marked as paid"})
 }
 
+// CheckOverdueInvoices runs the dunning schedule now rather than waiting for
+// the next scheduled run
 func (h *Handler) CheckOverdueInvoices(w http.ResponseWriter, r *http.Request) {
-    claims := middleware.GetUserFromContext(r)
-    if claims.Role != "admin" {
-        h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Admin access required"})
-        return
-    }
-
-    result, err := h.db.Exec(`
-        UPDATE invoices SET status = 'overdue' 
-        WHERE status = 'pending' AND due_date < CURRENT_DATE
-    `)
+    result, err := h.RunDunning(time.Now())
     if err != nil {
+        h.logger.Error("Dunning run failed", "error", err)
         h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to check invoices"})
         return
     }
 
-    rows, _ := result.RowsAffected()
-
-    h.db.Exec(`
-        UPDATE isps SET status = 'suspended' 
-        WHERE id IN (SELECT DISTINCT isp_id FROM invoices WHERE status = 'overdue') AND status = 'active'
-    `)
+    h.auditDunning(r, result)
 
-    h.logger.Info("Overdue invoices checked", "updated", rows)
+    h.logger.Info("Overdue invoices checked", "updated", result.MarkedOverdue, "reminders", result.RemindersSent,
+        "suspended", len(result.SuspendedISPs))
     h.sendJSON(w, http.StatusOK, Response{
         Success: true,
         Message: "Overdue invoices processed",
-        Data:    map[string]int64{"invoices_marked_overdue": rows},
+        Data:    result,
     })
 }
 
+// GenerateInvoicePDF serves the invoice as a PDF. The document is the one
+// issued for the invoice's current status, so downloading it again always
+// returns the same file.
 func (h *Handler) GenerateInvoicePDF(w http.ResponseWriter, r *http.Request) {
-    vars := mux.Vars(r)
-    id := vars["id"]
-
-    var invoiceID int
-    var ispID int
-    var amount float64
-    var status, dueDate, createdAt string
-
-    err := h.db.QueryRow(`
-        SELECT inv.id, inv.isp_id, inv.amount, inv.status, inv.due_date, inv.created_at
-        FROM invoices inv WHERE inv.id = $1
-    `, id).Scan(&invoiceID, &ispID, &amount, &status, &dueDate, &createdAt)
-
+    claims := middleware.GetUserFromContext(r)
+    inv, err := h.findInvoice(claims, mux.Vars(r)["id"])
     if err != nil {
         h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Invoice not found"})
         return
     }
 
-    var ispName, serverIP string
-    h.db.QueryRow("SELECT name, server_ip FROM isps WHERE id = $1", ispID).Scan(&ispName, &serverIP)
+    doc, sum, err := h.invoiceDocument(inv)
+    if err != nil {
+        h.logger.Error("Failed to render invoice PDF", "invoice_id", inv.ID, "error", err)
+        h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to generate invoice PDF"})
+        return
+    }
 
-    var planName string
-    h.db.QueryRow(`SELECT p.name FROM plans p JOIN isps i ON i.plan_id = p.id WHERE i.id = $1`, ispID).Scan(&planName)
-    if planName == "" {
-        planName = "Standard"
+    etag := `"` + sum + `"`
+    w.Header().Set("ETag", etag)
+    w.Header().Set("Cache-Control", "private, no-cache")
+    if r.Header.Get("If-None-Match") == etag {
+        w.WriteHeader(http.StatusNotModified)
+        return
     }
 
-    html := fmt.Sprintf(`<!DOCTYPE html>
-<html>
-<head>
-    <meta charset="UTF-8">
-    <title>Invoice #INV-%d</title>
-    <style>
-        body { font-family: Arial, sans-serif; margin: 40px; color: #333; }
-        .header { display: flex; justify-content: space-between; margin-bottom: 40px; border-bottom: 2px solid #3b82f6; padding-bottom: 20px; }
-        .logo { font-size: 28px; font-weight: bold; color: #3b82f6; }
-        .invoice-info { text-align: right; }
-        .invoice-number { font-size: 24px; font-weight: bold; color: #1e293b; }
-        .details { display: flex; justify-content: space-between; margin-bottom: 40px; }
-        .bill-to, .from { width: 45%%; }
-        .section-title { font-weight: bold; color: #666; margin-bottom: 10px; text-transform: uppercase; font-size: 12px; }
-        table { width: 100%%; border-collapse: collapse; margin-bottom: 40px; }
-        th { background: #3b82f6; color: white; padding: 12px; text-align: left; }
-        td { padding: 12px; border-bottom: 1px solid #e2e8f0; }
-        .total-row { background: #f8fafc; font-weight: bold; font-size: 18px; }
-        .status { display: inline-block; padding: 4px 12px; border-radius: 20px; font-size: 12px; font-weight: bold; }
-        .status.paid { background: #d1fae5; color: #059669; }
-        .status.pending { background: #fef3c7; color: #d97706; }
-        .status.overdue { background: #fee2e2; color: #dc2626; }
-        .footer { margin-top: 60px; text-align: center; color: #666; font-size: 12px; border-top: 1px solid #e2e8f0; padding-top: 20px; }
-        @media print { body { margin: 20px; } }
-    </style>
-</head>
-<body>
-    <div class="header">
-        <div class="logo">🚀 ISP SaaS Platform</div>
-        <div class="invoice-info">
-            <div class="invoice-number">INVOICE #INV-%d</div>
-            <div>Date: %s</div>
-            <div>Due: %s</div>
-            <div style="margin-top: 10px;"><span class="status %s">%s</span></div>
-        </div>
-    </div>
-    
-    <div class="details">
-        <div class="bill-to">
-            <div class="section-title">Bill To:</div>
-            <div style="font-size: 18px; font-weight: bold;">%s</div>
-            <div>Server: %s</div>
-        </div>
-        <div class="from">
-            <div class="section-title">From:</div>
-            <div style="font-size: 18px; font-weight: bold;">ISP SaaS Platform</div>
-            <div>Cache Management Services</div>
-        </div>
-    </div>
-    
-    <table>
-        <thead>
-            <tr>
-                <th>Description</th>
-                <th>Plan</th>
-                <th>Period</th>
-                <th style="text-align: right;">Amount</th>
-            </tr>
-        </thead>
-        <tbody>
-            <tr>
-                <td>ISP Cache Service - Monthly Subscription</td>
-                <td>%s</td>
-                <td>1 Month</td>
-                <td style="text-align: right;">$%.2f</td>
-            </tr>
-            <tr class="total-row">
-                <td colspan="3" style="text-align: right;">TOTAL:</td>
-                <td style="text-align: right;">$%.2f USD</td>
-            </tr>
-        </tbody>
-    </table>
-    
-    <div class="footer">
-        <p><strong>Thank you for your business!</strong></p>
-        <p>ISP SaaS Platform - Professional Cache Management Services</p>
-        <p style="margin-top: 20px;">To print this invoice, press Ctrl+P (or Cmd+P on Mac)</p>
-    </div>
-</body>
-</html>`, invoiceID, invoiceID, createdAt[:10], dueDate[:10], strings.ToLower(status), strings.ToUpper(status), 
-       ispName, serverIP, planName, amount, amount)
-
-    w.Header().Set("Content-Type", "text/html; charset=utf-8")
-    w.Write([]byte(html))
+    w.Header().Set("Content-Type", "application/pdf")
+    w.Header().Set("Content-Disposition", `inline; filename="`+inv.InvoiceNumber+`.pdf"`)
+    w.Header().Set("Content-Length", strconv.Itoa(len(doc)))
+    w.Write(doc)
 }
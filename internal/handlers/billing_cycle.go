@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+	"isp-saas.com/platform/internal/billing"
+)
+
+type BillingRunRequest struct {
+	// Month whose cycles to bill, "YYYY-MM". Defaults to the current month.
+	Period string `json:"period"`
+}
+
+type BillingRunResult struct {
+	Period    string `json:"period"`
+	Generated int    `json:"generated"`
+	Existing  int    `json:"already_billed"`
+	NotDue    int    `json:"not_due"`
+	// ISPs whose plan has no price in their currency, or whose currency has
+	// no exchange rate to the base currency
+	Skipped    int   `json:"skipped"`
+	InvoiceIDs []int `json:"invoice_ids"`
+}
+
+// RunBilling bills every ISP for its cycle starting in the requested month.
+// Running it again for the same month only fills in what is missing, so it
+// doubles as the backfill for missed cycles.
+func (h *Handler) RunBilling(w http.ResponseWriter, r *http.Request) {
+	var req BillingRunRequest
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
+			return
+		}
+	}
+
+	now := time.Now()
+	month := now
+	if req.Period != "" {
+		var err error
+		if month, err = billing.ParseMonth(req.Period); err != nil {
+			h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Period must be YYYY-MM"})
+			return
+		}
+	}
+
+	result, err := h.generateRecurringInvoices(month, now)
+	if err != nil {
+		h.logger.Error("Billing run failed", "period", req.Period, "error", err)
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Billing run failed"})
+		return
+	}
+
+	for _, id := range result.InvoiceIDs {
+		h.audit(r, "invoice.generate", "invoice", id, nil, h.auditSnapshot("invoices", id))
+	}
+
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Billing run completed", Data: result})
+}
+
+// RunBillingCycle is the scheduled billing run. It covers last month as well
+// as this one so a cycle is not lost when the run is missed on the last days
+// of a month.
+func (h *Handler) RunBillingCycle() ([]BillingRunResult, error) {
+	now := time.Now()
+	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	var results []BillingRunResult
+	for _, month := range []time.Time{thisMonth.AddDate(0, -1, 0), thisMonth} {
+		result, err := h.generateRecurringInvoices(month, now)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// generateRecurringInvoices invoices every active ISP on a priced plan for its
+// cycle starting in month, provided the cycle has begun by asOf. Cycles that
+// already have an invoice are left alone.
+func (h *Handler) generateRecurringInvoices(month, asOf time.Time) (BillingRunResult, error) {
+	result := BillingRunResult{Period: month.Format("2006-01"), InvoiceIDs: []int{}}
+	today := billing.Date(asOf)
+	dueDays := h.getSettingInt("invoice_due_days", 14)
+
+	// Usage of the period that just ended is metered on the plan it ran on,
+	// before scheduled changes switch plans for the new period
+	if _, err := h.RunUsageMetering(asOf); err != nil {
+		return result, err
+	}
+	if _, err := h.applyScheduledPlanChanges(asOf); err != nil {
+		return result, err
+	}
+
+	rows, err := h.db.Query(`
+		SELECT i.id, i.plan_id, p.name, i.currency, pb.plan_id IS NOT NULL, COALESCE(pb.price_monthly, 0),
+		       COALESCE(i.billing_anchor, i.created_at::date)
+		FROM isps i
+		JOIN plans p ON i.plan_id = p.id
+		LEFT JOIN plan_price_book pb ON pb.plan_id = p.id AND pb.currency = i.currency
+		WHERE i.status = 'active' AND (pb.plan_id IS NULL OR pb.price_monthly > 0)
+		ORDER BY i.id
+	`)
+	if err != nil {
+		return result, err
+	}
+
+	type ispCycle struct {
+		ispID, planID int
+		planName      string
+		currency      string
+		priced        bool
+		price         billing.Money
+		anchor        time.Time
+	}
+	var isps []ispCycle
+	for rows.Next() {
+		var c ispCycle
+		if err := rows.Scan(&c.ispID, &c.planID, &c.planName, &c.currency, &c.priced, &c.price, &c.anchor); err != nil {
+			rows.Close()
+			return result, err
+		}
+		isps = append(isps, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	for _, c := range isps {
+		period := billing.PeriodStarting(c.anchor, month.Year(), month.Month())
+		if period.Start.After(today) || period.Start.Before(billing.Date(c.anchor)) {
+			result.NotDue++
+			continue
+		}
+		if !c.priced {
+			result.Skipped++
+			h.logger.Warn("ISP not billed: plan has no price in its currency", "isp_id", c.ispID, "plan_id", c.planID,
+				"currency", c.currency)
+			continue
+		}
+
+		planID := c.planID
+		inv, created, err := h.billCycle(invoiceDraft{
+			ISPID:   c.ispID,
+			PlanID:  &planID,
+			DueDate: period.Start.AddDate(0, 0, dueDays),
+			Period:  &period,
+			Lines: []invoiceLine{{
+				Description: fmt.Sprintf("%s plan, %s to %s", c.planName,
+					period.Start.Format("2006-01-02"), period.End.Format("2006-01-02")),
+				Quantity:  billing.QuantityOne,
+				UnitPrice: c.price,
+				ItemType:  itemPlan,
+				PlanID:    &planID,
+			}},
+		})
+		if errors.Is(err, errNoExchangeRate) {
+			result.Skipped++
+			h.logger.Warn("ISP not billed", "isp_id", c.ispID, "error", err)
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		if !created {
+			result.Existing++
+			continue
+		}
+
+		result.Generated++
+		result.InvoiceIDs = append(result.InvoiceIDs, inv.ID)
+		h.issueInvoiceDocument(inv.ID)
+		h.logger.Info("Recurring invoice generated", "invoice_id", inv.ID, "invoice_number", inv.Number,
+			"isp_id", c.ispID, "period_start", period.Start.Format("2006-01-02"))
+	}
+
+	return result, nil
+}
+
+// billCycle creates the invoice for one ISP cycle unless the cycle was billed
+// already, in which case created is false. Pending items such as proration
+// credits are added to the invoice.
+func (h *Handler) billCycle(d invoiceDraft) (inv createdInvoice, created bool, err error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return inv, false, err
+	}
+	defer tx.Rollback()
+
+	var billed bool
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM invoices WHERE isp_id = $1 AND period_start = $2)",
+		d.ISPID, d.Period.Start).Scan(&billed)
+	if err != nil || billed {
+		return inv, false, err
+	}
+
+	pending, pendingIDs, err := takePendingItems(tx, d.ISPID)
+	if err != nil {
+		return inv, false, err
+	}
+	d.Lines = append(d.Lines, pending...)
+
+	inv, err = createInvoice(tx, d)
+	if isUniqueViolation(err, "idx_invoices_isp_period") {
+		// A concurrent run billed this cycle first; rolling back returns the number
+		return inv, false, nil
+	}
+	if err != nil {
+		return inv, false, err
+	}
+
+	if len(pendingIDs) > 0 {
+		if _, err := tx.Exec("UPDATE pending_invoice_items SET invoice_id = $1 WHERE id = ANY($2)",
+			inv.ID, pq.Array(pendingIDs)); err != nil {
+			return inv, false, err
+		}
+	}
+	return inv, true, tx.Commit()
+}
@@ -4,8 +4,18 @@ import (
 	"encoding/json"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
+	"isp-saas.com/platform/internal/billing"
+	"isp-saas.com/platform/internal/middleware"
+)
+
+// systemCostReference is the cache system's cost used for ROI, quoted in
+// systemCostCurrency
+const (
+	systemCostReference billing.Money = 200000
+	systemCostCurrency                = "USD"
 )
 
 // GetISPCommercialStats returns commercial metrics for an ISP
@@ -17,19 +27,27 @@ func (h *Handler) GetISPCommercialStats(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	claims := middleware.GetUserFromContext(r)
+	if !h.canAccessISP(claims, ispID) {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "ISP not found"})
+		return
+	}
+
 	// Get ISP data with commercial fields
 	var isp struct {
 		ID                 int     `json:"id"`
 		Name               string  `json:"name"`
 		CostPerMbps        float64 `json:"cost_per_mbps"`
+		Currency           string  `json:"currency"`
 		PeakTrafficMbps    int     `json:"peak_traffic_mbps"`
 		MonthlyBandwidthGB int     `json:"monthly_bandwidth_gb"`
 	}
 
-	query := `SELECT id, name, cost_per_mbps, peak_traffic_mbps, monthly_bandwidth_gb 
+	// cost_per_mbps is in the ISP's billing currency
+	query := `SELECT id, name, cost_per_mbps, currency, peak_traffic_mbps, monthly_bandwidth_gb 
 	          FROM isps WHERE id = $1`
 	err = h.db.QueryRow(query, ispID).Scan(
-		&isp.ID, &isp.Name, &isp.CostPerMbps, &isp.PeakTrafficMbps, &isp.MonthlyBandwidthGB,
+		&isp.ID, &isp.Name, &isp.CostPerMbps, &isp.Currency, &isp.PeakTrafficMbps, &isp.MonthlyBandwidthGB,
 	)
 	if err != nil {
 		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "ISP not found"})
@@ -94,15 +112,19 @@ func (h *Handler) GetISPCommercialStats(w http.ResponseWriter, r *http.Request)
 		peakTrafficWithCache = peakTrafficWithoutCache * (1 - hitRate/100)
 	}
 
-	// Calculate USD savings
-	monthlySavingsUSD := bandwidthSavedMbps * isp.CostPerMbps
-	annualSavingsUSD := monthlySavingsUSD * 12
+	// Calculate savings in the ISP's currency
+	monthlySavings := bandwidthSavedMbps * isp.CostPerMbps
+	annualSavings := monthlySavings * 12
 
-	// Calculate ROI
-	systemCost := 2000.0
+	// Calculate ROI against the reference system cost, converted to the ISP's
+	// currency. Without an exchange rate there is no ROI to report.
+	systemCost := 0.0
 	roiMonths := 0.0
-	if monthlySavingsUSD > 0 {
-		roiMonths = systemCost / monthlySavingsUSD
+	if rate, _, err := exchangeRate(h.db, systemCostCurrency, isp.Currency, time.Now()); err == nil {
+		systemCost = float64(systemCostReference.Convert(rate)) / 100
+	}
+	if monthlySavings > 0 && systemCost > 0 {
+		roiMonths = systemCost / monthlySavings
 	}
 
 	// Build response
@@ -111,6 +133,7 @@ func (h *Handler) GetISPCommercialStats(w http.ResponseWriter, r *http.Request)
 		"isp_name": isp.Name,
 		"config": map[string]interface{}{
 			"cost_per_mbps":         isp.CostPerMbps,
+			"currency":              isp.Currency,
 			"peak_traffic_baseline": isp.PeakTrafficMbps,
 		},
 		"performance": map[string]interface{}{
@@ -127,8 +150,9 @@ func (h *Handler) GetISPCommercialStats(w http.ResponseWriter, r *http.Request)
 			"reduction_percent":       (bandwidthSavedMbps / peakTrafficWithoutCache) * 100,
 		},
 		"savings": map[string]interface{}{
-			"monthly_usd":  monthlySavingsUSD,
-			"annual_usd":   annualSavingsUSD,
+			"currency":     isp.Currency,
+			"monthly":      monthlySavings,
+			"annual":       annualSavings,
 			"roi_months":   roiMonths,
 			"system_cost":  systemCost,
 			"payback_days": roiMonths * 30,
@@ -147,6 +171,12 @@ func (h *Handler) UpdateISPCommercialConfig(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	claims := middleware.GetUserFromContext(r)
+	if !h.canAccessISP(claims, ispID) {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "ISP not found"})
+		return
+	}
+
 	var input struct {
 		CostPerMbps     *float64 `json:"cost_per_mbps"`
 		PeakTrafficMbps *int     `json:"peak_traffic_mbps"`
@@ -157,6 +187,8 @@ func (h *Handler) UpdateISPCommercialConfig(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	before := h.auditSnapshot("isps", ispID)
+
 	// Update ISP commercial config
 	query := `UPDATE isps SET `
 	args := []interface{}{}
@@ -189,6 +221,8 @@ func (h *Handler) UpdateISPCommercialConfig(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	h.audit(r, "isp.commercial_update", "isp", ispID, before, h.auditSnapshot("isps", ispID))
+
 	h.sendJSON(w, http.StatusOK, Response{
 		Success: true,
 		Message: "Commercial configuration updated",
@@ -0,0 +1,459 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"isp-saas.com/platform/internal/billing"
+	"isp-saas.com/platform/internal/middleware"
+)
+
+type CommissionEntryResponse struct {
+	ID            int           `json:"id"`
+	ISPID         *int          `json:"isp_id"`
+	ISPName       string        `json:"isp_name"`
+	InvoiceID     int           `json:"invoice_id"`
+	InvoiceNumber *string       `json:"invoice_number"`
+	CreditNoteID  *int          `json:"credit_note_id"`
+	Base          billing.Money `json:"base"`
+	Rate          billing.Rate  `json:"rate"`
+	Amount        billing.Money `json:"amount"`
+	PayoutID      *int          `json:"payout_id"`
+	AccruedAt     string        `json:"accrued_at"`
+}
+
+type CommissionPayoutResponse struct {
+	ID            int                       `json:"id"`
+	DistributorID int                       `json:"distributor_id"`
+	CompanyName   string                    `json:"company_name"`
+	PeriodStart   string                    `json:"period_start"`
+	PeriodEnd     string                    `json:"period_end"`
+	Amount        billing.Money             `json:"amount"`
+	EntryCount    int                       `json:"entry_count"`
+	Status        string                    `json:"status"`
+	Reference     *string                   `json:"reference"`
+	PaidOutAt     *string                   `json:"paid_out_at"`
+	PaidOutBy     *int                      `json:"paid_out_by"`
+	CreatedAt     string                    `json:"created_at"`
+	Entries       []CommissionEntryResponse `json:"entries,omitempty"`
+}
+
+type ISPEarnings struct {
+	ISPID        *int          `json:"isp_id"`
+	ISPName      string        `json:"isp_name"`
+	PaidInvoices int           `json:"paid_invoices"`
+	Revenue      billing.Money `json:"revenue"`
+	Commission   billing.Money `json:"commission"`
+}
+
+// DistributorEarnings splits the ledger total by where the money is:
+// already paid out, on a statement waiting for payout, or accrued since the
+// last statement. Amounts are in the base currency.
+type DistributorEarnings struct {
+	DistributorID     int                        `json:"distributor_id"`
+	Currency          string                     `json:"currency"`
+	CommissionPercent billing.Rate               `json:"commission_percent"`
+	TotalEarnings     billing.Money              `json:"total_earnings"`
+	PaidOut           billing.Money              `json:"paid_out"`
+	AwaitingPayout    billing.Money              `json:"awaiting_payout"`
+	Unstated          billing.Money              `json:"unstated"`
+	ByISP             []ISPEarnings              `json:"by_isp"`
+	Payouts           []CommissionPayoutResponse `json:"payouts"`
+}
+
+type CommissionStatementResult struct {
+	PeriodStart string `json:"period_start"`
+	PeriodEnd   string `json:"period_end"`
+	PayoutIDs   []int  `json:"payout_ids"`
+}
+
+type MarkPaidOutRequest struct {
+	Reference string `json:"reference"`
+}
+
+// accrueCommission credits the distributor of a paid invoice's ISP with
+// commission on its subtotal at the distributor's current rate. Commission is
+// earned in the base currency, converted at the invoice's exchange rate. An
+// invoice accrues at most once; id is 0 when nothing was accrued.
+func accrueCommission(tx *sql.Tx, invoiceID int) (int, error) {
+	var distributorID, ispID int
+	var subtotal billing.Money
+	var exchangeRate billing.ExchangeRate
+	var rate billing.Rate
+	err := tx.QueryRow(`
+		SELECT d.id, i.id, inv.subtotal, inv.exchange_rate, d.commission_percent
+		FROM invoices inv
+		JOIN isps i ON inv.isp_id = i.id
+		JOIN distributors d ON i.distributor_id = d.id
+		WHERE inv.id = $1
+		FOR UPDATE OF d
+	`, invoiceID).Scan(&distributorID, &ispID, &subtotal, &exchangeRate, &rate)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	base := subtotal.Convert(exchangeRate)
+	amount := base.Percent(rate)
+	if amount == 0 {
+		return 0, nil
+	}
+
+	var id int
+	err = tx.QueryRow(`
+		INSERT INTO commission_entries (distributor_id, isp_id, invoice_id, base, rate, amount)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (invoice_id) WHERE credit_note_id IS NULL DO NOTHING
+		RETURNING id
+	`, distributorID, ispID, invoiceID, base, rate, amount).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return id, refreshTotalEarnings(tx, distributorID)
+}
+
+// reverseCommission takes back the commission earned on the part of an
+// invoice a credit note gives back, at the commission and exchange rates it
+// was accrued at. id is 0 when the invoice earned no commission.
+func reverseCommission(tx *sql.Tx, invoiceID, creditNoteID int, subtotal billing.Money) (int, error) {
+	var distributorID int
+	var ispID *int
+	var rate billing.Rate
+	var exchangeRate billing.ExchangeRate
+	err := tx.QueryRow(`
+		SELECT ce.distributor_id, ce.isp_id, ce.rate, inv.exchange_rate
+		FROM commission_entries ce
+		JOIN invoices inv ON ce.invoice_id = inv.id
+		WHERE ce.invoice_id = $1 AND ce.credit_note_id IS NULL
+	`, invoiceID).Scan(&distributorID, &ispID, &rate, &exchangeRate)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	base := subtotal.Convert(exchangeRate)
+	amount := base.Percent(rate)
+	if amount == 0 {
+		return 0, nil
+	}
+
+	var id int
+	err = tx.QueryRow(`
+		INSERT INTO commission_entries (distributor_id, isp_id, invoice_id, credit_note_id, base, rate, amount)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`, distributorID, ispID, invoiceID, creditNoteID, -base, rate, -amount).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, refreshTotalEarnings(tx, distributorID)
+}
+
+// refreshTotalEarnings recomputes distributors.total_earnings from the ledger
+func refreshTotalEarnings(tx *sql.Tx, distributorID int) error {
+	_, err := tx.Exec(`
+		UPDATE distributors SET total_earnings = (
+			SELECT COALESCE(SUM(amount), 0) FROM commission_entries WHERE distributor_id = $1
+		), updated_at = NOW()
+		WHERE id = $1
+	`, distributorID)
+	return err
+}
+
+// RunCommissionStatements puts every distributor's commission accrued before
+// the month of asOf on a payout statement for the previous month. Entries
+// that missed an earlier statement are swept into this one.
+func (h *Handler) RunCommissionStatements(asOf time.Time) (CommissionStatementResult, error) {
+	today := billing.Date(asOf)
+	thisMonth := time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, time.UTC)
+	lastMonth := thisMonth.AddDate(0, -1, 0)
+	period := billing.PeriodStarting(lastMonth, lastMonth.Year(), lastMonth.Month())
+
+	result := CommissionStatementResult{
+		PeriodStart: period.Start.Format("2006-01-02"),
+		PeriodEnd:   period.End.Format("2006-01-02"),
+		PayoutIDs:   []int{},
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		INSERT INTO commission_payouts (distributor_id, period_start, period_end, amount, entry_count)
+		SELECT distributor_id, $1, $2, SUM(amount), COUNT(*)
+		FROM commission_entries
+		WHERE payout_id IS NULL AND accrued_at < $3
+		GROUP BY distributor_id
+		ON CONFLICT (distributor_id, period_start) DO NOTHING
+		RETURNING id, distributor_id
+	`, period.Start, period.End, thisMonth)
+	if err != nil {
+		return result, err
+	}
+	distributors := map[int]int{}
+	for rows.Next() {
+		var id, distributorID int
+		if err := rows.Scan(&id, &distributorID); err != nil {
+			rows.Close()
+			return result, err
+		}
+		distributors[id] = distributorID
+		result.PayoutIDs = append(result.PayoutIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	for id, distributorID := range distributors {
+		if _, err := tx.Exec(`
+			UPDATE commission_entries SET payout_id = $1
+			WHERE distributor_id = $2 AND payout_id IS NULL AND accrued_at < $3
+		`, id, distributorID, thisMonth); err != nil {
+			return result, err
+		}
+	}
+	return result, tx.Commit()
+}
+
+// GetMyEarnings returns the calling distributor's commission earnings
+func (h *Handler) GetMyEarnings(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+	distributorID, ok := h.distributorIDForUser(claims.UserID)
+	if !ok {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Distributor profile not found"})
+		return
+	}
+	h.sendEarnings(w, distributorID)
+}
+
+// GetDistributorEarnings returns a distributor's commission earnings. The
+// route id is the distributor's user id.
+func (h *Handler) GetDistributorEarnings(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	claims := middleware.GetUserFromContext(r)
+	if !h.canViewDistributor(claims, id) {
+		h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Access denied"})
+		return
+	}
+
+	userID, _ := strconv.Atoi(id)
+	distributorID, ok := h.distributorIDForUser(userID)
+	if !ok {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Distributor not found"})
+		return
+	}
+	h.sendEarnings(w, distributorID)
+}
+
+func (h *Handler) sendEarnings(w http.ResponseWriter, distributorID int) {
+	e, err := h.distributorEarnings(distributorID)
+	if err != nil {
+		h.logger.Error("Failed to load earnings", "distributor_id", distributorID, "error", err)
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Data: e})
+}
+
+func (h *Handler) distributorEarnings(distributorID int) (DistributorEarnings, error) {
+	e := DistributorEarnings{DistributorID: distributorID, ByISP: []ISPEarnings{}}
+
+	currency, err := baseCurrency(h.db)
+	if err != nil {
+		return e, err
+	}
+	e.Currency = currency
+
+	err = h.db.QueryRow(`
+		SELECT d.commission_percent, d.total_earnings,
+		       COALESCE(SUM(ce.amount) FILTER (WHERE cp.status = 'paid_out'), 0),
+		       COALESCE(SUM(ce.amount) FILTER (WHERE cp.status = 'pending'), 0),
+		       COALESCE(SUM(ce.amount) FILTER (WHERE ce.id IS NOT NULL AND ce.payout_id IS NULL), 0)
+		FROM distributors d
+		LEFT JOIN commission_entries ce ON ce.distributor_id = d.id
+		LEFT JOIN commission_payouts cp ON ce.payout_id = cp.id
+		WHERE d.id = $1
+		GROUP BY d.id
+	`, distributorID).Scan(&e.CommissionPercent, &e.TotalEarnings, &e.PaidOut, &e.AwaitingPayout, &e.Unstated)
+	if err != nil {
+		return e, err
+	}
+
+	rows, err := h.db.Query(`
+		SELECT ce.isp_id, COALESCE(i.name, ''), COUNT(*) FILTER (WHERE ce.credit_note_id IS NULL),
+		       SUM(ce.base), SUM(ce.amount)
+		FROM commission_entries ce
+		LEFT JOIN isps i ON ce.isp_id = i.id
+		WHERE ce.distributor_id = $1
+		GROUP BY ce.isp_id, i.name
+		ORDER BY SUM(ce.amount) DESC
+	`, distributorID)
+	if err != nil {
+		return e, err
+	}
+	for rows.Next() {
+		var ie ISPEarnings
+		if err := rows.Scan(&ie.ISPID, &ie.ISPName, &ie.PaidInvoices, &ie.Revenue, &ie.Commission); err != nil {
+			rows.Close()
+			return e, err
+		}
+		e.ByISP = append(e.ByISP, ie)
+	}
+	rows.Close()
+
+	e.Payouts, err = h.queryPayouts(" WHERE cp.distributor_id = $1 ORDER BY cp.period_start DESC LIMIT 12", distributorID)
+	return e, err
+}
+
+const payoutSelect = `
+	SELECT cp.id, cp.distributor_id, COALESCE(d.company_name, ''), cp.period_start, cp.period_end, cp.amount,
+	       cp.entry_count, cp.status, cp.reference, cp.paid_out_at, cp.paid_out_by, cp.created_at
+	FROM commission_payouts cp
+	JOIN distributors d ON cp.distributor_id = d.id`
+
+func scanPayout(row interface{ Scan(...interface{}) error }, p *CommissionPayoutResponse) error {
+	var start, end time.Time
+	if err := row.Scan(&p.ID, &p.DistributorID, &p.CompanyName, &start, &end, &p.Amount, &p.EntryCount, &p.Status,
+		&p.Reference, &p.PaidOutAt, &p.PaidOutBy, &p.CreatedAt); err != nil {
+		return err
+	}
+	p.PeriodStart = start.Format("2006-01-02")
+	p.PeriodEnd = end.Format("2006-01-02")
+	return nil
+}
+
+func (h *Handler) queryPayouts(where string, args ...interface{}) ([]CommissionPayoutResponse, error) {
+	rows, err := h.db.Query(payoutSelect+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payouts := []CommissionPayoutResponse{}
+	for rows.Next() {
+		var p CommissionPayoutResponse
+		if err := scanPayout(rows, &p); err != nil {
+			return nil, err
+		}
+		payouts = append(payouts, p)
+	}
+	return payouts, rows.Err()
+}
+
+// GetCommissionPayouts lists payout statements of all distributors, newest
+// first. ?status=pending limits it to statements still to be paid out.
+func (h *Handler) GetCommissionPayouts(w http.ResponseWriter, r *http.Request) {
+	where, args := " ORDER BY cp.period_start DESC, cp.id", []interface{}{}
+	if status := r.URL.Query().Get("status"); status != "" {
+		if status != "pending" && status != "paid_out" {
+			h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "status must be pending or paid_out"})
+			return
+		}
+		where, args = " WHERE cp.status = $1"+where, append(args, status)
+	}
+
+	payouts, err := h.queryPayouts(where, args...)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Data: payouts})
+}
+
+// GetCommissionPayout returns a payout statement with its ledger entries
+func (h *Handler) GetCommissionPayout(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+
+	var p CommissionPayoutResponse
+	var ownerID int
+	err := scanPayout(h.db.QueryRow(payoutSelect+" WHERE cp.id = $1", mux.Vars(r)["id"]), &p)
+	if err == nil {
+		err = h.db.QueryRow("SELECT user_id FROM distributors WHERE id = $1", p.DistributorID).Scan(&ownerID)
+	}
+	if err != nil || !h.canViewDistributor(claims, strconv.Itoa(ownerID)) {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Payout not found"})
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT ce.id, ce.isp_id, COALESCE(i.name, ''), ce.invoice_id, inv.invoice_number, ce.credit_note_id, ce.base,
+		       ce.rate, ce.amount, ce.payout_id, ce.accrued_at
+		FROM commission_entries ce
+		JOIN invoices inv ON ce.invoice_id = inv.id
+		LEFT JOIN isps i ON ce.isp_id = i.id
+		WHERE ce.payout_id = $1
+		ORDER BY ce.accrued_at, ce.id
+	`, p.ID)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	p.Entries = []CommissionEntryResponse{}
+	for rows.Next() {
+		var e CommissionEntryResponse
+		if err := rows.Scan(&e.ID, &e.ISPID, &e.ISPName, &e.InvoiceID, &e.InvoiceNumber, &e.CreditNoteID, &e.Base,
+			&e.Rate, &e.Amount, &e.PayoutID, &e.AccruedAt); err != nil {
+			continue
+		}
+		p.Entries = append(p.Entries, e)
+	}
+
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Data: p})
+}
+
+// MarkPayoutPaidOut records that a payout statement was paid to the
+// distributor, e.g. with the bank transfer reference
+func (h *Handler) MarkPayoutPaidOut(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	claims := middleware.GetUserFromContext(r)
+
+	var req MarkPaidOutRequest
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
+			return
+		}
+	}
+
+	before := h.auditSnapshot("commission_payouts", id)
+	if before == nil {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Payout not found"})
+		return
+	}
+
+	result, err := h.db.Exec(`
+		UPDATE commission_payouts
+		SET status = 'paid_out', paid_out_at = NOW(), paid_out_by = $1, reference = $2
+		WHERE id = $3 AND status = 'pending'
+	`, claims.UserID, nullIfEmpty(strings.TrimSpace(req.Reference)), id)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to update payout"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		h.sendJSON(w, http.StatusConflict, Response{Success: false, Error: "Payout is already paid out"})
+		return
+	}
+
+	h.audit(r, "commission_payout.paid_out", "commission_payout", id, before, h.auditSnapshot("commission_payouts", id))
+	h.logger.Info("Commission payout paid out", "payout_id", id, "by", claims.UserID)
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Payout marked as paid out"})
+}
@@ -0,0 +1,428 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"isp-saas.com/platform/internal/billing"
+	"isp-saas.com/platform/internal/middleware"
+)
+
+// Credit note settlements
+const (
+	settleRefund = "refund"
+	settleCredit = "credit"
+)
+
+// paymentMethodCredit marks payments that move account credit from one
+// invoice to another rather than money the ISP paid
+const paymentMethodCredit = "credit"
+
+type CreditNoteResponse struct {
+	ID               int           `json:"id"`
+	CreditNoteNumber string        `json:"credit_note_number"`
+	InvoiceID        int           `json:"invoice_id"`
+	InvoiceNumber    string        `json:"invoice_number"`
+	ISPID            int           `json:"isp_id"`
+	Subtotal         billing.Money `json:"subtotal"`
+	TaxAmount        billing.Money `json:"tax_amount"`
+	Amount           billing.Money `json:"amount"`
+	Reason           string        `json:"reason"`
+	Settlement       string        `json:"settlement"`
+	RefundPaymentID  *int          `json:"refund_payment_id"`
+	CreatedBy        *int          `json:"created_by"`
+	CreatedAt        string        `json:"created_at"`
+}
+
+type CreateCreditNoteRequest struct {
+	// Defaults to everything on the invoice not credited yet
+	Amount billing.Money `json:"amount"`
+	Reason string        `json:"reason"`
+	// "credit" (default) keeps the amount for the next invoice, "refund"
+	// pays it back
+	Settlement    string `json:"settlement"`
+	PaymentMethod string `json:"payment_method"`
+	TransactionID string `json:"transaction_id"`
+}
+
+type CancelInvoiceRequest struct {
+	Reason string `json:"reason"`
+}
+
+var (
+	errInvoiceHasPayments = errors.New("invoice has payments")
+	errInvoiceNotPaid     = errors.New("invoice is not paid")
+	errCreditTooLarge     = errors.New("credit exceeds what is left on the invoice")
+)
+
+// applyAccountCredit pays up to due of a new invoice from the ISP's account
+// credit: whatever earlier invoices were paid beyond what they are owed, be it
+// from over-payments, credit notes kept as credit or negative invoices. The
+// oldest credit goes first. Each transfer is a pair of credit payments, one
+// taking the amount off the source invoice and one paying it on the new
+// invoice, so the ledger still adds up to what the ISP actually paid. Only
+// credit in the new invoice's currency is used.
+func applyAccountCredit(tx *sql.Tx, ispID, invoiceID int, due billing.Money) (billing.Money, error) {
+	rows, err := tx.Query(`
+		SELECT id, amount_paid - (amount - amount_credited)
+		FROM invoices
+		WHERE isp_id = $1 AND id <> $2 AND status <> 'cancelled' AND amount_paid > amount - amount_credited
+		  AND currency = (SELECT currency FROM invoices WHERE id = $2)
+		ORDER BY created_at, id
+		FOR UPDATE
+	`, ispID, invoiceID)
+	if err != nil {
+		return 0, err
+	}
+	type source struct {
+		id     int
+		credit billing.Money
+	}
+	var sources []source
+	for rows.Next() {
+		var s source
+		if err := rows.Scan(&s.id, &s.credit); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		sources = append(sources, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var applied billing.Money
+	for _, s := range sources {
+		take := s.credit
+		if take > due-applied {
+			take = due - applied
+		}
+		if take <= 0 {
+			break
+		}
+
+		if _, err := insertPayment(tx, newPayment{
+			InvoiceID: s.id,
+			Amount:    -take,
+			Method:    paymentMethodCredit,
+			Metadata:  json.RawMessage(fmt.Sprintf(`{"applied_to_invoice_id":%d}`, invoiceID)),
+		}); err != nil {
+			return applied, err
+		}
+		if _, err := insertPayment(tx, newPayment{
+			InvoiceID: invoiceID,
+			Amount:    take,
+			Method:    paymentMethodCredit,
+			Metadata:  json.RawMessage(fmt.Sprintf(`{"credit_from_invoice_id":%d}`, s.id)),
+		}); err != nil {
+			return applied, err
+		}
+		if _, err := refreshInvoiceStatus(tx, s.id); err != nil {
+			return applied, err
+		}
+		applied += take
+	}
+	if applied == 0 {
+		return 0, nil
+	}
+
+	bal, err := refreshInvoiceStatus(tx, invoiceID)
+	if err != nil || bal.Status != "paid" {
+		return applied, err
+	}
+	if _, err = accrueCommission(tx, invoiceID); err != nil {
+		return applied, err
+	}
+	_, err = renewLicensesForInvoice(tx, invoiceID)
+	return applied, err
+}
+
+// CancelInvoice voids an invoice nothing was paid on, waiving its charges.
+// Paid invoices are corrected with a credit note instead.
+func (h *Handler) CancelInvoice(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+
+	var req CancelInvoiceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "A reason is required"})
+		return
+	}
+
+	inv, err := h.findInvoice(claims, mux.Vars(r)["id"])
+	if err != nil {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Invoice not found"})
+		return
+	}
+
+	before := h.auditSnapshot("invoices", inv.ID)
+	ispID, reactivated, err := h.cancelInvoice(inv.ID, claims.UserID, req.Reason)
+	switch {
+	case errors.Is(err, errInvoiceCancelled):
+		h.sendJSON(w, http.StatusConflict, Response{Success: false, Error: "Invoice is already cancelled"})
+		return
+	case errors.Is(err, errInvoiceHasPayments):
+		h.sendJSON(w, http.StatusConflict, Response{Success: false, Error: "Invoice has payments; issue a credit note once it is paid instead"})
+		return
+	case err != nil:
+		h.logger.Error("Failed to cancel invoice", "invoice_id", inv.ID, "error", err)
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to cancel invoice"})
+		return
+	}
+
+	h.audit(r, "invoice.cancel", "invoice", inv.ID, before, h.auditSnapshot("invoices", inv.ID))
+	if reactivated {
+		h.ispReactivated(r, claims.UserID, ispID, inv.ID)
+	}
+	h.logger.Info("Invoice cancelled", "invoice_id", inv.ID, "reason", req.Reason, "by", claims.UserID)
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Invoice cancelled"})
+}
+
+func (h *Handler) cancelInvoice(invoiceID, userID int, reason string) (ispID int, reactivated bool, err error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	var status string
+	var paid billing.Money
+	err = tx.QueryRow("SELECT status, amount_paid FROM invoices WHERE id = $1 FOR UPDATE", invoiceID).Scan(&status, &paid)
+	if err != nil {
+		return 0, false, err
+	}
+	if status == "cancelled" {
+		return 0, false, errInvoiceCancelled
+	}
+	if paid != 0 {
+		return 0, false, errInvoiceHasPayments
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE invoices SET status = 'cancelled', paid_at = NULL, cancelled_at = NOW(), cancelled_by = $2,
+		                    cancellation_reason = $3
+		WHERE id = $1
+	`, invoiceID, userID, reason); err != nil {
+		return 0, false, err
+	}
+
+	// The cancelled invoice may have been the last one keeping the ISP suspended
+	ispID, reactivated, err = reactivateIfSettled(tx, invoiceID)
+	if err != nil {
+		return 0, false, err
+	}
+	return ispID, reactivated, tx.Commit()
+}
+
+// CreateCreditNote gives back part or all of a paid invoice, either as a
+// refund or as credit for the ISP's next invoice. The distributor's
+// commission on the credited amount is reversed.
+func (h *Handler) CreateCreditNote(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+
+	var req CreateCreditNoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "A reason is required"})
+		return
+	}
+	if req.Amount < 0 {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Amount cannot be negative"})
+		return
+	}
+	switch req.Settlement {
+	case "":
+		req.Settlement = settleCredit
+	case settleCredit, settleRefund:
+	default:
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "settlement must be credit or refund"})
+		return
+	}
+	req.PaymentMethod = strings.TrimSpace(req.PaymentMethod)
+	if req.PaymentMethod == "" {
+		req.PaymentMethod = "manual"
+	}
+	if req.PaymentMethod == paymentMethodCredit {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Refunds cannot use the credit payment method"})
+		return
+	}
+
+	inv, err := h.findInvoice(claims, mux.Vars(r)["id"])
+	if err != nil {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Invoice not found"})
+		return
+	}
+
+	cn, refund, commissionID, err := h.issueCreditNote(inv.ID, claims.UserID, req)
+	switch {
+	case errors.Is(err, errInvoiceNotPaid):
+		h.sendJSON(w, http.StatusConflict, Response{Success: false, Error: "Credit notes can only be issued for paid invoices"})
+		return
+	case errors.Is(err, errCreditTooLarge):
+		h.sendJSON(w, http.StatusConflict, Response{Success: false, Error: "Amount exceeds what is left to credit on the invoice"})
+		return
+	case errors.Is(err, errDuplicatePayment):
+		h.sendJSON(w, http.StatusConflict, Response{Success: false, Error: "A payment with this transaction ID was already recorded"})
+		return
+	case err != nil:
+		h.logger.Error("Failed to issue credit note", "invoice_id", inv.ID, "error", err)
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to issue credit note"})
+		return
+	}
+
+	h.audit(r, "credit_note.create", "credit_note", cn.ID, nil, h.auditSnapshot("credit_notes", cn.ID))
+	h.issueInvoiceDocument(inv.ID)
+	if cn.RefundPaymentID != nil {
+		h.paymentApplied(r, claims.UserID, *cn.RefundPaymentID, refund)
+	}
+	if commissionID != 0 {
+		h.audit(r, "commission.reverse", "commission_entry", commissionID, nil,
+			h.auditSnapshot("commission_entries", commissionID))
+	}
+	h.logger.Info("Credit note issued", "credit_note_id", cn.ID, "invoice_id", inv.ID, "amount", cn.Amount,
+		"settlement", cn.Settlement, "by", claims.UserID)
+	h.sendJSON(w, http.StatusCreated, Response{Success: true, Message: "Credit note issued", Data: cn})
+}
+
+// issueCreditNote stores the credit note and settles it in one transaction.
+// refund is the invoice's position after the refund payment, if any.
+func (h *Handler) issueCreditNote(invoiceID, userID int, req CreateCreditNoteRequest) (cn CreditNoteResponse, refund invoiceBalance, commissionID int, err error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return cn, refund, 0, err
+	}
+	defer tx.Rollback()
+
+	var status string
+	var amount, credited, tax billing.Money
+	err = tx.QueryRow(`
+		SELECT status, invoice_number, isp_id, amount, amount_credited, tax_amount
+		FROM invoices WHERE id = $1 FOR UPDATE
+	`, invoiceID).Scan(&status, &cn.InvoiceNumber, &cn.ISPID, &amount, &credited, &tax)
+	if err != nil {
+		return cn, refund, 0, err
+	}
+	if status != "paid" {
+		return cn, refund, 0, errInvoiceNotPaid
+	}
+
+	left := amount - credited
+	cn.Amount = req.Amount
+	if cn.Amount == 0 {
+		cn.Amount = left
+	}
+	if cn.Amount <= 0 || cn.Amount > left {
+		return cn, refund, 0, errCreditTooLarge
+	}
+	// The credit note carries the invoice's share of tax
+	cn.TaxAmount = tax.Share(int(cn.Amount), int(amount))
+	cn.Subtotal = cn.Amount - cn.TaxAmount
+	cn.InvoiceID, cn.Reason, cn.Settlement, cn.CreatedBy = invoiceID, req.Reason, req.Settlement, &userID
+
+	var year, seq int
+	err = tx.QueryRow(`
+		INSERT INTO credit_note_sequences (year, last_number) VALUES (EXTRACT(YEAR FROM CURRENT_DATE)::int, 1)
+		ON CONFLICT (year) DO UPDATE SET last_number = credit_note_sequences.last_number + 1
+		RETURNING year, last_number
+	`).Scan(&year, &seq)
+	if err != nil {
+		return cn, refund, 0, err
+	}
+	cn.CreditNoteNumber = billing.CreditNoteNumber(year, seq)
+
+	err = tx.QueryRow(`
+		INSERT INTO credit_notes (credit_note_number, invoice_id, isp_id, subtotal, tax_amount, amount, reason,
+		                          settlement, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id, created_at
+	`, cn.CreditNoteNumber, invoiceID, cn.ISPID, cn.Subtotal, cn.TaxAmount, cn.Amount, cn.Reason, cn.Settlement,
+		userID).Scan(&cn.ID, &cn.CreatedAt)
+	if err != nil {
+		return cn, refund, 0, err
+	}
+
+	if _, err := tx.Exec("UPDATE invoices SET amount_credited = amount_credited + $2 WHERE id = $1",
+		invoiceID, cn.Amount); err != nil {
+		return cn, refund, 0, err
+	}
+
+	if cn.Settlement == settleRefund {
+		paymentID, err := insertPayment(tx, newPayment{
+			InvoiceID:     invoiceID,
+			Amount:        -cn.Amount,
+			Method:        req.PaymentMethod,
+			TransactionID: strings.TrimSpace(req.TransactionID),
+			Metadata:      json.RawMessage(fmt.Sprintf(`{"credit_note_id":%d}`, cn.ID)),
+			RecordedBy:    userID,
+		})
+		if err != nil {
+			return cn, refund, 0, err
+		}
+		if refund, err = refreshInvoiceStatus(tx, invoiceID); err != nil {
+			return cn, refund, 0, err
+		}
+		cn.RefundPaymentID = &paymentID
+		if _, err := tx.Exec("UPDATE credit_notes SET refund_payment_id = $2 WHERE id = $1", cn.ID, paymentID); err != nil {
+			return cn, refund, 0, err
+		}
+	} else if _, err := refreshInvoiceStatus(tx, invoiceID); err != nil {
+		return cn, refund, 0, err
+	}
+
+	commissionID, err = reverseCommission(tx, invoiceID, cn.ID, cn.Subtotal)
+	if err != nil {
+		return cn, refund, 0, err
+	}
+	return cn, refund, commissionID, tx.Commit()
+}
+
+// GetInvoiceCreditNotes lists the credit notes issued against an invoice
+func (h *Handler) GetInvoiceCreditNotes(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+
+	inv, err := h.findInvoice(claims, mux.Vars(r)["id"])
+	if err != nil {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Invoice not found"})
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT cn.id, cn.credit_note_number, cn.invoice_id, inv.invoice_number, cn.isp_id, cn.subtotal, cn.tax_amount,
+		       cn.amount, cn.reason, cn.settlement, cn.refund_payment_id, cn.created_by, cn.created_at
+		FROM credit_notes cn
+		JOIN invoices inv ON cn.invoice_id = inv.id
+		WHERE cn.invoice_id = $1
+		ORDER BY cn.created_at, cn.id
+	`, inv.ID)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	notes := []CreditNoteResponse{}
+	for rows.Next() {
+		var cn CreditNoteResponse
+		if err := rows.Scan(&cn.ID, &cn.CreditNoteNumber, &cn.InvoiceID, &cn.InvoiceNumber, &cn.ISPID, &cn.Subtotal,
+			&cn.TaxAmount, &cn.Amount, &cn.Reason, &cn.Settlement, &cn.RefundPaymentID, &cn.CreatedBy,
+			&cn.CreatedAt); err != nil {
+			continue
+		}
+		notes = append(notes, cn)
+	}
+
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Data: notes})
+}
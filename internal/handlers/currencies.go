@@ -0,0 +1,413 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"isp-saas.com/platform/internal/billing"
+	"isp-saas.com/platform/internal/middleware"
+)
+
+var currencyCodePattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+var (
+	errNoExchangeRate = errors.New("no exchange rate for currency pair")
+	errNoPlanPrice    = errors.New("plan has no price in this currency")
+	errPendingItems   = errors.New("ISP has unbilled items")
+)
+
+type CurrencyResponse struct {
+	Code     string `json:"code"`
+	Name     string `json:"name"`
+	Symbol   string `json:"symbol"`
+	IsActive bool   `json:"is_active"`
+}
+
+type ExchangeRateResponse struct {
+	ID            int                  `json:"id"`
+	Currency      string               `json:"currency"`
+	QuoteCurrency string               `json:"quote_currency"`
+	Rate          billing.ExchangeRate `json:"rate"`
+	EffectiveDate string               `json:"effective_date"`
+	Source        string               `json:"source"`
+	CreatedBy     *int                 `json:"created_by"`
+	CreatedAt     string               `json:"created_at"`
+}
+
+// ExchangeRateRequest says one unit of currency is worth rate units of
+// quote_currency from effective_date, which defaults to today
+type ExchangeRateRequest struct {
+	Currency      string               `json:"currency"`
+	QuoteCurrency string               `json:"quote_currency"`
+	Rate          billing.ExchangeRate `json:"rate"`
+	EffectiveDate string               `json:"effective_date"`
+	Source        string               `json:"source"`
+}
+
+// PlanPriceResponse is a plan's price in one currency. The plan's own
+// currency is the default price; the others come from its price book.
+type PlanPriceResponse struct {
+	PlanID                  int           `json:"plan_id"`
+	Currency                string        `json:"currency"`
+	PriceMonthly            billing.Money `json:"price_monthly"`
+	CacheOveragePerGB       billing.Money `json:"cache_overage_per_gb"`
+	BandwidthOveragePerMbps billing.Money `json:"bandwidth_overage_per_mbps"`
+	IsDefault               bool          `json:"is_default"`
+}
+
+type PlanPriceRequest struct {
+	PriceMonthly            billing.Money `json:"price_monthly"`
+	CacheOveragePerGB       billing.Money `json:"cache_overage_per_gb"`
+	BandwidthOveragePerMbps billing.Money `json:"bandwidth_overage_per_mbps"`
+}
+
+// queryRower is a *sql.Tx or the database handle
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// normalizeCurrency upper-cases a currency code and reports whether it is
+// empty or a three-letter ISO 4217 code
+func normalizeCurrency(s string) (string, bool) {
+	code := strings.ToUpper(strings.TrimSpace(s))
+	return code, code == "" || currencyCodePattern.MatchString(code)
+}
+
+// baseCurrency is the currency revenue and commissions are reported in
+func baseCurrency(q queryRower) (string, error) {
+	var code string
+	err := q.QueryRow("SELECT COALESCE(value, '') FROM settings WHERE key = 'base_currency'").Scan(&code)
+	if err == sql.ErrNoRows || err == nil && code == "" {
+		return "USD", nil
+	}
+	return code, err
+}
+
+func currencyActive(q queryRower, code string) bool {
+	var active bool
+	q.QueryRow("SELECT EXISTS(SELECT 1 FROM currencies WHERE code = $1 AND is_active)", code).Scan(&active)
+	return active
+}
+
+// exchangeRate finds the rate converting from into to on a date: the latest
+// rate for the pair that is in effect by then, or the inverse of the latest
+// rate the other way round. It also returns the date the rate took effect.
+func exchangeRate(q queryRower, from, to string, on time.Time) (billing.ExchangeRate, time.Time, error) {
+	on = billing.Date(on)
+	if from == to {
+		return billing.ExchangeRateOne, on, nil
+	}
+
+	var rate billing.ExchangeRate
+	var effective time.Time
+	var inverse bool
+	err := q.QueryRow(`
+		SELECT rate, effective_date, currency <> $1
+		FROM exchange_rates
+		WHERE (currency = $1 AND quote_currency = $2 OR currency = $2 AND quote_currency = $1)
+		  AND effective_date <= $3
+		ORDER BY effective_date DESC, currency = $1 DESC
+		LIMIT 1
+	`, from, to, on).Scan(&rate, &effective, &inverse)
+	if err == sql.ErrNoRows {
+		return 0, on, errNoExchangeRate
+	}
+	if err != nil {
+		return 0, on, err
+	}
+	if inverse {
+		rate = rate.Inverse()
+	}
+	return rate, effective, nil
+}
+
+// planPriced reports whether a plan can be billed in currency
+func planPriced(q queryRower, planID int, currency string) bool {
+	var priced bool
+	q.QueryRow("SELECT EXISTS(SELECT 1 FROM plan_price_book WHERE plan_id = $1 AND currency = $2)",
+		planID, currency).Scan(&priced)
+	return priced
+}
+
+// validateISPCurrency returns an error message, or "" if an ISP on planID
+// can be billed in currency
+func (h *Handler) validateISPCurrency(currency string, planID *int) string {
+	if !currencyActive(h.db, currency) {
+		return "Unknown currency " + currency
+	}
+	if planID != nil && !planPriced(h.db, *planID, currency) {
+		return "Plan has no price in " + currency
+	}
+	return ""
+}
+
+// setISPCurrency switches the currency an ISP is billed in. Pending items are
+// priced in the old currency, so the switch waits until they are invoiced.
+func (h *Handler) setISPCurrency(ispID int, currency string) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current string
+	var pending bool
+	err = tx.QueryRow(`
+		SELECT currency, EXISTS(SELECT 1 FROM pending_invoice_items WHERE isp_id = $1 AND invoice_id IS NULL)
+		FROM isps WHERE id = $1
+		FOR UPDATE
+	`, ispID).Scan(&current, &pending)
+	if err != nil || current == currency {
+		return err
+	}
+	if pending {
+		return errPendingItems
+	}
+
+	if _, err := tx.Exec("UPDATE isps SET currency = $1, updated_at = NOW() WHERE id = $2", currency, ispID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetCurrencies lists the currencies plans and ISPs can be set to
+func (h *Handler) GetCurrencies(w http.ResponseWriter, r *http.Request) {
+	rows, err := h.db.Query("SELECT code, name, symbol, is_active FROM currencies WHERE is_active ORDER BY code")
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	currencies := []CurrencyResponse{}
+	for rows.Next() {
+		var c CurrencyResponse
+		if err := rows.Scan(&c.Code, &c.Name, &c.Symbol, &c.IsActive); err != nil {
+			continue
+		}
+		currencies = append(currencies, c)
+	}
+
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Data: currencies})
+}
+
+// GetExchangeRates lists recorded rates, newest first, optionally for one
+// currency
+func (h *Handler) GetExchangeRates(w http.ResponseWriter, r *http.Request) {
+	currency, ok := normalizeCurrency(r.URL.Query().Get("currency"))
+	if !ok {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "currency must be a three-letter ISO 4217 code"})
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT id, currency, quote_currency, rate, effective_date, source, created_by, created_at
+		FROM exchange_rates
+		WHERE $1 = '' OR currency = $1 OR quote_currency = $1
+		ORDER BY effective_date DESC, currency, quote_currency
+		LIMIT 200
+	`, currency)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	rates := []ExchangeRateResponse{}
+	for rows.Next() {
+		var x ExchangeRateResponse
+		if err := rows.Scan(&x.ID, &x.Currency, &x.QuoteCurrency, &x.Rate, &x.EffectiveDate, &x.Source,
+			&x.CreatedBy, &x.CreatedAt); err != nil {
+			continue
+		}
+		rates = append(rates, x)
+	}
+
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Data: rates})
+}
+
+// CreateExchangeRate records a rate. A second rate for the same pair and day
+// replaces the first; invoices keep the rate they were issued at.
+func (h *Handler) CreateExchangeRate(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+
+	var req ExchangeRateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
+		return
+	}
+
+	currency, ok1 := normalizeCurrency(req.Currency)
+	quote, ok2 := normalizeCurrency(req.QuoteCurrency)
+	if !ok1 || !ok2 || currency == "" || quote == "" {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "currency and quote_currency must be three-letter ISO 4217 codes"})
+		return
+	}
+	if currency == quote {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "currency and quote_currency must differ"})
+		return
+	}
+	if !currencyActive(h.db, currency) || !currencyActive(h.db, quote) {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Unknown currency"})
+		return
+	}
+	if req.Rate <= 0 {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "rate must be positive"})
+		return
+	}
+
+	effective := billing.Date(time.Now())
+	if req.EffectiveDate != "" {
+		var err error
+		if effective, err = time.Parse("2006-01-02", req.EffectiveDate); err != nil {
+			h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "effective_date must be YYYY-MM-DD"})
+			return
+		}
+	}
+	source := strings.TrimSpace(req.Source)
+	if source == "" {
+		source = "manual"
+	}
+
+	var id int
+	err := h.db.QueryRow(`
+		INSERT INTO exchange_rates (currency, quote_currency, rate, effective_date, source, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (currency, quote_currency, effective_date) DO UPDATE
+		SET rate = EXCLUDED.rate, source = EXCLUDED.source, created_by = EXCLUDED.created_by, created_at = NOW()
+		RETURNING id
+	`, currency, quote, req.Rate, effective, source, claims.UserID).Scan(&id)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to record exchange rate"})
+		return
+	}
+
+	h.audit(r, "exchange_rate.create", "exchange_rate", id, nil, h.auditSnapshot("exchange_rates", id))
+	h.logger.Info("Exchange rate recorded", "currency", currency, "quote_currency", quote, "rate", req.Rate.String(),
+		"effective_date", effective.Format("2006-01-02"), "by", claims.UserID)
+	h.sendJSON(w, http.StatusCreated, Response{Success: true, Message: "Exchange rate recorded", Data: map[string]int{"id": id}})
+}
+
+// GetPlanPrices returns a plan's price book: its default price and its price
+// in every other currency it is sold in
+func (h *Handler) GetPlanPrices(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	rows, err := h.db.Query(`
+		SELECT pb.plan_id, pb.currency, pb.price_monthly, pb.cache_overage_per_gb, pb.bandwidth_overage_per_mbps,
+		       pb.currency = p.currency
+		FROM plan_price_book pb
+		JOIN plans p ON pb.plan_id = p.id
+		WHERE pb.plan_id = $1
+		ORDER BY pb.currency = p.currency DESC, pb.currency
+	`, id)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	prices := []PlanPriceResponse{}
+	for rows.Next() {
+		var p PlanPriceResponse
+		if err := rows.Scan(&p.PlanID, &p.Currency, &p.PriceMonthly, &p.CacheOveragePerGB, &p.BandwidthOveragePerMbps,
+			&p.IsDefault); err != nil {
+			continue
+		}
+		prices = append(prices, p)
+	}
+	if len(prices) == 0 {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Plan not found"})
+		return
+	}
+
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Data: prices})
+}
+
+// SetPlanPrice adds or replaces a plan's price in a currency other than its
+// own. ISPs billed in that currency pay it from their next invoice.
+func (h *Handler) SetPlanPrice(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	currency, ok := normalizeCurrency(vars["currency"])
+	if !ok || currency == "" || !currencyActive(h.db, currency) {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Unknown currency"})
+		return
+	}
+
+	var req PlanPriceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
+		return
+	}
+	if req.PriceMonthly < 0 || req.CacheOveragePerGB < 0 || req.BandwidthOveragePerMbps < 0 {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Prices cannot be negative"})
+		return
+	}
+
+	var planCurrency string
+	if err := h.db.QueryRow("SELECT currency FROM plans WHERE id = $1", id).Scan(&planCurrency); err != nil {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Plan not found"})
+		return
+	}
+	if planCurrency == currency {
+		h.sendJSON(w, http.StatusConflict, Response{Success: false, Error: "This is the plan's own currency; its price is set on the plan"})
+		return
+	}
+
+	before := h.planPriceSnapshot(id, currency)
+	_, err := h.db.Exec(`
+		INSERT INTO plan_prices (plan_id, currency, price_monthly, cache_overage_per_gb, bandwidth_overage_per_mbps)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (plan_id, currency) DO UPDATE
+		SET price_monthly = EXCLUDED.price_monthly, cache_overage_per_gb = EXCLUDED.cache_overage_per_gb,
+		    bandwidth_overage_per_mbps = EXCLUDED.bandwidth_overage_per_mbps, updated_at = NOW()
+	`, id, currency, req.PriceMonthly, req.CacheOveragePerGB, req.BandwidthOveragePerMbps)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to set plan price"})
+		return
+	}
+
+	h.audit(r, "plan.price_set", "plan", id, before, h.planPriceSnapshot(id, currency))
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Plan price updated"})
+}
+
+// DeletePlanPrice takes a currency out of a plan's price book. ISPs billed in
+// it can no longer move to the plan, and ISPs already on it are left out of
+// billing runs until it is priced again.
+func (h *Handler) DeletePlanPrice(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	currency, _ := normalizeCurrency(vars["currency"])
+
+	before := h.planPriceSnapshot(id, currency)
+	result, err := h.db.Exec("DELETE FROM plan_prices WHERE plan_id = $1 AND currency = $2", id, currency)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to delete plan price"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Plan has no price in this currency"})
+		return
+	}
+
+	h.audit(r, "plan.price_delete", "plan", id, before, nil)
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Plan price deleted"})
+}
+
+func (h *Handler) planPriceSnapshot(planID, currency string) json.RawMessage {
+	var raw []byte
+	err := h.db.QueryRow("SELECT row_to_json(pp) FROM plan_prices pp WHERE plan_id = $1 AND currency = $2",
+		planID, currency).Scan(&raw)
+	if err != nil {
+		return nil
+	}
+	return raw
+}
@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"isp-saas.com/platform/internal/middleware"
+)
+
+// Logo limits. Logos are embedded in every invoice of the distributor's ISPs.
+const (
+	maxLogoBytes     = 512 << 10
+	maxLogoDimension = 2000
+)
+
+type DistributorBrandingResponse struct {
+	CompanyName     string  `json:"company_name"`
+	Address         string  `json:"address"`
+	TaxID           *string `json:"tax_id"`
+	HasLogo         bool    `json:"has_logo"`
+	LogoContentType *string `json:"logo_content_type"`
+	LogoSHA256      *string `json:"logo_sha256"`
+	UpdatedAt       string  `json:"updated_at"`
+}
+
+type DistributorBrandingRequest struct {
+	CompanyName string `json:"company_name"`
+	Address     string `json:"address"`
+	TaxID       string `json:"tax_id"`
+	// Base64-encoded PNG, JPEG or GIF. Omitted keeps the current logo; an
+	// empty string removes it.
+	Logo *string `json:"logo"`
+}
+
+// brandingDistributor resolves the {id} of a branding route, the
+// distributor's user id, to its distributor profile id
+func (h *Handler) brandingDistributor(w http.ResponseWriter, r *http.Request) (userID string, distributorID int, ok bool) {
+	userID = mux.Vars(r)["id"]
+
+	claims := middleware.GetUserFromContext(r)
+	if !h.canViewDistributor(claims, userID) {
+		h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Access denied"})
+		return "", 0, false
+	}
+
+	err := h.db.QueryRow(`
+		SELECT d.id FROM distributors d JOIN users u ON u.id = d.user_id
+		WHERE d.user_id = $1 AND u.role = 'distributor'
+	`, userID).Scan(&distributorID)
+	if err != nil {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Distributor not found"})
+		return "", 0, false
+	}
+	return userID, distributorID, true
+}
+
+// GetDistributorBranding returns what the distributor's ISPs see on their
+// invoices, without the logo itself
+func (h *Handler) GetDistributorBranding(w http.ResponseWriter, r *http.Request) {
+	_, distributorID, ok := h.brandingDistributor(w, r)
+	if !ok {
+		return
+	}
+
+	b, err := h.brandingSnapshot(distributorID)
+	if err == sql.ErrNoRows {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "No branding set; invoices use the platform's details"})
+		return
+	}
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Data: b})
+}
+
+// GetDistributorLogo serves the distributor's logo image
+func (h *Handler) GetDistributorLogo(w http.ResponseWriter, r *http.Request) {
+	_, distributorID, ok := h.brandingDistributor(w, r)
+	if !ok {
+		return
+	}
+
+	var logo []byte
+	var contentType string
+	err := h.db.QueryRow(`
+		SELECT logo, logo_content_type FROM distributor_branding
+		WHERE distributor_id = $1 AND logo IS NOT NULL
+	`, distributorID).Scan(&logo, &contentType)
+	if err != nil {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "No logo set"})
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Write(logo)
+}
+
+// UpdateDistributorBranding sets the company details and logo printed on the
+// invoices of the distributor's ISPs. Invoices already issued keep the
+// branding they were issued with.
+func (h *Handler) UpdateDistributorBranding(w http.ResponseWriter, r *http.Request) {
+	userID, distributorID, ok := h.brandingDistributor(w, r)
+	if !ok {
+		return
+	}
+
+	var req DistributorBrandingRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*maxLogoBytes)).Decode(&req); err != nil {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
+		return
+	}
+
+	req.CompanyName = strings.TrimSpace(req.CompanyName)
+	req.Address = strings.TrimSpace(req.Address)
+	req.TaxID = strings.TrimSpace(req.TaxID)
+	if req.CompanyName == "" || len(req.CompanyName) > 255 {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "company_name is required and at most 255 characters"})
+		return
+	}
+	if len(req.Address) > 1000 || len(req.TaxID) > 64 {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "address is at most 1000 and tax_id at most 64 characters"})
+		return
+	}
+
+	var logo []byte
+	var contentType string
+	if req.Logo != nil && *req.Logo != "" {
+		var msg string
+		logo, contentType, msg = decodeLogo(*req.Logo)
+		if msg != "" {
+			h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: msg})
+			return
+		}
+	}
+
+	var before interface{}
+	if b, err := h.brandingSnapshot(distributorID); err == nil {
+		before = b
+	}
+
+	// Without a logo in the request the stored one is kept, or removed when
+	// the request sent an empty string
+	_, err := h.db.Exec(`
+		INSERT INTO distributor_branding (distributor_id, company_name, address, tax_id, logo, logo_content_type)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (distributor_id) DO UPDATE SET
+			company_name = EXCLUDED.company_name,
+			address = EXCLUDED.address,
+			tax_id = EXCLUDED.tax_id,
+			logo = CASE WHEN $7 THEN EXCLUDED.logo ELSE distributor_branding.logo END,
+			logo_content_type = CASE WHEN $7 THEN EXCLUDED.logo_content_type ELSE distributor_branding.logo_content_type END,
+			updated_at = NOW()
+	`, distributorID, req.CompanyName, req.Address, nullIfEmpty(req.TaxID), logo, nullIfEmpty(contentType), req.Logo != nil)
+	if err != nil {
+		h.logger.Error("Failed to update distributor branding", "distributor_id", distributorID, "error", err)
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to update branding"})
+		return
+	}
+
+	after, _ := h.brandingSnapshot(distributorID)
+	h.audit(r, "distributor.branding_update", "distributor", userID, before, after)
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Branding updated successfully", Data: after})
+}
+
+// DeleteDistributorBranding reverts the distributor's ISPs to invoices with
+// the platform's details
+func (h *Handler) DeleteDistributorBranding(w http.ResponseWriter, r *http.Request) {
+	userID, distributorID, ok := h.brandingDistributor(w, r)
+	if !ok {
+		return
+	}
+
+	before, err := h.brandingSnapshot(distributorID)
+	if err == sql.ErrNoRows {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "No branding set"})
+		return
+	}
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	if _, err := h.db.Exec("DELETE FROM distributor_branding WHERE distributor_id = $1", distributorID); err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to delete branding"})
+		return
+	}
+
+	h.audit(r, "distributor.branding_delete", "distributor", userID, before, nil)
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Branding removed"})
+}
+
+// brandingSnapshot reads a distributor's branding for responses and the audit
+// log. The logo is represented by its hash rather than its bytes.
+func (h *Handler) brandingSnapshot(distributorID int) (*DistributorBrandingResponse, error) {
+	var b DistributorBrandingResponse
+	var logo []byte
+	err := h.db.QueryRow(`
+		SELECT b.company_name, b.address, b.tax_id, b.logo, b.logo_content_type, b.updated_at
+		FROM distributor_branding b WHERE b.distributor_id = $1
+	`, distributorID).Scan(&b.CompanyName, &b.Address, &b.TaxID, &logo, &b.LogoContentType, &b.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if len(logo) > 0 {
+		sum := sha256.Sum256(logo)
+		digest := hex.EncodeToString(sum[:])
+		b.HasLogo, b.LogoSHA256 = true, &digest
+	}
+	return &b, nil
+}
+
+// decodeLogo checks an uploaded logo and returns it with its content type,
+// or a message saying what is wrong with it
+func decodeLogo(encoded string) ([]byte, string, string) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, "", "logo must be base64-encoded"
+	}
+	if len(data) > maxLogoBytes {
+		return nil, "", "logo must be at most 512 KB"
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || (format != "png" && format != "jpeg" && format != "gif") {
+		return nil, "", "logo must be a PNG, JPEG or GIF image"
+	}
+	if cfg.Width == 0 || cfg.Height == 0 || cfg.Width > maxLogoDimension || cfg.Height > maxLogoDimension {
+		return nil, "", "logo must be at most 2000x2000 pixels"
+	}
+	if _, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+		return nil, "", "logo image is corrupt"
+	}
+	return data, "image/" + format, ""
+}
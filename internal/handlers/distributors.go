@@ -3,22 +3,28 @@ package handlers
 import (
     "encoding/json"
     "net/http"
+    "strconv"
 
     "github.com/gorilla/mux"
     "golang.org/x/crypto/bcrypt"
+    "isp-saas.com/platform/internal/billing"
     "isp-saas.com/platform/internal/middleware"
+    "isp-saas.com/platform/internal/rbac"
 )
 
 type DistributorResponse struct {
-    ID           int     `json:"id"`
-    Email        string  `json:"email"`
-    FullName     string  `json:"full_name"`
-    CompanyName  string  `json:"company_name"`
-    Commission   float64 `json:"commission_percent"`
-    TotalISPs    int     `json:"total_isps"`
-    TotalRevenue float64 `json:"total_revenue"`
-    IsActive     bool    `json:"is_active"`
-    CreatedAt    string  `json:"created_at"`
+    ID            int           `json:"id"`
+    Email         string        `json:"email"`
+    FullName      string        `json:"full_name"`
+    CompanyName   string        `json:"company_name"`
+    Commission    float64       `json:"commission_percent"`
+    TotalISPs     int           `json:"total_isps"`
+    // Paid invoices of the distributor's ISPs, in the base currency
+    TotalRevenue  float64       `json:"total_revenue"`
+    IsActive      bool          `json:"is_active"`
+    CreatedAt     string        `json:"created_at"`
+    // Commission accrued over all time, kept in step with the ledger
+    TotalEarnings billing.Money `json:"total_earnings"`
 }
 
 type CreateDistributorRequest struct {
@@ -30,18 +36,15 @@ type CreateDistributorRequest struct {
 }
 
 func (h *Handler) GetDistributors(w http.ResponseWriter, r *http.Request) {
-    claims := middleware.GetUserFromContext(r)
-    if claims.Role != "admin" {
-        h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Admin access required"})
-        return
-    }
-
     rows, err := h.db.Query(`
         SELECT u.id, u.email, COALESCE(u.full_name, '') as full_name, 
                COALESCE(d.company_name, '') as company_name,
                COALESCE(d.commission_percent, 0) as commission,
+               COALESCE(d.total_earnings, 0) as total_earnings,
                u.is_active, u.created_at,
-               (SELECT COUNT(*) FROM isps WHERE user_id = u.id) as total_isps
+               (SELECT COUNT(*) FROM isps WHERE distributor_id = d.id) as total_isps,
+               (SELECT COALESCE(SUM(ROUND((inv.amount - inv.amount_credited) * inv.exchange_rate, 2)), 0) FROM invoices inv JOIN isps i ON inv.isp_id = i.id
+                WHERE i.distributor_id = d.id AND inv.status = 'paid') as total_revenue
         FROM users u
         LEFT JOIN distributors d ON u.id = d.user_id
         WHERE u.role = 'distributor'
@@ -56,7 +59,7 @@ func (h *Handler) GetDistributors(w http.ResponseWriter, r *http.Request) {
     var distributors []DistributorResponse
     for rows.Next() {
         var d DistributorResponse
-        rows.Scan(&d.ID, &d.Email, &d.FullName, &d.CompanyName, &d.Commission, &d.IsActive, &d.CreatedAt, &d.TotalISPs)
+        rows.Scan(&d.ID, &d.Email, &d.FullName, &d.CompanyName, &d.Commission, &d.TotalEarnings, &d.IsActive, &d.CreatedAt, &d.TotalISPs, &d.TotalRevenue)
         distributors = append(distributors, d)
     }
 
@@ -68,7 +71,7 @@ func (h *Handler) GetDistributor(w http.ResponseWriter, r *http.Request) {
     id := vars["id"]
 
     claims := middleware.GetUserFromContext(r)
-    if claims.Role != "admin" && claims.Role != "distributor" {
+    if !h.canViewDistributor(claims, id) {
         h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Access denied"})
         return
     }
@@ -78,12 +81,15 @@ func (h *Handler) GetDistributor(w http.ResponseWriter, r *http.Request) {
         SELECT u.id, u.email, COALESCE(u.full_name, '') as full_name,
                COALESCE(d.company_name, '') as company_name,
                COALESCE(d.commission_percent, 0) as commission,
+               COALESCE(d.total_earnings, 0) as total_earnings,
                u.is_active, u.created_at,
-               (SELECT COUNT(*) FROM isps WHERE user_id = u.id) as total_isps
+               (SELECT COUNT(*) FROM isps WHERE distributor_id = d.id) as total_isps,
+               (SELECT COALESCE(SUM(ROUND((inv.amount - inv.amount_credited) * inv.exchange_rate, 2)), 0) FROM invoices inv JOIN isps i ON inv.isp_id = i.id
+                WHERE i.distributor_id = d.id AND inv.status = 'paid') as total_revenue
         FROM users u
         LEFT JOIN distributors d ON u.id = d.user_id
         WHERE u.id = $1 AND u.role = 'distributor'
-    `, id).Scan(&d.ID, &d.Email, &d.FullName, &d.CompanyName, &d.Commission, &d.IsActive, &d.CreatedAt, &d.TotalISPs)
+    `, id).Scan(&d.ID, &d.Email, &d.FullName, &d.CompanyName, &d.Commission, &d.TotalEarnings, &d.IsActive, &d.CreatedAt, &d.TotalISPs, &d.TotalRevenue)
 
     if err != nil {
         h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Distributor not found"})
@@ -95,10 +101,6 @@ func (h *Handler) GetDistributor(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handler) CreateDistributor(w http.ResponseWriter, r *http.Request) {
     claims := middleware.GetUserFromContext(r)
-    if claims.Role != "admin" {
-        h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Admin access required"})
-        return
-    }
 
     var req CreateDistributorRequest
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -111,6 +113,11 @@ func (h *Handler) CreateDistributor(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    if err := ValidatePassword(req.Password); err != nil {
+        h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: err.Error()})
+        return
+    }
+
     if req.Commission < 0 || req.Commission > 100 {
         req.Commission = 10 // Default 10%
     }
@@ -125,8 +132,8 @@ func (h *Handler) CreateDistributor(w http.ResponseWriter, r *http.Request) {
 
     var userID int
     err = tx.QueryRow(`
-        INSERT INTO users (email, password_hash, role, full_name) 
-        VALUES ($1, $2, 'distributor', $3) RETURNING id
+        INSERT INTO users (email, password_hash, role, full_name, email_verified, email_verified_at) 
+        VALUES ($1, $2, 'distributor', $3, true, NOW()) RETURNING id
     `, req.Email, string(hashedPassword), req.FullName).Scan(&userID)
 
     if err != nil {
@@ -147,6 +154,7 @@ func (h *Handler) CreateDistributor(w http.ResponseWriter, r *http.Request) {
 
     tx.Commit()
 
+    h.audit(r, "distributor.create", "distributor", userID, nil, h.distributorSnapshot(userID))
     h.logger.Info("Distributor created", "user_id", userID, "email", req.Email, "by", claims.UserID)
     h.sendJSON(w, http.StatusCreated, Response{
         Success: true,
@@ -159,18 +167,14 @@ func (h *Handler) UpdateDistributor(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     id := vars["id"]
 
-    claims := middleware.GetUserFromContext(r)
-    if claims.Role != "admin" {
-        h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Admin access required"})
-        return
-    }
-
     var req CreateDistributorRequest
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
         h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
         return
     }
 
+    before := h.distributorSnapshot(id)
+
     if req.FullName != "" {
         h.db.Exec("UPDATE users SET full_name = $1, updated_at = NOW() WHERE id = $2", req.FullName, id)
     }
@@ -184,6 +188,7 @@ func (h *Handler) UpdateDistributor(w http.ResponseWriter, r *http.Request) {
         `, req.CompanyName, req.Commission, id)
     }
 
+    h.audit(r, "distributor.update", "distributor", id, before, h.distributorSnapshot(id))
     h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Distributor updated successfully"})
 }
 
@@ -191,9 +196,17 @@ func (h *Handler) GetDistributorISPs(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     id := vars["id"]
 
-    rows, err := h.db.Query(`
-        SELECT id, name, server_ip, hw_id, status, cache_size_gb, bandwidth_limit_mbps, created_at
-        FROM isps WHERE user_id = $1 ORDER BY id
+    claims := middleware.GetUserFromContext(r)
+    if !h.canViewDistributor(claims, id) {
+        h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Access denied"})
+        return
+    }
+
+    // The route id is the distributor's user id; ISPs reference the
+    // distributor profile
+    rows, err := h.db.Query(ispSelect+`
+        JOIN distributors d ON i.distributor_id = d.id
+        WHERE d.user_id = $1 ORDER BY i.id
     `, id)
     if err != nil {
         h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
@@ -201,12 +214,39 @@ func (h *Handler) GetDistributorISPs(w http.ResponseWriter, r *http.Request) {
     }
     defer rows.Close()
 
-    var isps []ISPResponse
+    isps := []ISPResponse{}
     for rows.Next() {
         var isp ISPResponse
-        rows.Scan(&isp.ID, &isp.Name, &isp.ServerIP, &isp.HWID, &isp.Status, &isp.CacheSizeGB, &isp.BandwidthLimit, &isp.CreatedAt)
+        if err := scanISP(rows, &isp); err != nil {
+            continue
+        }
         isps = append(isps, isp)
     }
 
     h.sendJSON(w, http.StatusOK, Response{Success: true, Data: isps})
 }
+
+// canViewDistributor lets distributor managers see any distributor and
+// distributors see only their own profile
+func (h *Handler) canViewDistributor(claims *middleware.Claims, id string) bool {
+    if rbac.Allowed(claims.Role, rbac.DistributorManage) {
+        return true
+    }
+    return strconv.Itoa(claims.UserID) == id
+}
+
+// distributorSnapshot captures a distributor's account and profile for the
+// audit log. id is the distributor's user id.
+func (h *Handler) distributorSnapshot(id interface{}) map[string]interface{} {
+    user := h.auditSnapshot("users", id)
+    if user == nil {
+        return nil
+    }
+
+    var profileID int
+    h.db.QueryRow("SELECT id FROM distributors WHERE user_id = $1", id).Scan(&profileID)
+    return map[string]interface{}{
+        "user":    user,
+        "profile": h.auditSnapshot("distributors", profileID),
+    }
+}
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"isp-saas.com/platform/internal/billing"
+	"isp-saas.com/platform/internal/middleware"
+)
+
+type DunningResult struct {
+	MarkedOverdue int   `json:"invoices_marked_overdue"`
+	RemindersSent int   `json:"reminders_sent"`
+	SuspendedISPs []int `json:"suspended_isps"`
+}
+
+// dunningPolicy reads the schedule from settings: dunning_reminder_days and
+// auto_suspend_days
+func (h *Handler) dunningPolicy() billing.DunningPolicy {
+	offsets, err := billing.ParseReminderOffsets(h.getSetting("dunning_reminder_days", "-3,1,5"))
+	if err != nil {
+		h.logger.Warn("Invalid dunning_reminder_days setting, using the default", "error", err)
+		offsets = []int{-3, 1, 5}
+	}
+	return billing.DunningPolicy{
+		ReminderOffsets:  offsets,
+		SuspendAfterDays: h.getSettingInt("auto_suspend_days", 7),
+	}
+}
+
+// RunDunning marks unpaid invoices past their due date overdue, sends the
+// reminders that have fallen due and suspends ISPs whose invoices are still
+// unpaid auto_suspend_days after the due date. Each step is logged per
+// invoice, so running it repeatedly is safe.
+func (h *Handler) RunDunning(asOf time.Time) (DunningResult, error) {
+	result := DunningResult{SuspendedISPs: []int{}}
+	today := billing.Date(asOf)
+	policy := h.dunningPolicy()
+
+	res, err := h.db.Exec(`
+		UPDATE invoices SET status = 'overdue'
+		WHERE status IN ('pending', 'partially_paid') AND due_date < $1
+	`, today)
+	if err != nil {
+		return result, err
+	}
+	marked, _ := res.RowsAffected()
+	result.MarkedOverdue = int(marked)
+
+	rows, err := h.db.Query(`
+		SELECT inv.id, inv.invoice_number, inv.isp_id, inv.due_date, inv.amount - inv.amount_credited - inv.amount_paid, inv.currency
+		FROM invoices inv
+		WHERE inv.status IN ('pending', 'partially_paid', 'overdue') AND inv.due_date <= $1
+		ORDER BY inv.due_date, inv.id
+	`, today.AddDate(0, 0, maxReminderLead(policy)))
+	if err != nil {
+		return result, err
+	}
+
+	type openInvoice struct {
+		id, ispID  int
+		number     string
+		dueDate    time.Time
+		balanceDue billing.Money
+		currency   string
+	}
+	var invoices []openInvoice
+	for rows.Next() {
+		var inv openInvoice
+		if err := rows.Scan(&inv.id, &inv.number, &inv.ispID, &inv.dueDate, &inv.balanceDue, &inv.currency); err != nil {
+			rows.Close()
+			return result, err
+		}
+		invoices = append(invoices, inv)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	for _, inv := range invoices {
+		steps := policy.StepsDue(inv.dueDate, today)
+
+		// Only the latest reminder due is sent; earlier ones the job missed
+		// are logged as skipped rather than sent all at once
+		lastReminder := -1
+		for i, step := range steps {
+			if step.Kind == billing.StepReminder {
+				lastReminder = i
+			}
+		}
+
+		for i, step := range steps {
+			skipped := step.Kind == billing.StepReminder && i != lastReminder
+			taken, err := h.logDunningStep(inv.id, step, skipped)
+			if err != nil {
+				return result, err
+			}
+			if !taken || skipped {
+				continue
+			}
+
+			switch step.Kind {
+			case billing.StepReminder:
+				h.notifyISP(inv.ispID, notifyBilling, reminderTitle(inv.number, step.Offset),
+					fmt.Sprintf("Invoice %s for %s %s is due on %s.\n\nPay online or view the invoice at %s/billing\n",
+						inv.number, inv.balanceDue, inv.currency, inv.dueDate.Format("2006-01-02"), appURL()))
+				result.RemindersSent++
+
+			case billing.StepSuspend:
+				suspended, err := h.suspendForBilling(inv.ispID)
+				if err != nil {
+					return result, err
+				}
+				if suspended {
+					result.SuspendedISPs = append(result.SuspendedISPs, inv.ispID)
+					h.notifyISP(inv.ispID, notifyWarning, "Service suspended for non-payment",
+						fmt.Sprintf("Invoice %s for %s %s was due on %s and is still unpaid, so the service has been suspended.\n\n"+
+							"It is reactivated automatically once the invoice is paid in full.\n",
+							inv.number, inv.balanceDue, inv.currency, inv.dueDate.Format("2006-01-02")))
+					h.logger.Info("ISP suspended for non-payment", "isp_id", inv.ispID, "invoice_id", inv.id)
+				}
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// auditDunning records a dunning run and the suspensions it made. r is nil
+// for scheduled runs.
+func (h *Handler) auditDunning(r *http.Request, result DunningResult) {
+	var actorID interface{}
+	if r != nil {
+		if claims := middleware.GetUserFromContext(r); claims != nil {
+			actorID = claims.UserID
+		}
+	}
+	for _, ispID := range result.SuspendedISPs {
+		h.auditAs(r, actorID, "isp.suspend", "isp", ispID, nil, h.auditSnapshot("isps", ispID))
+	}
+	h.auditAs(r, actorID, "invoice.overdue_check", "invoice", nil, nil, result)
+}
+
+// logDunningStep records that step was taken for an invoice and reports
+// whether this call took it (false if it was logged before)
+func (h *Handler) logDunningStep(invoiceID int, step billing.DunningStep, skipped bool) (bool, error) {
+	var id int
+	err := h.db.QueryRow(`
+		INSERT INTO invoice_dunning (invoice_id, step, skipped) VALUES ($1, $2, $3)
+		ON CONFLICT (invoice_id, step) DO NOTHING
+		RETURNING id
+	`, invoiceID, step.Key(), skipped).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// suspendForBilling suspends an active ISP and marks the suspension as
+// billing's, so payment can lift it. ISPs that are already suspended are
+// left alone.
+func (h *Handler) suspendForBilling(ispID int) (bool, error) {
+	res, err := h.db.Exec(`
+		UPDATE isps SET status = 'suspended', suspension_reason = 'billing', updated_at = NOW()
+		WHERE id = $1 AND status = 'active'
+	`, ispID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	if n > 0 {
+		h.forgetValidations(h.licenseCacheKeys("l.isp_id = $1", ispID))
+	}
+	return n > 0, nil
+}
+
+// reactivateIfSettled lifts a billing suspension of the invoice's ISP once
+// the ISP has no overdue invoices left, after the invoice was paid or
+// cancelled. Manual suspensions are never lifted here.
+func reactivateIfSettled(tx *sql.Tx, invoiceID int) (ispID int, reactivated bool, err error) {
+	err = tx.QueryRow(`
+		UPDATE isps i SET status = 'active', suspension_reason = NULL, updated_at = NOW()
+		FROM invoices inv
+		WHERE inv.id = $1 AND i.id = inv.isp_id
+		  AND i.status = 'suspended' AND i.suspension_reason = 'billing'
+		  AND NOT EXISTS (SELECT 1 FROM invoices o WHERE o.isp_id = i.id AND o.status = 'overdue')
+		RETURNING i.id
+	`, invoiceID).Scan(&ispID)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return ispID, err == nil, err
+}
+
+func reminderTitle(number string, offset int) string {
+	switch {
+	case offset < 0:
+		return fmt.Sprintf("Invoice %s is due in %d days", number, -offset)
+	case offset == 0:
+		return fmt.Sprintf("Invoice %s is due today", number)
+	default:
+		return fmt.Sprintf("Invoice %s is %d days overdue", number, offset)
+	}
+}
+
+// maxReminderLead is how many days before the due date the first reminder
+// goes out, so invoices due within that window are picked up
+func maxReminderLead(p billing.DunningPolicy) int {
+	lead := 0
+	for _, step := range p.Steps() {
+		if -step.Offset > lead {
+			lead = -step.Offset
+		}
+	}
+	return lead
+}
@@ -5,17 +5,30 @@ import (
     "net/http"
     "time"
 
+    "isp-saas.com/platform/internal/scheduler"
     "isp-saas.com/platform/pkg/database"
+    "isp-saas.com/platform/pkg/license"
     "isp-saas.com/platform/pkg/logger"
+    "isp-saas.com/platform/pkg/mailer"
+    "isp-saas.com/platform/pkg/payments"
+    "isp-saas.com/platform/pkg/redis"
 )
 
 type Handler struct {
-    db     *database.DB
-    logger *logger.Logger
+    db        *database.DB
+    logger    *logger.Logger
+    mailer    mailer.Mailer
+    payments  payments.Config
+    // Signs the license documents agents verify offline
+    licenses  *license.Signer
+    // Caches license validations; nil when Redis is unavailable
+    cache     *redis.RedisClient
+    // Set with SetScheduler once the jobs are registered
+    scheduler *scheduler.Scheduler
 }
 
-func New(db *database.DB, l *logger.Logger) *Handler {
-    return &Handler{db: db, logger: l}
+func New(db *database.DB, l *logger.Logger, m mailer.Mailer, p payments.Config, ls *license.Signer, rc *redis.RedisClient) *Handler {
+    return &Handler{db: db, logger: l, mailer: m, payments: p, licenses: ls, cache: rc}
 }
 
 type Response struct {
@@ -0,0 +1,452 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"isp-saas.com/platform/internal/middleware"
+)
+
+type HWIDTransferRequest struct {
+	NewHWID string `json:"new_hw_id"`
+	Reason  string `json:"reason"`
+}
+
+type HWIDTransferReview struct {
+	Note string `json:"note"`
+	// Approve even though the ISP has used its transfers for the year
+	OverrideLimit bool `json:"override_limit"`
+}
+
+type HWIDTransferResponse struct {
+	ID          int     `json:"id"`
+	ISPID       int     `json:"isp_id"`
+	ISPName     string  `json:"isp_name"`
+	OldHWID     string  `json:"old_hw_id"`
+	NewHWID     string  `json:"new_hw_id"`
+	Reason      string  `json:"reason"`
+	Status      string  `json:"status"`
+	RequestedBy *int    `json:"requested_by"`
+	ReviewedBy  *int    `json:"reviewed_by"`
+	ReviewNote  *string `json:"review_note"`
+	CreatedAt   string  `json:"created_at"`
+	ReviewedAt  *string `json:"reviewed_at"`
+}
+
+type HWIDHistoryResponse struct {
+	HWID       string  `json:"hw_id"`
+	TransferID *int    `json:"transfer_id"`
+	BoundAt    string  `json:"bound_at"`
+	UnboundAt  *string `json:"unbound_at"`
+	Current    bool    `json:"current"`
+}
+
+// RequestHWIDTransfer asks for the ISP's licenses to be moved to a new
+// server's hardware ID. Nothing changes until an admin approves it.
+func (h *Handler) RequestHWIDTransfer(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+	id := mux.Vars(r)["id"]
+	if !h.canAccessISP(claims, id) {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "ISP not found"})
+		return
+	}
+
+	var req HWIDTransferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
+		return
+	}
+	req.NewHWID = strings.TrimSpace(req.NewHWID)
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.NewHWID == "" || len(req.NewHWID) > 255 {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "new_hw_id is required and at most 255 characters"})
+		return
+	}
+	if req.Reason == "" || len(req.Reason) > 1000 {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "reason is required and at most 1000 characters"})
+		return
+	}
+
+	var ispID int
+	var current string
+	if err := h.db.QueryRow("SELECT id, hw_id FROM isps WHERE id = $1", id).Scan(&ispID, &current); err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	if req.NewHWID == current {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "ISP is already bound to this hardware ID"})
+		return
+	}
+	if msg, status := h.checkHWIDTransfer(h.db, ispID, req.NewHWID); msg != "" {
+		h.sendJSON(w, status, Response{Success: false, Error: msg})
+		return
+	}
+
+	var transferID int
+	err := h.db.QueryRow(`
+		INSERT INTO hwid_transfers (isp_id, old_hw_id, new_hw_id, reason, requested_by)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id
+	`, ispID, current, req.NewHWID, req.Reason, claims.UserID).Scan(&transferID)
+	if isUniqueViolation(err, "idx_hwid_transfers_pending") {
+		h.sendJSON(w, http.StatusConflict, Response{Success: false, Error: "A hardware ID transfer is already pending for this ISP"})
+		return
+	}
+	if err != nil {
+		h.logger.Error("Failed to request HWID transfer", "isp_id", ispID, "error", err)
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to request transfer"})
+		return
+	}
+
+	h.audit(r, "hwid_transfer.request", "hwid_transfer", transferID, nil, h.auditSnapshot("hwid_transfers", transferID))
+	h.logger.Info("HWID transfer requested", "transfer_id", transferID, "isp_id", ispID, "by", claims.UserID)
+
+	transfer, _ := h.findHWIDTransfer(h.db, transferID)
+	h.sendJSON(w, http.StatusCreated, Response{Success: true, Message: "Transfer requested; an administrator will review it", Data: transfer})
+}
+
+// CancelHWIDTransfer withdraws the ISP's pending transfer request
+func (h *Handler) CancelHWIDTransfer(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+	id := mux.Vars(r)["id"]
+	if !h.canAccessISP(claims, id) {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "ISP not found"})
+		return
+	}
+
+	var transferID int
+	err := h.db.QueryRow(`
+		UPDATE hwid_transfers SET status = 'cancelled'
+		WHERE isp_id = $1 AND status = 'pending'
+		RETURNING id
+	`, id).Scan(&transferID)
+	if err == sql.ErrNoRows {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "No pending hardware ID transfer"})
+		return
+	}
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to cancel transfer"})
+		return
+	}
+
+	h.audit(r, "hwid_transfer.cancel", "hwid_transfer", transferID, nil, h.auditSnapshot("hwid_transfers", transferID))
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Transfer request cancelled"})
+}
+
+// GetISPHWIDTransfers lists the ISP's transfer requests, newest first
+func (h *Handler) GetISPHWIDTransfers(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+	id := mux.Vars(r)["id"]
+	if !h.canAccessISP(claims, id) {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "ISP not found"})
+		return
+	}
+
+	h.listHWIDTransfers(w, " WHERE t.isp_id = $1", id)
+}
+
+// GetHWIDTransfers is the review queue: every ISP's requests, optionally of
+// one status
+func (h *Handler) GetHWIDTransfers(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "":
+		h.listHWIDTransfers(w, "")
+	case "pending", "approved", "rejected", "cancelled":
+		h.listHWIDTransfers(w, " WHERE t.status = $1", status)
+	default:
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "status must be pending, approved, rejected or cancelled"})
+	}
+}
+
+func (h *Handler) listHWIDTransfers(w http.ResponseWriter, where string, args ...interface{}) {
+	rows, err := h.db.Query(hwidTransferSelect+where+" ORDER BY t.created_at DESC, t.id DESC", args...)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	transfers := []HWIDTransferResponse{}
+	for rows.Next() {
+		var t HWIDTransferResponse
+		if err := scanHWIDTransfer(rows, &t); err != nil {
+			continue
+		}
+		transfers = append(transfers, t)
+	}
+
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Data: transfers})
+}
+
+// GetISPHWIDHistory lists every hardware ID the ISP has been bound to, the
+// current one first
+func (h *Handler) GetISPHWIDHistory(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+	id := mux.Vars(r)["id"]
+	if !h.canAccessISP(claims, id) {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "ISP not found"})
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT hw_id, transfer_id, bound_at, unbound_at FROM isp_hwid_history
+		WHERE isp_id = $1 ORDER BY unbound_at DESC NULLS FIRST, bound_at DESC, id DESC
+	`, id)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	history := []HWIDHistoryResponse{}
+	for rows.Next() {
+		var e HWIDHistoryResponse
+		if err := rows.Scan(&e.HWID, &e.TransferID, &e.BoundAt, &e.UnboundAt); err != nil {
+			continue
+		}
+		e.Current = e.UnboundAt == nil
+		history = append(history, e)
+	}
+
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Data: history})
+}
+
+// ApproveHWIDTransfer rebinds the ISP to the requested hardware ID and signs
+// its licenses for it. From then on the old server fails online validation;
+// a license document it already holds runs it offline only until that
+// document expires.
+func (h *Handler) ApproveHWIDTransfer(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+
+	var req HWIDTransferReview
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	t, ok := h.pendingHWIDTransfer(w, tx, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+
+	// The request is stale if the ISP was rebound some other way since
+	var current string
+	if err := tx.QueryRow("SELECT hw_id FROM isps WHERE id = $1 FOR UPDATE", t.ISPID).Scan(&current); err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	if current != t.OldHWID {
+		h.sendJSON(w, http.StatusConflict, Response{Success: false, Error: "ISP's hardware ID has changed since the request; reject it and request again"})
+		return
+	}
+	if msg, status := h.checkHWIDTransfer(tx, t.ISPID, t.NewHWID); msg != "" && !(req.OverrideLimit && status == http.StatusTooManyRequests) {
+		h.sendJSON(w, status, Response{Success: false, Error: msg})
+		return
+	}
+
+	before := h.auditSnapshot("isps", t.ISPID)
+
+	_, err = tx.Exec("UPDATE isps SET hw_id = $1, updated_at = NOW() WHERE id = $2", t.NewHWID, t.ISPID)
+	if isUniqueViolation(err, "isps_hw_id_key") {
+		h.sendJSON(w, http.StatusConflict, Response{Success: false, Error: "Hardware ID is bound to another ISP"})
+		return
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE isp_hwid_history SET unbound_at = NOW() WHERE isp_id = $1 AND unbound_at IS NULL", t.ISPID)
+	}
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO isp_hwid_history (isp_id, hw_id, transfer_id) VALUES ($1, $2, $3)", t.ISPID, t.NewHWID, t.ID)
+	}
+	if err == nil {
+		_, err = tx.Exec(`
+			UPDATE hwid_transfers SET status = 'approved', reviewed_by = $2, reviewed_at = NOW(), review_note = $3
+			WHERE id = $1
+		`, t.ID, claims.UserID, nullIfEmpty(strings.TrimSpace(req.Note)))
+	}
+	if err == nil {
+		err = h.resignISPLicenses(tx, t.ISPID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		h.logger.Error("Failed to approve HWID transfer", "transfer_id", t.ID, "error", err)
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to approve transfer"})
+		return
+	}
+
+	h.audit(r, "isp.hwid_transfer", "isp", t.ISPID, before, h.auditSnapshot("isps", t.ISPID))
+	h.forgetValidations(h.licenseCacheKeys("l.isp_id = $1", t.ISPID))
+	h.audit(r, "hwid_transfer.approve", "hwid_transfer", t.ID, t, h.auditSnapshot("hwid_transfers", t.ID))
+	h.logger.Info("HWID transfer approved", "transfer_id", t.ID, "isp_id", t.ISPID,
+		"override_limit", req.OverrideLimit, "by", claims.UserID)
+	h.notifyISP(t.ISPID, notifyWarning, "Hardware ID transfer approved",
+		"The licenses of "+t.ISPName+" are now bound to hardware ID "+t.NewHWID+". The previous server can no longer validate them.")
+
+	transfer, _ := h.findHWIDTransfer(h.db, t.ID)
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Transfer approved", Data: transfer})
+}
+
+// RejectHWIDTransfer turns a request down; the note tells the ISP why
+func (h *Handler) RejectHWIDTransfer(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+
+	var req HWIDTransferReview
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
+		return
+	}
+	req.Note = strings.TrimSpace(req.Note)
+	if req.Note == "" || len(req.Note) > 1000 {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "note is required and at most 1000 characters"})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	t, ok := h.pendingHWIDTransfer(w, tx, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	_, err = tx.Exec(`
+		UPDATE hwid_transfers SET status = 'rejected', reviewed_by = $2, reviewed_at = NOW(), review_note = $3
+		WHERE id = $1
+	`, t.ID, claims.UserID, req.Note)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to reject transfer"})
+		return
+	}
+
+	h.audit(r, "hwid_transfer.reject", "hwid_transfer", t.ID, t, h.auditSnapshot("hwid_transfers", t.ID))
+	h.notifyISP(t.ISPID, notifyWarning, "Hardware ID transfer rejected",
+		"The request to move the licenses of "+t.ISPName+" to hardware ID "+t.NewHWID+" was rejected: "+req.Note)
+
+	transfer, _ := h.findHWIDTransfer(h.db, t.ID)
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Transfer rejected", Data: transfer})
+}
+
+// pendingHWIDTransfer locks the transfer in the route for review, answering
+// the request itself when the transfer is missing or already decided
+func (h *Handler) pendingHWIDTransfer(w http.ResponseWriter, tx *sql.Tx, id string) (*HWIDTransferResponse, bool) {
+	var t HWIDTransferResponse
+	err := scanHWIDTransfer(tx.QueryRow(hwidTransferSelect+" WHERE t.id = $1 FOR UPDATE OF t", id), &t)
+	if err == sql.ErrNoRows {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Transfer not found"})
+		return nil, false
+	}
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return nil, false
+	}
+	if t.Status != "pending" {
+		h.sendJSON(w, http.StatusConflict, Response{Success: false, Error: "Transfer is already " + t.Status})
+		return nil, false
+	}
+	return &t, true
+}
+
+// checkHWIDTransfer checks that the ISP may move to hwID: no other ISP holds
+// it and the ISP has transfers left this year. It returns why not with the
+// status to answer, or "" when the transfer is allowed. The yearly limit is
+// reported as 429 so an admin can tell it apart and override it.
+func (h *Handler) checkHWIDTransfer(q queryRower, ispID int, hwID string) (string, int) {
+	var taken bool
+	if err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM isps WHERE hw_id = $1 AND id <> $2)", hwID, ispID).Scan(&taken); err != nil {
+		return "Database error", http.StatusInternalServerError
+	}
+	if taken {
+		return "Hardware ID is bound to another ISP", http.StatusConflict
+	}
+
+	limit := h.getSettingInt("hwid_transfers_per_year", 2)
+	if limit <= 0 {
+		return "Hardware ID transfers are disabled", http.StatusTooManyRequests
+	}
+
+	// The limit-th most recent transfer of the last year, if there is one,
+	// holds up the next until a year after it
+	var nextAt time.Time
+	err := q.QueryRow(`
+		SELECT reviewed_at + INTERVAL '1 year' FROM hwid_transfers
+		WHERE isp_id = $1 AND status = 'approved' AND reviewed_at > NOW() - INTERVAL '1 year'
+		ORDER BY reviewed_at DESC OFFSET $2 LIMIT 1
+	`, ispID, limit-1).Scan(&nextAt)
+	if err == sql.ErrNoRows {
+		return "", 0
+	}
+	if err != nil {
+		return "Database error", http.StatusInternalServerError
+	}
+	return "ISP has used its " + strconv.Itoa(limit) + " hardware ID transfers for the year; the next is possible from " +
+		nextAt.Format("2006-01-02"), http.StatusTooManyRequests
+}
+
+// resignISPLicenses signs the ISP's active licenses for its current hardware
+func (h *Handler) resignISPLicenses(tx *sql.Tx, ispID int) error {
+	rows, err := tx.Query("SELECT id FROM licenses WHERE isp_id = $1 AND is_active = true", ispID)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if _, _, err := h.licenseToken(tx, id, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Handler) findHWIDTransfer(q queryRower, id interface{}) (*HWIDTransferResponse, error) {
+	var t HWIDTransferResponse
+	if err := scanHWIDTransfer(q.QueryRow(hwidTransferSelect+" WHERE t.id = $1", id), &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+const hwidTransferSelect = `
+	SELECT t.id, t.isp_id, i.name, t.old_hw_id, t.new_hw_id, t.reason, t.status,
+	       t.requested_by, t.reviewed_by, t.review_note, t.created_at, t.reviewed_at
+	FROM hwid_transfers t
+	JOIN isps i ON t.isp_id = i.id
+`
+
+func scanHWIDTransfer(row interface{ Scan(...interface{}) error }, t *HWIDTransferResponse) error {
+	return row.Scan(&t.ID, &t.ISPID, &t.ISPName, &t.OldHWID, &t.NewHWID, &t.Reason, &t.Status,
+		&t.RequestedBy, &t.ReviewedBy, &t.ReviewNote, &t.CreatedAt, &t.ReviewedAt)
+}
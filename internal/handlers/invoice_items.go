@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"isp-saas.com/platform/internal/billing"
+	"isp-saas.com/platform/internal/middleware"
+)
+
+// Invoice item types
+const (
+	itemPlan   = "plan"
+	itemUsage  = "usage"
+	itemManual = "manual"
+	// Credit or charge for a mid-period plan change
+	itemProration = "proration"
+)
+
+type InvoiceItemResponse struct {
+	ID          int              `json:"id"`
+	Description string           `json:"description"`
+	Quantity    billing.Quantity `json:"quantity"`
+	UnitPrice   billing.Money    `json:"unit_price"`
+	Amount      billing.Money    `json:"amount"`
+	ItemType    string           `json:"item_type"`
+	PlanID      *int             `json:"plan_id"`
+	UsageMetric *string          `json:"usage_metric"`
+}
+
+// invoiceDraft is an invoice before it is numbered, taxed and stored
+type invoiceDraft struct {
+	ISPID   int
+	PlanID  *int
+	DueDate time.Time
+	Period  *billing.Period
+	Lines   []invoiceLine
+}
+
+type invoiceLine struct {
+	Description string
+	Quantity    billing.Quantity
+	UnitPrice   billing.Money
+	ItemType    string
+	PlanID      *int
+	UsageMetric *string
+}
+
+type createdInvoice struct {
+	ID       int
+	Number   string
+	Currency string
+	billing.Totals
+	// Account credit used to pay the invoice
+	CreditApplied billing.Money
+}
+
+var errEmptyInvoice = errors.New("invoice has no items")
+
+// createInvoice stores d with its items in tx. It prices the lines, applies
+// the ISP's tax rate and takes the next invoice number; the number is only
+// used up if tx commits, which keeps the sequence gap-free. The invoice is in
+// the ISP's currency and keeps today's rate to the base currency. An invoice
+// with nothing to collect is settled as it is created; credit on the ISP's
+// account pays what it can of any other.
+func createInvoice(tx *sql.Tx, d invoiceDraft) (createdInvoice, error) {
+	var inv createdInvoice
+	if len(d.Lines) == 0 {
+		return inv, errEmptyInvoice
+	}
+
+	taxName, taxRate, err := taxRateForISP(tx, d.ISPID)
+	if err != nil {
+		return inv, err
+	}
+
+	amounts := make([]billing.Money, len(d.Lines))
+	for i, l := range d.Lines {
+		amounts[i] = l.UnitPrice.Times(l.Quantity)
+	}
+	inv.Totals = billing.ComputeTotals(amounts, taxRate)
+
+	if err := tx.QueryRow("SELECT currency FROM isps WHERE id = $1", d.ISPID).Scan(&inv.Currency); err != nil {
+		return inv, err
+	}
+	base, err := baseCurrency(tx)
+	if err != nil {
+		return inv, err
+	}
+	rate, rateDate, err := exchangeRate(tx, inv.Currency, base, time.Now())
+	if err != nil {
+		return inv, fmt.Errorf("%w: %s to %s", err, inv.Currency, base)
+	}
+
+	// The row lock on this year's counter serializes concurrent invoices
+	var year, seq int
+	err = tx.QueryRow(`
+		INSERT INTO invoice_sequences (year, last_number) VALUES (EXTRACT(YEAR FROM CURRENT_DATE)::int, 1)
+		ON CONFLICT (year) DO UPDATE SET last_number = invoice_sequences.last_number + 1
+		RETURNING year, last_number
+	`).Scan(&year, &seq)
+	if err != nil {
+		return inv, err
+	}
+	inv.Number = billing.InvoiceNumber(year, seq)
+
+	var periodStart, periodEnd interface{}
+	if d.Period != nil {
+		periodStart, periodEnd = d.Period.Start, d.Period.End
+	}
+
+	err = tx.QueryRow(`
+		INSERT INTO invoices (isp_id, plan_id, invoice_number, subtotal, tax_name, tax_rate, tax_amount, amount,
+		                      due_date, period_start, period_end, currency, base_currency, exchange_rate,
+		                      exchange_rate_date)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15) RETURNING id
+	`, d.ISPID, d.PlanID, inv.Number, inv.Subtotal, nullIfEmpty(taxName), taxRate, inv.Tax, inv.Total,
+		d.DueDate, periodStart, periodEnd, inv.Currency, base, rate, rateDate).Scan(&inv.ID)
+	if err != nil {
+		return inv, err
+	}
+
+	for i, l := range d.Lines {
+		_, err := tx.Exec(`
+			INSERT INTO invoice_items (invoice_id, position, description, quantity, unit_price, amount, item_type, plan_id, usage_metric)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		`, inv.ID, i+1, l.Description, l.Quantity, l.UnitPrice, amounts[i], l.ItemType, l.PlanID, l.UsageMetric)
+		if err != nil {
+			return inv, err
+		}
+	}
+
+	if inv.Total <= 0 {
+		// Proration credits can outweigh the charges; there is nothing to
+		// collect, so the invoice must not wait for payment and go overdue.
+		// A negative total is credit for later invoices.
+		_, err = refreshInvoiceStatus(tx, inv.ID)
+		return inv, err
+	}
+	inv.CreditApplied, err = applyAccountCredit(tx, d.ISPID, inv.ID, inv.Total)
+	return inv, err
+}
+
+// taxRateForISP picks the active tax rate for an ISP: its own rate, else its
+// country's, else the default. No configured rate means no tax.
+func taxRateForISP(tx *sql.Tx, ispID int) (string, billing.Rate, error) {
+	var name string
+	var rate billing.Rate
+	err := tx.QueryRow(`
+		SELECT t.name, t.rate_percent
+		FROM tax_rates t
+		JOIN isps i ON i.id = $1
+		WHERE t.is_active
+		  AND (t.isp_id = i.id OR (t.isp_id IS NULL AND (t.country_code = i.country_code OR t.country_code IS NULL)))
+		ORDER BY t.isp_id IS NULL, t.country_code IS NULL
+		LIMIT 1
+	`, ispID).Scan(&name, &rate)
+	if err == sql.ErrNoRows {
+		return "", 0, nil
+	}
+	return name, rate, err
+}
+
+// isUniqueViolation reports whether err is a duplicate key error on the named
+// unique index or constraint
+func isUniqueViolation(err error, constraint string) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == constraint
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+const invoiceSelect = `
+	SELECT inv.id, inv.invoice_number, inv.isp_id, i.name, inv.subtotal, COALESCE(inv.tax_name, ''),
+	       inv.tax_rate, inv.tax_amount, inv.amount, inv.amount_credited, inv.amount_paid, inv.status, inv.due_date,
+	       inv.paid_at, inv.cancelled_at, inv.cancellation_reason, inv.plan_id, inv.period_start, inv.period_end,
+	       inv.currency, inv.base_currency, inv.exchange_rate, inv.exchange_rate_date, inv.created_at
+	FROM invoices inv
+	JOIN isps i ON inv.isp_id = i.id
+`
+
+func scanInvoice(row interface{ Scan(...interface{}) error }, inv *InvoiceResponse) error {
+	err := row.Scan(&inv.ID, &inv.InvoiceNumber, &inv.ISPID, &inv.ISPName, &inv.Subtotal, &inv.TaxName,
+		&inv.TaxRate, &inv.TaxAmount, &inv.Amount, &inv.AmountCredited, &inv.AmountPaid, &inv.Status, &inv.DueDate,
+		&inv.PaidAt, &inv.CancelledAt, &inv.CancellationReason, &inv.PlanID, &inv.PeriodStart, &inv.PeriodEnd,
+		&inv.Currency, &inv.BaseCurrency, &inv.ExchangeRate, &inv.ExchangeRateDate, &inv.CreatedAt)
+	if err == nil {
+		inv.BalanceDue = inv.Amount - inv.AmountCredited - inv.AmountPaid
+	}
+	return err
+}
+
+// findInvoice loads an invoice with its items if it belongs to the caller's
+// tenant
+func (h *Handler) findInvoice(claims *middleware.Claims, id string) (*InvoiceResponse, error) {
+	scope, args := tenantScope(claims, "i", 2)
+	return h.loadInvoice(" WHERE inv.id = $1 AND "+scope, append([]interface{}{id}, args...)...)
+}
+
+// loadInvoice reads the invoice matching where, with its items
+func (h *Handler) loadInvoice(where string, args ...interface{}) (*InvoiceResponse, error) {
+	var inv InvoiceResponse
+	err := scanInvoice(h.db.QueryRow(invoiceSelect+where, args...), &inv)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := h.db.Query(`
+		SELECT id, description, quantity, unit_price, amount, item_type, plan_id, usage_metric
+		FROM invoice_items WHERE invoice_id = $1 ORDER BY position
+	`, inv.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	inv.Items = []InvoiceItemResponse{}
+	for rows.Next() {
+		var it InvoiceItemResponse
+		if err := rows.Scan(&it.ID, &it.Description, &it.Quantity, &it.UnitPrice, &it.Amount,
+			&it.ItemType, &it.PlanID, &it.UsageMetric); err != nil {
+			return nil, err
+		}
+		inv.Items = append(inv.Items, it)
+	}
+	return &inv, rows.Err()
+}
+
+// GetInvoice returns one invoice with its line items
+func (h *Handler) GetInvoice(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+
+	inv, err := h.findInvoice(claims, mux.Vars(r)["id"])
+	if err != nil {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Invoice not found"})
+		return
+	}
+
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Data: inv})
+}
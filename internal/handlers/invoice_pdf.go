@@ -0,0 +1,311 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"isp-saas.com/platform/internal/billing"
+	"isp-saas.com/platform/pkg/pdf"
+)
+
+// invoiceIssuer is who an invoice is from: the ISP's distributor when it has
+// set up branding, otherwise the platform
+type invoiceIssuer struct {
+	Name    string
+	Address string
+	TaxID   string
+	Logo    []byte
+}
+
+// invoiceCustomer is the ISP an invoice is billed to
+type invoiceCustomer struct {
+	Name     string
+	ServerIP string
+	Country  string
+}
+
+func (h *Handler) invoiceIssuer(ispID int) (invoiceIssuer, error) {
+	var from invoiceIssuer
+	var taxID sql.NullString
+	err := h.db.QueryRow(`
+		SELECT b.company_name, b.address, b.tax_id, b.logo
+		FROM isps i
+		JOIN distributor_branding b ON b.distributor_id = i.distributor_id
+		WHERE i.id = $1
+	`, ispID).Scan(&from.Name, &from.Address, &taxID, &from.Logo)
+	if err == sql.ErrNoRows {
+		return invoiceIssuer{
+			Name:    h.getSetting("invoice_company_name", "ISP SaaS Platform"),
+			Address: h.getSetting("invoice_company_address", ""),
+		}, nil
+	}
+	from.TaxID = taxID.String
+	return from, err
+}
+
+// invoiceDocument returns the PDF issued for the invoice in its current
+// status and with its current credits, rendering and storing it the first
+// time it is asked for
+func (h *Handler) invoiceDocument(inv *InvoiceResponse) (doc []byte, sum string, err error) {
+	const stored = "SELECT pdf, sha256 FROM invoice_documents WHERE invoice_id = $1 AND status = $2 AND amount_credited = $3"
+	err = h.db.QueryRow(stored, inv.ID, inv.Status, inv.AmountCredited).Scan(&doc, &sum)
+	if err != sql.ErrNoRows {
+		return doc, sum, err
+	}
+
+	from, err := h.invoiceIssuer(inv.ISPID)
+	if err != nil {
+		return nil, "", err
+	}
+	var to invoiceCustomer
+	err = h.db.QueryRow("SELECT name, host(server_ip), COALESCE(country_code, '') FROM isps WHERE id = $1",
+		inv.ISPID).Scan(&to.Name, &to.ServerIP, &to.Country)
+	if err != nil {
+		return nil, "", err
+	}
+
+	doc, err = renderInvoicePDF(inv, from, to)
+	if err != nil {
+		return nil, "", err
+	}
+	digest := sha256.Sum256(doc)
+
+	// A concurrent request may store its rendering first; both then serve
+	// the one that was kept
+	_, err = h.db.Exec(`
+		INSERT INTO invoice_documents (invoice_id, status, amount_credited, pdf, sha256) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (invoice_id, status, amount_credited) DO NOTHING
+	`, inv.ID, inv.Status, inv.AmountCredited, doc, hex.EncodeToString(digest[:]))
+	if err != nil {
+		return nil, "", err
+	}
+	err = h.db.QueryRow(stored, inv.ID, inv.Status, inv.AmountCredited).Scan(&doc, &sum)
+	return doc, sum, err
+}
+
+// issueInvoiceDocument stores the PDF of a newly created or credited invoice,
+// so the document reflects the issuer's branding at the time of issue. Failures are
+// logged; the document is then rendered on first download instead.
+func (h *Handler) issueInvoiceDocument(invoiceID int) {
+	inv, err := h.loadInvoice(" WHERE inv.id = $1", invoiceID)
+	if err == nil {
+		_, _, err = h.invoiceDocument(inv)
+	}
+	if err != nil {
+		h.logger.Error("Failed to issue invoice PDF", "invoice_id", invoiceID, "error", err)
+	}
+}
+
+// Invoice layout, in points
+const (
+	invMargin    = 50.0
+	invRight     = pdf.PageWidth - invMargin
+	invFooterTop = pdf.PageHeight - 70
+	// Right edges of the item table's numeric columns
+	invQtyRight   = 370.0
+	invPriceRight = 455.0
+	invDescWidth  = 250.0
+)
+
+var (
+	invAccent = pdf.Color{R: 59, G: 130, B: 246}
+	invMuted  = pdf.Color{R: 100, G: 116, B: 139}
+	invRule   = pdf.Color{R: 226, G: 232, B: 240}
+	invShade  = pdf.Color{R: 248, G: 250, B: 252}
+)
+
+var invoiceStatusColors = map[string]pdf.Color{
+	"paid":           {R: 5, G: 150, B: 105},
+	"pending":        {R: 217, G: 119, B: 6},
+	"partially_paid": {R: 37, G: 99, B: 235},
+	"overdue":        {R: 220, G: 38, B: 38},
+	"cancelled":      invMuted,
+}
+
+// renderInvoicePDF lays out an invoice on as many A4 pages as its items need
+func renderInvoicePDF(inv *InvoiceResponse, from invoiceIssuer, to invoiceCustomer) ([]byte, error) {
+	doc := pdf.New()
+	doc.Title = "Invoice " + inv.InvoiceNumber
+	doc.Author = from.Name
+	if created, err := time.Parse(time.RFC3339, inv.CreatedAt); err == nil {
+		doc.Created = created
+	}
+
+	amount := func(m billing.Money) string { return m.String() + " " + inv.Currency }
+	var pages []*pdf.Page
+	page := doc.AddPage()
+	pages = append(pages, page)
+
+	// Issuer, top left
+	y := invMargin
+	if len(from.Logo) > 0 {
+		if logo, err := doc.AddImage(from.Logo); err == nil {
+			w, h := logo.Size()
+			scale := 140 / float64(w)
+			if s := 50 / float64(h); s < scale {
+				scale = s
+			}
+			page.Image(logo, invMargin, y, float64(w)*scale, float64(h)*scale)
+			y += float64(h)*scale + 8
+		}
+	}
+	for i, line := range pdf.Wrap(pdf.HelveticaBold, 14, 260, from.Name) {
+		if i == 0 {
+			y += 14
+		} else {
+			y += 17
+		}
+		page.Text(invMargin, y, pdf.HelveticaBold, 14, pdf.Black, line)
+	}
+	for _, line := range pdf.Wrap(pdf.Helvetica, 9, 260, from.Address) {
+		if line == "" {
+			continue
+		}
+		y += 12
+		page.Text(invMargin, y, pdf.Helvetica, 9, invMuted, line)
+	}
+	if from.TaxID != "" {
+		y += 12
+		page.Text(invMargin, y, pdf.Helvetica, 9, invMuted, "Tax ID: "+from.TaxID)
+	}
+
+	// Invoice number, dates and status, top right
+	ry := invMargin + 22
+	page.TextRight(invRight, ry, pdf.HelveticaBold, 24, invAccent, "INVOICE")
+	ry += 18
+	page.TextRight(invRight, ry, pdf.HelveticaBold, 11, pdf.Black, inv.InvoiceNumber)
+	ry += 15
+	page.TextRight(invRight, ry, pdf.Helvetica, 9, pdf.Black, "Date: "+dateOnly(inv.CreatedAt))
+	ry += 12
+	page.TextRight(invRight, ry, pdf.Helvetica, 9, pdf.Black, "Due: "+dateOnly(inv.DueDate))
+	if inv.PaidAt != nil {
+		ry += 12
+		page.TextRight(invRight, ry, pdf.Helvetica, 9, pdf.Black, "Paid: "+dateOnly(*inv.PaidAt))
+	}
+	status := strings.ToUpper(strings.ReplaceAll(inv.Status, "_", " "))
+	badge := pdf.TextWidth(pdf.HelveticaBold, 9, status) + 16
+	color, ok := invoiceStatusColors[inv.Status]
+	if !ok {
+		color = invMuted
+	}
+	ry += 8
+	page.Rect(invRight-badge, ry, badge, 16, color)
+	page.Text(invRight-badge+8, ry+11, pdf.HelveticaBold, 9, pdf.White, status)
+	ry += 16
+
+	if ry > y {
+		y = ry
+	}
+	y += 16
+	page.Line(invMargin, y, invRight, y, 1.5, invAccent)
+
+	// Customer and service period
+	y += 22
+	page.Text(invMargin, y, pdf.HelveticaBold, 8, invMuted, "BILL TO")
+	if inv.PeriodStart != nil && inv.PeriodEnd != nil {
+		page.Text(330, y, pdf.HelveticaBold, 8, invMuted, "SERVICE PERIOD")
+		page.Text(330, y+16, pdf.Helvetica, 10, pdf.Black, dateOnly(*inv.PeriodStart)+" to "+dateOnly(*inv.PeriodEnd))
+	}
+	y += 16
+	page.Text(invMargin, y, pdf.HelveticaBold, 12, pdf.Black, to.Name)
+	y += 14
+	page.Text(invMargin, y, pdf.Helvetica, 9, invMuted, "Server: "+to.ServerIP)
+	if to.Country != "" {
+		y += 12
+		page.Text(invMargin, y, pdf.Helvetica, 9, invMuted, "Country: "+to.Country)
+	}
+
+	tableHeader := func(p *pdf.Page, y float64) float64 {
+		p.Rect(invMargin, y, invRight-invMargin, 22, invAccent)
+		p.Text(invMargin+8, y+15, pdf.HelveticaBold, 9, pdf.White, "Description")
+		p.TextRight(invQtyRight, y+15, pdf.HelveticaBold, 9, pdf.White, "Qty")
+		p.TextRight(invPriceRight, y+15, pdf.HelveticaBold, 9, pdf.White, "Unit price")
+		p.TextRight(invRight-8, y+15, pdf.HelveticaBold, 9, pdf.White, "Amount")
+		return y + 22
+	}
+	newPage := func() float64 {
+		page = doc.AddPage()
+		pages = append(pages, page)
+		return invMargin
+	}
+
+	// Line items, continued on the next page when they run into the footer
+	y = tableHeader(page, y+28)
+	for _, it := range inv.Items {
+		lines := pdf.Wrap(pdf.Helvetica, 9, invDescWidth, it.Description)
+		height := float64(len(lines))*12 + 10
+		if y+height > invFooterTop {
+			y = newPage()
+			y = tableHeader(page, y)
+		}
+		for i, line := range lines {
+			page.Text(invMargin+8, y+17+float64(i)*12, pdf.Helvetica, 9, pdf.Black, line)
+		}
+		page.TextRight(invQtyRight, y+17, pdf.Helvetica, 9, pdf.Black, it.Quantity.String())
+		page.TextRight(invPriceRight, y+17, pdf.Helvetica, 9, pdf.Black, amount(it.UnitPrice))
+		page.TextRight(invRight-8, y+17, pdf.Helvetica, 9, pdf.Black, amount(it.Amount))
+		y += height
+		page.Line(invMargin, y, invRight, y, 0.5, invRule)
+	}
+
+	// Totals and tax breakdown
+	taxLabel := "Tax"
+	if inv.TaxName != "" {
+		taxLabel = inv.TaxName
+	}
+	totals := [][2]string{
+		{"Subtotal", amount(inv.Subtotal)},
+		{taxLabel + " (" + inv.TaxRate.String() + "%)", amount(inv.TaxAmount)},
+	}
+	// A credited invoice shows the original total and what was given back,
+	// and the amount still owed in place of the total
+	totalLabel, total := "TOTAL", inv.Amount
+	if inv.AmountCredited != 0 {
+		totals = append(totals,
+			[2]string{"Total", amount(inv.Amount)},
+			[2]string{"Credited", "-" + amount(inv.AmountCredited)})
+		totalLabel, total = "NET TOTAL", inv.Amount-inv.AmountCredited
+	}
+	if y+float64(len(totals))*16+70 > invFooterTop {
+		y = newPage()
+	}
+	y += 8
+	for _, t := range totals {
+		y += 16
+		page.TextRight(invPriceRight, y, pdf.Helvetica, 9, pdf.Black, t[0])
+		page.TextRight(invRight-8, y, pdf.Helvetica, 9, pdf.Black, t[1])
+	}
+	y += 10
+	page.Rect(330, y, invRight-330, 26, invShade)
+	page.TextRight(invPriceRight, y+17, pdf.HelveticaBold, 11, pdf.Black, totalLabel)
+	page.TextRight(invRight-8, y+17, pdf.HelveticaBold, 11, pdf.Black, amount(total))
+	y += 26
+
+	if inv.Currency != inv.BaseCurrency && inv.ExchangeRateDate != nil {
+		y += 22
+		page.Text(invMargin, y, pdf.Helvetica, 8, invMuted, "Exchange rate on "+dateOnly(*inv.ExchangeRateDate)+
+			": 1 "+inv.Currency+" = "+inv.ExchangeRate.String()+" "+inv.BaseCurrency)
+	}
+
+	for i, p := range pages {
+		p.Line(invMargin, invFooterTop+20, invRight, invFooterTop+20, 0.5, invRule)
+		p.Text(invMargin, invFooterTop+36, pdf.HelveticaBold, 8, invMuted, "Thank you for your business!")
+		p.Text(invMargin, invFooterTop+48, pdf.Helvetica, 8, invMuted, from.Name+" - "+inv.InvoiceNumber)
+		p.TextRight(invRight, invFooterTop+48, pdf.Helvetica, 8, invMuted,
+			"Page "+strconv.Itoa(i+1)+" of "+strconv.Itoa(len(pages)))
+	}
+
+	return doc.Bytes()
+}
+
+// dateOnly trims a timestamp to its date
+func dateOnly(ts string) string {
+	if len(ts) >= 10 {
+		return ts[:10]
+	}
+	return ts
+}
@@ -1,26 +1,36 @@
 package handlers
 
 import (
+    "database/sql"
     "encoding/json"
+    "errors"
     "net/http"
+    "strconv"
+    "time"
 
     "github.com/gorilla/mux"
     "isp-saas.com/platform/internal/middleware"
+    "isp-saas.com/platform/internal/rbac"
 )
 
 type ISPResponse struct {
-    ID             int     `json:"id"`
-    UserID         *int    `json:"user_id"`
-    Name           string  `json:"name"`
-    ServerIP       string  `json:"server_ip"`
-    HWID           string  `json:"hw_id"`
-    Status         string  `json:"status"`
-    PlanID         *int    `json:"plan_id"`
-    PlanName       *string `json:"plan_name,omitempty"`
-    CacheSizeGB    int     `json:"cache_size_gb"`
-    BandwidthLimit int     `json:"bandwidth_limit_mbps"`
-    LastSeen       *string `json:"last_seen"`
-    CreatedAt      string  `json:"created_at"`
+    ID               int     `json:"id"`
+    UserID           *int    `json:"user_id"`
+    DistributorID    *int    `json:"distributor_id"`
+    Name             string  `json:"name"`
+    ServerIP         string  `json:"server_ip"`
+    HWID             string  `json:"hw_id"`
+    Status           string  `json:"status"`
+    PlanID           *int    `json:"plan_id"`
+    PlanName         *string `json:"plan_name,omitempty"`
+    CacheSizeGB      int     `json:"cache_size_gb"`
+    BandwidthLimit   int     `json:"bandwidth_limit_mbps"`
+    LastSeen         *string `json:"last_seen"`
+    SuspensionReason *string `json:"suspension_reason"`
+    BillingAnchor    *string `json:"billing_anchor"`
+    CountryCode      *string `json:"country_code"`
+    Currency         string  `json:"currency"`
+    CreatedAt        string  `json:"created_at"`
 }
 
 type CreateISPRequest struct {
@@ -30,6 +40,11 @@ type CreateISPRequest struct {
     PlanID         *int   `json:"plan_id"`
     CacheSizeGB    int    `json:"cache_size_gb"`
     BandwidthLimit int    `json:"bandwidth_limit_mbps"`
+    UserID         *int   `json:"user_id"`
+    DistributorID  *int   `json:"distributor_id"`
+    CountryCode    string `json:"country_code"`
+    // Billing currency; defaults to the plan's currency
+    Currency       string `json:"currency"`
 }
 
 type UpdateISPRequest struct {
@@ -39,55 +54,44 @@ type UpdateISPRequest struct {
     CacheSizeGB    int    `json:"cache_size_gb,omitempty"`
     BandwidthLimit int    `json:"bandwidth_limit_mbps,omitempty"`
     Status         string `json:"status,omitempty"`
+    UserID         *int   `json:"user_id,omitempty"`
+    DistributorID  *int   `json:"distributor_id,omitempty"`
+    CountryCode    string `json:"country_code,omitempty"`
+    Currency       string `json:"currency,omitempty"`
+}
+
+const ispSelect = `
+    SELECT i.id, i.user_id, i.distributor_id, i.name, i.server_ip, i.hw_id, i.status, i.plan_id,
+           p.name as plan_name, i.cache_size_gb, i.bandwidth_limit_mbps, i.last_seen, i.suspension_reason, i.billing_anchor, i.country_code, i.currency, i.created_at
+    FROM isps i
+    LEFT JOIN plans p ON i.plan_id = p.id
+`
+
+func scanISP(row interface{ Scan(...interface{}) error }, isp *ISPResponse) error {
+    return row.Scan(&isp.ID, &isp.UserID, &isp.DistributorID, &isp.Name, &isp.ServerIP, &isp.HWID,
+        &isp.Status, &isp.PlanID, &isp.PlanName, &isp.CacheSizeGB, &isp.BandwidthLimit,
+        &isp.LastSeen, &isp.SuspensionReason, &isp.BillingAnchor, &isp.CountryCode, &isp.Currency, &isp.CreatedAt)
 }
 
 func (h *Handler) GetISPs(w http.ResponseWriter, r *http.Request) {
     claims := middleware.GetUserFromContext(r)
-    
-    var rows interface{ Scan(...interface{}) error }
-    var err error
-    var isps []ISPResponse
-
-    query := `
-        SELECT i.id, i.user_id, i.name, i.server_ip, i.hw_id, i.status, i.plan_id, 
-               p.name as plan_name, i.cache_size_gb, i.bandwidth_limit_mbps, i.last_seen, i.created_at 
-        FROM isps i
-        LEFT JOIN plans p ON i.plan_id = p.id
-    `
-
-    if claims.Role == "admin" || claims.Role == "distributor" {
-        rowsResult, e := h.db.Query(query + " ORDER BY i.id")
-        err = e
-        if err == nil {
-            defer rowsResult.Close()
-            for rowsResult.Next() {
-                var isp ISPResponse
-                rowsResult.Scan(&isp.ID, &isp.UserID, &isp.Name, &isp.ServerIP, &isp.HWID, 
-                    &isp.Status, &isp.PlanID, &isp.PlanName, &isp.CacheSizeGB, &isp.BandwidthLimit, 
-                    &isp.LastSeen, &isp.CreatedAt)
-                isps = append(isps, isp)
-            }
-        }
-    } else {
-        rowsResult, e := h.db.Query(query+" WHERE i.user_id = $1 ORDER BY i.id", claims.UserID)
-        err = e
-        if err == nil {
-            defer rowsResult.Close()
-            for rowsResult.Next() {
-                var isp ISPResponse
-                rowsResult.Scan(&isp.ID, &isp.UserID, &isp.Name, &isp.ServerIP, &isp.HWID, 
-                    &isp.Status, &isp.PlanID, &isp.PlanName, &isp.CacheSizeGB, &isp.BandwidthLimit, 
-                    &isp.LastSeen, &isp.CreatedAt)
-                isps = append(isps, isp)
-            }
-        }
-    }
 
-    _ = rows
+    scope, args := tenantScope(claims, "i", 1)
+    rows, err := h.db.Query(ispSelect+" WHERE "+scope+" ORDER BY i.id", args...)
     if err != nil {
         h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
         return
     }
+    defer rows.Close()
+
+    isps := []ISPResponse{}
+    for rows.Next() {
+        var isp ISPResponse
+        if err := scanISP(rows, &isp); err != nil {
+            continue
+        }
+        isps = append(isps, isp)
+    }
 
     h.sendJSON(w, http.StatusOK, Response{Success: true, Data: isps})
 }
@@ -96,17 +100,11 @@ func (h *Handler) GetISP(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     id := vars["id"]
 
-    var isp ISPResponse
-    err := h.db.QueryRow(`
-        SELECT i.id, i.user_id, i.name, i.server_ip, i.hw_id, i.status, i.plan_id,
-               p.name as plan_name, i.cache_size_gb, i.bandwidth_limit_mbps, i.last_seen, i.created_at
-        FROM isps i
-        LEFT JOIN plans p ON i.plan_id = p.id
-        WHERE i.id = $1
-    `, id).Scan(&isp.ID, &isp.UserID, &isp.Name, &isp.ServerIP, &isp.HWID, 
-        &isp.Status, &isp.PlanID, &isp.PlanName, &isp.CacheSizeGB, &isp.BandwidthLimit, 
-        &isp.LastSeen, &isp.CreatedAt)
+    claims := middleware.GetUserFromContext(r)
+    scope, args := tenantScope(claims, "i", 2)
 
+    var isp ISPResponse
+    err := scanISP(h.db.QueryRow(ispSelect+" WHERE i.id = $1 AND "+scope, append([]interface{}{id}, args...)...), &isp)
     if err != nil {
         h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "ISP not found"})
         return
@@ -117,7 +115,7 @@ func (h *Handler) GetISP(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handler) CreateISP(w http.ResponseWriter, r *http.Request) {
     claims := middleware.GetUserFromContext(r)
-    
+
     var req CreateISPRequest
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
         h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
@@ -129,6 +127,42 @@ func (h *Handler) CreateISP(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    countryCode, ok := normalizeCountryCode(req.CountryCode)
+    if !ok {
+        h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "country_code must be a two-letter ISO 3166 code"})
+        return
+    }
+
+    currency, ok := normalizeCurrency(req.Currency)
+    if !ok {
+        h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "currency must be a three-letter ISO 4217 code"})
+        return
+    }
+
+    // Limits not given explicitly come from the plan
+    if req.PlanID != nil {
+        var cacheSize, bandwidth sql.NullInt64
+        var planCurrency string
+        h.db.QueryRow("SELECT cache_size_gb, bandwidth_limit_mbps, currency FROM plans WHERE id = $1", *req.PlanID).Scan(&cacheSize, &bandwidth, &planCurrency)
+        if currency == "" {
+            currency = planCurrency
+        }
+        if req.CacheSizeGB == 0 {
+            req.CacheSizeGB = int(cacheSize.Int64)
+        }
+        if req.BandwidthLimit == 0 {
+            req.BandwidthLimit = int(bandwidth.Int64)
+        }
+    }
+
+    if currency == "" {
+        currency, _ = baseCurrency(h.db)
+    }
+    if msg := h.validateISPCurrency(currency, req.PlanID); msg != "" {
+        h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: msg})
+        return
+    }
+
     if req.CacheSizeGB == 0 {
         req.CacheSizeGB = 10
     }
@@ -136,18 +170,42 @@ func (h *Handler) CreateISP(w http.ResponseWriter, r *http.Request) {
         req.BandwidthLimit = 1000
     }
 
+    // Distributors always create ISPs under themselves; only platform staff
+    // may place an ISP under another distributor
+    if !rbac.Allowed(claims.Role, rbac.TenantAll) {
+        distributorID, ok := h.distributorIDForUser(claims.UserID)
+        if !ok {
+            h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "No distributor profile for this account"})
+            return
+        }
+        req.DistributorID = &distributorID
+    } else if req.DistributorID != nil && !h.distributorExists(*req.DistributorID) {
+        h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Distributor not found"})
+        return
+    }
+
+    if req.UserID != nil && !h.canLinkISPUser(claims, *req.UserID) {
+        h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "user_id must refer to an ISP account in your tenant"})
+        return
+    }
+
     var ispID int
     err := h.db.QueryRow(`
-        INSERT INTO isps (user_id, name, server_ip, hw_id, plan_id, cache_size_gb, bandwidth_limit_mbps) 
-        VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id
-    `, claims.UserID, req.Name, req.ServerIP, req.HWID, req.PlanID, req.CacheSizeGB, req.BandwidthLimit).Scan(&ispID)
+        INSERT INTO isps (user_id, distributor_id, name, server_ip, hw_id, plan_id, cache_size_gb, bandwidth_limit_mbps, country_code, currency)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), $10) RETURNING id
+    `, req.UserID, req.DistributorID, req.Name, req.ServerIP, req.HWID, req.PlanID, req.CacheSizeGB, req.BandwidthLimit, countryCode, currency).Scan(&ispID)
 
     if err != nil {
         h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Failed to create ISP. HWID may already exist."})
         return
     }
 
-    h.logger.Info("ISP created", "isp_id", ispID, "name", req.Name, "by", claims.UserID)
+    if _, err := h.db.Exec("INSERT INTO isp_hwid_history (isp_id, hw_id) VALUES ($1, $2)", ispID, req.HWID); err != nil {
+        h.logger.Error("Failed to record HWID history", "isp_id", ispID, "error", err)
+    }
+
+    h.audit(r, "isp.create", "isp", ispID, nil, h.auditSnapshot("isps", ispID))
+    h.logger.Info("ISP created", "isp_id", ispID, "name", req.Name, "distributor_id", req.DistributorID, "by", claims.UserID)
     h.sendJSON(w, http.StatusCreated, Response{
         Success: true,
         Message: "ISP created successfully",
@@ -159,27 +217,101 @@ func (h *Handler) UpdateISP(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     id := vars["id"]
 
+    claims := middleware.GetUserFromContext(r)
+    if !h.canAccessISP(claims, id) {
+        h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "ISP not found"})
+        return
+    }
+
     var req UpdateISPRequest
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
         h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
         return
     }
 
+    if req.DistributorID != nil {
+        if !rbac.Allowed(claims.Role, rbac.TenantAll) {
+            h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Only administrators can move an ISP to another distributor"})
+            return
+        }
+        if !h.distributorExists(*req.DistributorID) {
+            h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Distributor not found"})
+            return
+        }
+    }
+
+    if req.UserID != nil && !h.canLinkISPUser(claims, *req.UserID) {
+        h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "user_id must refer to an ISP account in your tenant"})
+        return
+    }
+
+    countryCode, ok := normalizeCountryCode(req.CountryCode)
+    if !ok {
+        h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "country_code must be a two-letter ISO 3166 code"})
+        return
+    }
+
+    currency, ok := normalizeCurrency(req.Currency)
+    if !ok {
+        h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "currency must be a three-letter ISO 4217 code"})
+        return
+    }
+
+    ispID, _ := strconv.Atoi(id)
+    before := h.auditSnapshot("isps", id)
+
+    // The currency switches before a plan change in the same request, so the
+    // change is prorated in the new currency
+    if currency != "" {
+        planID := req.PlanID
+        if planID == nil {
+            h.db.QueryRow("SELECT plan_id FROM isps WHERE id = $1", ispID).Scan(&planID)
+        }
+        if msg := h.validateISPCurrency(currency, planID); msg != "" {
+            h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: msg})
+            return
+        }
+        err := h.setISPCurrency(ispID, currency)
+        if errors.Is(err, errPendingItems) {
+            h.sendJSON(w, http.StatusConflict, Response{Success: false, Error: "ISP has charges waiting for its next invoice in its current currency"})
+            return
+        }
+        if err != nil {
+            h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to update ISP"})
+            return
+        }
+    }
+
+    // A plan change is prorated and takes over the plan's limits; limits
+    // given in the same request still win
+    if req.PlanID != nil {
+        _, err := h.changePlan(ispID, *req.PlanID, false, claims.UserID, time.Now())
+        if err != nil && !errors.Is(err, errSamePlan) && h.sendPlanChangeError(w, err) {
+            return
+        }
+    }
+
     _, err := h.db.Exec(`
         UPDATE isps SET 
             name = COALESCE(NULLIF($1, ''), name),
             server_ip = COALESCE(NULLIF($2, ''), server_ip),
             cache_size_gb = CASE WHEN $3 > 0 THEN $3 ELSE cache_size_gb END,
             bandwidth_limit_mbps = CASE WHEN $4 > 0 THEN $4 ELSE bandwidth_limit_mbps END,
+            user_id = COALESCE($5, user_id),
+            distributor_id = COALESCE($6, distributor_id),
+            country_code = COALESCE(NULLIF($7, ''), country_code),
             updated_at = NOW()
-        WHERE id = $5
-    `, req.Name, req.ServerIP, req.CacheSizeGB, req.BandwidthLimit, id)
+        WHERE id = $8
+    `, req.Name, req.ServerIP, req.CacheSizeGB, req.BandwidthLimit, req.UserID, req.DistributorID, countryCode, id)
 
     if err != nil {
         h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to update ISP"})
         return
     }
 
+    h.audit(r, "isp.update", "isp", id, before, h.auditSnapshot("isps", id))
+    h.forgetValidations(h.licenseCacheKeys("l.isp_id = $1", id))
+
     h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "ISP updated successfully"})
 }
 
@@ -188,17 +320,17 @@ func (h *Handler) SuspendISP(w http.ResponseWriter, r *http.Request) {
     id := vars["id"]
 
     claims := middleware.GetUserFromContext(r)
-    if claims.Role != "admin" {
-        h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Admin access required"})
-        return
-    }
+    before := h.auditSnapshot("isps", id)
 
-    _, err := h.db.Exec("UPDATE isps SET status = 'suspended', updated_at = NOW() WHERE id = $1", id)
+    _, err := h.db.Exec("UPDATE isps SET status = 'suspended', suspension_reason = 'manual', updated_at = NOW() WHERE id = $1", id)
     if err != nil {
         h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to suspend ISP"})
         return
     }
 
+    h.audit(r, "isp.suspend", "isp", id, before, h.auditSnapshot("isps", id))
+    h.forgetValidations(h.licenseCacheKeys("l.isp_id = $1", id))
+
     h.logger.Info("ISP suspended", "isp_id", id, "by", claims.UserID)
     h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "ISP suspended successfully"})
 }
@@ -208,17 +340,16 @@ func (h *Handler) ActivateISP(w http.ResponseWriter, r *http.Request) {
     id := vars["id"]
 
     claims := middleware.GetUserFromContext(r)
-    if claims.Role != "admin" {
-        h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Admin access required"})
-        return
-    }
+    before := h.auditSnapshot("isps", id)
 
-    _, err := h.db.Exec("UPDATE isps SET status = 'active', updated_at = NOW() WHERE id = $1", id)
+    _, err := h.db.Exec("UPDATE isps SET status = 'active', suspension_reason = NULL, updated_at = NOW() WHERE id = $1", id)
     if err != nil {
         h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to activate ISP"})
         return
     }
 
+    h.audit(r, "isp.activate", "isp", id, before, h.auditSnapshot("isps", id))
+
     h.logger.Info("ISP activated", "isp_id", id, "by", claims.UserID)
     h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "ISP activated successfully"})
 }
@@ -228,17 +359,39 @@ func (h *Handler) DeleteISP(w http.ResponseWriter, r *http.Request) {
     id := vars["id"]
 
     claims := middleware.GetUserFromContext(r)
-    if claims.Role != "admin" {
-        h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Admin access required"})
-        return
-    }
+    before := h.auditSnapshot("isps", id)
+    // The licenses go with the ISP, so their keys are looked up first
+    cacheKeys := h.licenseCacheKeys("l.isp_id = $1", id)
 
     _, err := h.db.Exec("DELETE FROM isps WHERE id = $1", id)
     if err != nil {
         h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to delete ISP"})
         return
     }
+    h.forgetValidations(cacheKeys)
 
+    h.audit(r, "isp.delete", "isp", id, before, nil)
     h.logger.Info("ISP deleted", "isp_id", id, "by", claims.UserID)
     h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "ISP deleted successfully"})
 }
+
+func (h *Handler) distributorExists(id int) bool {
+    var exists bool
+    h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM distributors WHERE id = $1)", id).Scan(&exists)
+    return exists
+}
+
+// canLinkISPUser reports whether userID is an ISP account the caller may link
+// an ISP to. Outside platform staff the account must not yet own an ISP in
+// another tenant, or linking it would let a distributor take over (or hand
+// its ISP to) another distributor's customer.
+func (h *Handler) canLinkISPUser(claims *middleware.Claims, userID int) bool {
+    scope, args := tenantScope(claims, "i", 3)
+
+    var ok bool
+    err := h.db.QueryRow(`
+        SELECT EXISTS(SELECT 1 FROM users WHERE id = $1 AND role = $2)
+           AND NOT EXISTS(SELECT 1 FROM isps i WHERE i.user_id = $1 AND NOT COALESCE(`+scope+`, FALSE))
+    `, append([]interface{}{userID, rbac.RoleISP}, args...)...).Scan(&ok)
+    return err == nil && ok
+}
@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"isp-saas.com/platform/internal/middleware"
+	"isp-saas.com/platform/internal/scheduler"
+)
+
+// SetScheduler gives the handlers access to the scheduler behind /api/jobs
+func (h *Handler) SetScheduler(s *scheduler.Scheduler) {
+	h.scheduler = s
+}
+
+// Jobs defines the periodic work of the platform. Schedules are in UTC.
+func (h *Handler) Jobs() []scheduler.Job {
+	return []scheduler.Job{
+		{
+			Name:        "billing-cycle",
+			Description: "Generate recurring invoices for billing cycles that have started",
+			Schedule:    "0 1 * * *",
+			Run:         h.billingCycleJob,
+		},
+		{
+			Name:        "usage-metering",
+			Description: "Meter usage of completed billing periods and queue overage charges",
+			Schedule:    "30 0 * * *",
+			Run:         h.usageMeteringJob,
+		},
+		{
+			Name:        "commission-statements",
+			Description: "Put last month's distributor commission on payout statements",
+			Schedule:    "0 2 1 * *",
+			Run:         h.commissionStatementsJob,
+		},
+		{
+			Name:        "dunning",
+			Description: "Mark overdue invoices, send payment reminders and suspend for non-payment",
+			Schedule:    "0 * * * *",
+			Run:         h.dunningJob,
+		},
+		{
+			Name:        "license-expiry",
+			Description: "Warn ISPs about licenses expiring within license_expiry_warning_days",
+			Schedule:    "0 8 * * *",
+			Run:         h.licenseExpiryJob,
+		},
+		{
+			Name:        "log-cleanup",
+			Description: "Delete system logs and job run history past their retention",
+			Schedule:    "30 3 * * *",
+			Run:         h.logCleanupJob,
+		},
+		{
+			Name:        "telemetry-retention",
+			Description: "Delete telemetry older than telemetry_retention_days",
+			Schedule:    "0 4 * * *",
+			Run:         h.telemetryRetentionJob,
+		},
+		{
+			Name:        "license-validation-retention",
+			Description: "Delete license validation attempts older than license_validation_retention_days",
+			Schedule:    "15 4 * * *",
+			Run:         h.licenseValidationRetentionJob,
+		},
+	}
+}
+
+func (h *Handler) billingCycleJob(ctx context.Context) (interface{}, error) {
+	results, err := h.RunBillingCycle()
+	for _, result := range results {
+		for _, id := range result.InvoiceIDs {
+			h.auditAs(nil, nil, "invoice.generate", "invoice", id, nil, h.auditSnapshot("invoices", id))
+		}
+	}
+	return results, err
+}
+
+func (h *Handler) usageMeteringJob(ctx context.Context) (interface{}, error) {
+	return h.RunUsageMetering(time.Now())
+}
+
+func (h *Handler) commissionStatementsJob(ctx context.Context) (interface{}, error) {
+	result, err := h.RunCommissionStatements(time.Now())
+	for _, id := range result.PayoutIDs {
+		h.auditAs(nil, nil, "commission_payout.create", "commission_payout", id, nil,
+			h.auditSnapshot("commission_payouts", id))
+	}
+	return result, err
+}
+
+func (h *Handler) dunningJob(ctx context.Context) (interface{}, error) {
+	result, err := h.RunDunning(time.Now())
+	if err != nil {
+		return result, err
+	}
+	h.auditDunning(nil, result)
+	return result, nil
+}
+
+// licenseExpiryJob warns the people responsible for an ISP once when one of
+// its active licenses is about to expire
+func (h *Handler) licenseExpiryJob(ctx context.Context) (interface{}, error) {
+	days := h.getSettingInt("license_expiry_warning_days", 14)
+
+	rows, err := h.db.QueryContext(ctx, `
+		UPDATE licenses SET expiry_notified_at = NOW()
+		WHERE is_active = true AND expiry_notified_at IS NULL
+		  AND expires_at > NOW() AND expires_at <= NOW() + INTERVAL '1 day' * $1
+		RETURNING id, isp_id, license_key, expires_at
+	`, days)
+	if err != nil {
+		return nil, err
+	}
+
+	type expiring struct {
+		id, ispID int
+		key       string
+		expiresAt time.Time
+	}
+	var licenses []expiring
+	for rows.Next() {
+		var l expiring
+		if err := rows.Scan(&l.id, &l.ispID, &l.key, &l.expiresAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		licenses = append(licenses, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, l := range licenses {
+		h.notifyISP(l.ispID, notifyWarning, "License expires on "+l.expiresAt.Format("2006-01-02"),
+			fmt.Sprintf("License %s expires on %s. Renew it before then to keep the cache running.\n",
+				l.key, l.expiresAt.Format("2006-01-02")))
+	}
+	return map[string]int{"warned": len(licenses)}, nil
+}
+
+func (h *Handler) logCleanupJob(ctx context.Context) (interface{}, error) {
+	logs, err := h.deleteOldLogs()
+	if err != nil {
+		return nil, err
+	}
+	h.auditAs(nil, nil, "system_log.cleanup", "system_log", nil, nil, map[string]int64{"deleted": logs})
+
+	result, err := h.db.ExecContext(ctx, `
+		DELETE FROM job_runs WHERE status <> 'running' AND started_at < NOW() - INTERVAL '1 day' * $1
+	`, h.getSettingInt("job_run_retention_days", 90))
+	if err != nil {
+		return nil, err
+	}
+	runs, _ := result.RowsAffected()
+
+	return map[string]int64{"logs_deleted": logs, "job_runs_deleted": runs}, nil
+}
+
+func (h *Handler) telemetryRetentionJob(ctx context.Context) (interface{}, error) {
+	days := h.getSettingInt("telemetry_retention_days", 90)
+	result, err := h.db.ExecContext(ctx, `
+		DELETE FROM telemetry WHERE created_at < NOW() - INTERVAL '1 day' * $1
+	`, days)
+	if err != nil {
+		return nil, err
+	}
+	deleted, _ := result.RowsAffected()
+	return map[string]int64{"deleted": deleted}, nil
+}
+
+func (h *Handler) licenseValidationRetentionJob(ctx context.Context) (interface{}, error) {
+	days := h.getSettingInt("license_validation_retention_days", 90)
+	result, err := h.db.ExecContext(ctx, `
+		DELETE FROM license_validations WHERE created_at < NOW() - INTERVAL '1 day' * $1
+	`, days)
+	if err != nil {
+		return nil, err
+	}
+	deleted, _ := result.RowsAffected()
+	return map[string]int64{"deleted": deleted}, nil
+}
+
+// GetJobs lists the scheduled jobs with their next and last runs
+func (h *Handler) GetJobs(w http.ResponseWriter, r *http.Request) {
+	if h.scheduler == nil {
+		h.sendJSON(w, http.StatusServiceUnavailable, Response{Success: false, Error: "Scheduler is not running"})
+		return
+	}
+
+	jobs, err := h.scheduler.Jobs()
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Data: jobs})
+}
+
+// GetJobRuns returns a job's run history, newest first. ?limit caps it
+// (default 50, at most 500).
+func (h *Handler) GetJobRuns(w http.ResponseWriter, r *http.Request) {
+	if h.scheduler == nil {
+		h.sendJSON(w, http.StatusServiceUnavailable, Response{Success: false, Error: "Scheduler is not running"})
+		return
+	}
+
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "limit must be between 1 and 500"})
+			return
+		}
+		limit = n
+	}
+
+	runs, err := h.scheduler.Runs(mux.Vars(r)["name"], limit)
+	if errors.Is(err, scheduler.ErrUnknownJob) {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Job not found"})
+		return
+	}
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Data: runs})
+}
+
+// TriggerJob starts a job immediately. The job runs in the background; its
+// outcome shows up in the run history.
+func (h *Handler) TriggerJob(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+	if h.scheduler == nil {
+		h.sendJSON(w, http.StatusServiceUnavailable, Response{Success: false, Error: "Scheduler is not running"})
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	run, err := h.scheduler.Trigger(name, claims.UserID)
+	switch {
+	case errors.Is(err, scheduler.ErrUnknownJob):
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Job not found"})
+		return
+	case errors.Is(err, scheduler.ErrJobRunning):
+		h.sendJSON(w, http.StatusConflict, Response{Success: false, Error: "Job is already running"})
+		return
+	case err != nil:
+		h.logger.Error("Failed to trigger job", "job", name, "error", err)
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to start job"})
+		return
+	}
+
+	h.audit(r, "job.run", "job_run", run.ID, nil, run)
+	h.logger.Info("Job triggered", "job", name, "run_id", run.ID, "by", claims.UserID)
+	h.sendJSON(w, http.StatusAccepted, Response{Success: true, Message: "Job started", Data: run})
+}
@@ -0,0 +1,274 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Module keys are what licenses and agents carry, so they stay short and
+// machine-friendly
+var moduleKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{1,49}$`)
+
+type LicenseModuleResponse struct {
+	Key         string `json:"key"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	IsActive    bool   `json:"is_active"`
+}
+
+type LicenseModuleRequest struct {
+	Key         string `json:"key"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Defaults to true on creation. An inactive module is dropped from every
+	// license it was granted on when the license is next signed.
+	IsActive *bool `json:"is_active"`
+}
+
+type PlanModulesRequest struct {
+	Modules []string `json:"modules"`
+}
+
+// GetLicenseModules lists the module catalogue
+func (h *Handler) GetLicenseModules(w http.ResponseWriter, r *http.Request) {
+	rows, err := h.db.Query(`
+		SELECT key, name, COALESCE(description, ''), is_active FROM license_modules ORDER BY key
+	`)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	modules := []LicenseModuleResponse{}
+	for rows.Next() {
+		var m LicenseModuleResponse
+		if err := rows.Scan(&m.Key, &m.Name, &m.Description, &m.IsActive); err != nil {
+			continue
+		}
+		modules = append(modules, m)
+	}
+
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Data: modules})
+}
+
+// CreateLicenseModule adds a module to the catalogue. No plan includes it
+// until it is added to the plan's modules.
+func (h *Handler) CreateLicenseModule(w http.ResponseWriter, r *http.Request) {
+	var req LicenseModuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
+		return
+	}
+	if !moduleKeyPattern.MatchString(req.Key) {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "key must be 2 to 50 lowercase letters, digits or underscores, starting with a letter"})
+		return
+	}
+	if msg := validateLicenseModule(&req); msg != "" {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: msg})
+		return
+	}
+	isActive := req.IsActive == nil || *req.IsActive
+
+	_, err := h.db.Exec(`
+		INSERT INTO license_modules (key, name, description, is_active) VALUES ($1, $2, $3, $4)
+	`, req.Key, req.Name, nullIfEmpty(req.Description), isActive)
+	if isUniqueViolation(err, "license_modules_pkey") {
+		h.sendJSON(w, http.StatusConflict, Response{Success: false, Error: "Module already exists"})
+		return
+	}
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to create module"})
+		return
+	}
+
+	m := LicenseModuleResponse{Key: req.Key, Name: req.Name, Description: req.Description, IsActive: isActive}
+	h.audit(r, "license_module.create", "license_module", req.Key, nil, m)
+	h.sendJSON(w, http.StatusCreated, Response{Success: true, Message: "Module created successfully", Data: m})
+}
+
+// UpdateLicenseModule renames, describes, retires or reinstates a module. The
+// key cannot change since licenses carry it.
+func (h *Handler) UpdateLicenseModule(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+
+	var req LicenseModuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
+		return
+	}
+	if msg := validateLicenseModule(&req); msg != "" {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: msg})
+		return
+	}
+
+	var before LicenseModuleResponse
+	err := h.db.QueryRow(`
+		SELECT key, name, COALESCE(description, ''), is_active FROM license_modules WHERE key = $1
+	`, key).Scan(&before.Key, &before.Name, &before.Description, &before.IsActive)
+	if err == sql.ErrNoRows {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Module not found"})
+		return
+	}
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+
+	after := LicenseModuleResponse{Key: key, Name: req.Name, Description: req.Description, IsActive: before.IsActive}
+	if req.IsActive != nil {
+		after.IsActive = *req.IsActive
+	}
+	if _, err := h.db.Exec(`
+		UPDATE license_modules SET name = $2, description = $3, is_active = $4 WHERE key = $1
+	`, key, after.Name, nullIfEmpty(after.Description), after.IsActive); err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to update module"})
+		return
+	}
+
+	h.audit(r, "license_module.update", "license_module", key, before, after)
+	h.forgetValidations(h.licenseCacheKeys("l.modules ? $1", key))
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Module updated successfully", Data: after})
+}
+
+func validateLicenseModule(req *LicenseModuleRequest) string {
+	req.Name = strings.TrimSpace(req.Name)
+	req.Description = strings.TrimSpace(req.Description)
+	if req.Name == "" || len(req.Name) > 100 {
+		return "name is required and at most 100 characters"
+	}
+	if len(req.Description) > 1000 {
+		return "description is at most 1000 characters"
+	}
+	return ""
+}
+
+// SetPlanModules replaces the modules a plan entitles its ISPs to. The
+// licenses of ISPs already on the plan follow, as they do when an ISP changes
+// plan.
+func (h *Handler) SetPlanModules(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var req PlanModulesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
+		return
+	}
+	modules := uniqueModules(req.Modules)
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var planID int
+	var before []byte
+	err = tx.QueryRow(`
+		SELECT p.id, COALESCE((SELECT jsonb_agg(pm.module_key ORDER BY pm.module_key) FROM plan_modules pm WHERE pm.plan_id = p.id), '[]')
+		FROM plans p WHERE p.id = $1 FOR UPDATE
+	`, id).Scan(&planID, &before)
+	if err == sql.ErrNoRows {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Plan not found"})
+		return
+	}
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+
+	for _, m := range modules {
+		var active bool
+		if err := tx.QueryRow("SELECT is_active FROM license_modules WHERE key = $1", m).Scan(&active); err != nil || !active {
+			h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Unknown or inactive module: " + m})
+			return
+		}
+	}
+
+	_, err = tx.Exec("DELETE FROM plan_modules WHERE plan_id = $1", planID)
+	for _, m := range modules {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec("INSERT INTO plan_modules (plan_id, module_key) VALUES ($1, $2)", planID, m)
+	}
+	if err == nil {
+		_, err = tx.Exec(licenseModulesFromPlan+"l.isp_id IN (SELECT id FROM isps WHERE plan_id = $1)", planID, string(before))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		h.logger.Error("Failed to set plan modules", "plan_id", planID, "error", err)
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to update plan"})
+		return
+	}
+
+	h.forgetValidations(h.licenseCacheKeys("l.isp_id IN (SELECT id FROM isps WHERE plan_id = $1)", planID))
+
+	var previous []string
+	json.Unmarshal(before, &previous)
+	h.audit(r, "plan.modules_update", "plan", planID,
+		map[string]interface{}{"modules": previous}, map[string]interface{}{"modules": modules})
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Plan modules updated", Data: map[string]interface{}{"modules": modules}})
+}
+
+// licenseModulesFromPlan moves active licenses onto the modules of plan $1,
+// given the modules of the plan they were on before as the JSON array $2.
+// Modules new to the licenses' plan are granted and modules it lacks taken
+// away; a module both plans include keeps its state, so one left out of a
+// license when it was created stays out. The statement is completed with the
+// condition choosing the licenses.
+const licenseModulesFromPlan = `
+	UPDATE licenses l SET modules = (
+		SELECT COALESCE(jsonb_agg(pm.module_key ORDER BY pm.module_key), '[]'::jsonb)
+		FROM plan_modules pm
+		WHERE pm.plan_id = $1 AND (l.modules ? pm.module_key OR NOT ($2::jsonb ? pm.module_key))
+	), updated_at = NOW()
+	WHERE l.is_active = true AND `
+
+// ispModules returns the modules an ISP is entitled to, sorted, and the name
+// of its plan. An ISP without a plan may hold any active module.
+func ispModules(q queryRower, ispID int) (string, []string, error) {
+	var planName string
+	var modulesJSON []byte
+	err := q.QueryRow(`
+		SELECT COALESCE(p.name, ''), COALESCE((
+			SELECT jsonb_agg(m.key ORDER BY m.key) FROM license_modules m
+			WHERE m.is_active AND (i.plan_id IS NULL OR EXISTS (
+				SELECT 1 FROM plan_modules pm WHERE pm.plan_id = i.plan_id AND pm.module_key = m.key
+			))
+		), '[]')
+		FROM isps i
+		LEFT JOIN plans p ON i.plan_id = p.id
+		WHERE i.id = $1
+	`, ispID).Scan(&planName, &modulesJSON)
+	if err != nil {
+		return "", nil, err
+	}
+	modules := []string{}
+	json.Unmarshal(modulesJSON, &modules)
+	return planName, modules, nil
+}
+
+// uniqueModules trims, de-duplicates and sorts module keys
+func uniqueModules(keys []string) []string {
+	seen := make(map[string]bool, len(keys))
+	modules := []string{}
+	for _, k := range keys {
+		k = strings.TrimSpace(k)
+		if k != "" && !seen[k] {
+			seen[k] = true
+			modules = append(modules, k)
+		}
+	}
+	sort.Strings(modules)
+	return modules
+}
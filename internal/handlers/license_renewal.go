@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"isp-saas.com/platform/internal/middleware"
+)
+
+// License states. A license in grace has expired but still validates until
+// license_grace_days have passed.
+const (
+	licenseActive  = "active"
+	licenseGrace   = "grace"
+	licenseExpired = "expired"
+	licenseRevoked = "revoked"
+)
+
+// defaultLicenseDays is the term of a new or renewed license when the
+// request does not give one
+const defaultLicenseDays = 30
+
+type RenewLicenseRequest struct {
+	DaysValid int `json:"days_valid"`
+}
+
+type ExtendLicenseRequest struct {
+	Days int `json:"days"`
+}
+
+// licenseGrace is how long an expired license keeps validating
+func (h *Handler) licenseGrace() time.Duration {
+	days := h.getSettingInt("license_grace_days", 7)
+	if days < 0 {
+		days = 0
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// licenseState derives a license's status at now and the whole days left
+// in it: until expiry while active, until the grace period ends while in
+// grace
+func licenseState(isActive bool, expiresAt time.Time, grace time.Duration, now time.Time) (string, int) {
+	daysUntil := func(t time.Time) int { return int(math.Ceil(t.Sub(now).Hours() / 24)) }
+	switch {
+	case !isActive:
+		return licenseRevoked, 0
+	case now.Before(expiresAt):
+		return licenseActive, daysUntil(expiresAt)
+	case now.Before(expiresAt.Add(grace)):
+		return licenseGrace, daysUntil(expiresAt.Add(grace))
+	}
+	return licenseExpired, 0
+}
+
+func (l *LicenseResponse) setState(grace time.Duration, now time.Time) {
+	l.Status, l.DaysRemaining = licenseState(l.IsActive, l.ExpiresAt, grace, now)
+	l.GraceEndsAt = l.ExpiresAt.Add(grace)
+}
+
+// RenewLicense starts a new term of days_valid days under the same key. The
+// term follows on from the current one, or starts now if the license has
+// already expired.
+func (h *Handler) RenewLicense(w http.ResponseWriter, r *http.Request) {
+	var req RenewLicenseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
+		return
+	}
+	if req.DaysValid == 0 {
+		req.DaysValid = defaultLicenseDays
+	}
+	if req.DaysValid < 0 || req.DaysValid > 3660 {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "days_valid must be between 1 and 3660"})
+		return
+	}
+
+	h.changeLicenseExpiry(w, r, "license.renew", "License renewed",
+		"GREATEST(expires_at, NOW()) + INTERVAL '1 day' * $2", req.DaysValid)
+}
+
+// ExtendLicense adds days to the license's current expiry, for example to
+// bridge a late payment. Unlike renewing, the days count from the expiry even
+// when it has passed.
+func (h *Handler) ExtendLicense(w http.ResponseWriter, r *http.Request) {
+	var req ExtendLicenseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
+		return
+	}
+	if req.Days <= 0 || req.Days > 3660 {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "days must be between 1 and 3660"})
+		return
+	}
+
+	h.changeLicenseExpiry(w, r, "license.extend", "License extended",
+		"expires_at + INTERVAL '1 day' * $2", req.Days)
+}
+
+// changeLicenseExpiry sets the expiry of the license in the route to expr,
+// which reads the number of days as $2, and signs the license again. The key
+// stays the same. Revoked licenses are not changed.
+func (h *Handler) changeLicenseExpiry(w http.ResponseWriter, r *http.Request, action, message, expr string, days int) {
+	id := mux.Vars(r)["id"]
+	claims := middleware.GetUserFromContext(r)
+	before := h.auditSnapshot("licenses", id)
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var licenseID int
+	var isActive bool
+	err = tx.QueryRow("SELECT id, is_active FROM licenses WHERE id = $1 FOR UPDATE", id).Scan(&licenseID, &isActive)
+	if err == sql.ErrNoRows {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "License not found"})
+		return
+	}
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	if !isActive {
+		h.sendJSON(w, http.StatusConflict, Response{Success: false, Error: "License is revoked"})
+		return
+	}
+
+	// The expiry warning is sent again before the new expiry
+	var expiresAt time.Time
+	err = tx.QueryRow(`
+		UPDATE licenses SET expires_at = `+expr+`, expiry_notified_at = NULL, updated_at = NOW()
+		WHERE id = $1 RETURNING expires_at
+	`, licenseID, days).Scan(&expiresAt)
+	if err == nil {
+		_, _, err = h.licenseToken(tx, licenseID, "")
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		h.logger.Error("Failed to change license expiry", "license_id", licenseID, "error", err)
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to update license"})
+		return
+	}
+
+	h.audit(r, action, "license", licenseID, before, h.auditSnapshot("licenses", licenseID))
+	h.forgetValidations(h.licenseCacheKeys("l.id = $1", licenseID))
+	h.logger.Info(message, "license_id", licenseID, "expires_at", expiresAt, "by", claims.UserID)
+	h.sendJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: message,
+		Data: map[string]interface{}{
+			"id":         licenseID,
+			"expires_at": expiresAt.Format(time.RFC3339),
+		},
+	})
+}
+
+// renewLicensesForInvoice renews the active licenses of a paid invoice's ISP.
+// A billing cycle's invoice keeps them valid through the cycle and until the
+// next cycle's invoice falls due, which is as long after that cycle starts as
+// this one's was. Invoices without a cycle renew nothing. Returns the ids of
+// the licenses renewed.
+func renewLicensesForInvoice(tx *sql.Tx, invoiceID int) ([]int, error) {
+	rows, err := tx.Query(`
+		UPDATE licenses l SET
+			expires_at = (inv.period_end + 1 + (inv.due_date - inv.period_start))::timestamp,
+			expiry_notified_at = NULL,
+			updated_at = NOW()
+		FROM invoices inv
+		WHERE inv.id = $1 AND inv.period_end IS NOT NULL
+		  AND l.isp_id = inv.isp_id AND l.is_active = true
+		  AND l.expires_at < (inv.period_end + 1 + (inv.due_date - inv.period_start))::timestamp
+		RETURNING l.id
+	`, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// auditLicenseRenewals records licenses renewed by a payment and drops their
+// cached validations
+func (h *Handler) auditLicenseRenewals(r *http.Request, actorID interface{}, invoiceID int, ids []int) {
+	for _, id := range ids {
+		h.auditAs(r, actorID, "license.renew", "license", id, nil, h.auditSnapshot("licenses", id))
+	}
+	if len(ids) > 0 {
+		h.forgetValidations(h.licenseCacheKeys("l.id = ANY($1)", pq.Array(ids)))
+		h.logger.Info("Licenses renewed by payment", "invoice_id", invoiceID, "licenses", len(ids))
+	}
+}
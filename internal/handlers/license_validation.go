@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"isp-saas.com/platform/internal/middleware"
+	"isp-saas.com/platform/pkg/license"
+)
+
+// Outcomes of a validation attempt. The first two are successes.
+const (
+	validationValid           = "valid"
+	validationGrace           = "grace"
+	validationInvalidRequest  = "invalid_request"
+	validationUnknownLicense  = "unknown_license"
+	validationHWIDMismatch    = "hwid_mismatch"
+	validationHWIDTransferred = "hwid_transferred"
+	validationRevoked         = "revoked"
+	validationExpired         = "expired"
+	validationISPSuspended    = "isp_suspended"
+	validationError           = "error"
+)
+
+const validationCachePrefix = "license:validation:"
+
+// licenseValidation is a successful validation, as kept in the cache. The
+// status is worked out from the dates whenever it is answered, so a cached
+// license still moves into its grace period on time.
+type licenseValidation struct {
+	LicenseID   int            `json:"license_id"`
+	ISPID       int            `json:"isp_id"`
+	HWID        string         `json:"hw_id"`
+	ExpiresAt   time.Time      `json:"expires_at"`
+	GraceEndsAt time.Time      `json:"grace_ends_at"`
+	Modules     []string       `json:"modules"`
+	Limits      license.Limits `json:"limits"`
+	Token       string         `json:"license"`
+	KeyID       string         `json:"key_id"`
+}
+
+type LicenseValidationResponse struct {
+	ID        int64   `json:"id"`
+	HWID      *string `json:"hw_id"`
+	SourceIP  *string `json:"source_ip"`
+	Success   bool    `json:"success"`
+	Reason    string  `json:"reason"`
+	Cached    bool    `json:"cached"`
+	CreatedAt string  `json:"created_at"`
+}
+
+// LicenseValidationSource is one server, by address and hardware ID, that
+// validated a license
+type LicenseValidationSource struct {
+	SourceIP  *string `json:"source_ip"`
+	HWID      *string `json:"hw_id"`
+	Attempts  int     `json:"attempts"`
+	Failures  int     `json:"failures"`
+	FirstSeen string  `json:"first_seen"`
+	LastSeen  string  `json:"last_seen"`
+}
+
+type LicenseValidationSummary struct {
+	Attempts      int `json:"attempts"`
+	Failures      int `json:"failures"`
+	DistinctIPs   int `json:"distinct_ips"`
+	DistinctHWIDs int `json:"distinct_hw_ids"`
+	// More than one here means several servers are using the license at
+	// the same time
+	DistinctIPsLastHour int `json:"distinct_ips_last_hour"`
+}
+
+// result is the status of the validation at now and the data to answer it
+// with
+func (v *licenseValidation) result(now time.Time) (string, map[string]interface{}) {
+	status, daysRemaining := licenseState(true, v.ExpiresAt, v.GraceEndsAt.Sub(v.ExpiresAt), now)
+	return status, map[string]interface{}{
+		"isp_id":         v.ISPID,
+		"expires_at":     v.ExpiresAt.Format(time.RFC3339),
+		"grace_ends_at":  v.GraceEndsAt.Format(time.RFC3339),
+		"days_remaining": daysRemaining,
+		"modules":        v.Modules,
+		"limits":         v.Limits,
+		"status":         status,
+		"license":        v.Token,
+		"key_id":         v.KeyID,
+	}
+}
+
+// validationOutcome is the outcome recorded for a license status that
+// validates
+func validationOutcome(status string) string {
+	if status == licenseGrace {
+		return validationGrace
+	}
+	return validationValid
+}
+
+// cachedValidation returns the cached validation of a license key, or nil
+// when there is none or Redis is unavailable
+func (h *Handler) cachedValidation(licenseKey string) *licenseValidation {
+	if h.cache == nil {
+		return nil
+	}
+	raw, err := h.cache.Get(validationCachePrefix + licenseKey)
+	if err != nil {
+		return nil
+	}
+	var v licenseValidation
+	if err := json.Unmarshal([]byte(raw), &v); err != nil {
+		return nil
+	}
+	return &v
+}
+
+// cacheValidation keeps a successful validation for
+// license_validation_cache_seconds, and never past the end of the grace
+// period
+func (h *Handler) cacheValidation(licenseKey string, v *licenseValidation) {
+	if h.cache == nil {
+		return
+	}
+	ttl := time.Duration(h.getSettingInt("license_validation_cache_seconds", 300)) * time.Second
+	if left := time.Until(v.GraceEndsAt); left < ttl {
+		ttl = left
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	raw, err := json.Marshal(v)
+	if err == nil {
+		err = h.cache.Set(validationCachePrefix+licenseKey, raw, ttl)
+	}
+	if err != nil {
+		h.logger.Warn("Failed to cache license validation", "license_id", v.LicenseID, "error", err)
+	}
+}
+
+// licenseCacheKeys returns the cache keys of the licenses l matching where
+func (h *Handler) licenseCacheKeys(where string, args ...interface{}) []string {
+	if h.cache == nil {
+		return nil
+	}
+	rows, err := h.db.Query("SELECT l.license_key FROM licenses l WHERE "+where, args...)
+	if err != nil {
+		h.logger.Error("Failed to look up licenses to invalidate", "error", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err == nil {
+			keys = append(keys, validationCachePrefix+key)
+		}
+	}
+	return keys
+}
+
+// forgetValidations drops cached validations, so the next validation of
+// those licenses sees a change. Call it once the change is committed.
+func (h *Handler) forgetValidations(keys []string) {
+	if h.cache == nil || len(keys) == 0 {
+		return
+	}
+	if err := h.cache.Delete(keys...); err != nil {
+		h.logger.Error("Failed to invalidate cached license validations", "licenses", len(keys), "error", err)
+	}
+}
+
+// touchISP sets the ISP's last_seen. With Redis it is written at most once a
+// minute per ISP, rather than on every validation.
+func (h *Handler) touchISP(ispID int) {
+	if h.cache != nil {
+		ok, err := h.cache.SetNX("isp:last_seen:"+strconv.Itoa(ispID), 1, time.Minute)
+		if err == nil && !ok {
+			return
+		}
+	}
+	h.db.Exec("UPDATE isps SET last_seen = NOW() WHERE id = $1", ispID)
+}
+
+// recordValidation logs a validation attempt. licenseID is nil when the key
+// matched no license of the agent's ISP.
+func (h *Handler) recordValidation(r *http.Request, licenseID interface{}, ispID int, req ValidateLicenseRequest, reason string, cached bool) {
+	_, err := h.db.Exec(`
+		INSERT INTO license_validations (license_id, isp_id, license_key, hw_id, source_ip, success, reason, cached)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, licenseID, ispID, validationField(req.LicenseKey), validationField(req.HWID), clientIP(r),
+		reason == validationValid || reason == validationGrace, reason, cached)
+	if err != nil {
+		h.logger.Error("Failed to record license validation", "isp_id", ispID, "reason", reason, "error", err)
+	}
+}
+
+// validationField is a value from the agent as stored with an attempt: nil
+// when empty or too long for the column
+func validationField(s string) interface{} {
+	if s == "" || len(s) > 255 {
+		return nil
+	}
+	return s
+}
+
+// GetLicenseValidations shows where a license has been validated from over
+// the last ?days= (7 by default): a summary, each server that used it, and
+// the latest ?limit= attempts. Several servers at once point to a cloned
+// license.
+func (h *Handler) GetLicenseValidations(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+	scope, args := tenantScope(claims, "i", 2)
+
+	var licenseID int
+	err := h.db.QueryRow(`
+		SELECT l.id FROM licenses l JOIN isps i ON l.isp_id = i.id
+		WHERE l.id = $1 AND `+scope, append([]interface{}{mux.Vars(r)["id"]}, args...)...).Scan(&licenseID)
+	if err != nil {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "License not found"})
+		return
+	}
+
+	days, limit := 7, 100
+	if v := r.URL.Query().Get("days"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 1 && n <= 90 {
+			days = n
+		} else {
+			h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "days must be between 1 and 90"})
+			return
+		}
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 1 && n <= 1000 {
+			limit = n
+		} else {
+			h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "limit must be between 1 and 1000"})
+			return
+		}
+	}
+
+	var summary LicenseValidationSummary
+	err = h.db.QueryRow(`
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE NOT success),
+		       COUNT(DISTINCT source_ip), COUNT(DISTINCT hw_id),
+		       COUNT(DISTINCT source_ip) FILTER (WHERE created_at > NOW() - INTERVAL '1 hour')
+		FROM license_validations
+		WHERE license_id = $1 AND created_at > NOW() - INTERVAL '1 day' * $2
+	`, licenseID, days).Scan(&summary.Attempts, &summary.Failures, &summary.DistinctIPs, &summary.DistinctHWIDs,
+		&summary.DistinctIPsLastHour)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+
+	sources := []LicenseValidationSource{}
+	rows, err := h.db.Query(`
+		SELECT host(source_ip), hw_id, COUNT(*), COUNT(*) FILTER (WHERE NOT success), MIN(created_at), MAX(created_at)
+		FROM license_validations
+		WHERE license_id = $1 AND created_at > NOW() - INTERVAL '1 day' * $2
+		GROUP BY source_ip, hw_id
+		ORDER BY MAX(created_at) DESC
+	`, licenseID, days)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	for rows.Next() {
+		var s LicenseValidationSource
+		if err := rows.Scan(&s.SourceIP, &s.HWID, &s.Attempts, &s.Failures, &s.FirstSeen, &s.LastSeen); err != nil {
+			continue
+		}
+		sources = append(sources, s)
+	}
+	rows.Close()
+
+	attempts := []LicenseValidationResponse{}
+	rows, err = h.db.Query(`
+		SELECT id, hw_id, host(source_ip), success, reason, cached, created_at
+		FROM license_validations
+		WHERE license_id = $1 AND created_at > NOW() - INTERVAL '1 day' * $2
+		ORDER BY created_at DESC, id DESC
+		LIMIT $3
+	`, licenseID, days, limit)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a LicenseValidationResponse
+		if err := rows.Scan(&a.ID, &a.HWID, &a.SourceIP, &a.Success, &a.Reason, &a.Cached, &a.CreatedAt); err != nil {
+			continue
+		}
+		attempts = append(attempts, a)
+	}
+
+	h.sendJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"days":     days,
+			"summary":  summary,
+			"sources":  sources,
+			"attempts": attempts,
+		},
+	})
+}
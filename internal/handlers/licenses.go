@@ -2,26 +2,32 @@ package handlers
 
 import (
     "crypto/rand"
+    "database/sql"
+    "encoding/base64"
     "encoding/hex"
     "encoding/json"
     "net/http"
-    "os"
+    "slices"
     "time"
 
-    "github.com/golang-jwt/jwt/v5"
     "github.com/gorilla/mux"
     "isp-saas.com/platform/internal/middleware"
+    "isp-saas.com/platform/pkg/license"
 )
 
 type LicenseResponse struct {
-    ID         int      `json:"id"`
-    ISPID      int      `json:"isp_id"`
-    ISPName    string   `json:"isp_name,omitempty"`
-    LicenseKey string   `json:"license_key"`
-    ExpiresAt  string   `json:"expires_at"`
-    IsActive   bool     `json:"is_active"`
-    Modules    []string `json:"modules"`
-    CreatedAt  string   `json:"created_at"`
+    ID            int       `json:"id"`
+    ISPID         int       `json:"isp_id"`
+    ISPName       string    `json:"isp_name,omitempty"`
+    LicenseKey    string    `json:"license_key"`
+    ExpiresAt     time.Time `json:"expires_at"`
+    IsActive      bool      `json:"is_active"`
+    Modules       []string  `json:"modules"`
+    CreatedAt     string    `json:"created_at"`
+    // active, grace, expired or revoked; see licenseState
+    Status        string    `json:"status"`
+    DaysRemaining int       `json:"days_remaining"`
+    GraceEndsAt   time.Time `json:"grace_ends_at"`
 }
 
 type CreateLicenseRequest struct {
@@ -37,24 +43,23 @@ type ValidateLicenseRequest struct {
 
 func (h *Handler) GetLicenses(w http.ResponseWriter, r *http.Request) {
     claims := middleware.GetUserFromContext(r)
-    if claims.Role != "admin" && claims.Role != "distributor" {
-        h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Access denied"})
-        return
-    }
+    scope, args := tenantScope(claims, "i", 1)
 
     rows, err := h.db.Query(`
         SELECT l.id, l.isp_id, i.name as isp_name, l.license_key, l.expires_at, l.is_active, l.modules, l.created_at
         FROM licenses l
         JOIN isps i ON l.isp_id = i.id
+        WHERE `+scope+`
         ORDER BY l.created_at DESC
-    `)
+    `, args...)
     if err != nil {
         h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
         return
     }
     defer rows.Close()
 
-    var licenses []LicenseResponse
+    grace, now := h.licenseGrace(), time.Now()
+    licenses := []LicenseResponse{}
     for rows.Next() {
         var l LicenseResponse
         var modulesJSON []byte
@@ -62,6 +67,7 @@ func (h *Handler) GetLicenses(w http.ResponseWriter, r *http.Request) {
             continue
         }
         json.Unmarshal(modulesJSON, &l.Modules)
+        l.setState(grace, now)
         licenses = append(licenses, l)
     }
 
@@ -72,30 +78,29 @@ func (h *Handler) GetLicense(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     id := vars["id"]
 
+    claims := middleware.GetUserFromContext(r)
+    scope, args := tenantScope(claims, "i", 2)
+
     var l LicenseResponse
     var modulesJSON []byte
     err := h.db.QueryRow(`
         SELECT l.id, l.isp_id, i.name as isp_name, l.license_key, l.expires_at, l.is_active, l.modules, l.created_at
         FROM licenses l
         JOIN isps i ON l.isp_id = i.id
-        WHERE l.id = $1
-    `, id).Scan(&l.ID, &l.ISPID, &l.ISPName, &l.LicenseKey, &l.ExpiresAt, &l.IsActive, &modulesJSON, &l.CreatedAt)
+        WHERE l.id = $1 AND `+scope, append([]interface{}{id}, args...)...).Scan(&l.ID, &l.ISPID, &l.ISPName, &l.LicenseKey, &l.ExpiresAt, &l.IsActive, &modulesJSON, &l.CreatedAt)
 
     if err != nil {
         h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "License not found"})
         return
     }
     json.Unmarshal(modulesJSON, &l.Modules)
+    l.setState(h.licenseGrace(), time.Now())
 
     h.sendJSON(w, http.StatusOK, Response{Success: true, Data: l})
 }
 
 func (h *Handler) CreateLicense(w http.ResponseWriter, r *http.Request) {
     claims := middleware.GetUserFromContext(r)
-    if claims.Role != "admin" {
-        h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Admin access required"})
-        return
-    }
 
     var req CreateLicenseRequest
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -109,29 +114,65 @@ func (h *Handler) CreateLicense(w http.ResponseWriter, r *http.Request) {
     }
 
     if req.DaysValid == 0 {
-        req.DaysValid = 30
+        req.DaysValid = defaultLicenseDays
     }
 
+    // Licenses carry only modules the ISP's plan includes, all of them unless
+    // the request picks some
+    planName, entitled, err := ispModules(h.db, req.ISPID)
+    if err == sql.ErrNoRows {
+        h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "ISP not found"})
+        return
+    }
+    if err != nil {
+        h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+        return
+    }
+    req.Modules = uniqueModules(req.Modules)
     if len(req.Modules) == 0 {
-        req.Modules = []string{"cache", "https", "monitoring"}
+        req.Modules = entitled
+    }
+    for _, m := range req.Modules {
+        if !slices.Contains(entitled, m) {
+            msg := "Unknown or inactive module: " + m
+            if planName != "" {
+                msg = "Plan " + planName + " does not include module " + m
+            }
+            h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: msg})
+            return
+        }
     }
 
     licenseKey := generateLicenseKey()
     expiresAt := time.Now().AddDate(0, 0, req.DaysValid)
-    token := generateLicenseToken(req.ISPID, licenseKey, expiresAt)
     modulesJSON, _ := json.Marshal(req.Modules)
 
+    tx, err := h.db.Begin()
+    if err != nil {
+        h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to create license"})
+        return
+    }
+    defer tx.Rollback()
+
+    // The token is signed once the row exists, from what was stored
     var licenseID int
-    err := h.db.QueryRow(`
+    err = tx.QueryRow(`
         INSERT INTO licenses (isp_id, license_key, token, expires_at, modules)
-        VALUES ($1, $2, $3, $4, $5) RETURNING id
-    `, req.ISPID, licenseKey, token, expiresAt, modulesJSON).Scan(&licenseID)
-
+        VALUES ($1, $2, '', $3, $4) RETURNING id
+    `, req.ISPID, licenseKey, expiresAt, modulesJSON).Scan(&licenseID)
+    if err == nil {
+        _, _, err = h.licenseToken(tx, licenseID, "")
+    }
+    if err == nil {
+        err = tx.Commit()
+    }
     if err != nil {
+        h.logger.Error("Failed to create license", "isp_id", req.ISPID, "error", err)
         h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to create license"})
         return
     }
 
+    h.audit(r, "license.create", "license", licenseID, nil, h.auditSnapshot("licenses", licenseID))
     h.logger.Info("License created", "license_id", licenseID, "isp_id", req.ISPID, "by", claims.UserID)
     h.sendJSON(w, http.StatusCreated, Response{
         Success: true,
@@ -144,61 +185,125 @@ func (h *Handler) CreateLicense(w http.ResponseWriter, r *http.Request) {
     })
 }
 
+// ValidateLicense checks a cache server's license. Successful validations are
+// answered from Redis until the license changes; every attempt is recorded
+// for the license's validation history.
 func (h *Handler) ValidateLicense(w http.ResponseWriter, r *http.Request) {
+    agent := middleware.GetAgentFromContext(r)
+
     var req ValidateLicenseRequest
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        h.recordValidation(r, nil, agent.ISPID, req, validationInvalidRequest, false)
         h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
         return
     }
 
-    var ispID int
+    now := time.Now()
+    if v := h.cachedValidation(req.LicenseKey); v != nil && v.ISPID == agent.ISPID && v.HWID == req.HWID {
+        if status, data := v.result(now); status != licenseExpired {
+            h.touchISP(v.ISPID)
+            h.recordValidation(r, v.LicenseID, agent.ISPID, req, validationOutcome(status), true)
+            h.sendValidation(w, status, data)
+            return
+        }
+    }
+
+    var licenseID, ispID int
+    var hwID string
     var expiresAt time.Time
     var isActive bool
-    var modulesJSON []byte
-    var ispStatus string
+    var ispStatus, token string
 
     err := h.db.QueryRow(`
-        SELECT l.isp_id, l.expires_at, l.is_active, l.modules, i.status
+        SELECT l.id, l.isp_id, i.hw_id, l.expires_at, l.is_active, i.status, l.token
         FROM licenses l
         JOIN isps i ON l.isp_id = i.id
-        WHERE l.license_key = $1 AND i.hw_id = $2
-    `, req.LicenseKey, req.HWID).Scan(&ispID, &expiresAt, &isActive, &modulesJSON, &ispStatus)
+        WHERE l.license_key = $1 AND l.isp_id = $2
+    `, req.LicenseKey, agent.ISPID).Scan(&licenseID, &ispID, &hwID, &expiresAt, &isActive, &ispStatus, &token)
 
     if err != nil {
+        h.recordValidation(r, nil, agent.ISPID, req, validationUnknownLicense, false)
+        h.sendJSON(w, http.StatusUnauthorized, Response{Success: false, Error: "Invalid license or hardware ID"})
+        return
+    }
+
+    if req.HWID != hwID {
+        // A server that was replaced through a hardware ID transfer is told
+        // so, rather than that its license is invalid
+        var transferred bool
+        h.db.QueryRow(`
+            SELECT EXISTS(
+                SELECT 1 FROM isp_hwid_history
+                WHERE isp_id = $1 AND hw_id = $2 AND unbound_at IS NOT NULL
+            )
+        `, agent.ISPID, req.HWID).Scan(&transferred)
+        if transferred {
+            h.recordValidation(r, licenseID, agent.ISPID, req, validationHWIDTransferred, false)
+            h.sendJSON(w, http.StatusUnauthorized, Response{Success: false, Error: "Hardware ID has been transferred to another server"})
+            return
+        }
+        h.recordValidation(r, licenseID, agent.ISPID, req, validationHWIDMismatch, false)
         h.sendJSON(w, http.StatusUnauthorized, Response{Success: false, Error: "Invalid license or hardware ID"})
         return
     }
 
     if !isActive {
+        h.recordValidation(r, licenseID, agent.ISPID, req, validationRevoked, false)
         h.sendJSON(w, http.StatusUnauthorized, Response{Success: false, Error: "License is deactivated"})
         return
     }
 
-    if time.Now().After(expiresAt) {
+    // An expired license keeps working through the grace period, so the
+    // cache does not go offline the moment it lapses
+    grace := h.licenseGrace()
+    if status, _ := licenseState(true, expiresAt, grace, now); status == licenseExpired {
+        h.recordValidation(r, licenseID, agent.ISPID, req, validationExpired, false)
         h.sendJSON(w, http.StatusUnauthorized, Response{Success: false, Error: "License has expired"})
         return
     }
 
     if ispStatus == "suspended" {
+        h.recordValidation(r, licenseID, agent.ISPID, req, validationISPSuspended, false)
         h.sendJSON(w, http.StatusUnauthorized, Response{Success: false, Error: "ISP account is suspended"})
         return
     }
 
-    h.db.Exec("UPDATE isps SET last_seen = NOW() WHERE id = $1", ispID)
+    h.touchISP(ispID)
 
-    var modules []string
-    json.Unmarshal(modulesJSON, &modules)
+    // The agent keeps the signed license to run on while the platform is
+    // unreachable. Its claims are the entitlements the agent enforces.
+    token, c, err := h.licenseToken(h.db, licenseID, token)
+    if err != nil {
+        h.logger.Error("Failed to sign license", "license_id", licenseID, "error", err)
+        h.recordValidation(r, licenseID, agent.ISPID, req, validationError, false)
+        h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to sign license"})
+        return
+    }
 
-    h.sendJSON(w, http.StatusOK, Response{
-        Success: true,
-        Message: "License is valid",
-        Data: map[string]interface{}{
-            "isp_id":     ispID,
-            "expires_at": expiresAt.Format(time.RFC3339),
-            "modules":    modules,
-            "status":     "active",
-        },
-    })
+    v := &licenseValidation{
+        LicenseID:   licenseID,
+        ISPID:       ispID,
+        HWID:        hwID,
+        ExpiresAt:   expiresAt,
+        GraceEndsAt: expiresAt.Add(grace),
+        Modules:     c.Modules,
+        Limits:      c.Limits,
+        Token:       token,
+        KeyID:       h.licenses.KeyID(),
+    }
+    h.cacheValidation(req.LicenseKey, v)
+
+    status, data := v.result(now)
+    h.recordValidation(r, licenseID, agent.ISPID, req, validationOutcome(status), false)
+    h.sendValidation(w, status, data)
+}
+
+func (h *Handler) sendValidation(w http.ResponseWriter, status string, data map[string]interface{}) {
+    message := "License is valid"
+    if status == licenseGrace {
+        message = "License has expired and is in its grace period; renew it to keep the cache running"
+    }
+    h.sendJSON(w, http.StatusOK, Response{Success: true, Message: message, Data: data})
 }
 
 func (h *Handler) RevokeLicense(w http.ResponseWriter, r *http.Request) {
@@ -206,10 +311,7 @@ func (h *Handler) RevokeLicense(w http.ResponseWriter, r *http.Request) {
     id := vars["id"]
 
     claims := middleware.GetUserFromContext(r)
-    if claims.Role != "admin" {
-        h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Admin access required"})
-        return
-    }
+    before := h.auditSnapshot("licenses", id)
 
     _, err := h.db.Exec("UPDATE licenses SET is_active = false, updated_at = NOW() WHERE id = $1", id)
     if err != nil {
@@ -217,6 +319,8 @@ func (h *Handler) RevokeLicense(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    h.audit(r, "license.revoke", "license", id, before, h.auditSnapshot("licenses", id))
+    h.forgetValidations(h.licenseCacheKeys("l.id = $1", id))
     h.logger.Info("License revoked", "license_id", id, "by", claims.UserID)
     h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "License revoked successfully"})
 }
@@ -227,20 +331,106 @@ func generateLicenseKey() string {
     return "ISP-" + hex.EncodeToString(bytes)[:24]
 }
 
-func generateLicenseToken(ispID int, licenseKey string, expiresAt time.Time) string {
-    secret := os.Getenv("JWT_SECRET")
-    if secret == "" {
-        secret = "your-super-secret-key-change-in-production"
+// dbExecutor is a *sql.Tx or the database handle
+type dbExecutor interface {
+    queryRower
+    Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// licenseToken returns the signed license document of a license and the
+// claims in it. stored is the token on file; it is kept while it still
+// matches the license, and otherwise, for example after the ISP's hardware,
+// plan or limits changed or the signing key was replaced, a new one is signed
+// and stored.
+//
+// The document grants the license's modules that are still in the catalogue
+// and, for an ISP on a plan, included in the plan.
+func (h *Handler) licenseToken(q dbExecutor, licenseID int, stored string) (string, *license.Claims, error) {
+    var c license.Claims
+    var modulesJSON []byte
+    var expiresAt time.Time
+    err := q.QueryRow(`
+        SELECT l.license_key, l.isp_id, i.hw_id, l.expires_at,
+               COALESCE((
+                   SELECT jsonb_agg(m.key ORDER BY m.key) FROM license_modules m
+                   WHERE m.is_active AND l.modules ? m.key AND (i.plan_id IS NULL OR EXISTS (
+                       SELECT 1 FROM plan_modules pm WHERE pm.plan_id = i.plan_id AND pm.module_key = m.key
+                   ))
+               ), '[]'),
+               i.cache_size_gb, i.bandwidth_limit_mbps, p.max_connections
+        FROM licenses l
+        JOIN isps i ON l.isp_id = i.id
+        LEFT JOIN plans p ON i.plan_id = p.id
+        WHERE l.id = $1
+    `, licenseID).Scan(&c.LicenseKey, &c.ISPID, &c.HWID, &expiresAt, &modulesJSON,
+        &c.Limits.CacheSizeGB, &c.Limits.BandwidthLimitMbps, &c.Limits.MaxConnections)
+    if err != nil {
+        return "", nil, err
+    }
+    c.Modules = []string{}
+    json.Unmarshal(modulesJSON, &c.Modules)
+
+    grace := h.licenseGrace()
+    if h.licenses.Current(stored, c, expiresAt, grace) {
+        return stored, &c, nil
+    }
+
+    token, err := h.licenses.Sign(c, time.Now(), expiresAt, grace)
+    if err != nil {
+        return "", nil, err
+    }
+    _, err = q.Exec("UPDATE licenses SET token = $1 WHERE id = $2", token, licenseID)
+    return token, &c, err
+}
+
+// GetLicenseFile downloads the signed license document, for installing a
+// cache server by hand or keeping a copy offline
+func (h *Handler) GetLicenseFile(w http.ResponseWriter, r *http.Request) {
+    claims := middleware.GetUserFromContext(r)
+    scope, args := tenantScope(claims, "i", 2)
+
+    var licenseID int
+    var licenseKey, token string
+    var isActive bool
+    err := h.db.QueryRow(`
+        SELECT l.id, l.license_key, l.token, l.is_active
+        FROM licenses l
+        JOIN isps i ON l.isp_id = i.id
+        WHERE l.id = $1 AND `+scope, append([]interface{}{mux.Vars(r)["id"]}, args...)...).Scan(&licenseID, &licenseKey, &token, &isActive)
+    if err != nil {
+        h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "License not found"})
+        return
+    }
+    if !isActive {
+        h.sendJSON(w, http.StatusConflict, Response{Success: false, Error: "License is deactivated"})
+        return
     }
 
-    claims := jwt.MapClaims{
-        "isp_id":      ispID,
-        "license_key": licenseKey,
-        "exp":         expiresAt.Unix(),
-        "iat":         time.Now().Unix(),
+    token, _, err = h.licenseToken(h.db, licenseID, token)
+    if err != nil {
+        h.logger.Error("Failed to sign license", "license_id", licenseID, "error", err)
+        h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to sign license"})
+        return
     }
 
-    token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-    signedToken, _ := token.SignedString([]byte(secret))
-    return signedToken
+    w.Header().Set("Content-Type", "application/jwt")
+    w.Header().Set("Content-Disposition", `attachment; filename="`+licenseKey+`.lic"`)
+    w.Write([]byte(token))
+}
+
+// GetLicensePublicKey publishes the key license documents are signed with.
+// Agents verify their license against it (EdDSA over Ed25519, key named by
+// the token's kid header) without calling the platform.
+func (h *Handler) GetLicensePublicKey(w http.ResponseWriter, r *http.Request) {
+    h.sendJSON(w, http.StatusOK, Response{
+        Success: true,
+        Data: map[string]interface{}{
+            "algorithm":  "EdDSA",
+            "curve":      "Ed25519",
+            "key_id":     h.licenses.KeyID(),
+            "public_key": base64.StdEncoding.EncodeToString(h.licenses.PublicKey()),
+            "pem":        h.licenses.PublicKeyPEM(),
+            "issuer":     license.Issuer,
+        },
+    })
 }
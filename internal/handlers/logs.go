@@ -10,6 +10,7 @@ import (
 
 type SystemLogResponse struct {
     ID        int             `json:"id"`
+    ISPID     *int            `json:"isp_id,omitempty"`
     Level     string          `json:"level"`
     Source    string          `json:"source"`
     Message   string          `json:"message"`
@@ -25,12 +26,6 @@ type CreateLogRequest struct {
 }
 
 func (h *Handler) GetSystemLogs(w http.ResponseWriter, r *http.Request) {
-    claims := middleware.GetUserFromContext(r)
-    if claims.Role != "admin" {
-        h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Admin access required"})
-        return
-    }
-
     level := r.URL.Query().Get("level")
     source := r.URL.Query().Get("source")
     limitStr := r.URL.Query().Get("limit")
@@ -41,7 +36,7 @@ func (h *Handler) GetSystemLogs(w http.ResponseWriter, r *http.Request) {
         }
     }
 
-    query := `SELECT id, level, COALESCE(source, ''), message, metadata, created_at FROM system_logs WHERE 1=1`
+    query := `SELECT id, isp_id, level, COALESCE(source, ''), message, metadata, created_at FROM system_logs WHERE 1=1`
     args := []interface{}{}
     argCount := 0
 
@@ -71,7 +66,7 @@ func (h *Handler) GetSystemLogs(w http.ResponseWriter, r *http.Request) {
     var logs []SystemLogResponse
     for rows.Next() {
         var log SystemLogResponse
-        rows.Scan(&log.ID, &log.Level, &log.Source, &log.Message, &log.Metadata, &log.CreatedAt)
+        rows.Scan(&log.ID, &log.ISPID, &log.Level, &log.Source, &log.Message, &log.Metadata, &log.CreatedAt)
         logs = append(logs, log)
     }
 
@@ -96,11 +91,12 @@ func (h *Handler) CreateSystemLog(w http.ResponseWriter, r *http.Request) {
     }
 
     metadataJSON, _ := json.Marshal(req.Metadata)
+    agent := middleware.GetAgentFromContext(r)
 
     var logID int
     err := h.db.QueryRow(`
-        INSERT INTO system_logs (level, source, message, metadata) VALUES ($1, $2, $3, $4) RETURNING id
-    `, req.Level, req.Source, req.Message, metadataJSON).Scan(&logID)
+        INSERT INTO system_logs (level, source, message, metadata, isp_id) VALUES ($1, $2, $3, $4, $5) RETURNING id
+    `, req.Level, req.Source, req.Message, metadataJSON, agent.ISPID).Scan(&logID)
 
     if err != nil {
         h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to create log"})
@@ -111,12 +107,6 @@ func (h *Handler) CreateSystemLog(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) GetLogStats(w http.ResponseWriter, r *http.Request) {
-    claims := middleware.GetUserFromContext(r)
-    if claims.Role != "admin" {
-        h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Admin access required"})
-        return
-    }
-
     rows, err := h.db.Query(`
         SELECT level, COUNT(*) as count 
         FROM system_logs 
@@ -141,22 +131,26 @@ func (h *Handler) GetLogStats(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) DeleteOldLogs(w http.ResponseWriter, r *http.Request) {
-    claims := middleware.GetUserFromContext(r)
-    if claims.Role != "admin" {
-        h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Admin access required"})
-        return
-    }
-
-    result, err := h.db.Exec("DELETE FROM system_logs WHERE created_at < NOW() - INTERVAL '30 days'")
+    rows, err := h.deleteOldLogs()
     if err != nil {
         h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to delete logs"})
         return
     }
 
-    rows, _ := result.RowsAffected()
+    h.audit(r, "system_log.cleanup", "system_log", nil, nil, map[string]int64{"deleted": rows})
     h.sendJSON(w, http.StatusOK, Response{
         Success: true,
         Message: "Old logs deleted",
         Data:    map[string]int64{"deleted": rows},
     })
 }
+
+// deleteOldLogs removes system logs older than log_retention_days
+func (h *Handler) deleteOldLogs() (int64, error) {
+    days := h.getSettingInt("log_retention_days", 30)
+    result, err := h.db.Exec("DELETE FROM system_logs WHERE created_at < NOW() - INTERVAL '1 day' * $1", days)
+    if err != nil {
+        return 0, err
+    }
+    return result.RowsAffected()
+}
@@ -0,0 +1,361 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"isp-saas.com/platform/internal/middleware"
+	"isp-saas.com/platform/internal/rbac"
+	"isp-saas.com/platform/pkg/totp"
+)
+
+const (
+	mfaIssuer         = "ISP SaaS Platform"
+	mfaPendingTTL     = 5 * time.Minute
+	recoveryCodeCount = 10
+	mfaClockSkewSteps = 1
+)
+
+type MFACodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// EnrollMFA starts TOTP enrollment by generating a secret. Enrollment is not
+// active until ConfirmMFA receives a valid code for it.
+func (h *Handler) EnrollMFA(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+
+	var email string
+	var enabled bool
+	err := h.db.QueryRow("SELECT email, mfa_enabled FROM users WHERE id = $1", claims.UserID).Scan(&email, &enabled)
+	if err != nil {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "User not found"})
+		return
+	}
+	if enabled {
+		h.sendJSON(w, http.StatusConflict, Response{Success: false, Error: "Two-factor authentication is already enabled"})
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to generate secret"})
+		return
+	}
+
+	_, err = h.db.Exec("UPDATE users SET mfa_pending_secret = $1, updated_at = NOW() WHERE id = $2", secret, claims.UserID)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to start enrollment"})
+		return
+	}
+
+	h.sendJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Scan the QR code with your authenticator app, then confirm with a code",
+		Data: map[string]interface{}{
+			"secret":           secret,
+			"provisioning_uri": totp.ProvisioningURI(mfaIssuer, email, secret),
+		},
+	})
+}
+
+// ConfirmMFA activates the pending secret and returns one-time recovery
+// codes. When called with an mfa_pending token (mandatory enrollment during
+// login) it also completes the login.
+func (h *Handler) ConfirmMFA(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+
+	var req MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Code is required"})
+		return
+	}
+
+	var pending sql.NullString
+	var enabled bool
+	h.db.QueryRow("SELECT mfa_pending_secret, mfa_enabled FROM users WHERE id = $1", claims.UserID).Scan(&pending, &enabled)
+	if enabled || !pending.Valid {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "No enrollment in progress"})
+		return
+	}
+
+	step, ok := totp.Validate(pending.String, req.Code, time.Now(), mfaClockSkewSteps)
+	if !ok {
+		h.sendJSON(w, http.StatusUnauthorized, Response{Success: false, Error: "Invalid code"})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE users SET mfa_enabled = true, mfa_secret = mfa_pending_secret, mfa_pending_secret = NULL,
+		       mfa_last_step = $1, updated_at = NOW()
+		WHERE id = $2
+	`, step, claims.UserID)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to enable two-factor authentication"})
+		return
+	}
+
+	codes, err := replaceRecoveryCodes(tx, claims.UserID)
+	if err != nil || tx.Commit() != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to enable two-factor authentication"})
+		return
+	}
+
+	h.audit(r, "user.mfa_enable", "user", claims.UserID, nil, nil)
+	h.logger.Info("Two-factor authentication enabled", "user_id", claims.UserID)
+
+	data := map[string]interface{}{"recovery_codes": codes}
+	if claims.Purpose == middleware.PurposeMFAPending {
+		tokens, err := h.startSession(r, claims.UserID, claims.Email, claims.Role)
+		if err != nil {
+			h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to generate token"})
+			return
+		}
+		for k, v := range tokens.data() {
+			data[k] = v
+		}
+	}
+
+	h.sendJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Two-factor authentication enabled. Store the recovery codes somewhere safe.",
+		Data:    data,
+	})
+}
+
+// VerifyMFA completes a login that is waiting for the second factor. It
+// accepts either a TOTP code or an unused recovery code.
+func (h *Handler) VerifyMFA(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+	if claims.Purpose != middleware.PurposeMFAPending {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "No login awaiting verification"})
+		return
+	}
+
+	var req MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Code == "" && req.RecoveryCode == "") {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Code or recovery code is required"})
+		return
+	}
+
+	if !h.verifySecondFactor(w, r, claims.UserID, req) {
+		return
+	}
+
+	tokens, err := h.startSession(r, claims.UserID, claims.Email, claims.Role)
+	if err != nil {
+		h.logger.Error("Failed to start session", "error", err)
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to generate token"})
+		return
+	}
+
+	h.logger.Info("User logged in", "user_id", claims.UserID, "email", claims.Email, "session_id", tokens.SessionID, "mfa", true)
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Login successful", Data: tokens.data()})
+}
+
+func (h *Handler) DisableMFA(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+
+	if h.mfaRequiredForRole(claims.Role) {
+		h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Two-factor authentication is mandatory for your role"})
+		return
+	}
+
+	var req MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Code == "" && req.RecoveryCode == "") {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Code or recovery code is required"})
+		return
+	}
+
+	if !h.verifySecondFactor(w, r, claims.UserID, req) {
+		return
+	}
+
+	h.db.Exec(`
+		UPDATE users SET mfa_enabled = false, mfa_secret = NULL, mfa_pending_secret = NULL,
+		       mfa_last_step = NULL, updated_at = NOW()
+		WHERE id = $1
+	`, claims.UserID)
+	h.db.Exec("DELETE FROM mfa_recovery_codes WHERE user_id = $1", claims.UserID)
+
+	h.audit(r, "user.mfa_disable", "user", claims.UserID, nil, nil)
+	h.logger.Info("Two-factor authentication disabled", "user_id", claims.UserID)
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodes invalidates all recovery codes and issues new ones
+func (h *Handler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+
+	var req MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Code is required"})
+		return
+	}
+
+	if !h.verifySecondFactor(w, r, claims.UserID, MFACodeRequest{Code: req.Code}) {
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(tx, claims.UserID)
+	if err != nil || tx.Commit() != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to generate recovery codes"})
+		return
+	}
+
+	h.audit(r, "user.mfa_recovery_codes", "user", claims.UserID, nil, nil)
+
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Data: map[string]interface{}{"recovery_codes": codes}})
+}
+
+// verifySecondFactor checks a second factor and answers the request when it
+// is wrong or locked. mfa_max_attempts wrong codes in a row lock the user's
+// second factor for mfa_lockout_minutes, however many addresses they come
+// from.
+func (h *Handler) verifySecondFactor(w http.ResponseWriter, r *http.Request, userID int, req MFACodeRequest) bool {
+	var lockedFor sql.NullFloat64
+	h.db.QueryRow(`
+		SELECT EXTRACT(EPOCH FROM mfa_locked_until - NOW()) FROM users WHERE id = $1 AND mfa_locked_until > NOW()
+	`, userID).Scan(&lockedFor)
+	if lockedFor.Valid {
+		w.Header().Set("Retry-After", strconv.Itoa(int(lockedFor.Float64)+1))
+		h.sendJSON(w, http.StatusTooManyRequests, Response{Success: false, Error: "Too many invalid codes, try again later"})
+		return false
+	}
+
+	if h.checkSecondFactor(userID, req) {
+		h.db.Exec(`
+			UPDATE users SET mfa_failed_attempts = 0, mfa_locked_until = NULL
+			WHERE id = $1 AND (mfa_failed_attempts > 0 OR mfa_locked_until IS NOT NULL)
+		`, userID)
+		return true
+	}
+
+	var locked bool
+	err := h.db.QueryRow(`
+		UPDATE users SET
+			mfa_failed_attempts = CASE WHEN mfa_failed_attempts + 1 >= $2 THEN 0 ELSE mfa_failed_attempts + 1 END,
+			mfa_locked_until = CASE WHEN mfa_failed_attempts + 1 >= $2 THEN NOW() + INTERVAL '1 minute' * $3 END
+		WHERE id = $1
+		RETURNING mfa_locked_until IS NOT NULL
+	`, userID, h.getSettingInt("mfa_max_attempts", 5), h.getSettingInt("mfa_lockout_minutes", 15)).Scan(&locked)
+	if err != nil {
+		h.logger.Error("Failed to count two-factor failure", "user_id", userID, "error", err)
+	}
+
+	h.logger.Warn("Two-factor verification failed", "user_id", userID, "ip", clientIP(r), "locked", locked)
+	if locked {
+		h.auditAs(r, userID, "user.mfa_lockout", "user", userID, nil, nil)
+	}
+	h.sendJSON(w, http.StatusUnauthorized, Response{Success: false, Error: "Invalid code"})
+	return false
+}
+
+// checkSecondFactor verifies a TOTP code (rejecting replays of an already
+// accepted time step) or consumes a recovery code.
+func (h *Handler) checkSecondFactor(userID int, req MFACodeRequest) bool {
+	if req.RecoveryCode != "" {
+		result, err := h.db.Exec(`
+			UPDATE mfa_recovery_codes SET used_at = NOW()
+			WHERE id = (
+				SELECT id FROM mfa_recovery_codes
+				WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+				LIMIT 1
+			)
+		`, userID, hashToken(normalizeRecoveryCode(req.RecoveryCode)))
+		if err != nil {
+			return false
+		}
+		rows, _ := result.RowsAffected()
+		return rows == 1
+	}
+
+	var secret sql.NullString
+	var lastStep sql.NullInt64
+	err := h.db.QueryRow(`
+		SELECT mfa_secret, mfa_last_step FROM users WHERE id = $1 AND mfa_enabled = true
+	`, userID).Scan(&secret, &lastStep)
+	if err != nil || !secret.Valid {
+		return false
+	}
+
+	step, ok := totp.Validate(secret.String, req.Code, time.Now(), mfaClockSkewSteps)
+	if !ok || (lastStep.Valid && step <= lastStep.Int64) {
+		return false
+	}
+
+	result, err := h.db.Exec(`
+		UPDATE users SET mfa_last_step = $1
+		WHERE id = $2 AND (mfa_last_step IS NULL OR mfa_last_step < $1)
+	`, step, userID)
+	if err != nil {
+		return false
+	}
+	rows, _ := result.RowsAffected()
+	return rows == 1
+}
+
+func (h *Handler) mfaRequiredForRole(role string) bool {
+	return role == rbac.RoleAdmin && h.getSetting("mfa_required_admin", "false") == "true"
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID int) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM mfa_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := generateRandomKey(5)
+		codes[i] = raw[:5] + "-" + raw[5:]
+		if _, err := tx.Exec(`
+			INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)
+		`, userID, hashToken(normalizeRecoveryCode(codes[i]))); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// generateMFAPendingToken issues the limited token returned by Login when a
+// second factor is still needed. It carries no session and is rejected by
+// the regular auth middleware.
+func generateMFAPendingToken(userID int, email, role string) (string, error) {
+	claims := middleware.Claims{
+		UserID:  userID,
+		Email:   email,
+		Role:    role,
+		Purpose: middleware.PurposeMFAPending,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(mfaPendingTTL)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(jwtSecret()))
+}
@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"isp-saas.com/platform/internal/middleware"
+	"isp-saas.com/platform/pkg/mailer"
+)
+
+// Notification types
+const (
+	notifyWarning = "warning"
+	notifyBilling = "billing"
+)
+
+type NotificationResponse struct {
+	ID        int    `json:"id"`
+	Title     string `json:"title"`
+	Message   string `json:"message"`
+	Type      string `json:"type"`
+	IsRead    bool   `json:"is_read"`
+	CreatedAt string `json:"created_at"`
+}
+
+// notifyISP tells everyone responsible for an ISP: its own account and its
+// distributor. Each gets an in-app notification and an email. Failures are
+// logged; a notification never fails the operation that caused it.
+func (h *Handler) notifyISP(ispID int, kind, title, message string) {
+	rows, err := h.db.Query(`
+		SELECT u.id, u.email
+		FROM isps i
+		JOIN users u ON u.id = i.user_id
+		WHERE i.id = $1 AND u.is_active = true
+		UNION
+		SELECT u.id, u.email
+		FROM isps i
+		JOIN distributors d ON d.id = i.distributor_id
+		JOIN users u ON u.id = d.user_id
+		WHERE i.id = $1 AND u.is_active = true
+	`, ispID)
+	if err != nil {
+		h.logger.Error("Failed to look up notification recipients", "isp_id", ispID, "error", err)
+		return
+	}
+
+	type recipient struct {
+		id    int
+		email string
+	}
+	var recipients []recipient
+	for rows.Next() {
+		var rc recipient
+		if err := rows.Scan(&rc.id, &rc.email); err == nil {
+			recipients = append(recipients, rc)
+		}
+	}
+	rows.Close()
+
+	for _, rc := range recipients {
+		if _, err := h.db.Exec(`
+			INSERT INTO notifications (user_id, title, message, type) VALUES ($1, $2, $3, $4)
+		`, rc.id, title, message, kind); err != nil {
+			h.logger.Error("Failed to store notification", "user_id", rc.id, "error", err)
+		}
+		if err := h.mailer.Send(mailer.Message{To: rc.email, Subject: title, Body: message}); err != nil {
+			h.logger.Error("Failed to send notification email", "user_id", rc.id, "error", err)
+		}
+	}
+}
+
+// GetNotifications lists the caller's notifications, newest first.
+// ?unread=true limits the list to unread ones.
+func (h *Handler) GetNotifications(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+
+	query := `
+		SELECT id, title, COALESCE(message, ''), COALESCE(type, 'info'), is_read, created_at
+		FROM notifications WHERE user_id = $1`
+	if unread, _ := strconv.ParseBool(r.URL.Query().Get("unread")); unread {
+		query += " AND is_read = false"
+	}
+	query += " ORDER BY created_at DESC, id DESC LIMIT 100"
+
+	rows, err := h.db.Query(query, claims.UserID)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	notifications := []NotificationResponse{}
+	for rows.Next() {
+		var n NotificationResponse
+		if err := rows.Scan(&n.ID, &n.Title, &n.Message, &n.Type, &n.IsRead, &n.CreatedAt); err != nil {
+			continue
+		}
+		notifications = append(notifications, n)
+	}
+
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Data: notifications})
+}
+
+func (h *Handler) MarkNotificationRead(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+
+	result, err := h.db.Exec("UPDATE notifications SET is_read = true WHERE id = $1 AND user_id = $2",
+		mux.Vars(r)["id"], claims.UserID)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Notification not found"})
+		return
+	}
+
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Notification marked as read"})
+}
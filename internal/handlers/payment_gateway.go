@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"isp-saas.com/platform/internal/billing"
+	"isp-saas.com/platform/internal/middleware"
+	"isp-saas.com/platform/pkg/payments"
+)
+
+// maxWebhookBody caps the webhook payload read into memory
+const maxWebhookBody = 1 << 20
+
+type CheckoutRequest struct {
+	// Provider defaults to the configured default provider
+	Provider   string `json:"provider"`
+	SuccessURL string `json:"success_url"`
+	CancelURL  string `json:"cancel_url"`
+}
+
+// CreateCheckoutSession opens a hosted payment page for what is still due on
+// an invoice, so ISPs can pay without staff recording the payment
+func (h *Handler) CreateCheckoutSession(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+
+	var req CheckoutRequest
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
+			return
+		}
+	}
+	if req.Provider == "" {
+		req.Provider = h.payments.Default
+	}
+	provider, ok := h.payments.Providers[req.Provider]
+	if !ok {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Payment provider is not configured"})
+		return
+	}
+
+	inv, err := h.findInvoice(claims, mux.Vars(r)["id"])
+	if err != nil {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Invoice not found"})
+		return
+	}
+	if inv.Status == "cancelled" || inv.BalanceDue <= 0 {
+		h.sendJSON(w, http.StatusConflict, Response{Success: false, Error: "Invoice has nothing left to pay"})
+		return
+	}
+
+	if req.SuccessURL == "" {
+		req.SuccessURL = appURL() + "/billing?checkout=success&invoice=" + inv.InvoiceNumber
+	}
+	if req.CancelURL == "" {
+		req.CancelURL = appURL() + "/billing?checkout=cancelled&invoice=" + inv.InvoiceNumber
+	}
+
+	session, err := provider.CreateCheckoutSession(r.Context(), payments.CheckoutRequest{
+		InvoiceID:     inv.ID,
+		InvoiceNumber: inv.InvoiceNumber,
+		Description:   "Invoice " + inv.InvoiceNumber,
+		Amount:        inv.BalanceDue.MinorUnits(inv.Currency),
+		Currency:      strings.ToLower(inv.Currency),
+		CustomerEmail: claims.Email,
+		SuccessURL:    req.SuccessURL,
+		CancelURL:     req.CancelURL,
+	})
+	if err != nil {
+		h.logger.Error("Failed to create checkout session", "invoice_id", inv.ID, "provider", req.Provider, "error", err)
+		h.sendJSON(w, http.StatusBadGateway, Response{Success: false, Error: "Payment provider is unavailable"})
+		return
+	}
+
+	var id int
+	err = h.db.QueryRow(`
+		INSERT INTO checkout_sessions (invoice_id, provider, session_id, amount, currency, url, created_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (provider, session_id) DO UPDATE SET url = EXCLUDED.url
+		RETURNING id
+	`, inv.ID, req.Provider, session.ID, inv.BalanceDue, strings.ToLower(inv.Currency), session.URL, claims.UserID, session.ExpiresAt).Scan(&id)
+	if err != nil {
+		h.logger.Error("Failed to store checkout session", "invoice_id", inv.ID, "session_id", session.ID, "error", err)
+	}
+
+	h.audit(r, "invoice.checkout", "invoice", inv.ID, nil, map[string]interface{}{
+		"provider": req.Provider, "session_id": session.ID, "amount": inv.BalanceDue,
+	})
+	h.sendJSON(w, http.StatusCreated, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"provider":   req.Provider,
+			"session_id": session.ID,
+			"url":        session.URL,
+			"amount":     inv.BalanceDue,
+			"expires_at": session.ExpiresAt,
+		},
+	})
+}
+
+// PaymentWebhook receives gateway notifications. The signature is checked by
+// the provider, every event is processed at most once, and a succeeded
+// payment is recorded against the invoice named in its metadata.
+func (h *Handler) PaymentWebhook(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	provider, ok := h.payments.Providers[name]
+	if !ok {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Unknown payment provider"})
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+	if err != nil {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
+		return
+	}
+
+	event, err := provider.ParseWebhook(body, r.Header)
+	if err != nil {
+		h.logger.Warn("Rejected payment webhook", "provider", name, "ip", clientIP(r), "error", err)
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: err.Error()})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var eventRowID int
+	err = tx.QueryRow(`
+		INSERT INTO payment_events (provider, event_id, event_type, payload)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (provider, event_id) DO NOTHING
+		RETURNING id
+	`, name, event.ID, event.RawType, auditJSON(json.RawMessage(event.Payload))).Scan(&eventRowID)
+	if err == sql.ErrNoRows {
+		h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Event already processed"})
+		return
+	}
+	if err != nil {
+		h.logger.Error("Failed to store payment event", "provider", name, "event_id", event.ID, "error", err)
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+
+	paymentID, bal, reason, err := h.applyPaymentEvent(tx, name, event)
+	if err != nil {
+		// Not acknowledged, so the gateway delivers the event again later
+		h.logger.Error("Failed to apply payment event", "provider", name, "event_id", event.ID, "error", err)
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to process event"})
+		return
+	}
+
+	status := "processed"
+	if paymentID == 0 {
+		status = "ignored"
+	}
+	_, err = tx.Exec(`
+		UPDATE payment_events SET status = $1, error = $2, payment_id = $3,
+		       invoice_id = (SELECT id FROM invoices WHERE id = $4)
+		WHERE id = $5
+	`, status, nullIfEmpty(reason), nullIfZero(paymentID), event.InvoiceID, eventRowID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		h.logger.Error("Failed to store payment event", "provider", name, "event_id", event.ID, "error", err)
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+
+	if paymentID != 0 {
+		h.paymentApplied(r, nil, paymentID, bal)
+		h.logger.Info("Gateway payment recorded", "provider", name, "event_id", event.ID,
+			"invoice_id", event.InvoiceID, "payment_id", paymentID)
+	} else if reason != "" {
+		h.logger.Warn("Payment event ignored", "provider", name, "event_id", event.ID, "type", event.RawType, "reason", reason)
+	}
+
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Event " + status})
+}
+
+// applyPaymentEvent records the payment carried by a succeeded event. Events
+// that cannot be applied are acknowledged with a reason instead of an error,
+// since redelivering them would not help; err is only for failures worth a
+// retry.
+func (h *Handler) applyPaymentEvent(tx *sql.Tx, provider string, event *payments.Event) (paymentID int, bal invoiceBalance, reason string, err error) {
+	switch {
+	case event.Type != payments.EventPaymentSucceeded:
+		return 0, bal, "", nil
+	case event.InvoiceID == 0:
+		return 0, bal, "event has no invoice reference", nil
+	case event.Amount <= 0:
+		return 0, bal, "event has no amount", nil
+	}
+
+	// Payments are taken in the invoice's currency
+	var currency string
+	err = tx.QueryRow("SELECT currency FROM invoices WHERE id = $1", event.InvoiceID).Scan(&currency)
+	if err == sql.ErrNoRows {
+		return 0, bal, errInvoiceNotFound.Error(), nil
+	}
+	if err != nil {
+		return 0, bal, "", err
+	}
+	if !strings.EqualFold(event.Currency, currency) {
+		return 0, bal, "currency " + event.Currency + " does not match invoice currency " + currency, nil
+	}
+
+	amount, err := billing.MoneyFromMinorUnits(event.Amount, currency)
+	if err != nil {
+		return 0, bal, fmt.Sprintf("amount %d is not a valid %s amount", event.Amount, currency), nil
+	}
+
+	metadata, _ := json.Marshal(map[string]string{"provider_event_id": event.ID, "currency": event.Currency})
+
+	// A rejected insert aborts the transaction, and the event row still has
+	// to be written, so the payment gets its own savepoint
+	if _, err := tx.Exec("SAVEPOINT gateway_payment"); err != nil {
+		return 0, bal, "", err
+	}
+	paymentID, bal, err = recordPayment(tx, newPayment{
+		InvoiceID:     event.InvoiceID,
+		Amount:        amount,
+		Method:        provider,
+		TransactionID: event.TransactionID,
+		Metadata:      metadata,
+	})
+	if errors.Is(err, errInvoiceNotFound) || errors.Is(err, errInvoiceCancelled) || errors.Is(err, errDuplicatePayment) {
+		if _, rbErr := tx.Exec("ROLLBACK TO SAVEPOINT gateway_payment"); rbErr != nil {
+			return 0, bal, "", rbErr
+		}
+		return 0, bal, err.Error(), nil
+	}
+	return paymentID, bal, "", err
+}
+
+func nullIfZero(n int) interface{} {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
@@ -0,0 +1,475 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"isp-saas.com/platform/internal/billing"
+	"isp-saas.com/platform/internal/middleware"
+)
+
+type PaymentResponse struct {
+	ID            int             `json:"id"`
+	InvoiceID     int             `json:"invoice_id"`
+	Amount        billing.Money   `json:"amount"`
+	PaymentMethod *string         `json:"payment_method"`
+	TransactionID *string         `json:"transaction_id"`
+	Status        string          `json:"status"`
+	Metadata      json.RawMessage `json:"metadata"`
+	RecordedBy    *int            `json:"recorded_by"`
+	CreatedAt     string          `json:"created_at"`
+}
+
+type RecordPaymentRequest struct {
+	Amount        billing.Money   `json:"amount"`
+	PaymentMethod string          `json:"payment_method"`
+	TransactionID string          `json:"transaction_id"`
+	Metadata      json.RawMessage `json:"metadata"`
+}
+
+// newPayment is a payment about to be written to the ledger
+type newPayment struct {
+	InvoiceID     int
+	Amount        billing.Money
+	Method        string
+	TransactionID string
+	Metadata      json.RawMessage
+	RecordedBy    interface{}
+}
+
+// invoiceBalance is an invoice's position after a payment
+type invoiceBalance struct {
+	InvoiceID      int           `json:"invoice_id"`
+	Status         string        `json:"status"`
+	Amount         billing.Money `json:"amount"`
+	AmountCredited billing.Money `json:"amount_credited"`
+	AmountPaid     billing.Money `json:"amount_paid"`
+	BalanceDue     billing.Money `json:"balance_due"`
+	// Set when the payment lifted a billing suspension of the invoice's ISP
+	ReactivatedISP int `json:"reactivated_isp_id,omitempty"`
+	// Commission ledger entry accrued for the distributor, if any
+	commissionID int
+	// Licenses the payment renewed
+	renewedLicenses []int
+}
+
+var (
+	errInvoiceNotFound  = errors.New("invoice not found")
+	errInvoiceCancelled = errors.New("invoice is cancelled")
+	errDuplicatePayment = errors.New("payment already recorded")
+)
+
+// recordPayment adds p to the ledger in tx and re-derives the invoice status.
+// Any amount is accepted: a partial payment leaves the invoice partially_paid,
+// an over-payment leaves a credit on the ISP's account and a negative amount
+// is a refund.
+func recordPayment(tx *sql.Tx, p newPayment) (int, invoiceBalance, error) {
+	var bal invoiceBalance
+
+	// Lock the invoice so concurrent payments are applied one after another
+	var status string
+	err := tx.QueryRow("SELECT status FROM invoices WHERE id = $1 FOR UPDATE", p.InvoiceID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return 0, bal, errInvoiceNotFound
+	}
+	if err != nil {
+		return 0, bal, err
+	}
+	if status == "cancelled" {
+		return 0, bal, errInvoiceCancelled
+	}
+
+	paymentID, err := insertPayment(tx, p)
+	if err != nil {
+		return 0, bal, err
+	}
+
+	bal, err = refreshInvoiceStatus(tx, p.InvoiceID)
+	if err != nil || bal.Status != "paid" {
+		return paymentID, bal, err
+	}
+
+	if bal.commissionID, err = accrueCommission(tx, p.InvoiceID); err != nil {
+		return paymentID, bal, err
+	}
+	if bal.renewedLicenses, err = renewLicensesForInvoice(tx, p.InvoiceID); err != nil {
+		return paymentID, bal, err
+	}
+
+	ispID, reactivated, err := reactivateIfSettled(tx, p.InvoiceID)
+	if reactivated {
+		bal.ReactivatedISP = ispID
+	}
+	return paymentID, bal, err
+}
+
+// insertPayment writes p to the ledger without touching the invoice
+func insertPayment(tx *sql.Tx, p newPayment) (int, error) {
+	var paymentID int
+	err := tx.QueryRow(`
+		INSERT INTO payments (invoice_id, amount, payment_method, transaction_id, status, metadata, recorded_by)
+		VALUES ($1, $2, $3, $4, 'completed', $5, $6) RETURNING id
+	`, p.InvoiceID, p.Amount, p.Method, nullIfEmpty(p.TransactionID), auditJSON(p.Metadata), p.RecordedBy).Scan(&paymentID)
+	if isUniqueViolation(err, "idx_payments_transaction") {
+		return 0, errDuplicatePayment
+	}
+	return paymentID, err
+}
+
+// paymentApplied reports the side effects of a committed payment: the audit
+// entries of the payment, any commission accrued and licenses renewed and, if
+// the ISP was reactivated, its audit entry and notification
+func (h *Handler) paymentApplied(r *http.Request, actorID interface{}, paymentID int, bal invoiceBalance) {
+	h.auditAs(r, actorID, "payment.create", "payment", paymentID, nil, h.auditSnapshot("payments", paymentID))
+	if bal.commissionID != 0 {
+		h.auditAs(r, actorID, "commission.accrue", "commission_entry", bal.commissionID, nil,
+			h.auditSnapshot("commission_entries", bal.commissionID))
+	}
+	h.auditLicenseRenewals(r, actorID, bal.InvoiceID, bal.renewedLicenses)
+	if bal.ReactivatedISP != 0 {
+		h.ispReactivated(r, actorID, bal.ReactivatedISP, bal.InvoiceID)
+	}
+}
+
+// ispReactivated audits and announces the lifting of a billing suspension
+func (h *Handler) ispReactivated(r *http.Request, actorID interface{}, ispID, invoiceID int) {
+	h.auditAs(r, actorID, "isp.activate", "isp", ispID, nil, h.auditSnapshot("isps", ispID))
+	h.notifyISP(ispID, notifyBilling, "Service reactivated",
+		"All overdue invoices are settled and the service has been reactivated.\n")
+	h.logger.Info("ISP reactivated", "isp_id", ispID, "invoice_id", invoiceID)
+}
+
+// refreshInvoiceStatus recomputes amount_paid from the completed payments and
+// derives the status from it. What credit notes gave back is not owed. An
+// overdue invoice stays overdue until it is paid in full.
+func refreshInvoiceStatus(tx *sql.Tx, invoiceID int) (invoiceBalance, error) {
+	bal := invoiceBalance{InvoiceID: invoiceID}
+	err := tx.QueryRow(`
+		UPDATE invoices inv SET
+			amount_paid = p.total,
+			status = CASE
+				WHEN inv.status = 'cancelled' THEN inv.status
+				WHEN p.total >= inv.amount - inv.amount_credited THEN 'paid'
+				WHEN inv.status = 'overdue' THEN 'overdue'
+				WHEN p.total > 0 THEN 'partially_paid'
+				ELSE 'pending'
+			END,
+			paid_at = CASE WHEN p.total >= inv.amount - inv.amount_credited THEN COALESCE(inv.paid_at, NOW()) END
+		FROM (
+			SELECT COALESCE(SUM(amount), 0) AS total FROM payments WHERE invoice_id = $1 AND status = 'completed'
+		) p
+		WHERE inv.id = $1
+		RETURNING inv.status, inv.amount, inv.amount_credited, inv.amount_paid
+	`, invoiceID).Scan(&bal.Status, &bal.Amount, &bal.AmountCredited, &bal.AmountPaid)
+	bal.BalanceDue = bal.Amount - bal.AmountCredited - bal.AmountPaid
+	return bal, err
+}
+
+// RecordPayment adds a payment to an invoice's ledger
+func (h *Handler) RecordPayment(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	claims := middleware.GetUserFromContext(r)
+
+	var req RecordPaymentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
+		return
+	}
+	if req.Amount <= 0 {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Amount must be positive"})
+		return
+	}
+	if len(req.Metadata) > 0 && !json.Valid(req.Metadata) {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Metadata must be valid JSON"})
+		return
+	}
+	req.PaymentMethod = strings.TrimSpace(req.PaymentMethod)
+	if req.PaymentMethod == "" {
+		req.PaymentMethod = "manual"
+	}
+
+	inv, err := h.findInvoice(claims, id)
+	if err != nil {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Invoice not found"})
+		return
+	}
+
+	paymentID, bal, err := h.applyPayment(newPayment{
+		InvoiceID:     inv.ID,
+		Amount:        req.Amount,
+		Method:        req.PaymentMethod,
+		TransactionID: strings.TrimSpace(req.TransactionID),
+		Metadata:      req.Metadata,
+		RecordedBy:    claims.UserID,
+	})
+	if h.sendPaymentError(w, err) {
+		return
+	}
+
+	h.paymentApplied(r, claims.UserID, paymentID, bal)
+	h.logger.Info("Payment recorded", "payment_id", paymentID, "invoice_id", inv.ID, "amount", req.Amount,
+		"status", bal.Status, "by", claims.UserID)
+	h.sendJSON(w, http.StatusCreated, Response{
+		Success: true,
+		Message: "Payment recorded",
+		Data: map[string]interface{}{
+			"id":      paymentID,
+			"invoice": bal,
+		},
+	})
+}
+
+// applyPayment records p in its own transaction
+func (h *Handler) applyPayment(p newPayment) (int, invoiceBalance, error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return 0, invoiceBalance{}, err
+	}
+	defer tx.Rollback()
+
+	paymentID, bal, err := recordPayment(tx, p)
+	if err != nil {
+		return 0, bal, err
+	}
+	return paymentID, bal, tx.Commit()
+}
+
+// sendPaymentError answers a failed payment and reports whether it sent an
+// error response
+func (h *Handler) sendPaymentError(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, errInvoiceNotFound):
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Invoice not found"})
+	case errors.Is(err, errInvoiceCancelled):
+		h.sendJSON(w, http.StatusConflict, Response{Success: false, Error: "Invoice is cancelled"})
+	case errors.Is(err, errDuplicatePayment):
+		h.sendJSON(w, http.StatusConflict, Response{Success: false, Error: "A payment with this transaction ID was already recorded"})
+	default:
+		h.logger.Error("Failed to record payment", "error", err)
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to record payment"})
+	}
+	return true
+}
+
+// GetInvoicePayments lists an invoice's payments, oldest first
+func (h *Handler) GetInvoicePayments(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+
+	inv, err := h.findInvoice(claims, mux.Vars(r)["id"])
+	if err != nil {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Invoice not found"})
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT id, invoice_id, amount, payment_method, transaction_id, status, metadata, recorded_by, created_at
+		FROM payments WHERE invoice_id = $1 ORDER BY created_at, id
+	`, inv.ID)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	payments := []PaymentResponse{}
+	for rows.Next() {
+		var p PaymentResponse
+		var metadata []byte
+		if err := rows.Scan(&p.ID, &p.InvoiceID, &p.Amount, &p.PaymentMethod, &p.TransactionID, &p.Status,
+			&metadata, &p.RecordedBy, &p.CreatedAt); err != nil {
+			continue
+		}
+		p.Metadata = nullableJSON(metadata)
+		payments = append(payments, p)
+	}
+
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Data: payments})
+}
+
+type AccountBalance struct {
+	ISPID         int           `json:"isp_id"`
+	Currency      string        `json:"currency"`
+	TotalInvoiced billing.Money `json:"total_invoiced"`
+	TotalCredited billing.Money `json:"total_credited"`
+	TotalPaid     billing.Money `json:"total_paid"`
+	// Balance is what the ISP owes; negative means the ISP is in credit
+	Balance       billing.Money `json:"balance"`
+	OverdueAmount billing.Money `json:"overdue_amount"`
+	OpenInvoices  int           `json:"open_invoices"`
+	// Credit waiting to be applied to the next invoice
+	CreditAvailable billing.Money `json:"credit_available"`
+}
+
+// GetISPBalance returns an ISP's account balance across all its invoices in
+// one currency: the ISP's billing currency unless ?currency= asks for another
+func (h *Handler) GetISPBalance(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	claims := middleware.GetUserFromContext(r)
+	if !h.canAccessISP(claims, id) {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "ISP not found"})
+		return
+	}
+	currency, ok := h.accountCurrency(r, id)
+	if !ok {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "currency must be a three-letter ISO 4217 code"})
+		return
+	}
+
+	b := AccountBalance{Currency: currency}
+	err := h.db.QueryRow(`
+		SELECT $1::int,
+		       COALESCE(SUM(amount), 0),
+		       COALESCE(SUM(amount_credited), 0),
+		       COALESCE(SUM(amount_paid), 0),
+		       COALESCE(SUM(amount - amount_credited - amount_paid) FILTER (WHERE status = 'overdue'), 0),
+		       COUNT(*) FILTER (WHERE status IN ('pending', 'partially_paid', 'overdue')),
+		       COALESCE(SUM(amount_paid - (amount - amount_credited)) FILTER (WHERE amount_paid > amount - amount_credited), 0)
+		FROM invoices
+		WHERE isp_id = $1 AND status <> 'cancelled' AND currency = $2
+	`, id, currency).Scan(&b.ISPID, &b.TotalInvoiced, &b.TotalCredited, &b.TotalPaid, &b.OverdueAmount, &b.OpenInvoices,
+		&b.CreditAvailable)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	b.Balance = b.TotalInvoiced - b.TotalCredited - b.TotalPaid
+
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Data: b})
+}
+
+type StatementEntry struct {
+	Date      string        `json:"date"`
+	Type      string        `json:"type"` // invoice, payment, refund or credit_note
+	InvoiceID int           `json:"invoice_id"`
+	PaymentID *int          `json:"payment_id,omitempty"`
+	Reference string        `json:"reference"`
+	Debit     billing.Money `json:"debit"`
+	Credit    billing.Money `json:"credit"`
+	Balance   billing.Money `json:"balance"`
+}
+
+type AccountStatement struct {
+	ISPID          int              `json:"isp_id"`
+	Currency       string           `json:"currency"`
+	From           *string          `json:"from"`
+	To             *string          `json:"to"`
+	OpeningBalance billing.Money    `json:"opening_balance"`
+	ClosingBalance billing.Money    `json:"closing_balance"`
+	Entries        []StatementEntry `json:"entries"`
+}
+
+// GetISPStatement lists an ISP's invoices, payments, refunds and credit notes
+// in date order with a running balance. Account credit moved from one invoice
+// to another nets to zero and is left out. Optional from and to (YYYY-MM-DD)
+// limit the entries shown; everything before from is carried in the opening
+// balance. Like the balance, a statement covers one currency.
+func (h *Handler) GetISPStatement(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	claims := middleware.GetUserFromContext(r)
+	if !h.canAccessISP(claims, id) {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "ISP not found"})
+		return
+	}
+
+	var from, to *time.Time
+	for _, f := range []struct {
+		param string
+		dst   **time.Time
+	}{{"from", &from}, {"to", &to}} {
+		v := r.URL.Query().Get(f.param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid " + f.param + ": use YYYY-MM-DD"})
+			return
+		}
+		*f.dst = &t
+	}
+
+	currency, ok := h.accountCurrency(r, id)
+	if !ok {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "currency must be a three-letter ISO 4217 code"})
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT created_at, 'invoice', id, NULL::int, invoice_number, amount, 0::numeric
+		FROM invoices
+		WHERE isp_id = $1 AND status <> 'cancelled' AND currency = $2
+		UNION ALL
+		SELECT p.created_at, CASE WHEN p.amount < 0 THEN 'refund' ELSE 'payment' END, p.invoice_id, p.id,
+		       COALESCE(p.transaction_id, inv.invoice_number), GREATEST(-p.amount, 0), GREATEST(p.amount, 0)
+		FROM payments p
+		JOIN invoices inv ON p.invoice_id = inv.id
+		WHERE inv.isp_id = $1 AND inv.status <> 'cancelled' AND inv.currency = $2 AND p.status = 'completed'
+		  AND p.payment_method <> 'credit'
+		UNION ALL
+		SELECT cn.created_at, 'credit_note', cn.invoice_id, NULL::int, cn.credit_note_number, 0::numeric, cn.amount
+		FROM credit_notes cn
+		JOIN invoices inv ON cn.invoice_id = inv.id
+		WHERE cn.isp_id = $1 AND inv.currency = $2
+		ORDER BY 1, 2
+	`, id, currency)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	st := AccountStatement{Currency: currency, Entries: []StatementEntry{}}
+	st.ISPID, _ = strconv.Atoi(id)
+	var balance billing.Money
+	for rows.Next() {
+		var e StatementEntry
+		var at time.Time
+		if err := rows.Scan(&at, &e.Type, &e.InvoiceID, &e.PaymentID, &e.Reference, &e.Debit, &e.Credit); err != nil {
+			h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+			return
+		}
+		day := billing.Date(at)
+		if to != nil && day.After(*to) {
+			break
+		}
+		balance += e.Debit - e.Credit
+		if from != nil && day.Before(*from) {
+			st.OpeningBalance = balance
+			continue
+		}
+		e.Date = at.Format(time.RFC3339)
+		e.Balance = balance
+		st.Entries = append(st.Entries, e)
+	}
+	st.ClosingBalance = balance
+
+	if from != nil {
+		s := from.Format("2006-01-02")
+		st.From = &s
+	}
+	if to != nil {
+		s := to.Format("2006-01-02")
+		st.To = &s
+	}
+
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Data: st})
+}
+
+// accountCurrency is the currency asked for with ?currency=, or else the
+// ISP's billing currency. ok is false for a malformed code.
+func (h *Handler) accountCurrency(r *http.Request, ispID string) (string, bool) {
+	currency, ok := normalizeCurrency(r.URL.Query().Get("currency"))
+	if !ok || currency != "" {
+		return currency, ok
+	}
+	h.db.QueryRow("SELECT currency FROM isps WHERE id = $1", ispID).Scan(&currency)
+	return currency, true
+}
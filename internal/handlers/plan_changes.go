@@ -0,0 +1,465 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"isp-saas.com/platform/internal/billing"
+	"isp-saas.com/platform/internal/middleware"
+)
+
+var (
+	errPlanNotFound = errors.New("plan not found")
+	errSamePlan     = errors.New("ISP is already on this plan")
+)
+
+type PlanChangeRequest struct {
+	PlanID int `json:"plan_id"`
+	// Switch when the current billing period ends instead of now, typically
+	// for downgrades
+	AtPeriodEnd bool `json:"at_period_end"`
+}
+
+type PlanChangeResponse struct {
+	ID            int           `json:"id"`
+	ISPID         int           `json:"isp_id"`
+	FromPlanID    *int          `json:"from_plan_id"`
+	FromPlanName  *string       `json:"from_plan_name"`
+	ToPlanID      int           `json:"to_plan_id"`
+	ToPlanName    string        `json:"to_plan_name"`
+	EffectiveDate string        `json:"effective_date"`
+	Status        string        `json:"status"`
+	Credit        billing.Money `json:"credit"`
+	Charge        billing.Money `json:"charge"`
+	RequestedBy   *int          `json:"requested_by"`
+	CreatedAt     string        `json:"created_at"`
+	AppliedAt     *string       `json:"applied_at"`
+}
+
+// ispPlanState is an ISP's plan and billing cycle, read under a row lock
+type ispPlanState struct {
+	planID   *int
+	planName string
+	currency string
+	price    billing.Money
+	anchor   time.Time
+}
+
+type planInfo struct {
+	name  string
+	price billing.Money
+}
+
+// ChangeISPPlan moves an ISP to another plan. An immediate change credits
+// the unused part of the old plan and charges the new plan for the rest of
+// the billing period; both show up on the next recurring invoice. With
+// at_period_end the change waits for the next period instead.
+func (h *Handler) ChangeISPPlan(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+	id := mux.Vars(r)["id"]
+	if !h.canAccessISP(claims, id) {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "ISP not found"})
+		return
+	}
+	ispID, _ := strconv.Atoi(id)
+
+	var req PlanChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.PlanID <= 0 {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "plan_id is required"})
+		return
+	}
+
+	before := h.auditSnapshot("isps", ispID)
+	change, err := h.changePlan(ispID, req.PlanID, req.AtPeriodEnd, claims.UserID, time.Now())
+	if h.sendPlanChangeError(w, err) {
+		return
+	}
+
+	if change.Status == "applied" {
+		h.audit(r, "isp.plan_change", "isp", ispID, before, h.auditSnapshot("isps", ispID))
+	} else {
+		h.audit(r, "isp.plan_schedule", "isp", ispID, nil, change)
+	}
+	h.logger.Info("ISP plan changed", "isp_id", ispID, "plan_id", req.PlanID, "status", change.Status,
+		"effective", change.EffectiveDate, "by", claims.UserID)
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Data: change})
+}
+
+// GetISPPlanChanges lists an ISP's plan changes, newest first
+func (h *Handler) GetISPPlanChanges(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+	id := mux.Vars(r)["id"]
+	if !h.canAccessISP(claims, id) {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "ISP not found"})
+		return
+	}
+
+	rows, err := h.db.Query(planChangeSelect+" WHERE pc.isp_id = $1 ORDER BY pc.created_at DESC, pc.id DESC", id)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	changes := []PlanChangeResponse{}
+	for rows.Next() {
+		var c PlanChangeResponse
+		if err := scanPlanChange(rows, &c); err != nil {
+			continue
+		}
+		changes = append(changes, c)
+	}
+
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Data: changes})
+}
+
+// CancelScheduledPlanChange drops a plan change that has not taken effect yet
+func (h *Handler) CancelScheduledPlanChange(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+	id := mux.Vars(r)["id"]
+	if !h.canAccessISP(claims, id) {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "ISP not found"})
+		return
+	}
+
+	var changeID int
+	err := h.db.QueryRow(`
+		UPDATE plan_changes SET status = 'cancelled'
+		WHERE isp_id = $1 AND status = 'scheduled'
+		RETURNING id
+	`, id).Scan(&changeID)
+	if err == sql.ErrNoRows {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "No scheduled plan change"})
+		return
+	}
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+
+	h.audit(r, "isp.plan_schedule_cancel", "isp", id, h.auditSnapshot("plan_changes", changeID), nil)
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Scheduled plan change cancelled"})
+}
+
+func (h *Handler) sendPlanChangeError(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, errPlanNotFound):
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Plan not found"})
+	case errors.Is(err, errSamePlan):
+		h.sendJSON(w, http.StatusConflict, Response{Success: false, Error: "ISP is already on this plan"})
+	case errors.Is(err, errNoPlanPrice):
+		h.sendJSON(w, http.StatusConflict, Response{Success: false, Error: "Plan has no price in the ISP's currency"})
+	case errors.Is(err, sql.ErrNoRows):
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "ISP not found"})
+	default:
+		h.logger.Error("Plan change failed", "error", err)
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to change plan"})
+	}
+	return true
+}
+
+// changePlan switches ispID to planID now, or schedules the switch for the
+// start of the next billing period. Any change scheduled earlier is
+// replaced.
+func (h *Handler) changePlan(ispID, planID int, atPeriodEnd bool, requestedBy int, asOf time.Time) (PlanChangeResponse, error) {
+	var change PlanChangeResponse
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return change, err
+	}
+	defer tx.Rollback()
+
+	isp, err := lockISPPlan(tx, ispID)
+	if err != nil {
+		return change, err
+	}
+	plan, err := activePlan(tx, planID, isp.currency)
+	if err != nil {
+		return change, err
+	}
+	if isp.planID != nil && *isp.planID == planID {
+		return change, errSamePlan
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE plan_changes SET status = 'cancelled' WHERE isp_id = $1 AND status = 'scheduled'
+	`, ispID); err != nil {
+		return change, err
+	}
+
+	today := billing.Date(asOf)
+	period := billing.PeriodContaining(isp.anchor, today)
+
+	var changeID int
+	if atPeriodEnd {
+		err = tx.QueryRow(`
+			INSERT INTO plan_changes (isp_id, from_plan_id, to_plan_id, effective_date, status, requested_by)
+			VALUES ($1, $2, $3, $4, 'scheduled', $5) RETURNING id
+		`, ispID, isp.planID, planID, period.End.AddDate(0, 0, 1), requestedBy).Scan(&changeID)
+		if err != nil {
+			return change, err
+		}
+	} else {
+		// Prorate only when this period was billed on the old plan. An unbilled
+		// period is invoiced on the new plan when the billing run gets to it.
+		var billed bool
+		err := tx.QueryRow(`
+			SELECT EXISTS(SELECT 1 FROM invoices WHERE isp_id = $1 AND period_start = $2 AND status <> 'cancelled')
+		`, ispID, period.Start).Scan(&billed)
+		if err != nil {
+			return change, err
+		}
+
+		var pr billing.Proration
+		if billed {
+			pr = period.Prorate(today, isp.price, plan.price)
+		}
+
+		err = tx.QueryRow(`
+			INSERT INTO plan_changes (isp_id, from_plan_id, to_plan_id, effective_date, status, credit, charge,
+			                          requested_by, applied_at)
+			VALUES ($1, $2, $3, $4, 'applied', $5, $6, $7, NOW()) RETURNING id
+		`, ispID, isp.planID, planID, today, pr.Credit, pr.Charge, requestedBy).Scan(&changeID)
+		if err != nil {
+			return change, err
+		}
+
+		span := fmt.Sprintf("%s to %s", today.Format("2006-01-02"), period.End.Format("2006-01-02"))
+		if pr.Credit > 0 {
+			_, err := addPendingItem(tx, ispID, changeID, invoiceLine{
+				Description: fmt.Sprintf("Unused time on %s plan, %s", isp.planName, span),
+				Quantity:    billing.QuantityOne,
+				UnitPrice:   -pr.Credit,
+				ItemType:    itemProration,
+				PlanID:      isp.planID,
+			})
+			if err != nil {
+				return change, err
+			}
+		}
+		if pr.Charge > 0 {
+			_, err := addPendingItem(tx, ispID, changeID, invoiceLine{
+				Description: fmt.Sprintf("Remaining time on %s plan, %s", plan.name, span),
+				Quantity:    billing.QuantityOne,
+				UnitPrice:   pr.Charge,
+				ItemType:    itemProration,
+				PlanID:      &planID,
+			})
+			if err != nil {
+				return change, err
+			}
+		}
+
+		if err := setISPPlan(tx, ispID, planID); err != nil {
+			return change, err
+		}
+	}
+
+	if err := scanPlanChange(tx.QueryRow(planChangeSelect+" WHERE pc.id = $1", changeID), &change); err != nil {
+		return change, err
+	}
+	if err := tx.Commit(); err != nil {
+		return change, err
+	}
+	if change.Status == "applied" {
+		h.forgetValidations(h.licenseCacheKeys("l.isp_id = $1", ispID))
+	}
+	return change, nil
+}
+
+// applyScheduledPlanChanges carries out the scheduled changes whose date has
+// come. Billing runs it first, so a new period is billed on the new plan.
+func (h *Handler) applyScheduledPlanChanges(asOf time.Time) (int, error) {
+	rows, err := h.db.Query(`
+		SELECT id, isp_id, to_plan_id FROM plan_changes
+		WHERE status = 'scheduled' AND effective_date <= $1
+		ORDER BY effective_date, id
+	`, billing.Date(asOf))
+	if err != nil {
+		return 0, err
+	}
+
+	type dueChange struct{ id, ispID, planID int }
+	var due []dueChange
+	for rows.Next() {
+		var c dueChange
+		if err := rows.Scan(&c.id, &c.ispID, &c.planID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for _, c := range due {
+		ok, err := h.applyScheduledPlanChange(c.id, c.ispID, c.planID)
+		if err != nil {
+			return applied, err
+		}
+		if ok {
+			applied++
+			h.auditAs(nil, nil, "isp.plan_change", "isp", c.ispID, nil, h.auditSnapshot("isps", c.ispID))
+			h.logger.Info("Scheduled plan change applied", "isp_id", c.ispID, "plan_id", c.planID, "change_id", c.id)
+		}
+	}
+	return applied, nil
+}
+
+func (h *Handler) applyScheduledPlanChange(changeID, ispID, planID int) (bool, error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Cancelled or applied by a concurrent run in the meantime
+	res, err := tx.Exec(`
+		UPDATE plan_changes SET status = 'applied', applied_at = NOW()
+		WHERE id = $1 AND status = 'scheduled'
+	`, changeID)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	if err := setISPPlan(tx, ispID, planID); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	h.forgetValidations(h.licenseCacheKeys("l.isp_id = $1", ispID))
+	return true, nil
+}
+
+// lockISPPlan reads an ISP's plan priced in the ISP's currency. A plan with
+// no price in that currency is priced at 0, so nothing is credited for it.
+func lockISPPlan(tx *sql.Tx, ispID int) (ispPlanState, error) {
+	var s ispPlanState
+	err := tx.QueryRow(`
+		SELECT i.plan_id, COALESCE(p.name, ''), i.currency, COALESCE(pb.price_monthly, 0),
+		       COALESCE(i.billing_anchor, i.created_at::date)
+		FROM isps i
+		LEFT JOIN plans p ON i.plan_id = p.id
+		LEFT JOIN plan_price_book pb ON pb.plan_id = i.plan_id AND pb.currency = i.currency
+		WHERE i.id = $1
+		FOR UPDATE OF i
+	`, ispID).Scan(&s.planID, &s.planName, &s.currency, &s.price, &s.anchor)
+	return s, err
+}
+
+// activePlan reads a plan that can be sold in currency
+func activePlan(tx *sql.Tx, planID int, currency string) (planInfo, error) {
+	var p planInfo
+	var priced bool
+	err := tx.QueryRow(`
+		SELECT p.name, pb.plan_id IS NOT NULL, COALESCE(pb.price_monthly, 0)
+		FROM plans p
+		LEFT JOIN plan_price_book pb ON pb.plan_id = p.id AND pb.currency = $2
+		WHERE p.id = $1 AND p.is_active = true
+	`, planID, currency).Scan(&p.name, &priced, &p.price)
+	if err == sql.ErrNoRows {
+		return p, errPlanNotFound
+	}
+	if err == nil && !priced {
+		return p, errNoPlanPrice
+	}
+	return p, err
+}
+
+// setISPPlan puts an ISP on a plan and takes over the plan's cache size and
+// bandwidth limit. Limits the plan leaves empty keep their current value. The
+// ISP's licenses move to the new plan's modules.
+func setISPPlan(tx *sql.Tx, ispID, planID int) error {
+	var before []byte
+	err := tx.QueryRow(`
+		SELECT COALESCE((SELECT jsonb_agg(pm.module_key) FROM plan_modules pm WHERE pm.plan_id = i.plan_id), '[]')
+		FROM isps i WHERE i.id = $1
+	`, ispID).Scan(&before)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE isps i SET plan_id = p.id,
+		       cache_size_gb = COALESCE(p.cache_size_gb, i.cache_size_gb),
+		       bandwidth_limit_mbps = COALESCE(p.bandwidth_limit_mbps, i.bandwidth_limit_mbps),
+		       updated_at = NOW()
+		FROM plans p
+		WHERE i.id = $1 AND p.id = $2
+	`, ispID, planID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(licenseModulesFromPlan+"l.isp_id = $3", planID, string(before), ispID)
+	return err
+}
+
+// addPendingItem queues a line for the ISP's next recurring invoice.
+// planChangeID is nil for items that do not come from a plan change.
+func addPendingItem(tx *sql.Tx, ispID int, planChangeID interface{}, l invoiceLine) (int, error) {
+	var id int
+	err := tx.QueryRow(`
+		INSERT INTO pending_invoice_items (isp_id, plan_change_id, description, quantity, unit_price, item_type,
+		                                   plan_id, usage_metric)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id
+	`, ispID, planChangeID, l.Description, l.Quantity, l.UnitPrice, l.ItemType, l.PlanID, l.UsageMetric).Scan(&id)
+	return id, err
+}
+
+// takePendingItems locks the ISP's unbilled pending items and returns them as
+// invoice lines along with their ids
+func takePendingItems(tx *sql.Tx, ispID int) ([]invoiceLine, []int, error) {
+	rows, err := tx.Query(`
+		SELECT id, description, quantity, unit_price, item_type, plan_id, usage_metric
+		FROM pending_invoice_items
+		WHERE isp_id = $1 AND invoice_id IS NULL
+		ORDER BY id
+		FOR UPDATE
+	`, ispID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var lines []invoiceLine
+	var ids []int
+	for rows.Next() {
+		var id int
+		var l invoiceLine
+		if err := rows.Scan(&id, &l.Description, &l.Quantity, &l.UnitPrice, &l.ItemType, &l.PlanID, &l.UsageMetric); err != nil {
+			return nil, nil, err
+		}
+		lines = append(lines, l)
+		ids = append(ids, id)
+	}
+	return lines, ids, rows.Err()
+}
+
+const planChangeSelect = `
+	SELECT pc.id, pc.isp_id, pc.from_plan_id, fp.name, pc.to_plan_id, tp.name, pc.effective_date, pc.status,
+	       pc.credit, pc.charge, pc.requested_by, pc.created_at, pc.applied_at
+	FROM plan_changes pc
+	LEFT JOIN plans fp ON pc.from_plan_id = fp.id
+	JOIN plans tp ON pc.to_plan_id = tp.id
+`
+
+func scanPlanChange(row interface{ Scan(...interface{}) error }, c *PlanChangeResponse) error {
+	return row.Scan(&c.ID, &c.ISPID, &c.FromPlanID, &c.FromPlanName, &c.ToPlanID, &c.ToPlanName,
+		&c.EffectiveDate, &c.Status, &c.Credit, &c.Charge, &c.RequestedBy, &c.CreatedAt, &c.AppliedAt)
+}
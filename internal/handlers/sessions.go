@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"isp-saas.com/platform/internal/middleware"
+)
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var (
+	errRefreshTokenInvalid = errors.New("invalid refresh token")
+	errRefreshTokenReused  = errors.New("refresh token reuse detected")
+	errAccountDisabled     = errors.New("account is disabled")
+)
+
+type SessionResponse struct {
+	ID         int     `json:"id"`
+	IPAddress  *string `json:"ip_address"`
+	UserAgent  string  `json:"user_agent"`
+	CreatedAt  string  `json:"created_at"`
+	LastUsedAt *string `json:"last_used_at"`
+	ExpiresAt  string  `json:"expires_at"`
+	Current    bool    `json:"current"`
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// tokenPair is what every successful sign-in or refresh hands back
+type tokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	SessionID    int
+}
+
+func (t tokenPair) data() map[string]interface{} {
+	return map[string]interface{}{
+		"token":         t.AccessToken,
+		"refresh_token": t.RefreshToken,
+		"expires_in":    int(accessTokenTTL.Seconds()),
+	}
+}
+
+// startSession opens a new server-side session for the user and issues its
+// first access/refresh token pair.
+func (h *Handler) startSession(r *http.Request, userID int, email, role string) (tokenPair, error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return tokenPair{}, err
+	}
+	defer tx.Rollback()
+
+	expiresAt := time.Now().Add(refreshTokenTTL)
+
+	var sessionID int
+	err = tx.QueryRow(`
+		INSERT INTO sessions (user_id, ip_address, user_agent, expires_at)
+		VALUES ($1, $2, $3, $4) RETURNING id
+	`, userID, clientIP(r), r.UserAgent(), expiresAt).Scan(&sessionID)
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	refreshToken := generateRandomKey(32)
+	_, err = tx.Exec(`
+		INSERT INTO refresh_tokens (session_id, token_hash, expires_at) VALUES ($1, $2, $3)
+	`, sessionID, hashToken(refreshToken), expiresAt)
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	accessToken, err := generateJWT(userID, email, role, sessionID)
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return tokenPair{}, err
+	}
+
+	return tokenPair{AccessToken: accessToken, RefreshToken: refreshToken, SessionID: sessionID}, nil
+}
+
+// rotateRefreshToken exchanges a refresh token for a new pair. Presenting a
+// token that was already rotated revokes the whole session, since it means
+// either the client or an attacker holds a stale copy.
+func (h *Handler) rotateRefreshToken(refreshToken string) (tokenPair, error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return tokenPair{}, err
+	}
+	defer tx.Rollback()
+
+	var tokenID, sessionID, userID int
+	var usedAt, revokedAt sql.NullTime
+	var expiresAt time.Time
+	var email, role string
+	var isActive bool
+	err = tx.QueryRow(`
+		SELECT rt.id, rt.session_id, rt.used_at, rt.expires_at, s.revoked_at,
+		       u.id, u.email, u.role, u.is_active
+		FROM refresh_tokens rt
+		JOIN sessions s ON rt.session_id = s.id
+		JOIN users u ON s.user_id = u.id
+		WHERE rt.token_hash = $1
+		FOR UPDATE OF rt, s
+	`, hashToken(refreshToken)).Scan(&tokenID, &sessionID, &usedAt, &expiresAt, &revokedAt,
+		&userID, &email, &role, &isActive)
+	if err != nil {
+		return tokenPair{}, errRefreshTokenInvalid
+	}
+
+	if revokedAt.Valid || time.Now().After(expiresAt) {
+		return tokenPair{}, errRefreshTokenInvalid
+	}
+
+	if usedAt.Valid {
+		tx.Exec(`
+			UPDATE sessions SET revoked_at = NOW(), revoked_reason = 'refresh_token_reuse' WHERE id = $1
+		`, sessionID)
+		tx.Commit()
+		h.logger.Warn("Refresh token reuse detected, session revoked", "session_id", sessionID, "user_id", userID)
+		return tokenPair{}, errRefreshTokenReused
+	}
+
+	if !isActive {
+		return tokenPair{}, errAccountDisabled
+	}
+
+	newExpiresAt := time.Now().Add(refreshTokenTTL)
+	newToken := generateRandomKey(32)
+
+	if _, err := tx.Exec("UPDATE refresh_tokens SET used_at = NOW() WHERE id = $1", tokenID); err != nil {
+		return tokenPair{}, err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO refresh_tokens (session_id, token_hash, expires_at) VALUES ($1, $2, $3)
+	`, sessionID, hashToken(newToken), newExpiresAt); err != nil {
+		return tokenPair{}, err
+	}
+	if _, err := tx.Exec(`
+		UPDATE sessions SET last_used_at = NOW(), expires_at = $1 WHERE id = $2
+	`, newExpiresAt, sessionID); err != nil {
+		return tokenPair{}, err
+	}
+
+	accessToken, err := generateJWT(userID, email, role, sessionID)
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return tokenPair{}, err
+	}
+
+	return tokenPair{AccessToken: accessToken, RefreshToken: newToken, SessionID: sessionID}, nil
+}
+
+// revokeUserSessions ends every active session of a user
+func (h *Handler) revokeUserSessions(userID interface{}, reason string) (int64, error) {
+	result, err := h.db.Exec(`
+		UPDATE sessions SET revoked_at = NOW(), revoked_reason = $1
+		WHERE user_id = $2 AND revoked_at IS NULL
+	`, reason, userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+
+	_, err := h.db.Exec(`
+		UPDATE sessions SET revoked_at = NOW(), revoked_reason = 'logout'
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`, claims.SessionID, claims.UserID)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to log out"})
+		return
+	}
+
+	h.logger.Info("User logged out", "user_id", claims.UserID, "session_id", claims.SessionID)
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Logged out successfully"})
+}
+
+func (h *Handler) LogoutAll(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+
+	revoked, err := h.revokeUserSessions(claims.UserID, "logout_all")
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to log out"})
+		return
+	}
+
+	h.logger.Info("User logged out of all sessions", "user_id", claims.UserID, "sessions", revoked)
+	h.sendJSON(w, http.StatusOK, Response{
+		Success: true,
+		Message: "Logged out of all sessions",
+		Data:    map[string]int64{"sessions_revoked": revoked},
+	})
+}
+
+func (h *Handler) GetSessions(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+
+	rows, err := h.db.Query(`
+		SELECT id, HOST(ip_address), COALESCE(user_agent, ''), created_at, last_used_at, expires_at
+		FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		ORDER BY last_used_at DESC
+	`, claims.UserID)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	sessions := []SessionResponse{}
+	for rows.Next() {
+		var s SessionResponse
+		if err := rows.Scan(&s.ID, &s.IPAddress, &s.UserAgent, &s.CreatedAt, &s.LastUsedAt, &s.ExpiresAt); err != nil {
+			continue
+		}
+		s.Current = s.ID == claims.SessionID
+		sessions = append(sessions, s)
+	}
+
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Data: sessions})
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// clientIP returns the caller's address suitable for an INET column, or nil
+func clientIP(r *http.Request) interface{} {
+	ip := r.Header.Get("X-Forwarded-For")
+	if ip == "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		ip = host
+	}
+	ip = strings.TrimSpace(strings.Split(ip, ",")[0])
+	if net.ParseIP(ip) == nil {
+		return nil
+	}
+	return ip
+}
@@ -3,8 +3,12 @@ package handlers
 import (
     "encoding/json"
     "net/http"
+    "strconv"
+    "time"
 
+    "isp-saas.com/platform/internal/billing"
     "isp-saas.com/platform/internal/middleware"
+    "isp-saas.com/platform/internal/rbac"
 )
 
 type SettingResponse struct {
@@ -20,12 +24,6 @@ type UpdateSettingRequest struct {
 }
 
 func (h *Handler) GetSettings(w http.ResponseWriter, r *http.Request) {
-    claims := middleware.GetUserFromContext(r)
-    if claims.Role != "admin" {
-        h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Admin access required"})
-        return
-    }
-
     rows, err := h.db.Query(`
         SELECT id, key, COALESCE(value, ''), COALESCE(description, ''), updated_at
         FROM settings ORDER BY key
@@ -63,12 +61,29 @@ func (h *Handler) GetSetting(w http.ResponseWriter, r *http.Request) {
     h.sendJSON(w, http.StatusOK, Response{Success: true, Data: map[string]string{"key": key, "value": value}})
 }
 
+// getSetting reads a platform setting, falling back to defaultValue when the
+// key is missing or empty
+func (h *Handler) getSetting(key, defaultValue string) string {
+    var value string
+    err := h.db.QueryRow("SELECT COALESCE(value, '') FROM settings WHERE key = $1", key).Scan(&value)
+    if err != nil || value == "" {
+        return defaultValue
+    }
+    return value
+}
+
+// getSettingInt reads a numeric platform setting, falling back to
+// defaultValue when it is missing or not a number
+func (h *Handler) getSettingInt(key string, defaultValue int) int {
+    n, err := strconv.Atoi(h.getSetting(key, ""))
+    if err != nil {
+        return defaultValue
+    }
+    return n
+}
+
 func (h *Handler) UpdateSetting(w http.ResponseWriter, r *http.Request) {
     claims := middleware.GetUserFromContext(r)
-    if claims.Role != "admin" {
-        h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Admin access required"})
-        return
-    }
 
     key := r.URL.Query().Get("key")
     if key == "" {
@@ -82,6 +97,21 @@ func (h *Handler) UpdateSetting(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    // Switching the base currency only affects invoices issued afterwards;
+    // earlier ones keep the base currency and rate they were issued with
+    if key == "base_currency" {
+        code, ok := normalizeCurrency(req.Value)
+        if !ok || code == "" || !currencyActive(h.db, code) {
+            h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "base_currency must be an active currency code"})
+            return
+        }
+        req.Value = code
+    }
+
+    var settingID int
+    h.db.QueryRow("SELECT id FROM settings WHERE key = $1", key).Scan(&settingID)
+    before := h.auditSnapshot("settings", settingID)
+
     result, err := h.db.Exec(`
         UPDATE settings SET value = $1, updated_by = $2, updated_at = NOW() WHERE key = $3
     `, req.Value, claims.UserID, key)
@@ -97,40 +127,69 @@ func (h *Handler) UpdateSetting(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    h.audit(r, "setting.update", "setting", settingID, before, h.auditSnapshot("settings", settingID))
     h.logger.Info("Setting updated", "key", key, "value", req.Value, "by", claims.UserID)
     h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Setting updated successfully"})
 }
 
 func (h *Handler) GetDashboardStats(w http.ResponseWriter, r *http.Request) {
     claims := middleware.GetUserFromContext(r)
-    if claims.Role != "admin" && claims.Role != "distributor" {
-        h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Access denied"})
-        return
-    }
+    scope, args := tenantScope(claims, "i", 1)
 
     stats := make(map[string]interface{})
 
     // Total ISPs
     var totalISPs, activeISPs, suspendedISPs int
-    h.db.QueryRow("SELECT COUNT(*) FROM isps").Scan(&totalISPs)
-    h.db.QueryRow("SELECT COUNT(*) FROM isps WHERE status = 'active'").Scan(&activeISPs)
-    h.db.QueryRow("SELECT COUNT(*) FROM isps WHERE status = 'suspended'").Scan(&suspendedISPs)
+    h.db.QueryRow(`
+        SELECT COUNT(*),
+               COUNT(*) FILTER (WHERE i.status = 'active'),
+               COUNT(*) FILTER (WHERE i.status = 'suspended')
+        FROM isps i WHERE `+scope, args...).Scan(&totalISPs, &activeISPs, &suspendedISPs)
 
-    // Total Users
+    // Total Users: the whole platform for staff, ISP accounts in the tenant otherwise
     var totalUsers int
-    h.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&totalUsers)
+    if rbac.Allowed(claims.Role, rbac.TenantAll) {
+        h.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&totalUsers)
+    } else {
+        h.db.QueryRow("SELECT COUNT(DISTINCT i.user_id) FROM isps i WHERE "+scope, args...).Scan(&totalUsers)
+    }
 
-    // Revenue stats
-    var totalRevenue, pendingRevenue float64
-    h.db.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM invoices WHERE status = 'paid'").Scan(&totalRevenue)
-    h.db.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM invoices WHERE status = 'pending'").Scan(&pendingRevenue)
+    // Revenue stats in the base currency. Invoices are converted at the rate
+    // they were issued at; ones issued under an earlier base currency are
+    // converted on from that at today's rate.
+    base, _ := baseCurrency(h.db)
+    var totalRevenue, pendingRevenue billing.Money
+    rows, err := h.db.Query(`
+        SELECT inv.base_currency,
+               COALESCE(SUM(ROUND((inv.amount - inv.amount_credited) * inv.exchange_rate, 2)) FILTER (WHERE inv.status = 'paid'), 0),
+               COALESCE(SUM(ROUND(inv.amount * inv.exchange_rate, 2)) FILTER (WHERE inv.status = 'pending'), 0)
+        FROM invoices inv JOIN isps i ON inv.isp_id = i.id
+        WHERE `+scope+`
+        GROUP BY inv.base_currency`, args...)
+    if err == nil {
+        defer rows.Close()
+        for rows.Next() {
+            var currency string
+            var paid, pending billing.Money
+            if err := rows.Scan(&currency, &paid, &pending); err != nil {
+                continue
+            }
+            rate, _, err := exchangeRate(h.db, currency, base, time.Now())
+            if err != nil {
+                h.logger.Warn("Revenue left out of dashboard", "currency", currency, "base_currency", base, "error", err)
+                continue
+            }
+            totalRevenue += paid.Convert(rate)
+            pendingRevenue += pending.Convert(rate)
+        }
+    }
 
     // Telemetry stats (last 24h)
     var totalHits, totalMisses, bandwidthSaved int64
     h.db.QueryRow(`
-        SELECT COALESCE(SUM(cache_hits), 0), COALESCE(SUM(cache_misses), 0), COALESCE(SUM(bandwidth_saved_mb), 0)
-        FROM telemetry WHERE created_at > NOW() - INTERVAL '24 hours'
-    `).Scan(&totalHits, &totalMisses, &bandwidthSaved)
+        SELECT COALESCE(SUM(t.cache_hits), 0), COALESCE(SUM(t.cache_misses), 0), COALESCE(SUM(t.bandwidth_saved_mb), 0)
+        FROM telemetry t JOIN isps i ON t.isp_id = i.id
+        WHERE t.created_at > NOW() - INTERVAL '24 hours' AND `+scope, args...).Scan(&totalHits, &totalMisses, &bandwidthSaved)
 
     var hitRate float64
     if totalHits+totalMisses > 0 {
@@ -139,8 +198,11 @@ func (h *Handler) GetDashboardStats(w http.ResponseWriter, r *http.Request) {
 
     // Active licenses
     var activeLicenses, expiringSoon int
-    h.db.QueryRow("SELECT COUNT(*) FROM licenses WHERE is_active = true AND expires_at > NOW()").Scan(&activeLicenses)
-    h.db.QueryRow("SELECT COUNT(*) FROM licenses WHERE is_active = true AND expires_at BETWEEN NOW() AND NOW() + INTERVAL '7 days'").Scan(&expiringSoon)
+    h.db.QueryRow(`
+        SELECT COUNT(*) FILTER (WHERE l.expires_at > NOW()),
+               COUNT(*) FILTER (WHERE l.expires_at BETWEEN NOW() AND NOW() + INTERVAL '7 days')
+        FROM licenses l JOIN isps i ON l.isp_id = i.id
+        WHERE l.is_active = true AND `+scope, args...).Scan(&activeLicenses, &expiringSoon)
 
     stats["isps"] = map[string]int{
         "total":     totalISPs,
@@ -150,9 +212,10 @@ func (h *Handler) GetDashboardStats(w http.ResponseWriter, r *http.Request) {
     stats["users"] = map[string]int{
         "total": totalUsers,
     }
-    stats["revenue"] = map[string]float64{
-        "total":   totalRevenue,
-        "pending": pendingRevenue,
+    stats["revenue"] = map[string]interface{}{
+        "total":    totalRevenue,
+        "pending":  pendingRevenue,
+        "currency": base,
     }
     stats["cache"] = map[string]interface{}{
         "hits":            totalHits,
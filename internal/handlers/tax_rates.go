@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"isp-saas.com/platform/internal/billing"
+	"isp-saas.com/platform/internal/middleware"
+)
+
+var countryCodePattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
+type TaxRateResponse struct {
+	ID          int          `json:"id"`
+	Name        string       `json:"name"`
+	RatePercent billing.Rate `json:"rate_percent"`
+	CountryCode *string      `json:"country_code"`
+	ISPID       *int         `json:"isp_id"`
+	IsActive    bool         `json:"is_active"`
+	CreatedAt   string       `json:"created_at"`
+}
+
+// TaxRateRequest sets a rate for one ISP, for a country, or, with neither,
+// the default rate
+type TaxRateRequest struct {
+	Name        string       `json:"name"`
+	RatePercent billing.Rate `json:"rate_percent"`
+	CountryCode *string      `json:"country_code"`
+	ISPID       *int         `json:"isp_id"`
+	IsActive    *bool        `json:"is_active"`
+}
+
+func (h *Handler) GetTaxRates(w http.ResponseWriter, r *http.Request) {
+	rows, err := h.db.Query(`
+		SELECT id, name, rate_percent, country_code, isp_id, is_active, created_at
+		FROM tax_rates
+		ORDER BY isp_id NULLS FIRST, country_code NULLS FIRST, id
+	`)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	rates := []TaxRateResponse{}
+	for rows.Next() {
+		var t TaxRateResponse
+		if err := rows.Scan(&t.ID, &t.Name, &t.RatePercent, &t.CountryCode, &t.ISPID, &t.IsActive, &t.CreatedAt); err != nil {
+			continue
+		}
+		rates = append(rates, t)
+	}
+
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Data: rates})
+}
+
+func (h *Handler) CreateTaxRate(w http.ResponseWriter, r *http.Request) {
+	var req TaxRateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
+		return
+	}
+	if msg := validateTaxRate(&req); msg != "" {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: msg})
+		return
+	}
+	if req.ISPID != nil && !h.canAccessISP(middleware.GetUserFromContext(r), *req.ISPID) {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "ISP not found"})
+		return
+	}
+
+	isActive := req.IsActive == nil || *req.IsActive
+
+	var id int
+	err := h.db.QueryRow(`
+		INSERT INTO tax_rates (name, rate_percent, country_code, isp_id, is_active)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id
+	`, req.Name, req.RatePercent, req.CountryCode, req.ISPID, isActive).Scan(&id)
+	if err != nil {
+		h.sendJSON(w, http.StatusConflict, Response{Success: false, Error: "An active tax rate already exists for this scope"})
+		return
+	}
+
+	h.audit(r, "tax_rate.create", "tax_rate", id, nil, h.auditSnapshot("tax_rates", id))
+	h.sendJSON(w, http.StatusCreated, Response{Success: true, Message: "Tax rate created", Data: map[string]int{"id": id}})
+}
+
+// UpdateTaxRate replaces a rate. Invoices keep the rate they were issued
+// with, so this only affects invoices created afterwards.
+func (h *Handler) UpdateTaxRate(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var req TaxRateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid request body"})
+		return
+	}
+	if msg := validateTaxRate(&req); msg != "" {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: msg})
+		return
+	}
+	if req.ISPID != nil && !h.canAccessISP(middleware.GetUserFromContext(r), *req.ISPID) {
+		h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "ISP not found"})
+		return
+	}
+
+	before := h.auditSnapshot("tax_rates", id)
+	if before == nil {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Tax rate not found"})
+		return
+	}
+
+	_, err := h.db.Exec(`
+		UPDATE tax_rates SET name = $1, rate_percent = $2, country_code = $3, isp_id = $4,
+		       is_active = COALESCE($5, is_active), updated_at = NOW()
+		WHERE id = $6
+	`, req.Name, req.RatePercent, req.CountryCode, req.ISPID, req.IsActive, id)
+	if err != nil {
+		h.sendJSON(w, http.StatusConflict, Response{Success: false, Error: "An active tax rate already exists for this scope"})
+		return
+	}
+
+	h.audit(r, "tax_rate.update", "tax_rate", id, before, h.auditSnapshot("tax_rates", id))
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Tax rate updated"})
+}
+
+func (h *Handler) DeleteTaxRate(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	before := h.auditSnapshot("tax_rates", id)
+	if before == nil {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "Tax rate not found"})
+		return
+	}
+
+	if _, err := h.db.Exec("DELETE FROM tax_rates WHERE id = $1", id); err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to delete tax rate"})
+		return
+	}
+
+	h.audit(r, "tax_rate.delete", "tax_rate", id, before, nil)
+	h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "Tax rate deleted"})
+}
+
+// validateTaxRate normalizes req and returns an error message, or "" if it
+// is valid
+func validateTaxRate(req *TaxRateRequest) string {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return "Name is required"
+	}
+	if req.RatePercent < 0 || req.RatePercent > 100*billing.RatePercentUnit {
+		return "rate_percent must be between 0 and 100"
+	}
+	if req.CountryCode != nil {
+		code, ok := normalizeCountryCode(*req.CountryCode)
+		if !ok {
+			return "country_code must be a two-letter ISO 3166 code"
+		}
+		req.CountryCode = &code
+		if code == "" {
+			req.CountryCode = nil
+		}
+	}
+	if req.CountryCode != nil && req.ISPID != nil {
+		return "Set either country_code or isp_id, not both"
+	}
+	return ""
+}
+
+// normalizeCountryCode upper-cases a country code and reports whether it is
+// empty or a two-letter ISO 3166 code
+func normalizeCountryCode(s string) (string, bool) {
+	code := strings.ToUpper(strings.TrimSpace(s))
+	return code, code == "" || countryCodePattern.MatchString(code)
+}
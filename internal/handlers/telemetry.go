@@ -2,6 +2,7 @@ package handlers
 
 import (
     "encoding/json"
+    "fmt"
     "net/http"
 
     "github.com/gorilla/mux"
@@ -9,14 +10,16 @@ import (
 )
 
 type TelemetryData struct {
-    ISPID          int     `json:"isp_id"`
-    CacheHits      int64   `json:"cache_hits"`
-    CacheMisses    int64   `json:"cache_misses"`
-    BandwidthSaved int64   `json:"bandwidth_saved_mb"`
-    TotalRequests  int64   `json:"total_requests"`
-    CacheSizeUsed  int     `json:"cache_size_used_mb"`
-    CPUUsage       float64 `json:"cpu_usage"`
-    MemoryUsage    float64 `json:"memory_usage"`
+    ISPID          int      `json:"isp_id"`
+    CacheHits      int64    `json:"cache_hits"`
+    CacheMisses    int64    `json:"cache_misses"`
+    BandwidthSaved int64    `json:"bandwidth_saved_mb"`
+    TotalRequests  int64    `json:"total_requests"`
+    CacheSizeUsed  int      `json:"cache_size_used_mb"`
+    CPUUsage       float64  `json:"cpu_usage"`
+    MemoryUsage    float64  `json:"memory_usage"`
+    // Optional; used for 95th percentile throughput metering
+    ThroughputMbps *float64 `json:"throughput_mbps"`
 }
 
 type TelemetryResponse struct {
@@ -40,10 +43,12 @@ func (h *Handler) SubmitTelemetry(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    if data.ISPID == 0 {
-        h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "ISP ID is required"})
+    agent := middleware.GetAgentFromContext(r)
+    if data.ISPID != 0 && data.ISPID != agent.ISPID {
+        h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "API key is not valid for this ISP"})
         return
     }
+    data.ISPID = agent.ISPID
 
     var ispStatus string
     err := h.db.QueryRow("SELECT status FROM isps WHERE id = $1", data.ISPID).Scan(&ispStatus)
@@ -53,9 +58,9 @@ func (h *Handler) SubmitTelemetry(w http.ResponseWriter, r *http.Request) {
     }
 
     _, err = h.db.Exec(`
-        INSERT INTO telemetry (isp_id, cache_hits, cache_misses, bandwidth_saved_mb, total_requests, cache_size_used_mb, cpu_usage, memory_usage)
-        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-    `, data.ISPID, data.CacheHits, data.CacheMisses, data.BandwidthSaved, data.TotalRequests, data.CacheSizeUsed, data.CPUUsage, data.MemoryUsage)
+        INSERT INTO telemetry (isp_id, cache_hits, cache_misses, bandwidth_saved_mb, total_requests, cache_size_used_mb, cpu_usage, memory_usage, throughput_mbps)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+    `, data.ISPID, data.CacheHits, data.CacheMisses, data.BandwidthSaved, data.TotalRequests, data.CacheSizeUsed, data.CPUUsage, data.MemoryUsage, data.ThroughputMbps)
 
     if err != nil {
         h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Failed to save telemetry"})
@@ -75,45 +80,27 @@ func (h *Handler) SubmitTelemetry(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handler) GetTelemetryStats(w http.ResponseWriter, r *http.Request) {
     claims := middleware.GetUserFromContext(r)
-    
+
     ispID := r.URL.Query().Get("isp_id")
     limit := r.URL.Query().Get("limit")
     if limit == "" {
         limit = "100"
     }
 
-    var query string
-    var args []interface{}
-
-    if claims.Role == "admin" || claims.Role == "distributor" {
-        if ispID != "" {
-            query = `
-                SELECT id, isp_id, cache_hits, cache_misses, bandwidth_saved_mb, total_requests, 
-                       cache_size_used_mb, COALESCE(cpu_usage, 0), COALESCE(memory_usage, 0), created_at
-                FROM telemetry WHERE isp_id = $1
-                ORDER BY created_at DESC LIMIT $2
-            `
-            args = []interface{}{ispID, limit}
-        } else {
-            query = `
-                SELECT id, isp_id, cache_hits, cache_misses, bandwidth_saved_mb, total_requests,
-                       cache_size_used_mb, COALESCE(cpu_usage, 0), COALESCE(memory_usage, 0), created_at
-                FROM telemetry
-                ORDER BY created_at DESC LIMIT $1
-            `
-            args = []interface{}{limit}
-        }
-    } else {
-        query = `
-            SELECT t.id, t.isp_id, t.cache_hits, t.cache_misses, t.bandwidth_saved_mb, t.total_requests,
-                   t.cache_size_used_mb, COALESCE(t.cpu_usage, 0), COALESCE(t.memory_usage, 0), t.created_at
-            FROM telemetry t
-            JOIN isps i ON t.isp_id = i.id
-            WHERE i.user_id = $1
-            ORDER BY t.created_at DESC LIMIT $2
-        `
-        args = []interface{}{claims.UserID, limit}
+    scope, args := tenantScope(claims, "i", 1)
+    query := `
+        SELECT t.id, t.isp_id, t.cache_hits, t.cache_misses, t.bandwidth_saved_mb, t.total_requests,
+               t.cache_size_used_mb, COALESCE(t.cpu_usage, 0), COALESCE(t.memory_usage, 0), t.created_at
+        FROM telemetry t
+        JOIN isps i ON t.isp_id = i.id
+        WHERE ` + scope
+
+    if ispID != "" {
+        args = append(args, ispID)
+        query += fmt.Sprintf(" AND t.isp_id = $%d", len(args))
     }
+    args = append(args, limit)
+    query += fmt.Sprintf(" ORDER BY t.created_at DESC LIMIT $%d", len(args))
 
     rows, err := h.db.Query(query, args...)
     if err != nil {
@@ -122,7 +109,7 @@ func (h *Handler) GetTelemetryStats(w http.ResponseWriter, r *http.Request) {
     }
     defer rows.Close()
 
-    var telemetry []TelemetryResponse
+    telemetry := []TelemetryResponse{}
     for rows.Next() {
         var t TelemetryResponse
         rows.Scan(&t.ID, &t.ISPID, &t.CacheHits, &t.CacheMisses, &t.BandwidthSaved, 
@@ -141,6 +128,12 @@ func (h *Handler) GetISPTelemetry(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     ispID := vars["id"]
 
+    claims := middleware.GetUserFromContext(r)
+    if !h.canAccessISP(claims, ispID) {
+        h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "ISP not found"})
+        return
+    }
+
     row := h.db.QueryRow(`
         SELECT 
             COALESCE(SUM(cache_hits), 0) as total_hits,
@@ -189,58 +182,29 @@ func (h *Handler) GetTelemetryHistory(w http.ResponseWriter, r *http.Request) {
         hours = "24"
     }
 
-    var query string
-    var args []interface{}
-
-    if claims.Role == "admin" {
-        if ispID != "" {
-            query = `
-                SELECT 
-                    date_trunc('hour', created_at) as time_bucket,
-                    SUM(cache_hits) as hits,
-                    SUM(cache_misses) as misses,
-                    SUM(bandwidth_saved_mb) as bandwidth_saved,
-                    AVG(cpu_usage) as avg_cpu,
-                    AVG(memory_usage) as avg_memory
-                FROM telemetry 
-                WHERE isp_id = $1 AND created_at > NOW() - INTERVAL '1 hour' * $2
-                GROUP BY time_bucket
-                ORDER BY time_bucket ASC
-            `
-            args = []interface{}{ispID, hours}
-        } else {
-            query = `
-                SELECT 
-                    date_trunc('hour', created_at) as time_bucket,
-                    SUM(cache_hits) as hits,
-                    SUM(cache_misses) as misses,
-                    SUM(bandwidth_saved_mb) as bandwidth_saved,
-                    AVG(cpu_usage) as avg_cpu,
-                    AVG(memory_usage) as avg_memory
-                FROM telemetry 
-                WHERE created_at > NOW() - INTERVAL '1 hour' * $1
-                GROUP BY time_bucket
-                ORDER BY time_bucket ASC
-            `
-            args = []interface{}{hours}
-        }
-    } else {
-        query = `
-            SELECT 
-                date_trunc('hour', t.created_at) as time_bucket,
-                SUM(t.cache_hits) as hits,
-                SUM(t.cache_misses) as misses,
-                SUM(t.bandwidth_saved_mb) as bandwidth_saved,
-                AVG(t.cpu_usage) as avg_cpu,
-                AVG(t.memory_usage) as avg_memory
-            FROM telemetry t
-            JOIN isps i ON t.isp_id = i.id
-            WHERE i.user_id = $1 AND t.created_at > NOW() - INTERVAL '1 hour' * $2
-            GROUP BY time_bucket
-            ORDER BY time_bucket ASC
-        `
-        args = []interface{}{claims.UserID, hours}
-    }
+    scope, args := tenantScope(claims, "i", 1)
+    query := `
+        SELECT 
+            date_trunc('hour', t.created_at) as time_bucket,
+            SUM(t.cache_hits) as hits,
+            SUM(t.cache_misses) as misses,
+            SUM(t.bandwidth_saved_mb) as bandwidth_saved,
+            AVG(t.cpu_usage) as avg_cpu,
+            AVG(t.memory_usage) as avg_memory
+        FROM telemetry t
+        JOIN isps i ON t.isp_id = i.id
+        WHERE ` + scope
+
+    if ispID != "" {
+        args = append(args, ispID)
+        query += fmt.Sprintf(" AND t.isp_id = $%d", len(args))
+    }
+    args = append(args, hours)
+    query += fmt.Sprintf(`
+          AND t.created_at > NOW() - INTERVAL '1 hour' * $%d
+        GROUP BY time_bucket
+        ORDER BY time_bucket ASC
+    `, len(args))
 
     rows, err := h.db.Query(query, args...)
     if err != nil {
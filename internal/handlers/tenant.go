@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"fmt"
+
+	"isp-saas.com/platform/internal/middleware"
+	"isp-saas.com/platform/internal/rbac"
+)
+
+// tenantScope returns a SQL condition on the isps table (under alias) that
+// limits rows to the caller's tenant tree: every ISP for platform staff, the
+// ISPs a distributor resells and the ISPs an ISP user owns. Its placeholder is
+// numbered argN so the condition can be combined with other arguments.
+func tenantScope(claims *middleware.Claims, alias string, argN int) (string, []interface{}) {
+	if rbac.Allowed(claims.Role, rbac.TenantAll) {
+		return "TRUE", nil
+	}
+
+	cond := fmt.Sprintf(
+		"(%[1]s.user_id = $%[2]d OR %[1]s.distributor_id IN (SELECT id FROM distributors WHERE user_id = $%[2]d))",
+		alias, argN)
+	return cond, []interface{}{claims.UserID}
+}
+
+// canAccessISP reports whether the ISP exists inside the caller's tenant tree.
+// Handlers answer 404 rather than 403 when it does not, so other tenants' ISP
+// ids cannot be probed.
+func (h *Handler) canAccessISP(claims *middleware.Claims, ispID interface{}) bool {
+	scope, args := tenantScope(claims, "i", 2)
+
+	var exists bool
+	err := h.db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM isps i WHERE i.id = $1 AND "+scope+")",
+		append([]interface{}{ispID}, args...)...,
+	).Scan(&exists)
+	return err == nil && exists
+}
+
+// distributorIDForUser returns the distributor profile id of a distributor user
+func (h *Handler) distributorIDForUser(userID int) (int, bool) {
+	var id int
+	err := h.db.QueryRow("SELECT id FROM distributors WHERE user_id = $1", userID).Scan(&id)
+	return id, err == nil
+}
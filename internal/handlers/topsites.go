@@ -2,6 +2,7 @@ package handlers
 
 import (
     "encoding/json"
+    "fmt"
     "net/http"
 
     "github.com/gorilla/mux"
@@ -41,66 +42,38 @@ func (h *Handler) GetTopSites(w http.ResponseWriter, r *http.Request) {
         limit = "10"
     }
 
+    scope, args := tenantScope(claims, "i", 1)
+
     var query string
-    var args []interface{}
-
-    if claims.Role == "admin" {
-        if ispID != "" {
-            query = `
-                SELECT cs.id, cs.domain, cs.hits, cs.bandwidth_saved_mb, 
-                       COALESCE(ac.name, 'Other') as category,
-                       COALESCE(ac.icon, '🌐') as icon,
-                       cs.last_accessed
-                FROM cached_sites cs
-                LEFT JOIN app_categories ac ON cs.domain LIKE ANY(ac.domains)
-                WHERE cs.isp_id = $1
-                ORDER BY cs.hits DESC
-                LIMIT $2
-            `
-            args = []interface{}{ispID, limit}
-        } else {
-            query = `
-                SELECT cs.id, cs.domain, SUM(cs.hits) as hits, SUM(cs.bandwidth_saved_mb) as bandwidth_saved_mb,
-                       COALESCE(ac.name, 'Other') as category,
-                       COALESCE(ac.icon, '🌐') as icon,
-                       MAX(cs.last_accessed) as last_accessed
-                FROM cached_sites cs
-                LEFT JOIN app_categories ac ON cs.domain LIKE ANY(ac.domains)
-                GROUP BY cs.domain, ac.name, ac.icon
-                ORDER BY hits DESC
-                LIMIT $1
-            `
-            args = []interface{}{limit}
-        }
-    } else if claims.Role == "distributor" {
-        query = `
-            SELECT cs.id, cs.domain, SUM(cs.hits) as hits, SUM(cs.bandwidth_saved_mb) as bandwidth_saved_mb,
+    if ispID != "" {
+        args = append(args, ispID, limit)
+        query = fmt.Sprintf(`
+            SELECT cs.id, cs.domain, cs.hits, cs.bandwidth_saved_mb, 
                    COALESCE(ac.name, 'Other') as category,
                    COALESCE(ac.icon, '🌐') as icon,
-                   MAX(cs.last_accessed) as last_accessed
+                   cs.last_accessed
             FROM cached_sites cs
-            LEFT JOIN app_categories ac ON cs.domain LIKE ANY(ac.domains)
             JOIN isps i ON cs.isp_id = i.id
-            WHERE i.user_id = $1
-            GROUP BY cs.domain, ac.name, ac.icon
-            ORDER BY hits DESC
-            LIMIT $2
-        `
-        args = []interface{}{claims.UserID, limit}
+            LEFT JOIN app_categories ac ON cs.domain LIKE ANY(ac.domains)
+            WHERE %s AND cs.isp_id = $%d
+            ORDER BY cs.hits DESC
+            LIMIT $%d
+        `, scope, len(args)-1, len(args))
     } else {
-        query = `
-            SELECT cs.id, cs.domain, cs.hits, cs.bandwidth_saved_mb,
+        args = append(args, limit)
+        query = fmt.Sprintf(`
+            SELECT MIN(cs.id), cs.domain, SUM(cs.hits) as hits, SUM(cs.bandwidth_saved_mb) as bandwidth_saved_mb,
                    COALESCE(ac.name, 'Other') as category,
                    COALESCE(ac.icon, '🌐') as icon,
-                   cs.last_accessed
+                   MAX(cs.last_accessed) as last_accessed
             FROM cached_sites cs
-            LEFT JOIN app_categories ac ON cs.domain LIKE ANY(ac.domains)
             JOIN isps i ON cs.isp_id = i.id
-            WHERE i.user_id = $1
-            ORDER BY cs.hits DESC
-            LIMIT $2
-        `
-        args = []interface{}{claims.UserID, limit}
+            LEFT JOIN app_categories ac ON cs.domain LIKE ANY(ac.domains)
+            WHERE %s
+            GROUP BY cs.domain, ac.name, ac.icon
+            ORDER BY hits DESC
+            LIMIT $%d
+        `, scope, len(args))
     }
 
     rows, err := h.db.Query(query, args...)
@@ -128,46 +101,22 @@ func (h *Handler) GetTopSites(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) GetTopApps(w http.ResponseWriter, r *http.Request) {
     claims := middleware.GetUserFromContext(r)
 
-    var query string
-    var args []interface{}
-
-    if claims.Role == "admin" {
-        query = `
-            SELECT ac.name, ac.icon, COALESCE(SUM(cs.hits), 0) as total_hits, 
-                   COALESCE(SUM(cs.bandwidth_saved_mb), 0) as total_bandwidth
-            FROM app_categories ac
-            LEFT JOIN cached_sites cs ON cs.domain LIKE ANY(ac.domains)
-            GROUP BY ac.id, ac.name, ac.icon
-            ORDER BY total_hits DESC
-            LIMIT 10
-        `
-    } else if claims.Role == "distributor" {
-        query = `
-            SELECT ac.name, ac.icon, COALESCE(SUM(cs.hits), 0) as total_hits,
-                   COALESCE(SUM(cs.bandwidth_saved_mb), 0) as total_bandwidth
-            FROM app_categories ac
-            LEFT JOIN cached_sites cs ON cs.domain LIKE ANY(ac.domains)
-            LEFT JOIN isps i ON cs.isp_id = i.id
-            WHERE i.user_id = $1 OR cs.id IS NULL
-            GROUP BY ac.id, ac.name, ac.icon
-            ORDER BY total_hits DESC
-            LIMIT 10
-        `
-        args = []interface{}{claims.UserID}
-    } else {
-        query = `
-            SELECT ac.name, ac.icon, COALESCE(SUM(cs.hits), 0) as total_hits,
-                   COALESCE(SUM(cs.bandwidth_saved_mb), 0) as total_bandwidth
-            FROM app_categories ac
-            LEFT JOIN cached_sites cs ON cs.domain LIKE ANY(ac.domains)
-            LEFT JOIN isps i ON cs.isp_id = i.id
-            WHERE i.user_id = $1 OR cs.id IS NULL
-            GROUP BY ac.id, ac.name, ac.icon
-            ORDER BY total_hits DESC
-            LIMIT 10
-        `
-        args = []interface{}{claims.UserID}
-    }
+    // Filter sites before joining so categories with no traffic in this
+    // tenant still show up with zero hits
+    scope, args := tenantScope(claims, "i", 1)
+    query := `
+        SELECT ac.name, ac.icon, COALESCE(SUM(cs.hits), 0) as total_hits,
+               COALESCE(SUM(cs.bandwidth_saved_mb), 0) as total_bandwidth
+        FROM app_categories ac
+        LEFT JOIN (
+            SELECT cs.* FROM cached_sites cs
+            JOIN isps i ON cs.isp_id = i.id
+            WHERE ` + scope + `
+        ) cs ON cs.domain LIKE ANY(ac.domains)
+        GROUP BY ac.id, ac.name, ac.icon
+        ORDER BY total_hits DESC
+        LIMIT 10
+    `
 
     rows, err := h.db.Query(query, args...)
     if err != nil {
@@ -205,8 +154,15 @@ func (h *Handler) ReportCachedSite(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    if req.ISPID == 0 || req.Domain == "" {
-        h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "ISP ID and domain are required"})
+    agent := middleware.GetAgentFromContext(r)
+    if req.ISPID != 0 && req.ISPID != agent.ISPID {
+        h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "API key is not valid for this ISP"})
+        return
+    }
+    req.ISPID = agent.ISPID
+
+    if req.Domain == "" {
+        h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Domain is required"})
         return
     }
 
@@ -234,6 +190,12 @@ func (h *Handler) GetISPDashboard(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     ispID := vars["id"]
 
+    claims := middleware.GetUserFromContext(r)
+    if !h.canAccessISP(claims, ispID) {
+        h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "ISP not found"})
+        return
+    }
+
     // Get ISP info
     var ispName, status string
     var cacheSize, bandwidth int
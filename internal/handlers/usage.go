@@ -0,0 +1,340 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"isp-saas.com/platform/internal/billing"
+	"isp-saas.com/platform/internal/middleware"
+)
+
+// Usage metrics billed against the ISP's limits
+const (
+	metricCache      = "cache_gb_peak"
+	metricThroughput = "throughput_mbps_p95"
+)
+
+type UsageMetric struct {
+	Metric    string           `json:"metric"`
+	Unit      string           `json:"unit"`
+	Included  billing.Quantity `json:"included"`
+	Measured  billing.Quantity `json:"measured"`
+	Overage   billing.Quantity `json:"overage"`
+	UnitPrice billing.Money    `json:"unit_price"`
+	Amount    billing.Money    `json:"amount"`
+}
+
+// UsageReport is an ISP's usage in one billing period. Until the period is
+// over it is a projection from the samples so far.
+type UsageReport struct {
+	ISPID        int           `json:"isp_id"`
+	PlanID       *int          `json:"plan_id"`
+	PeriodStart  string        `json:"period_start"`
+	PeriodEnd    string        `json:"period_end"`
+	Currency     string        `json:"currency"`
+	Projected    bool          `json:"projected"`
+	Samples      int           `json:"samples"`
+	Metrics      []UsageMetric `json:"metrics"`
+	TotalOverage billing.Money `json:"total_overage"`
+}
+
+type UsageMeteringResult struct {
+	Metered      int           `json:"isps_metered"`
+	WithOverage  int           `json:"isps_with_overage"`
+	TotalOverage billing.Money `json:"total_overage"`
+}
+
+// ispUsagePlan is what an ISP's usage is measured against, priced in the
+// ISP's currency. The limits are the ISP's own, as its license enforces them:
+// the plan's unless the ISP was granted others. ISPs whose plan has no price
+// in the currency are not metered.
+type ispUsagePlan struct {
+	ispID          int
+	planID         int
+	currency       string
+	anchor         time.Time
+	cacheGB        int
+	bandwidthMbps  int
+	cachePrice     billing.Money
+	bandwidthPrice billing.Money
+}
+
+const ispUsagePlanSelect = `
+	SELECT i.id, p.id, i.currency, COALESCE(i.billing_anchor, i.created_at::date),
+	       COALESCE(i.cache_size_gb, p.cache_size_gb, 0), COALESCE(i.bandwidth_limit_mbps, p.bandwidth_limit_mbps, 0),
+	       pb.cache_overage_per_gb, pb.bandwidth_overage_per_mbps
+	FROM isps i
+	JOIN plans p ON i.plan_id = p.id
+	JOIN plan_price_book pb ON pb.plan_id = p.id AND pb.currency = i.currency
+`
+
+func scanISPUsagePlan(row interface{ Scan(...interface{}) error }, u *ispUsagePlan) error {
+	return row.Scan(&u.ispID, &u.planID, &u.currency, &u.anchor, &u.cacheGB, &u.bandwidthMbps, &u.cachePrice, &u.bandwidthPrice)
+}
+
+// measureUsage computes usage for period from telemetry up to asOf: the peak
+// cache size and the 95th percentile of throughput. Samples without a
+// reported throughput use the bandwidth saved since the previous sample.
+func (h *Handler) measureUsage(u ispUsagePlan, period billing.Period, asOf time.Time) (UsageReport, error) {
+	planID := u.planID
+	report := UsageReport{
+		ISPID:       u.ispID,
+		PlanID:      &planID,
+		PeriodStart: period.Start.Format("2006-01-02"),
+		PeriodEnd:   period.End.Format("2006-01-02"),
+		Currency:    u.currency,
+	}
+
+	until := period.End.AddDate(0, 0, 1)
+	if asOf.Before(until) {
+		until = asOf
+		report.Projected = true
+	}
+
+	var peakCacheMB int64
+	var p95Mbps float64
+	err := h.db.QueryRow(`
+		WITH samples AS (
+			SELECT cache_size_used_mb,
+			       COALESCE(throughput_mbps,
+			                bandwidth_saved_mb * 8 / NULLIF(EXTRACT(EPOCH FROM created_at - LAG(created_at) OVER (ORDER BY created_at)), 0)
+			       ) AS mbps
+			FROM telemetry
+			WHERE isp_id = $1 AND created_at >= $2 AND created_at < $3
+		)
+		SELECT COUNT(*), COALESCE(MAX(cache_size_used_mb), 0),
+		       COALESCE(percentile_cont(0.95) WITHIN GROUP (ORDER BY mbps), 0)
+		FROM samples
+	`, u.ispID, period.Start, until).Scan(&report.Samples, &peakCacheMB, &p95Mbps)
+	if err != nil {
+		return report, err
+	}
+
+	report.Metrics = []UsageMetric{
+		usageMetric(metricCache, "GB", u.cacheGB, float64(peakCacheMB)/1024, u.cachePrice),
+		usageMetric(metricThroughput, "Mbps", u.bandwidthMbps, p95Mbps, u.bandwidthPrice),
+	}
+	for _, m := range report.Metrics {
+		report.TotalOverage += m.Amount
+	}
+	return report, nil
+}
+
+// usageMetric prices measured usage against an included amount. A limit of 0
+// means the metric is not limited.
+func usageMetric(metric, unit string, included int, measured float64, price billing.Money) UsageMetric {
+	m := UsageMetric{
+		Metric:    metric,
+		Unit:      unit,
+		Included:  billing.Quantity(included) * billing.QuantityOne,
+		Measured:  billing.Quantity(math.Round(measured * float64(billing.QuantityOne))),
+		UnitPrice: price,
+	}
+	if included > 0 && m.Measured > m.Included {
+		m.Overage = m.Measured - m.Included
+		m.Amount = price.Times(m.Overage)
+	}
+	return m
+}
+
+// RunUsageMetering meters every ISP's last completed billing period and
+// queues its overage for the next recurring invoice. Periods are metered
+// once; the billing run calls this before invoicing the new period.
+func (h *Handler) RunUsageMetering(asOf time.Time) (UsageMeteringResult, error) {
+	var result UsageMeteringResult
+	today := billing.Date(asOf)
+
+	rows, err := h.db.Query(ispUsagePlanSelect + " WHERE i.status <> 'inactive' ORDER BY i.id")
+	if err != nil {
+		return result, err
+	}
+	var plans []ispUsagePlan
+	for rows.Next() {
+		var u ispUsagePlan
+		if err := scanISPUsagePlan(rows, &u); err != nil {
+			rows.Close()
+			return result, err
+		}
+		plans = append(plans, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	for _, u := range plans {
+		current := billing.PeriodContaining(u.anchor, today)
+		last := billing.PeriodContaining(u.anchor, current.Start.AddDate(0, 0, -1))
+		if last.Start.Before(billing.Date(u.anchor)) {
+			continue
+		}
+
+		report, metered, err := h.meterPeriod(u, last, asOf)
+		if err != nil {
+			return result, err
+		}
+		if !metered {
+			continue
+		}
+
+		result.Metered++
+		if report.TotalOverage > 0 {
+			result.WithOverage++
+			result.TotalOverage += report.TotalOverage
+			h.logger.Info("Usage overage queued", "isp_id", u.ispID, "period_start", report.PeriodStart,
+				"amount", report.TotalOverage.String())
+		}
+	}
+	return result, nil
+}
+
+// meterPeriod records the usage of one completed period and queues its
+// overage. metered is false if the period was recorded before.
+func (h *Handler) meterPeriod(u ispUsagePlan, period billing.Period, asOf time.Time) (report UsageReport, metered bool, err error) {
+	var done bool
+	err = h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM usage_records WHERE isp_id = $1 AND period_start = $2)",
+		u.ispID, period.Start).Scan(&done)
+	if err != nil || done {
+		return report, false, err
+	}
+
+	report, err = h.measureUsage(u, period, asOf)
+	if err != nil {
+		return report, false, err
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return report, false, err
+	}
+	defer tx.Rollback()
+
+	span := fmt.Sprintf("%s to %s", report.PeriodStart, report.PeriodEnd)
+	for _, m := range report.Metrics {
+		var pendingID interface{}
+		if m.Amount > 0 {
+			metric := m.Metric
+			id, err := addPendingItem(tx, u.ispID, nil, invoiceLine{
+				Description: fmt.Sprintf("%s overage, %s (%s %s included)", usageMetricLabel(m.Metric), span,
+					m.Included, m.Unit),
+				Quantity:    m.Overage,
+				UnitPrice:   m.UnitPrice,
+				ItemType:    itemUsage,
+				PlanID:      &u.planID,
+				UsageMetric: &metric,
+			})
+			if err != nil {
+				return report, false, err
+			}
+			pendingID = id
+		}
+
+		var recordID int
+		err := tx.QueryRow(`
+			INSERT INTO usage_records (isp_id, plan_id, period_start, period_end, metric, included, measured, overage,
+			                           unit_price, amount, samples, pending_item_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+			ON CONFLICT (isp_id, period_start, metric) DO NOTHING
+			RETURNING id
+		`, u.ispID, u.planID, period.Start, period.End, m.Metric, m.Included, m.Measured, m.Overage,
+			m.UnitPrice, m.Amount, report.Samples, pendingID).Scan(&recordID)
+		if err == sql.ErrNoRows {
+			// A concurrent run metered it first; rolling back drops the pending item
+			return report, false, nil
+		}
+		if err != nil {
+			return report, false, err
+		}
+	}
+
+	return report, true, tx.Commit()
+}
+
+func usageMetricLabel(metric string) string {
+	switch metric {
+	case metricCache:
+		return "Cache storage (peak)"
+	case metricThroughput:
+		return "Bandwidth (95th percentile)"
+	}
+	return metric
+}
+
+// GetISPUsage returns the projected usage and overage of the current billing
+// period along with the metered usage of past periods
+func (h *Handler) GetISPUsage(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.GetUserFromContext(r)
+	id := mux.Vars(r)["id"]
+	if !h.canAccessISP(claims, id) {
+		h.sendJSON(w, http.StatusNotFound, Response{Success: false, Error: "ISP not found"})
+		return
+	}
+	ispID, _ := strconv.Atoi(id)
+
+	var u ispUsagePlan
+	err := scanISPUsagePlan(h.db.QueryRow(ispUsagePlanSelect+" WHERE i.id = $1", ispID), &u)
+	if err == sql.ErrNoRows {
+		h.sendJSON(w, http.StatusConflict, Response{Success: false, Error: "ISP has no plan priced in its currency"})
+		return
+	}
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+
+	now := time.Now()
+	current, err := h.measureUsage(u, billing.PeriodContaining(u.anchor, now), now)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT metric, included, measured, overage, unit_price, amount, period_start, period_end
+		FROM usage_records
+		WHERE isp_id = $1
+		ORDER BY period_start DESC, metric
+		LIMIT 24
+	`, ispID)
+	if err != nil {
+		h.sendJSON(w, http.StatusInternalServerError, Response{Success: false, Error: "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	type usageRecord struct {
+		UsageMetric
+		PeriodStart string `json:"period_start"`
+		PeriodEnd   string `json:"period_end"`
+	}
+	history := []usageRecord{}
+	for rows.Next() {
+		var rec usageRecord
+		if err := rows.Scan(&rec.Metric, &rec.Included, &rec.Measured, &rec.Overage, &rec.UnitPrice, &rec.Amount,
+			&rec.PeriodStart, &rec.PeriodEnd); err != nil {
+			continue
+		}
+		rec.Unit = usageMetricUnit(rec.Metric)
+		history = append(history, rec)
+	}
+
+	h.sendJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"current": current,
+			"history": history,
+		},
+	})
+}
+
+func usageMetricUnit(metric string) string {
+	if metric == metricCache {
+		return "GB"
+	}
+	return "Mbps"
+}
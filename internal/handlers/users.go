@@ -8,6 +8,7 @@ import (
     "github.com/gorilla/mux"
     "golang.org/x/crypto/bcrypt"
     "isp-saas.com/platform/internal/middleware"
+    "isp-saas.com/platform/internal/rbac"
 )
 
 type UserResponse struct {
@@ -28,12 +29,6 @@ type UpdateUserRequest struct {
 }
 
 func (h *Handler) GetUsers(w http.ResponseWriter, r *http.Request) {
-    claims := middleware.GetUserFromContext(r)
-    if claims.Role != "admin" {
-        h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Admin access required"})
-        return
-    }
-
     rows, err := h.db.Query(`
         SELECT id, email, role, COALESCE(full_name, '') as full_name, is_active, created_at 
         FROM users ORDER BY id
@@ -63,7 +58,7 @@ func (h *Handler) GetUser(w http.ResponseWriter, r *http.Request) {
     claims := middleware.GetUserFromContext(r)
     userID, _ := strconv.Atoi(id)
     
-    if claims.Role != "admin" && claims.UserID != userID {
+    if !rbac.Allowed(claims.Role, rbac.UserRead) && claims.UserID != userID {
         h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Access denied"})
         return
     }
@@ -89,7 +84,7 @@ func (h *Handler) UpdateUser(w http.ResponseWriter, r *http.Request) {
     claims := middleware.GetUserFromContext(r)
     userID, _ := strconv.Atoi(id)
     
-    if claims.Role != "admin" && claims.UserID != userID {
+    if !rbac.Allowed(claims.Role, rbac.UserWrite) && claims.UserID != userID {
         h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Access denied"})
         return
     }
@@ -100,6 +95,15 @@ func (h *Handler) UpdateUser(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    before := h.auditSnapshot("users", id)
+
+    if req.Password != "" {
+        if err := ValidatePassword(req.Password); err != nil {
+            h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: err.Error()})
+            return
+        }
+    }
+
     if req.Email != "" {
         _, err := h.db.Exec("UPDATE users SET email = $1, updated_at = NOW() WHERE id = $2", req.Email, id)
         if err != nil {
@@ -115,10 +119,18 @@ func (h *Handler) UpdateUser(w http.ResponseWriter, r *http.Request) {
     if req.Password != "" {
         hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
         h.db.Exec("UPDATE users SET password_hash = $1, updated_at = NOW() WHERE id = $2", string(hashedPassword), id)
+        h.db.Exec(`
+            UPDATE sessions SET revoked_at = NOW(), revoked_reason = 'password_change'
+            WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL
+        `, id, claims.SessionID)
     }
 
-    if claims.Role == "admin" {
+    if rbac.Allowed(claims.Role, rbac.UserWrite) {
         if req.Role != "" {
+            if !rbac.ValidRole(req.Role) {
+                h.sendJSON(w, http.StatusBadRequest, Response{Success: false, Error: "Invalid role"})
+                return
+            }
             h.db.Exec("UPDATE users SET role = $1, updated_at = NOW() WHERE id = $2", req.Role, id)
         }
         if req.IsActive != nil {
@@ -126,6 +138,7 @@ func (h *Handler) UpdateUser(w http.ResponseWriter, r *http.Request) {
         }
     }
 
+    h.audit(r, "user.update", "user", id, before, h.auditSnapshot("users", id))
     h.logger.Info("User updated", "user_id", id, "by", claims.UserID)
     h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "User updated successfully"})
 }
@@ -135,10 +148,7 @@ func (h *Handler) DeleteUser(w http.ResponseWriter, r *http.Request) {
     id := vars["id"]
 
     claims := middleware.GetUserFromContext(r)
-    if claims.Role != "admin" {
-        h.sendJSON(w, http.StatusForbidden, Response{Success: false, Error: "Admin access required"})
-        return
-    }
+    before := h.auditSnapshot("users", id)
 
     result, err := h.db.Exec("DELETE FROM users WHERE id = $1", id)
     if err != nil {
@@ -152,6 +162,7 @@ func (h *Handler) DeleteUser(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    h.audit(r, "user.delete", "user", id, before, nil)
     h.logger.Info("User deleted", "user_id", id, "by", claims.UserID)
     h.sendJSON(w, http.StatusOK, Response{Success: true, Message: "User deleted successfully"})
 }
@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"isp-saas.com/platform/pkg/database"
+)
+
+const AgentContextKey contextKey = "agent"
+
+// Agent API key scopes
+const (
+	PermTelemetry = "telemetry"
+	PermSites     = "sites"
+	PermLogs      = "logs"
+	PermStatus    = "status"
+)
+
+// AgentPermissions lists every scope an agent key can be granted
+var AgentPermissions = []string{PermTelemetry, PermSites, PermLogs, PermStatus}
+
+// AgentKey identifies the ISP agent behind an authenticated request
+type AgentKey struct {
+	KeyID       int
+	ISPID       int
+	Permissions []string
+}
+
+func (a *AgentKey) Can(permission string) bool {
+	for _, p := range a.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// HashAPIKey returns the digest stored in api_keys.key_hash for a raw key
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+type AgentAuth struct {
+	db *database.DB
+}
+
+func NewAgentAuth(db *database.DB) *AgentAuth {
+	return &AgentAuth{db: db}
+}
+
+// Require authenticates the agent API key sent in X-API-Key and checks it
+// carries the given scope. The key's ISP is stored in the request context.
+func (a *AgentAuth) Require(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := strings.TrimSpace(r.Header.Get("X-API-Key"))
+			if key == "" {
+				http.Error(w, `{"success":false,"error":"API key required"}`, http.StatusUnauthorized)
+				return
+			}
+
+			agent := &AgentKey{}
+			var permissionsJSON []byte
+			err := a.db.QueryRow(`
+				SELECT id, isp_id, COALESCE(permissions, '[]')
+				FROM api_keys
+				WHERE key_hash = $1 AND is_active = true
+				  AND (expires_at IS NULL OR expires_at > NOW())
+			`, HashAPIKey(key)).Scan(&agent.KeyID, &agent.ISPID, &permissionsJSON)
+			if err != nil {
+				http.Error(w, `{"success":false,"error":"Invalid API key"}`, http.StatusUnauthorized)
+				return
+			}
+			json.Unmarshal(permissionsJSON, &agent.Permissions)
+
+			if !agent.Can(permission) {
+				http.Error(w, `{"success":false,"error":"API key lacks required permission"}`, http.StatusForbidden)
+				return
+			}
+
+			a.db.Exec("UPDATE api_keys SET last_used = NOW() WHERE id = $1", agent.KeyID)
+
+			ctx := context.WithValue(r.Context(), AgentContextKey, agent)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func GetAgentFromContext(r *http.Request) *AgentKey {
+	agent, ok := r.Context().Value(AgentContextKey).(*AgentKey)
+	if !ok {
+		return nil
+	}
+	return agent
+}
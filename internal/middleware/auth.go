@@ -7,20 +7,50 @@ import (
     "strings"
 
     "github.com/golang-jwt/jwt/v5"
+    "isp-saas.com/platform/internal/rbac"
+    "isp-saas.com/platform/pkg/database"
 )
 
 type contextKey string
 
 const UserContextKey contextKey = "user"
 
+// PurposeMFAPending marks the short-lived token issued after a correct
+// password when a second factor is still required. It only grants access to
+// the MFA completion endpoints.
+const PurposeMFAPending = "mfa_pending"
+
 type Claims struct {
-    UserID int    `json:"user_id"`
-    Email  string `json:"email"`
-    Role   string `json:"role"`
+    UserID    int    `json:"user_id"`
+    Email     string `json:"email"`
+    Role      string `json:"role"`
+    SessionID int    `json:"sid"`
+    Purpose   string `json:"purpose,omitempty"`
     jwt.RegisteredClaims
 }
 
-func AuthMiddleware(next http.Handler) http.Handler {
+type Auth struct {
+    db *database.DB
+}
+
+func NewAuth(db *database.DB) *Auth {
+    return &Auth{db: db}
+}
+
+// Middleware validates the access token and checks that its session has not
+// been revoked and that the user is still active. The role is taken from the
+// database so role changes apply without waiting for the token to expire.
+func (a *Auth) Middleware(next http.Handler) http.Handler {
+    return a.handler(next, false)
+}
+
+// MFAMiddleware accepts either a full access token or an mfa_pending token.
+// Handlers behind it must check claims.Purpose themselves.
+func (a *Auth) MFAMiddleware(next http.Handler) http.Handler {
+    return a.handler(next, true)
+}
+
+func (a *Auth) handler(next http.Handler, allowMFAPending bool) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
         authHeader := r.Header.Get("Authorization")
         if authHeader == "" {
@@ -54,6 +84,35 @@ func AuthMiddleware(next http.Handler) http.Handler {
             return
         }
 
+        var role string
+        var isActive bool
+        switch {
+        case claims.Purpose == PurposeMFAPending && allowMFAPending:
+            err = a.db.QueryRow(
+                "SELECT role, is_active FROM users WHERE id = $1", claims.UserID,
+            ).Scan(&role, &isActive)
+        case claims.Purpose == "" && claims.SessionID != 0:
+            err = a.db.QueryRow(`
+                SELECT u.role, u.is_active
+                FROM sessions s
+                JOIN users u ON s.user_id = u.id
+                WHERE s.id = $1 AND s.user_id = $2 AND s.revoked_at IS NULL AND s.expires_at > NOW()
+            `, claims.SessionID, claims.UserID).Scan(&role, &isActive)
+        default:
+            http.Error(w, `{"success":false,"error":"Invalid token claims"}`, http.StatusUnauthorized)
+            return
+        }
+
+        if err != nil {
+            http.Error(w, `{"success":false,"error":"Session has been revoked"}`, http.StatusUnauthorized)
+            return
+        }
+        if !isActive {
+            http.Error(w, `{"success":false,"error":"Account is disabled"}`, http.StatusUnauthorized)
+            return
+        }
+        claims.Role = role
+
         ctx := context.WithValue(r.Context(), UserContextKey, claims)
         next.ServeHTTP(w, r.WithContext(ctx))
     })
@@ -87,3 +146,23 @@ func RequireRole(roles ...string) func(http.Handler) http.Handler {
         })
     }
 }
+
+// RequirePermission rejects callers whose role does not grant permission
+func RequirePermission(permission rbac.Permission) func(http.Handler) http.Handler {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            claims := GetUserFromContext(r)
+            if claims == nil {
+                http.Error(w, `{"success":false,"error":"Unauthorized"}`, http.StatusUnauthorized)
+                return
+            }
+
+            if !rbac.Allowed(claims.Role, permission) {
+                http.Error(w, `{"success":false,"error":"Insufficient permissions"}`, http.StatusForbidden)
+                return
+            }
+
+            next.ServeHTTP(w, r)
+        })
+    }
+}
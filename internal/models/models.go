@@ -32,6 +32,7 @@ type Plan struct {
 type ISP struct {
     ID              int            `json:"id"`
     UserID          sql.NullInt64  `json:"user_id"`
+    DistributorID   sql.NullInt64  `json:"distributor_id"`
     Name            string         `json:"name"`
     ServerIP        string         `json:"server_ip"`
     HWID            string         `json:"hw_id"`
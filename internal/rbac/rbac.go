@@ -0,0 +1,131 @@
+// Package rbac maps user roles to the actions they may perform. Routes declare
+// the permission they need; handlers never compare role names directly.
+package rbac
+
+type Permission string
+
+const (
+	// Own account: sessions, MFA, profile
+	AccountSelf Permission = "account:self"
+
+	DashboardRead Permission = "dashboard:read"
+
+	// Data of every tenant rather than only the caller's own ISPs
+	TenantAll Permission = "tenant:all"
+
+	UserRead  Permission = "user:read"
+	UserWrite Permission = "user:write"
+
+	DistributorRead   Permission = "distributor:read"
+	DistributorManage Permission = "distributor:manage"
+	// Logo and company details printed on the distributor's ISPs' invoices
+	DistributorBranding Permission = "distributor:branding"
+
+	ISPRead    Permission = "isp:read"
+	ISPWrite   Permission = "isp:write"
+	ISPDelete  Permission = "isp:delete"
+	ISPSuspend Permission = "isp:suspend"
+
+	APIKeyManage Permission = "apikey:manage"
+
+	LicenseRead   Permission = "license:read"
+	LicenseWrite  Permission = "license:write"
+	LicenseRevoke Permission = "license:revoke"
+
+	// Moving an ISP's licenses to a replacement server: asking for it, and
+	// approving or rejecting the request
+	HWIDTransferRequest Permission = "hwid_transfer:request"
+	HWIDTransferReview  Permission = "hwid_transfer:review"
+
+	TelemetryRead Permission = "telemetry:read"
+
+	// Plan catalogue: pricing and limits
+	PlanWrite Permission = "plan:write"
+
+	InvoiceRead  Permission = "invoice:read"
+	InvoiceWrite Permission = "invoice:write"
+	// Paying an invoice online through a payment provider
+	InvoicePay Permission = "invoice:pay"
+
+	AuditRead Permission = "audit:read"
+
+	LogRead  Permission = "log:read"
+	LogWrite Permission = "log:write"
+
+	SettingRead  Permission = "setting:read"
+	SettingWrite Permission = "setting:write"
+
+	AgentVersionRead  Permission = "agent_version:read"
+	AgentVersionWrite Permission = "agent_version:write"
+
+	// Background jobs: listing runs and triggering a job by hand
+	JobRead Permission = "job:read"
+	JobRun  Permission = "job:run"
+)
+
+const (
+	RoleAdmin       = "admin"
+	RoleDistributor = "distributor"
+	RoleISP         = "isp"
+)
+
+// Roles lists every role a user can hold
+var Roles = []string{RoleAdmin, RoleDistributor, RoleISP}
+
+var rolePermissions = map[string][]Permission{
+	RoleAdmin: {
+		AccountSelf, DashboardRead, TenantAll,
+		UserRead, UserWrite,
+		DistributorRead, DistributorManage, DistributorBranding,
+		ISPRead, ISPWrite, ISPDelete, ISPSuspend,
+		APIKeyManage,
+		LicenseRead, LicenseWrite, LicenseRevoke,
+		HWIDTransferRequest, HWIDTransferReview,
+		TelemetryRead,
+		PlanWrite,
+		InvoiceRead, InvoiceWrite, InvoicePay,
+		AuditRead,
+		LogRead, LogWrite,
+		SettingRead, SettingWrite,
+		AgentVersionRead, AgentVersionWrite,
+		JobRead, JobRun,
+	},
+	RoleDistributor: {
+		AccountSelf, DashboardRead,
+		DistributorRead, DistributorBranding,
+		ISPRead, ISPWrite,
+		LicenseRead,
+		HWIDTransferRequest,
+		TelemetryRead,
+		InvoiceRead, InvoicePay,
+	},
+	RoleISP: {
+		AccountSelf,
+		ISPRead,
+		HWIDTransferRequest,
+		TelemetryRead,
+		InvoiceRead, InvoicePay,
+	},
+}
+
+var grants = func() map[string]map[Permission]bool {
+	m := make(map[string]map[Permission]bool, len(rolePermissions))
+	for role, perms := range rolePermissions {
+		m[role] = make(map[Permission]bool, len(perms))
+		for _, p := range perms {
+			m[role][p] = true
+		}
+	}
+	return m
+}()
+
+// Allowed reports whether role holds permission
+func Allowed(role string, p Permission) bool {
+	return grants[role][p]
+}
+
+// ValidRole reports whether role is a known role
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
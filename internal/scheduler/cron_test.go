@@ -0,0 +1,59 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	from := time.Date(2026, 3, 31, 23, 59, 30, 0, time.UTC) // a Tuesday
+
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2026, 4, 1, 2, 30, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2026, 4, 1, 9, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2026, 4, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 6 31 * *", time.Date(2026, 5, 31, 6, 0, 0, 0, time.UTC)},
+		{"5,35 */6 1 1 *", time.Date(2027, 1, 1, 0, 5, 0, 0, time.UTC)},
+		// Day of month and day of week both restricted: either matches
+		{"0 0 15 * 5", time.Date(2026, 4, 3, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		s, err := ParseSchedule(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseSchedule(%q): %v", tt.expr, err)
+		}
+		if got := s.Next(from); !got.Equal(tt.want) {
+			t.Errorf("%q: Next = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestParseScheduleInvalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := ParseSchedule(expr); err == nil {
+			t.Errorf("ParseSchedule(%q) succeeded, want error", expr)
+		}
+	}
+}
+
+func TestRegisterScheduleThatNeverRuns(t *testing.T) {
+	s := New(nil, nil, nil)
+	for _, expr := range []string{"0 0 30 2 *", "0 0 31 4,6,9,11 *"} {
+		if _, err := ParseSchedule(expr); err != nil {
+			t.Fatalf("ParseSchedule(%q): %v", expr, err)
+		}
+		if err := s.Register(Job{Name: expr, Schedule: expr}); err == nil {
+			t.Errorf("Register(%q) succeeded, want error", expr)
+		}
+	}
+
+	// 29 February matches in leap years only, which is still a next run
+	if err := s.Register(Job{Name: "leap-day", Schedule: "0 0 29 2 *"}); err != nil {
+		t.Errorf("Register(0 0 29 2 *): %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+	"time"
+
+	"isp-saas.com/platform/pkg/logger"
+	"isp-saas.com/platform/pkg/redis"
+)
+
+// Locker hands out named locks shared by every API replica, so each job run
+// happens on one replica only. ok is false when another replica holds the
+// lock; release gives it back.
+type Locker interface {
+	Acquire(ctx context.Context, name string, ttl time.Duration) (release func(), ok bool, err error)
+}
+
+// NewLocker returns a Redis lock when Redis is available, falling back to a
+// Postgres advisory lock whenever Redis cannot be reached
+func NewLocker(rc *redis.RedisClient, db *sql.DB, owner string, log *logger.Logger) Locker {
+	pg := &PostgresLocker{db: db}
+	if rc == nil {
+		return pg
+	}
+	return &fallbackLocker{primary: &RedisLocker{client: rc, owner: owner}, secondary: pg, log: log}
+}
+
+// RedisLocker takes locks as keys that expire after the ttl, so a replica
+// that dies mid-run does not hold a job forever
+type RedisLocker struct {
+	client *redis.RedisClient
+	owner  string
+}
+
+func (l *RedisLocker) Acquire(ctx context.Context, name string, ttl time.Duration) (func(), bool, error) {
+	key := "scheduler:lock:" + name
+	ok, err := l.client.SetNX(key, l.owner, ttl)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return func() { l.client.DeleteIfEqual(key, l.owner) }, true, nil
+}
+
+// PostgresLocker takes session-level advisory locks. The lock lives on a
+// dedicated connection and is dropped with it if the replica dies.
+type PostgresLocker struct {
+	db *sql.DB
+}
+
+func (l *PostgresLocker) Acquire(ctx context.Context, name string, ttl time.Duration) (func(), bool, error) {
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	key := advisoryKey(name)
+	var ok bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&ok); err != nil || !ok {
+		conn.Close()
+		return nil, false, err
+	}
+
+	return func() {
+		conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", key)
+		conn.Close()
+	}, true, nil
+}
+
+// advisoryKey maps a job name onto the bigint key space of advisory locks
+func advisoryKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("scheduler:" + name))
+	return int64(h.Sum64())
+}
+
+type fallbackLocker struct {
+	primary, secondary Locker
+	log                *logger.Logger
+}
+
+func (l *fallbackLocker) Acquire(ctx context.Context, name string, ttl time.Duration) (func(), bool, error) {
+	release, ok, err := l.primary.Acquire(ctx, name, ttl)
+	if err == nil {
+		return release, ok, nil
+	}
+	l.log.Warn("Redis lock unavailable, using Postgres advisory lock", "job", name, "error", err)
+	return l.secondary.Acquire(ctx, name, ttl)
+}
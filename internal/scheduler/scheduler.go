@@ -0,0 +1,353 @@
+// Package scheduler runs periodic jobs inside the API process. Every replica
+// runs the scheduler; a shared lock makes sure each run happens on one of
+// them, and every run is recorded in job_runs.
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"isp-saas.com/platform/pkg/logger"
+)
+
+// Run statuses
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// Run triggers
+const (
+	TriggerSchedule = "schedule"
+	TriggerManual   = "manual"
+)
+
+const defaultTimeout = 30 * time.Minute
+
+var (
+	ErrUnknownJob = errors.New("unknown job")
+	ErrJobRunning = errors.New("job is already running")
+)
+
+// Job is a unit of periodic work. Run returns a summary of what it did,
+// which is stored with the run.
+type Job struct {
+	Name        string
+	Description string
+	// Cron expression in UTC, see ParseSchedule
+	Schedule string
+	// Upper bound for one run; also how long the lock is held at most.
+	// Defaults to 30 minutes.
+	Timeout time.Duration
+	Run     func(ctx context.Context) (interface{}, error)
+}
+
+type JobInfo struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Schedule    string     `json:"schedule"`
+	NextRun     *time.Time `json:"next_run"`
+	LastRun     *RunRecord `json:"last_run"`
+}
+
+type RunRecord struct {
+	ID          int             `json:"id"`
+	Job         string          `json:"job"`
+	Trigger     string          `json:"trigger"`
+	TriggeredBy *int            `json:"triggered_by"`
+	Instance    string          `json:"instance"`
+	Status      string          `json:"status"`
+	StartedAt   time.Time       `json:"started_at"`
+	FinishedAt  *time.Time      `json:"finished_at"`
+	DurationMS  *int64          `json:"duration_ms"`
+	Result      json.RawMessage `json:"result"`
+	Error       *string         `json:"error"`
+}
+
+type entry struct {
+	job      Job
+	schedule Schedule
+	next     time.Time
+	running  bool
+}
+
+type Scheduler struct {
+	db       *sql.DB
+	locker   Locker
+	log      *logger.Logger
+	instance string
+
+	mu      sync.Mutex
+	jobs    map[string]*entry
+	started bool
+}
+
+func New(db *sql.DB, locker Locker, log *logger.Logger) *Scheduler {
+	return &Scheduler{db: db, locker: locker, log: log, instance: Instance(), jobs: map[string]*entry{}}
+}
+
+// Instance names this replica in locks and run records
+func Instance() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+// Register adds a job. Names must be unique, and the schedule must match
+// some time: one that never does, such as 30 February, has no next run.
+func (s *Scheduler) Register(job Job) error {
+	sched, err := ParseSchedule(job.Schedule)
+	if err != nil {
+		return fmt.Errorf("job %s: %w", job.Name, err)
+	}
+	if sched.Next(time.Now()).IsZero() {
+		return fmt.Errorf("job %s: schedule %q never runs", job.Name, job.Schedule)
+	}
+	if job.Timeout <= 0 {
+		job.Timeout = defaultTimeout
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[job.Name]; ok {
+		return fmt.Errorf("job %s registered twice", job.Name)
+	}
+	s.jobs[job.Name] = &entry{job: job, schedule: sched}
+	return nil
+}
+
+// Start runs jobs on their schedules until ctx is cancelled. Without Start,
+// jobs only run when triggered.
+func (s *Scheduler) Start(ctx context.Context) {
+	s.mu.Lock()
+	now := time.Now()
+	for _, e := range s.jobs {
+		e.next = e.schedule.Next(now)
+	}
+	s.started = true
+	s.mu.Unlock()
+
+	go func() {
+		for {
+			now := time.Now()
+			timer := time.NewTimer(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case tick := <-timer.C:
+				s.runDue(tick)
+			}
+		}
+	}()
+}
+
+func (s *Scheduler) runDue(now time.Time) {
+	s.mu.Lock()
+	var due []*entry
+	for _, e := range s.jobs {
+		if !e.next.After(now) {
+			e.next = e.schedule.Next(now)
+			due = append(due, e)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, e := range due {
+		go func(e *entry) {
+			_, run, err := s.begin(e, TriggerSchedule, nil)
+			switch {
+			case errors.Is(err, ErrJobRunning):
+				s.log.Debug("Job skipped, running elsewhere", "job", e.job.Name)
+			case err != nil:
+				s.log.Error("Failed to start job", "job", e.job.Name, "error", err)
+			default:
+				run()
+			}
+		}(e)
+	}
+}
+
+// Trigger starts a job now and returns its run record while it executes in
+// the background
+func (s *Scheduler) Trigger(name string, userID int) (RunRecord, error) {
+	s.mu.Lock()
+	e, ok := s.jobs[name]
+	s.mu.Unlock()
+	if !ok {
+		return RunRecord{}, ErrUnknownJob
+	}
+
+	record, run, err := s.begin(e, TriggerManual, &userID)
+	if err != nil {
+		return RunRecord{}, err
+	}
+	go run()
+	return record, nil
+}
+
+// begin takes the job's lock and records the run as started. The returned
+// function executes the job, records the outcome and releases the lock.
+func (s *Scheduler) begin(e *entry, trigger string, userID *int) (RunRecord, func(), error) {
+	record := RunRecord{Job: e.job.Name, Trigger: trigger, TriggeredBy: userID, Instance: s.instance, Status: StatusRunning}
+
+	s.mu.Lock()
+	if e.running {
+		s.mu.Unlock()
+		return record, nil, ErrJobRunning
+	}
+	e.running = true
+	s.mu.Unlock()
+
+	done := func() {
+		s.mu.Lock()
+		e.running = false
+		s.mu.Unlock()
+	}
+
+	release, ok, err := s.locker.Acquire(context.Background(), e.job.Name, e.job.Timeout)
+	if err != nil || !ok {
+		done()
+		if err == nil {
+			err = ErrJobRunning
+		}
+		return record, nil, err
+	}
+
+	var triggeredBy interface{}
+	if userID != nil {
+		triggeredBy = *userID
+	}
+	err = s.db.QueryRow(`
+		INSERT INTO job_runs (job_name, trigger_type, triggered_by, instance, status)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, started_at
+	`, e.job.Name, trigger, triggeredBy, s.instance, StatusRunning).Scan(&record.ID, &record.StartedAt)
+	if err != nil {
+		release()
+		done()
+		return record, nil, err
+	}
+	runID := record.ID
+
+	return record, func() {
+		defer done()
+		defer release()
+
+		start := time.Now()
+		result, err := s.execute(e.job)
+		duration := time.Since(start)
+
+		status, errText := StatusSucceeded, interface{}(nil)
+		if err != nil {
+			status, errText = StatusFailed, err.Error()
+			s.log.Error("Job failed", "job", e.job.Name, "run_id", runID, "duration", duration.String(), "error", err)
+		} else {
+			s.log.Info("Job finished", "job", e.job.Name, "run_id", runID, "duration", duration.String())
+		}
+
+		var resultJSON interface{}
+		if result != nil {
+			if b, err := json.Marshal(result); err == nil {
+				resultJSON = b
+			}
+		}
+		if _, err := s.db.Exec(`
+			UPDATE job_runs SET status = $1, finished_at = NOW(), duration_ms = $2, result = $3, error = $4
+			WHERE id = $5
+		`, status, duration.Milliseconds(), resultJSON, errText, runID); err != nil {
+			s.log.Error("Failed to record job run", "job", e.job.Name, "run_id", runID, "error", err)
+		}
+	}, nil
+}
+
+// execute runs the job under its timeout, turning a panic into an error so a
+// broken job cannot take the API down
+func (s *Scheduler) execute(job Job) (result interface{}, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), job.Timeout)
+	defer cancel()
+
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return job.Run(ctx)
+}
+
+// Jobs lists the registered jobs with their next and most recent runs
+func (s *Scheduler) Jobs() ([]JobInfo, error) {
+	last, err := s.query(`WHERE r.id IN (SELECT MAX(id) FROM job_runs GROUP BY job_name)`)
+	if err != nil {
+		return nil, err
+	}
+	lastByJob := make(map[string]RunRecord, len(last))
+	for _, r := range last {
+		lastByJob[r.Job] = r
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobs := make([]JobInfo, 0, len(s.jobs))
+	for name, e := range s.jobs {
+		info := JobInfo{Name: name, Description: e.job.Description, Schedule: e.job.Schedule}
+		if s.started {
+			next := e.next
+			info.NextRun = &next
+		}
+		if r, ok := lastByJob[name]; ok {
+			info.LastRun = &r
+		}
+		jobs = append(jobs, info)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Name < jobs[j].Name })
+	return jobs, nil
+}
+
+// Runs returns a job's run history, newest first
+func (s *Scheduler) Runs(name string, limit int) ([]RunRecord, error) {
+	s.mu.Lock()
+	_, ok := s.jobs[name]
+	s.mu.Unlock()
+	if !ok {
+		return nil, ErrUnknownJob
+	}
+	return s.query(`WHERE r.job_name = $1 ORDER BY r.id DESC LIMIT $2`, name, limit)
+}
+
+func (s *Scheduler) query(where string, args ...interface{}) ([]RunRecord, error) {
+	rows, err := s.db.Query(`
+		SELECT r.id, r.job_name, r.trigger_type, r.triggered_by, COALESCE(r.instance, ''), r.status,
+		       r.started_at, r.finished_at, r.duration_ms, r.result, r.error
+		FROM job_runs r `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []RunRecord{}
+	for rows.Next() {
+		var r RunRecord
+		var result []byte
+		if err := rows.Scan(&r.ID, &r.Job, &r.Trigger, &r.TriggeredBy, &r.Instance, &r.Status,
+			&r.StartedAt, &r.FinishedAt, &r.DurationMS, &result, &r.Error); err != nil {
+			return nil, err
+		}
+		if len(result) > 0 {
+			r.Result = result
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS idx_system_logs_isp;
+DROP INDEX IF EXISTS idx_api_keys_hash;
+
+ALTER TABLE system_logs DROP COLUMN IF EXISTS isp_id;
+
+ALTER TABLE api_keys DROP COLUMN IF EXISTS revoked_at;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS created_by;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS key_prefix;
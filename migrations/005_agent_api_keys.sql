@@ -0,0 +1,16 @@
+-- Agent authentication with per-ISP API keys
+
+-- Short, non-secret prefix shown in listings so admins can tell keys apart
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS key_prefix VARCHAR(16);
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS created_by INTEGER REFERENCES users(id) ON DELETE SET NULL;
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS revoked_at TIMESTAMP;
+
+-- Agent logs are attributed to the ISP that owns the key
+ALTER TABLE system_logs ADD COLUMN IF NOT EXISTS isp_id INTEGER REFERENCES isps(id) ON DELETE SET NULL;
+
+-- Keys are looked up by hash on every agent request
+CREATE UNIQUE INDEX IF NOT EXISTS idx_api_keys_hash ON api_keys(key_hash);
+CREATE INDEX IF NOT EXISTS idx_system_logs_isp ON system_logs(isp_id);
+
+COMMENT ON COLUMN api_keys.key_hash IS 'SHA-256 hex digest of the raw API key';
+COMMENT ON COLUMN api_keys.permissions IS 'Agent scopes: telemetry, sites, logs, status';
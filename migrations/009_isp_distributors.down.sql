@@ -0,0 +1,9 @@
+-- Hand distributor-owned ISPs without an ISP account back to the distributor user
+UPDATE isps i SET user_id = d.user_id
+FROM distributors d
+WHERE i.distributor_id = d.id AND i.user_id IS NULL;
+
+DROP INDEX IF EXISTS idx_isps_user;
+DROP INDEX IF EXISTS idx_isps_distributor;
+
+ALTER TABLE isps DROP COLUMN IF EXISTS distributor_id;
@@ -0,0 +1,13 @@
+-- Distributor ownership of ISPs
+
+ALTER TABLE isps ADD COLUMN IF NOT EXISTS distributor_id INTEGER REFERENCES distributors(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS idx_isps_distributor ON isps(distributor_id);
+CREATE INDEX IF NOT EXISTS idx_isps_user ON isps(user_id);
+
+-- ISPs created by a distributor used to carry the distributor's user id in
+-- user_id. Move that ownership to distributor_id; user_id is the ISP's own
+-- account from now on.
+UPDATE isps i SET distributor_id = d.id, user_id = NULL
+FROM distributors d
+WHERE i.user_id = d.user_id AND i.distributor_id IS NULL;
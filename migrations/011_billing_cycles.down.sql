@@ -0,0 +1,9 @@
+DELETE FROM settings WHERE key = 'invoice_due_days';
+
+DROP INDEX IF EXISTS idx_invoices_isp_period;
+
+ALTER TABLE invoices DROP COLUMN IF EXISTS period_end;
+ALTER TABLE invoices DROP COLUMN IF EXISTS period_start;
+ALTER TABLE invoices DROP COLUMN IF EXISTS plan_id;
+
+ALTER TABLE isps DROP COLUMN IF EXISTS billing_anchor;
@@ -0,0 +1,19 @@
+-- Recurring monthly invoices generated from each ISP's plan
+
+-- Billing cycles start on this date every month. Existing ISPs anchor on the
+-- day they signed up, new ones on the day they are created.
+ALTER TABLE isps ADD COLUMN IF NOT EXISTS billing_anchor DATE;
+UPDATE isps SET billing_anchor = COALESCE(created_at::date, CURRENT_DATE) WHERE billing_anchor IS NULL;
+ALTER TABLE isps ALTER COLUMN billing_anchor SET DEFAULT CURRENT_DATE;
+
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS plan_id INTEGER REFERENCES plans(id) ON DELETE SET NULL;
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS period_start DATE;
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS period_end DATE;
+
+-- One generated invoice per ISP and cycle. Manual invoices have no period and
+-- are not constrained (NULLs never conflict).
+CREATE UNIQUE INDEX IF NOT EXISTS idx_invoices_isp_period ON invoices(isp_id, period_start);
+
+INSERT INTO settings (key, value, description) VALUES
+('invoice_due_days', '14', 'Days after the start of a billing period that its invoice is due')
+ON CONFLICT (key) DO NOTHING;
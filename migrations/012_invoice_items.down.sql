@@ -0,0 +1,12 @@
+DROP TABLE IF EXISTS invoice_sequences;
+DROP TABLE IF EXISTS invoice_items;
+DROP TABLE IF EXISTS tax_rates;
+
+DROP INDEX IF EXISTS idx_invoices_number;
+ALTER TABLE invoices DROP COLUMN IF EXISTS tax_amount;
+ALTER TABLE invoices DROP COLUMN IF EXISTS tax_rate;
+ALTER TABLE invoices DROP COLUMN IF EXISTS tax_name;
+ALTER TABLE invoices DROP COLUMN IF EXISTS subtotal;
+ALTER TABLE invoices DROP COLUMN IF EXISTS invoice_number;
+
+ALTER TABLE isps DROP COLUMN IF EXISTS country_code;
@@ -0,0 +1,86 @@
+-- Invoice line items, tax rates and sequential invoice numbers
+
+ALTER TABLE isps ADD COLUMN IF NOT EXISTS country_code CHAR(2);
+
+-- An ISP-specific rate wins over the rate for the ISP's country, which wins
+-- over the default rate (neither country nor ISP set)
+CREATE TABLE IF NOT EXISTS tax_rates (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    rate_percent NUMERIC(7,4) NOT NULL CHECK (rate_percent >= 0 AND rate_percent <= 100),
+    country_code CHAR(2),
+    isp_id INTEGER REFERENCES isps(id) ON DELETE CASCADE,
+    is_active BOOLEAN DEFAULT true,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CHECK (isp_id IS NULL OR country_code IS NULL)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_tax_rates_isp ON tax_rates(isp_id)
+    WHERE is_active AND isp_id IS NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_tax_rates_country ON tax_rates(country_code)
+    WHERE is_active AND country_code IS NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_tax_rates_default ON tax_rates((true))
+    WHERE is_active AND isp_id IS NULL AND country_code IS NULL;
+
+-- amount stays the invoice total; subtotal and tax break it down. The tax
+-- name and rate are copied so later rate changes do not alter old invoices.
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS invoice_number VARCHAR(32);
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS subtotal DECIMAL(10,2);
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS tax_name VARCHAR(100);
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS tax_rate NUMERIC(7,4) NOT NULL DEFAULT 0;
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS tax_amount DECIMAL(10,2) NOT NULL DEFAULT 0;
+
+UPDATE invoices SET subtotal = amount WHERE subtotal IS NULL;
+ALTER TABLE invoices ALTER COLUMN subtotal SET NOT NULL;
+
+CREATE TABLE IF NOT EXISTS invoice_items (
+    id SERIAL PRIMARY KEY,
+    invoice_id INTEGER NOT NULL REFERENCES invoices(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    description VARCHAR(255) NOT NULL,
+    quantity NUMERIC(12,3) NOT NULL DEFAULT 1,
+    unit_price DECIMAL(10,2) NOT NULL,
+    amount DECIMAL(10,2) NOT NULL,
+    item_type VARCHAR(20) NOT NULL DEFAULT 'manual' CHECK (item_type IN ('plan', 'usage', 'manual')),
+    plan_id INTEGER REFERENCES plans(id) ON DELETE SET NULL,
+    usage_metric VARCHAR(50),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (invoice_id, position)
+);
+
+-- Existing invoices become a single line for their amount
+INSERT INTO invoice_items (invoice_id, position, description, quantity, unit_price, amount, item_type, plan_id)
+SELECT inv.id, 1,
+       CASE WHEN inv.period_start IS NULL THEN 'ISP cache service'
+            ELSE COALESCE(p.name || ' plan', 'Subscription') || ', ' || inv.period_start || ' to ' || inv.period_end END,
+       1, inv.amount, inv.amount,
+       CASE WHEN inv.plan_id IS NULL THEN 'manual' ELSE 'plan' END,
+       inv.plan_id
+FROM invoices inv
+LEFT JOIN plans p ON inv.plan_id = p.id
+WHERE NOT EXISTS (SELECT 1 FROM invoice_items it WHERE it.invoice_id = inv.id);
+
+-- Last number issued per calendar year. Numbers are taken by incrementing
+-- this row inside the transaction that creates the invoice, so a rolled back
+-- invoice gives its number back and the sequence has no gaps.
+CREATE TABLE IF NOT EXISTS invoice_sequences (
+    year INTEGER PRIMARY KEY,
+    last_number INTEGER NOT NULL
+);
+
+UPDATE invoices inv SET invoice_number = n.number
+FROM (
+    SELECT id, 'INV-' || EXTRACT(YEAR FROM created_at)::int || '-' ||
+           LPAD(ROW_NUMBER() OVER (PARTITION BY EXTRACT(YEAR FROM created_at) ORDER BY created_at, id)::text, 6, '0') AS number
+    FROM invoices
+) n
+WHERE inv.id = n.id AND inv.invoice_number IS NULL;
+
+INSERT INTO invoice_sequences (year, last_number)
+SELECT EXTRACT(YEAR FROM created_at)::int, COUNT(*) FROM invoices GROUP BY 1
+ON CONFLICT (year) DO NOTHING;
+
+ALTER TABLE invoices ALTER COLUMN invoice_number SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_invoices_number ON invoices(invoice_number);
+CREATE INDEX IF NOT EXISTS idx_invoice_items_invoice ON invoice_items(invoice_id);
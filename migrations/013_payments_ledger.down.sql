@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS idx_payments_transaction;
+ALTER TABLE payments DROP COLUMN IF EXISTS recorded_by;
+
+ALTER TABLE invoices DROP COLUMN IF EXISTS amount_paid;
+
+UPDATE invoices SET status = 'pending' WHERE status = 'partially_paid';
+ALTER TABLE invoices DROP CONSTRAINT IF EXISTS invoices_status_check;
+ALTER TABLE invoices ADD CONSTRAINT invoices_status_check
+    CHECK (status IN ('pending', 'paid', 'overdue', 'cancelled'));
@@ -0,0 +1,24 @@
+-- Invoice status is derived from the payments ledger
+
+ALTER TABLE invoices DROP CONSTRAINT IF EXISTS invoices_status_check;
+ALTER TABLE invoices ADD CONSTRAINT invoices_status_check
+    CHECK (status IN ('pending', 'partially_paid', 'paid', 'overdue', 'cancelled'));
+
+-- Sum of completed payments, kept in step with the ledger on every payment
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS amount_paid DECIMAL(10,2) NOT NULL DEFAULT 0;
+
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS recorded_by INTEGER REFERENCES users(id) ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS idx_payments_invoice ON payments(invoice_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_payments_transaction ON payments(payment_method, transaction_id)
+    WHERE transaction_id IS NOT NULL;
+
+-- Invoices marked paid before the ledger existed get a payment for their amount
+INSERT INTO payments (invoice_id, amount, payment_method, status, created_at)
+SELECT inv.id, inv.amount, 'legacy', 'completed', COALESCE(inv.paid_at, inv.created_at)
+FROM invoices inv
+WHERE inv.status = 'paid'
+  AND NOT EXISTS (SELECT 1 FROM payments p WHERE p.invoice_id = inv.id);
+
+UPDATE invoices inv SET amount_paid = p.total
+FROM (SELECT invoice_id, SUM(amount) AS total FROM payments WHERE status = 'completed' GROUP BY invoice_id) p
+WHERE inv.id = p.invoice_id;
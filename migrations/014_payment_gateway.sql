@@ -0,0 +1,35 @@
+-- Payment gateway checkout sessions and webhook events
+
+CREATE TABLE IF NOT EXISTS checkout_sessions (
+    id SERIAL PRIMARY KEY,
+    invoice_id INTEGER NOT NULL REFERENCES invoices(id) ON DELETE CASCADE,
+    provider VARCHAR(50) NOT NULL,
+    session_id VARCHAR(255) NOT NULL,
+    amount DECIMAL(10,2) NOT NULL,
+    currency VARCHAR(3) NOT NULL,
+    url TEXT,
+    created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    expires_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (provider, session_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_checkout_sessions_invoice ON checkout_sessions(invoice_id);
+
+-- Every verified webhook, once per provider event id. Gateways retry and
+-- sometimes deliver twice; the unique key makes processing idempotent.
+CREATE TABLE IF NOT EXISTS payment_events (
+    id SERIAL PRIMARY KEY,
+    provider VARCHAR(50) NOT NULL,
+    event_id VARCHAR(255) NOT NULL,
+    event_type VARCHAR(100) NOT NULL,
+    invoice_id INTEGER REFERENCES invoices(id) ON DELETE SET NULL,
+    payment_id INTEGER REFERENCES payments(id) ON DELETE SET NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'received' CHECK (status IN ('received', 'processed', 'ignored')),
+    error TEXT,
+    payload JSONB,
+    received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (provider, event_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_payment_events_invoice ON payment_events(invoice_id);
@@ -0,0 +1,5 @@
+UPDATE settings SET description = 'Days after due date to auto-suspend' WHERE key = 'auto_suspend_days';
+DELETE FROM settings WHERE key = 'dunning_reminder_days';
+
+DROP TABLE IF EXISTS invoice_dunning;
+ALTER TABLE isps DROP COLUMN IF EXISTS suspension_reason;
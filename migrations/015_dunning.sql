@@ -0,0 +1,25 @@
+-- Dunning: payment reminders and suspension after auto_suspend_days
+
+-- Why an ISP is suspended. Only 'billing' suspensions are lifted
+-- automatically once the ISP pays.
+ALTER TABLE isps ADD COLUMN IF NOT EXISTS suspension_reason VARCHAR(20)
+    CHECK (suspension_reason IN ('billing', 'manual'));
+UPDATE isps SET suspension_reason = 'manual' WHERE status = 'suspended' AND suspension_reason IS NULL;
+
+-- Steps already taken per invoice, so each reminder goes out once. Steps
+-- that were overtaken by a later one before the job ran are logged as skipped.
+CREATE TABLE IF NOT EXISTS invoice_dunning (
+    id SERIAL PRIMARY KEY,
+    invoice_id INTEGER NOT NULL REFERENCES invoices(id) ON DELETE CASCADE,
+    step VARCHAR(30) NOT NULL,
+    skipped BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (invoice_id, step)
+);
+
+INSERT INTO settings (key, value, description) VALUES
+('dunning_reminder_days', '-3,1,5', 'Days relative to the due date to send payment reminders (negative is before)')
+ON CONFLICT (key) DO NOTHING;
+
+UPDATE settings SET description = 'Days after the due date to suspend an ISP with an unpaid invoice (negative disables)'
+WHERE key = 'auto_suspend_days';
@@ -0,0 +1,4 @@
+DELETE FROM settings WHERE key IN ('log_retention_days', 'license_expiry_warning_days', 'job_run_retention_days');
+
+ALTER TABLE licenses DROP COLUMN IF EXISTS expiry_notified_at;
+DROP TABLE IF EXISTS job_runs;
@@ -0,0 +1,27 @@
+-- Background job scheduler: one row per job run
+
+CREATE TABLE IF NOT EXISTS job_runs (
+    id SERIAL PRIMARY KEY,
+    job_name VARCHAR(100) NOT NULL,
+    trigger_type VARCHAR(20) NOT NULL CHECK (trigger_type IN ('schedule', 'manual')),
+    triggered_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    -- Replica that ran the job (hostname:pid)
+    instance VARCHAR(255),
+    status VARCHAR(20) NOT NULL DEFAULT 'running' CHECK (status IN ('running', 'succeeded', 'failed')),
+    started_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    finished_at TIMESTAMP,
+    duration_ms BIGINT,
+    result JSONB,
+    error TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_job_runs_job ON job_runs(job_name, id DESC);
+
+-- Licenses whose expiry warning went out, so it is sent once
+ALTER TABLE licenses ADD COLUMN IF NOT EXISTS expiry_notified_at TIMESTAMP;
+
+INSERT INTO settings (key, value, description) VALUES
+('log_retention_days', '30', 'Days to keep system logs'),
+('license_expiry_warning_days', '14', 'Days before a license expires to warn the ISP'),
+('job_run_retention_days', '90', 'Days to keep background job run history')
+ON CONFLICT (key) DO NOTHING;
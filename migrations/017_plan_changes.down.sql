@@ -0,0 +1,7 @@
+DELETE FROM invoice_items WHERE item_type = 'proration';
+ALTER TABLE invoice_items DROP CONSTRAINT IF EXISTS invoice_items_item_type_check;
+ALTER TABLE invoice_items ADD CONSTRAINT invoice_items_item_type_check
+    CHECK (item_type IN ('plan', 'usage', 'manual'));
+
+DROP TABLE IF EXISTS pending_invoice_items;
+DROP TABLE IF EXISTS plan_changes;
@@ -0,0 +1,43 @@
+-- Plan changes: prorated mid-cycle switches and downgrades scheduled for the
+-- next billing period
+
+CREATE TABLE IF NOT EXISTS plan_changes (
+    id SERIAL PRIMARY KEY,
+    isp_id INTEGER NOT NULL REFERENCES isps(id) ON DELETE CASCADE,
+    from_plan_id INTEGER REFERENCES plans(id) ON DELETE SET NULL,
+    to_plan_id INTEGER NOT NULL REFERENCES plans(id),
+    effective_date DATE NOT NULL,
+    status VARCHAR(20) NOT NULL CHECK (status IN ('scheduled', 'applied', 'cancelled')),
+    -- Unused time on the old plan and the rest of the period on the new one
+    credit NUMERIC(12,2) NOT NULL DEFAULT 0,
+    charge NUMERIC(12,2) NOT NULL DEFAULT 0,
+    requested_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    applied_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_plan_changes_isp ON plan_changes(isp_id, created_at DESC);
+-- At most one change waiting per ISP
+CREATE UNIQUE INDEX IF NOT EXISTS idx_plan_changes_scheduled ON plan_changes(isp_id) WHERE status = 'scheduled';
+CREATE INDEX IF NOT EXISTS idx_plan_changes_due ON plan_changes(effective_date) WHERE status = 'scheduled';
+
+-- Charges and credits waiting for the ISP's next recurring invoice
+CREATE TABLE IF NOT EXISTS pending_invoice_items (
+    id SERIAL PRIMARY KEY,
+    isp_id INTEGER NOT NULL REFERENCES isps(id) ON DELETE CASCADE,
+    plan_change_id INTEGER REFERENCES plan_changes(id) ON DELETE CASCADE,
+    description TEXT NOT NULL,
+    quantity NUMERIC(12,3) NOT NULL DEFAULT 1,
+    unit_price NUMERIC(12,2) NOT NULL,
+    item_type VARCHAR(20) NOT NULL,
+    plan_id INTEGER REFERENCES plans(id) ON DELETE SET NULL,
+    -- Set once billed
+    invoice_id INTEGER REFERENCES invoices(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_pending_invoice_items_isp ON pending_invoice_items(isp_id) WHERE invoice_id IS NULL;
+
+ALTER TABLE invoice_items DROP CONSTRAINT IF EXISTS invoice_items_item_type_check;
+ALTER TABLE invoice_items ADD CONSTRAINT invoice_items_item_type_check
+    CHECK (item_type IN ('plan', 'usage', 'manual', 'proration'));
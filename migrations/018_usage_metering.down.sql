@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS usage_records;
+
+ALTER TABLE pending_invoice_items DROP COLUMN IF EXISTS usage_metric;
+ALTER TABLE telemetry DROP COLUMN IF EXISTS throughput_mbps;
+ALTER TABLE plans DROP COLUMN IF EXISTS bandwidth_overage_per_mbps;
+ALTER TABLE plans DROP COLUMN IF EXISTS cache_overage_per_gb;
@@ -0,0 +1,31 @@
+-- Usage metering: monthly usage per ISP measured from telemetry, billed
+-- against per-plan overage prices
+
+-- Price per unit above the plan's limit; 0 means overage is not billed
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS cache_overage_per_gb NUMERIC(10,2) NOT NULL DEFAULT 0;
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS bandwidth_overage_per_mbps NUMERIC(10,2) NOT NULL DEFAULT 0;
+
+-- Throughput as reported by the agent. Older agents do not send it; their
+-- throughput is derived from bandwidth_saved_mb between samples.
+ALTER TABLE telemetry ADD COLUMN IF NOT EXISTS throughput_mbps DECIMAL(10,2);
+
+ALTER TABLE pending_invoice_items ADD COLUMN IF NOT EXISTS usage_metric VARCHAR(50);
+
+-- One row per ISP, billing period and metric once the period is metered
+CREATE TABLE IF NOT EXISTS usage_records (
+    id SERIAL PRIMARY KEY,
+    isp_id INTEGER NOT NULL REFERENCES isps(id) ON DELETE CASCADE,
+    plan_id INTEGER REFERENCES plans(id) ON DELETE SET NULL,
+    period_start DATE NOT NULL,
+    period_end DATE NOT NULL,
+    metric VARCHAR(50) NOT NULL,
+    included NUMERIC(14,3) NOT NULL,
+    measured NUMERIC(14,3) NOT NULL,
+    overage NUMERIC(14,3) NOT NULL,
+    unit_price NUMERIC(10,2) NOT NULL,
+    amount NUMERIC(12,2) NOT NULL,
+    samples INTEGER NOT NULL,
+    pending_item_id INTEGER REFERENCES pending_invoice_items(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (isp_id, period_start, metric)
+);
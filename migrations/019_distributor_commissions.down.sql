@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS commission_entries;
+DROP TABLE IF EXISTS commission_payouts;
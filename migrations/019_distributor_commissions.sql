@@ -0,0 +1,39 @@
+-- Distributor commissions: a ledger entry per paid invoice and monthly payout
+-- statements
+
+CREATE TABLE IF NOT EXISTS commission_payouts (
+    id SERIAL PRIMARY KEY,
+    distributor_id INTEGER NOT NULL REFERENCES distributors(id) ON DELETE CASCADE,
+    period_start DATE NOT NULL,
+    period_end DATE NOT NULL,
+    amount NUMERIC(12,2) NOT NULL,
+    entry_count INTEGER NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'paid_out')),
+    reference VARCHAR(255),
+    paid_out_at TIMESTAMP,
+    paid_out_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (distributor_id, period_start)
+);
+
+-- rate is the distributor's commission_percent when the invoice was paid and
+-- base is the invoice subtotal, so tax never earns commission
+CREATE TABLE IF NOT EXISTS commission_entries (
+    id SERIAL PRIMARY KEY,
+    distributor_id INTEGER NOT NULL REFERENCES distributors(id) ON DELETE CASCADE,
+    isp_id INTEGER REFERENCES isps(id) ON DELETE SET NULL,
+    invoice_id INTEGER NOT NULL UNIQUE REFERENCES invoices(id) ON DELETE CASCADE,
+    base NUMERIC(12,2) NOT NULL,
+    rate NUMERIC(5,2) NOT NULL,
+    amount NUMERIC(12,2) NOT NULL,
+    -- Set once the entry is on a payout statement
+    payout_id INTEGER REFERENCES commission_payouts(id) ON DELETE SET NULL,
+    accrued_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_commission_entries_distributor ON commission_entries(distributor_id, accrued_at);
+CREATE INDEX IF NOT EXISTS idx_commission_entries_unstated ON commission_entries(distributor_id) WHERE payout_id IS NULL;
+
+-- total_earnings was never maintained; from now on it is the ledger total
+UPDATE distributors d SET total_earnings = COALESCE(
+    (SELECT SUM(amount) FROM commission_entries e WHERE e.distributor_id = d.id), 0);
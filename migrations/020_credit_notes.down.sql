@@ -0,0 +1,12 @@
+DELETE FROM commission_entries WHERE credit_note_id IS NOT NULL;
+DROP INDEX IF EXISTS idx_commission_entries_invoice;
+ALTER TABLE commission_entries ADD CONSTRAINT commission_entries_invoice_id_key UNIQUE (invoice_id);
+ALTER TABLE commission_entries DROP COLUMN IF EXISTS credit_note_id;
+
+DROP TABLE IF EXISTS credit_notes;
+DROP TABLE IF EXISTS credit_note_sequences;
+
+ALTER TABLE invoices DROP COLUMN IF EXISTS amount_credited;
+ALTER TABLE invoices DROP COLUMN IF EXISTS cancellation_reason;
+ALTER TABLE invoices DROP COLUMN IF EXISTS cancelled_by;
+ALTER TABLE invoices DROP COLUMN IF EXISTS cancelled_at;
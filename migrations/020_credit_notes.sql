@@ -0,0 +1,42 @@
+-- Invoice cancellation, credit notes and refunds
+
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS cancelled_at TIMESTAMP;
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS cancelled_by INTEGER REFERENCES users(id) ON DELETE SET NULL;
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS cancellation_reason TEXT;
+
+-- What credit notes gave back. The invoice is owed amount - amount_credited;
+-- payments beyond that are credit on the ISP's account.
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS amount_credited DECIMAL(10,2) NOT NULL DEFAULT 0;
+
+-- Credit notes are numbered like invoices, in their own gap-free sequence
+CREATE TABLE IF NOT EXISTS credit_note_sequences (
+    year INTEGER PRIMARY KEY,
+    last_number INTEGER NOT NULL
+);
+
+-- A refund settlement pays the amount back as a negative payment on the
+-- invoice; a credit settlement leaves it on the account for the next invoice
+CREATE TABLE IF NOT EXISTS credit_notes (
+    id SERIAL PRIMARY KEY,
+    credit_note_number VARCHAR(32) NOT NULL UNIQUE,
+    invoice_id INTEGER NOT NULL REFERENCES invoices(id) ON DELETE CASCADE,
+    isp_id INTEGER NOT NULL REFERENCES isps(id) ON DELETE CASCADE,
+    subtotal DECIMAL(10,2) NOT NULL,
+    tax_amount DECIMAL(10,2) NOT NULL DEFAULT 0,
+    amount DECIMAL(10,2) NOT NULL CHECK (amount > 0),
+    reason TEXT NOT NULL,
+    settlement VARCHAR(20) NOT NULL CHECK (settlement IN ('refund', 'credit')),
+    refund_payment_id INTEGER REFERENCES payments(id) ON DELETE SET NULL,
+    created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_credit_notes_invoice ON credit_notes(invoice_id);
+CREATE INDEX IF NOT EXISTS idx_credit_notes_isp ON credit_notes(isp_id, created_at);
+
+-- A credit note takes back the commission on what it credits: one accrual per
+-- invoice plus one reversal per credit note
+ALTER TABLE commission_entries ADD COLUMN IF NOT EXISTS credit_note_id INTEGER UNIQUE REFERENCES credit_notes(id) ON DELETE CASCADE;
+ALTER TABLE commission_entries DROP CONSTRAINT IF EXISTS commission_entries_invoice_id_key;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_commission_entries_invoice ON commission_entries(invoice_id)
+    WHERE credit_note_id IS NULL;
@@ -0,0 +1,14 @@
+ALTER TABLE invoices DROP COLUMN IF EXISTS exchange_rate_date;
+ALTER TABLE invoices DROP COLUMN IF EXISTS exchange_rate;
+ALTER TABLE invoices DROP COLUMN IF EXISTS base_currency;
+ALTER TABLE invoices DROP COLUMN IF EXISTS currency;
+
+ALTER TABLE isps DROP COLUMN IF EXISTS currency;
+
+DROP VIEW IF EXISTS plan_price_book;
+DROP TABLE IF EXISTS plan_prices;
+ALTER TABLE plans DROP COLUMN IF EXISTS currency;
+
+DROP TABLE IF EXISTS exchange_rates;
+DELETE FROM settings WHERE key = 'base_currency';
+DROP TABLE IF EXISTS currencies;
@@ -0,0 +1,78 @@
+-- Multi-currency billing: plans are priced per currency, ISPs are billed in
+-- their own currency and every invoice keeps the exchange rate it was issued at
+
+CREATE TABLE IF NOT EXISTS currencies (
+    code CHAR(3) PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    symbol VARCHAR(8) NOT NULL,
+    is_active BOOLEAN NOT NULL DEFAULT true
+);
+
+INSERT INTO currencies (code, name, symbol) VALUES
+('USD', 'US Dollar', '$'),
+('EUR', 'Euro', '€'),
+('MXN', 'Mexican Peso', '$'),
+('BRL', 'Brazilian Real', 'R$'),
+('ARS', 'Argentine Peso', '$'),
+('CLP', 'Chilean Peso', '$'),
+('COP', 'Colombian Peso', '$'),
+('PEN', 'Peruvian Sol', 'S/'),
+('UYU', 'Uruguayan Peso', '$U'),
+('BOB', 'Bolivian Boliviano', 'Bs'),
+('PYG', 'Paraguayan Guarani', '₲'),
+('GTQ', 'Guatemalan Quetzal', 'Q'),
+('CRC', 'Costa Rican Colon', '₡'),
+('DOP', 'Dominican Peso', 'RD$')
+ON CONFLICT (code) DO NOTHING;
+
+INSERT INTO settings (key, value, description) VALUES
+('base_currency', 'USD', 'Currency dashboard revenue and distributor commissions are reported in')
+ON CONFLICT (key) DO NOTHING;
+
+-- One unit of currency is worth rate units of quote_currency from
+-- effective_date until the next rate for the pair
+CREATE TABLE IF NOT EXISTS exchange_rates (
+    id SERIAL PRIMARY KEY,
+    currency CHAR(3) NOT NULL REFERENCES currencies(code),
+    quote_currency CHAR(3) NOT NULL REFERENCES currencies(code),
+    rate NUMERIC(20,8) NOT NULL CHECK (rate > 0),
+    effective_date DATE NOT NULL,
+    source VARCHAR(50) NOT NULL DEFAULT 'manual',
+    created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CHECK (currency <> quote_currency),
+    UNIQUE (currency, quote_currency, effective_date)
+);
+
+-- A plan's own prices are in its currency; the price book adds prices in
+-- other currencies so ISPs are not billed at a floating conversion
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'USD' REFERENCES currencies(code);
+
+CREATE TABLE IF NOT EXISTS plan_prices (
+    plan_id INTEGER NOT NULL REFERENCES plans(id) ON DELETE CASCADE,
+    currency CHAR(3) NOT NULL REFERENCES currencies(code),
+    price_monthly NUMERIC(10,2) NOT NULL CHECK (price_monthly >= 0),
+    cache_overage_per_gb NUMERIC(10,2) NOT NULL DEFAULT 0,
+    bandwidth_overage_per_mbps NUMERIC(10,2) NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (plan_id, currency)
+);
+
+CREATE OR REPLACE VIEW plan_price_book AS
+SELECT id AS plan_id, currency, price_monthly, cache_overage_per_gb, bandwidth_overage_per_mbps
+FROM plans
+UNION ALL
+SELECT pp.plan_id, pp.currency, pp.price_monthly, pp.cache_overage_per_gb, pp.bandwidth_overage_per_mbps
+FROM plan_prices pp
+JOIN plans p ON p.id = pp.plan_id AND p.currency <> pp.currency;
+
+ALTER TABLE isps ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'USD' REFERENCES currencies(code);
+
+-- Invoice amounts are in currency; exchange_rate converts them to
+-- base_currency as of exchange_rate_date
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'USD';
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS base_currency CHAR(3) NOT NULL DEFAULT 'USD';
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS exchange_rate NUMERIC(20,8) NOT NULL DEFAULT 1;
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS exchange_rate_date DATE;
+
+UPDATE invoices SET exchange_rate_date = created_at::date WHERE exchange_rate_date IS NULL;
@@ -0,0 +1,3 @@
+DELETE FROM settings WHERE key IN ('invoice_company_name', 'invoice_company_address');
+DROP TABLE IF EXISTS invoice_documents;
+DROP TABLE IF EXISTS distributor_branding;
@@ -0,0 +1,30 @@
+-- PDF invoices: distributor branding and the issued documents
+
+-- How a distributor's ISPs see their invoices. ISPs without a branded
+-- distributor get the platform's invoice_company_* settings.
+CREATE TABLE IF NOT EXISTS distributor_branding (
+    distributor_id INTEGER PRIMARY KEY REFERENCES distributors(id) ON DELETE CASCADE,
+    company_name VARCHAR(255) NOT NULL,
+    address TEXT NOT NULL DEFAULT '',
+    tax_id VARCHAR(64),
+    logo BYTEA,
+    logo_content_type VARCHAR(50),
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- The PDF as issued, one per invoice status: a paid invoice gets a new
+-- document, but the one sent while it was pending never changes
+CREATE TABLE IF NOT EXISTS invoice_documents (
+    id SERIAL PRIMARY KEY,
+    invoice_id INTEGER NOT NULL REFERENCES invoices(id) ON DELETE CASCADE,
+    status VARCHAR(50) NOT NULL,
+    pdf BYTEA NOT NULL,
+    sha256 CHAR(64) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (invoice_id, status)
+);
+
+INSERT INTO settings (key, value, description) VALUES
+('invoice_company_name', 'ISP SaaS Platform', 'Issuer name printed on invoices of ISPs without a branded distributor'),
+('invoice_company_address', '', 'Issuer address printed on invoices, one line per row')
+ON CONFLICT (key) DO NOTHING;
@@ -0,0 +1 @@
+DELETE FROM settings WHERE key = 'license_grace_days';
@@ -0,0 +1,6 @@
+-- License grace period: an expired license keeps validating, flagged as in
+-- grace, for this many days
+
+INSERT INTO settings (key, value, description) VALUES
+('license_grace_days', '7', 'Days an expired license keeps working before cache servers stop')
+ON CONFLICT (key) DO NOTHING;
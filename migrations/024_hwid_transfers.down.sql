@@ -0,0 +1,4 @@
+DELETE FROM settings WHERE key = 'hwid_transfers_per_year';
+
+DROP TABLE IF EXISTS isp_hwid_history;
+DROP TABLE IF EXISTS hwid_transfers;
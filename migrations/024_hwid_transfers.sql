@@ -0,0 +1,42 @@
+-- Hardware ID transfers: an ISP that replaces its cache server asks to move
+-- its licenses to the new hardware, and an admin approves the rebind
+
+CREATE TABLE IF NOT EXISTS hwid_transfers (
+    id SERIAL PRIMARY KEY,
+    isp_id INTEGER NOT NULL REFERENCES isps(id) ON DELETE CASCADE,
+    old_hw_id VARCHAR(255) NOT NULL,
+    new_hw_id VARCHAR(255) NOT NULL,
+    reason TEXT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'rejected', 'cancelled')),
+    requested_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    reviewed_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    review_note TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    reviewed_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_hwid_transfers_isp ON hwid_transfers(isp_id, created_at DESC);
+-- At most one request waiting per ISP
+CREATE UNIQUE INDEX IF NOT EXISTS idx_hwid_transfers_pending ON hwid_transfers(isp_id) WHERE status = 'pending';
+
+-- Every hardware ID an ISP has been bound to. The current one has no
+-- unbound_at.
+CREATE TABLE IF NOT EXISTS isp_hwid_history (
+    id SERIAL PRIMARY KEY,
+    isp_id INTEGER NOT NULL REFERENCES isps(id) ON DELETE CASCADE,
+    hw_id VARCHAR(255) NOT NULL,
+    transfer_id INTEGER REFERENCES hwid_transfers(id) ON DELETE SET NULL,
+    bound_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    unbound_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_isp_hwid_history_isp ON isp_hwid_history(isp_id, bound_at DESC);
+CREATE INDEX IF NOT EXISTS idx_isp_hwid_history_hw_id ON isp_hwid_history(hw_id);
+
+INSERT INTO isp_hwid_history (isp_id, hw_id, bound_at)
+SELECT i.id, i.hw_id, COALESCE(i.created_at, CURRENT_TIMESTAMP) FROM isps i
+WHERE NOT EXISTS (SELECT 1 FROM isp_hwid_history h WHERE h.isp_id = i.id);
+
+INSERT INTO settings (key, value, description) VALUES
+('hwid_transfers_per_year', '2', 'Hardware ID transfers an ISP may have approved in any 365 days')
+ON CONFLICT (key) DO NOTHING;
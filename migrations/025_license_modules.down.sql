@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS plan_modules;
+DROP TABLE IF EXISTS license_modules;
@@ -0,0 +1,40 @@
+-- License modules: the catalogue of modules a cache server can run, and the
+-- modules each plan entitles its ISPs to
+
+CREATE TABLE IF NOT EXISTS license_modules (
+    key VARCHAR(50) PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    description TEXT,
+    is_active BOOLEAN NOT NULL DEFAULT true,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO license_modules (key, name, description) VALUES
+('cache', 'Caching', 'Content caching'),
+('https', 'HTTPS acceleration', 'Caching and acceleration of HTTPS traffic'),
+('monitoring', 'Monitoring', 'Basic cache and traffic statistics'),
+('advanced_stats', 'Advanced statistics', 'Detailed per-site and commercial statistics'),
+('custom_rules', 'Custom rules', 'Operator-defined caching rules')
+ON CONFLICT (key) DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS plan_modules (
+    plan_id INTEGER NOT NULL REFERENCES plans(id) ON DELETE CASCADE,
+    module_key VARCHAR(50) NOT NULL REFERENCES license_modules(key),
+    PRIMARY KEY (plan_id, module_key)
+);
+
+-- Existing plans are entitled to the modules behind the features they
+-- advertise
+INSERT INTO plan_modules (plan_id, module_key)
+SELECT DISTINCT p.id, m.module_key
+FROM plans p
+CROSS JOIN LATERAL jsonb_array_elements_text(COALESCE(p.features, '[]'::jsonb)) f(feature)
+JOIN (VALUES
+    ('cache', 'cache'),
+    ('basic_stats', 'monitoring'),
+    ('advanced_stats', 'monitoring'),
+    ('advanced_stats', 'advanced_stats'),
+    ('https_acceleration', 'https'),
+    ('custom_rules', 'custom_rules')
+) m(feature, module_key) ON m.feature = f.feature
+ON CONFLICT DO NOTHING;
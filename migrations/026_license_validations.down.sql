@@ -0,0 +1,3 @@
+DELETE FROM settings WHERE key IN ('license_validation_cache_seconds', 'license_validation_retention_days');
+
+DROP TABLE IF EXISTS license_validations;
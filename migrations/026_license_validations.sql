@@ -0,0 +1,27 @@
+-- License validation attempts, successful or not, for spotting licenses used
+-- from more than one server
+
+CREATE TABLE IF NOT EXISTS license_validations (
+    id BIGSERIAL PRIMARY KEY,
+    -- Unset when the key matched no license of the agent's ISP
+    license_id INTEGER REFERENCES licenses(id) ON DELETE CASCADE,
+    isp_id INTEGER REFERENCES isps(id) ON DELETE CASCADE,
+    license_key VARCHAR(255),
+    hw_id VARCHAR(255),
+    source_ip INET,
+    success BOOLEAN NOT NULL,
+    -- valid or grace on success, otherwise why validation failed
+    reason VARCHAR(30) NOT NULL,
+    -- Answered from the validation cache
+    cached BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_license_validations_license ON license_validations(license_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_license_validations_isp ON license_validations(isp_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_license_validations_created ON license_validations(created_at);
+
+INSERT INTO settings (key, value, description) VALUES
+('license_validation_cache_seconds', '300', 'Seconds a successful license validation is answered from Redis'),
+('license_validation_retention_days', '90', 'Days to keep license validation attempts')
+ON CONFLICT (key) DO NOTHING;
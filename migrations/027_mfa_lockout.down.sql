@@ -0,0 +1,4 @@
+DELETE FROM settings WHERE key IN ('mfa_max_attempts', 'mfa_lockout_minutes');
+
+ALTER TABLE users DROP COLUMN IF EXISTS mfa_locked_until;
+ALTER TABLE users DROP COLUMN IF EXISTS mfa_failed_attempts;
@@ -0,0 +1,10 @@
+-- Lock the second factor after repeated wrong codes, so a code cannot be
+-- guessed by spreading attempts over many addresses
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS mfa_failed_attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS mfa_locked_until TIMESTAMP;
+
+INSERT INTO settings (key, value, description) VALUES
+('mfa_max_attempts', '5', 'Wrong two-factor codes in a row before the second factor is locked'),
+('mfa_lockout_minutes', '15', 'Minutes the second factor stays locked after too many wrong codes')
+ON CONFLICT (key) DO NOTHING;
@@ -0,0 +1,5 @@
+DELETE FROM invoice_documents WHERE amount_credited <> 0;
+
+ALTER TABLE invoice_documents DROP CONSTRAINT IF EXISTS invoice_documents_revision_key;
+ALTER TABLE invoice_documents ADD CONSTRAINT invoice_documents_invoice_id_status_key UNIQUE (invoice_id, status);
+ALTER TABLE invoice_documents DROP COLUMN IF EXISTS amount_credited;
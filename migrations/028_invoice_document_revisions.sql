@@ -0,0 +1,6 @@
+-- A credit note changes what a paid invoice is owed without changing its
+-- status, so issued PDFs are also keyed on the amount credited at the time
+
+ALTER TABLE invoice_documents ADD COLUMN IF NOT EXISTS amount_credited DECIMAL(10,2) NOT NULL DEFAULT 0;
+ALTER TABLE invoice_documents DROP CONSTRAINT IF EXISTS invoice_documents_invoice_id_status_key;
+ALTER TABLE invoice_documents ADD CONSTRAINT invoice_documents_revision_key UNIQUE (invoice_id, status, amount_credited);
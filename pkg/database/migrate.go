@@ -0,0 +1,443 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationLockKey is the pg_advisory_lock key held while migrations run, so
+// replicas starting at the same time apply each migration exactly once
+const migrationLockKey int64 = 0x69737073616173 // "ispsaas"
+
+// baselineVersion is the last migration that predates the schema_migrations
+// ledger. Databases set up before it had no record of what ran.
+const baselineVersion int64 = 10
+
+// Migration states reported by Status
+const (
+	MigrationApplied  = "applied"
+	MigrationPending  = "pending"
+	MigrationModified = "modified" // applied, but the file changed since
+	MigrationMissing  = "missing"  // applied, but the file is gone
+)
+
+var ErrPendingMigrations = errors.New("database has pending migrations")
+
+// Migration is one versioned schema change. Files are named
+// NNN_description.sql, with an optional NNN_description.down.sql that
+// reverts it.
+type Migration struct {
+	Version   int64
+	Name      string
+	UpSQL     string
+	DownSQL   string
+	Checksum  string
+	State     string
+	AppliedAt *time.Time
+}
+
+type appliedMigration struct {
+	name      string
+	checksum  string
+	appliedAt time.Time
+}
+
+// Migrator applies the migrations in a directory and records them in the
+// schema_migrations ledger. Databases created before the ledger existed are
+// baselined on the first Up: migrations 001-010 are recorded as applied
+// without running them again, since their seed data would be duplicated.
+type Migrator struct {
+	db   *DB
+	path string
+	log  func(format string, args ...interface{})
+}
+
+func (db *DB) Migrator(migrationsPath string) *Migrator {
+	return &Migrator{
+		db:   db,
+		path: migrationsPath,
+		log:  func(format string, args ...interface{}) { fmt.Printf(format+"\n", args...) },
+	}
+}
+
+// RunMigrations applies every pending migration
+func (db *DB) RunMigrations(migrationsPath string) error {
+	_, err := db.Migrator(migrationsPath).Up()
+	return err
+}
+
+// Up applies pending migrations in version order, each in its own
+// transaction, and returns how many ran. It refuses to run if an applied
+// migration was modified or removed.
+func (m *Migrator) Up() (int, error) {
+	count := 0
+	err := m.withLock(func(conn *sql.Conn) error {
+		if err := m.baseline(conn); err != nil {
+			return err
+		}
+		migrations, err := m.load(conn)
+		if err != nil {
+			return err
+		}
+		if err := checkIntegrity(migrations); err != nil {
+			return err
+		}
+
+		for _, mig := range migrations {
+			if mig.State != MigrationPending {
+				continue
+			}
+			if err := m.apply(conn, mig); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// Down reverts the last steps applied migrations, newest first. Every one of
+// them needs a .down.sql file.
+func (m *Migrator) Down(steps int) (int, error) {
+	count := 0
+	err := m.withLock(func(conn *sql.Conn) error {
+		migrations, err := m.load(conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+			mig := migrations[i]
+			if mig.State == MigrationPending {
+				continue
+			}
+			if mig.State == MigrationMissing {
+				return fmt.Errorf("cannot revert migration %d: file not found", mig.Version)
+			}
+			if mig.DownSQL == "" {
+				return fmt.Errorf("cannot revert migration %d_%s: no down migration", mig.Version, mig.Name)
+			}
+			if err := m.revert(conn, mig); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// Status lists every migration known either from disk or from the ledger
+func (m *Migrator) Status() ([]Migration, error) {
+	conn, err := m.db.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := ensureLedger(conn); err != nil {
+		return nil, err
+	}
+	return m.load(conn)
+}
+
+// Check returns ErrPendingMigrations if the schema is behind the migration
+// files, or an integrity error if applied migrations were changed
+func (m *Migrator) Check() error {
+	migrations, err := m.Status()
+	if err != nil {
+		return err
+	}
+	if err := checkIntegrity(migrations); err != nil {
+		return err
+	}
+	for _, mig := range migrations {
+		if mig.State == MigrationPending {
+			return ErrPendingMigrations
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) withLock(fn func(conn *sql.Conn) error) error {
+	ctx := context.Background()
+
+	// Advisory locks belong to a session, so everything runs on one connection
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockKey)
+
+	if err := ensureLedger(conn); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func ensureLedger(conn *sql.Conn) error {
+	_, err := conn.ExecContext(context.Background(), `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version BIGINT PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			checksum VARCHAR(64) NOT NULL,
+			execution_ms INTEGER,
+			applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	return nil
+}
+
+// baseline records the migrations up to baselineVersion as applied when the
+// schema already exists (the plans table from 001 is there) but the ledger is
+// still empty
+func (m *Migrator) baseline(conn *sql.Conn) error {
+	ctx := context.Background()
+
+	var legacy bool
+	err := conn.QueryRowContext(ctx, `
+		SELECT to_regclass('plans') IS NOT NULL AND NOT EXISTS(SELECT 1 FROM schema_migrations)
+	`).Scan(&legacy)
+	if err != nil {
+		return fmt.Errorf("failed to inspect schema: %w", err)
+	}
+	if !legacy {
+		return nil
+	}
+
+	files, err := readMigrationFiles(m.path)
+	if err != nil {
+		return err
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	migrations := baselineMigrations(files)
+	for _, mig := range migrations {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)
+		`, mig.Version, mig.Name, mig.Checksum)
+		if err != nil {
+			return fmt.Errorf("failed to record migration %d_%s: %w", mig.Version, mig.Name, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit baseline: %w", err)
+	}
+
+	m.log("Existing schema found, recorded migrations 1-%d as applied", baselineVersion)
+	return nil
+}
+
+// baselineMigrations returns the migrations a pre-ledger database already has
+func baselineMigrations(files []Migration) []Migration {
+	var migrations []Migration
+	for _, mig := range files {
+		if mig.Version <= baselineVersion {
+			migrations = append(migrations, mig)
+		}
+	}
+	return migrations
+}
+
+func (m *Migrator) apply(conn *sql.Conn, mig Migration) error {
+	ctx := context.Background()
+	start := time.Now()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, mig.UpSQL); err != nil {
+		return fmt.Errorf("failed to execute migration %d_%s: %w", mig.Version, mig.Name, err)
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO schema_migrations (version, name, checksum, execution_ms) VALUES ($1, $2, $3, $4)
+	`, mig.Version, mig.Name, mig.Checksum, time.Since(start).Milliseconds())
+	if err != nil {
+		return fmt.Errorf("failed to record migration %d_%s: %w", mig.Version, mig.Name, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migration %d_%s: %w", mig.Version, mig.Name, err)
+	}
+
+	m.log("Migration applied: %d_%s (%s)", mig.Version, mig.Name, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+func (m *Migrator) revert(conn *sql.Conn, mig Migration) error {
+	ctx := context.Background()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, mig.DownSQL); err != nil {
+		return fmt.Errorf("failed to revert migration %d_%s: %w", mig.Version, mig.Name, err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = $1", mig.Version); err != nil {
+		return fmt.Errorf("failed to update schema_migrations: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit revert of %d_%s: %w", mig.Version, mig.Name, err)
+	}
+
+	m.log("Migration reverted: %d_%s", mig.Version, mig.Name)
+	return nil
+}
+
+// load merges the migration files with the ledger, sorted by version
+func (m *Migrator) load(conn *sql.Conn) ([]Migration, error) {
+	files, err := readMigrationFiles(m.path)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.QueryContext(context.Background(), "SELECT version, name, checksum, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := map[int64]appliedMigration{}
+	for rows.Next() {
+		var version int64
+		var a appliedMigration
+		if err := rows.Scan(&version, &a.name, &a.checksum, &a.appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = a
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return mergeLedger(files, applied), nil
+}
+
+// mergeLedger sets the state of each migration file from the ledger of
+// applied migrations, and adds the applied ones whose file is gone
+func mergeLedger(files []Migration, applied map[int64]appliedMigration) []Migration {
+	var migrations []Migration
+	for _, mig := range files {
+		mig.State = MigrationPending
+		if a, ok := applied[mig.Version]; ok {
+			appliedAt := a.appliedAt
+			mig.AppliedAt = &appliedAt
+			mig.State = MigrationApplied
+			if a.checksum != mig.Checksum {
+				mig.State = MigrationModified
+			}
+			delete(applied, mig.Version)
+		}
+		migrations = append(migrations, mig)
+	}
+	for version, a := range applied {
+		appliedAt := a.appliedAt
+		migrations = append(migrations, Migration{
+			Version: version, Name: a.name, Checksum: a.checksum,
+			State: MigrationMissing, AppliedAt: &appliedAt,
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations
+}
+
+// readMigrationFiles reads the migrations in path, sorted by version, pairing
+// each with its .down.sql file
+func readMigrationFiles(path string) ([]Migration, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations directory: %w", err)
+	}
+
+	byVersion := map[int64]*Migration{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || filepath.Ext(name) != ".sql" {
+			continue
+		}
+
+		down := strings.HasSuffix(name, ".down.sql")
+		base := strings.TrimSuffix(strings.TrimSuffix(name, ".sql"), ".down")
+
+		prefix, desc, _ := strings.Cut(base, "_")
+		version, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: file name must start with a version number", name)
+		}
+
+		content, err := os.ReadFile(filepath.Join(path, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %w", name, err)
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: desc}
+			byVersion[version] = mig
+		} else if mig.Name != desc {
+			return nil, fmt.Errorf("migration version %d is used by both %s and %s", version, mig.Name, desc)
+		}
+
+		if down {
+			mig.DownSQL = string(content)
+		} else {
+			if mig.UpSQL != "" {
+				return nil, fmt.Errorf("migration version %d is defined twice", version)
+			}
+			mig.UpSQL = string(content)
+			sum := sha256.Sum256(content)
+			mig.Checksum = hex.EncodeToString(sum[:])
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.UpSQL == "" {
+			return nil, fmt.Errorf("migration %d_%s has a down file but no up file", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+func checkIntegrity(migrations []Migration) error {
+	for _, mig := range migrations {
+		switch mig.State {
+		case MigrationModified:
+			return fmt.Errorf("migration %d_%s was changed after it was applied (checksum mismatch)", mig.Version, mig.Name)
+		case MigrationMissing:
+			return fmt.Errorf("migration %d_%s was applied but its file is missing", mig.Version, mig.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeMigrations(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func checksum(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestReadMigrationFiles(t *testing.T) {
+	dir := writeMigrations(t, map[string]string{
+		"010_billing.sql":     "CREATE TABLE billing ();",
+		"002_users.sql":       "CREATE TABLE users ();",
+		"002_users.down.sql":  "DROP TABLE users;",
+		"1_initial.sql":       "CREATE TABLE isps ();",
+		"README.md":           "not a migration",
+		"011_notes.sql.orig":  "not a migration either",
+		"003_plans.down.sql~": "editor backup",
+	})
+	if err := os.Mkdir(filepath.Join(dir, "004_dir.sql"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	migrations, err := readMigrationFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		version int64
+		name    string
+		up      string
+		down    string
+	}{
+		{1, "initial", "CREATE TABLE isps ();", ""},
+		{2, "users", "CREATE TABLE users ();", "DROP TABLE users;"},
+		{10, "billing", "CREATE TABLE billing ();", ""},
+	}
+	if len(migrations) != len(want) {
+		t.Fatalf("got %d migrations, want %d: %+v", len(migrations), len(want), migrations)
+	}
+	for i, w := range want {
+		m := migrations[i]
+		if m.Version != w.version || m.Name != w.name || m.UpSQL != w.up || m.DownSQL != w.down {
+			t.Errorf("migration %d: got %d_%s up=%q down=%q, want %d_%s up=%q down=%q",
+				i, m.Version, m.Name, m.UpSQL, m.DownSQL, w.version, w.name, w.up, w.down)
+		}
+		// Only the up file is checksummed, so adding a down file later does
+		// not mark an applied migration modified
+		if m.Checksum != checksum(w.up) {
+			t.Errorf("%d_%s: checksum %s, want %s", m.Version, m.Name, m.Checksum, checksum(w.up))
+		}
+	}
+}
+
+func TestReadMigrationFilesInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		err   string
+	}{
+		{"two names for a version", []string{"001_users.sql", "001_plans.sql"}, "is used by both"},
+		{"down file for another name", []string{"001_users.sql", "001_plans.down.sql"}, "is used by both"},
+		{"same version written differently", []string{"001_users.sql", "1_users.sql"}, "is defined twice"},
+		{"down file alone", []string{"001_users.sql", "002_plans.down.sql"}, "has a down file but no up file"},
+		{"no version", []string{"users.sql"}, "must start with a version number"},
+		{"bad version", []string{"v1_users.sql"}, "must start with a version number"},
+	}
+	for _, tt := range tests {
+		files := map[string]string{}
+		for _, f := range tt.files {
+			files[f] = "SELECT 1;"
+		}
+		_, err := readMigrationFiles(writeMigrations(t, files))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got %v, want an error containing %q", tt.name, err, tt.err)
+		}
+	}
+
+	if _, err := readMigrationFiles(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("reading a missing directory succeeded, want error")
+	}
+}
+
+func TestMergeLedger(t *testing.T) {
+	files := []Migration{
+		{Version: 1, Name: "initial", Checksum: checksum("a")},
+		{Version: 2, Name: "users", Checksum: checksum("b")},
+		{Version: 3, Name: "plans", Checksum: checksum("c")},
+	}
+	appliedAt := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		applied   map[int64]appliedMigration
+		states    string
+		integrity string
+	}{
+		{"fresh database", map[int64]appliedMigration{}, "pending pending pending", ""},
+		{"partly applied", map[int64]appliedMigration{
+			1: {"initial", checksum("a"), appliedAt},
+		}, "applied pending pending", ""},
+		{"up to date", map[int64]appliedMigration{
+			1: {"initial", checksum("a"), appliedAt},
+			2: {"users", checksum("b"), appliedAt},
+			3: {"plans", checksum("c"), appliedAt},
+		}, "applied applied applied", ""},
+		{"file changed after it was applied", map[int64]appliedMigration{
+			1: {"initial", checksum("a"), appliedAt},
+			2: {"users", checksum("b, edited"), appliedAt},
+		}, "applied modified pending", "checksum mismatch"},
+		{"file removed after it was applied", map[int64]appliedMigration{
+			1: {"initial", checksum("a"), appliedAt},
+			4: {"billing", checksum("d"), appliedAt},
+		}, "applied pending pending missing", "file is missing"},
+	}
+	for _, tt := range tests {
+		migrations := mergeLedger(files, tt.applied)
+
+		states := make([]string, len(migrations))
+		for i, m := range migrations {
+			states[i] = m.State
+			if int64(i+1) != m.Version {
+				t.Errorf("%s: migration %d has version %d", tt.name, i, m.Version)
+			}
+			if (m.State == MigrationPending) != (m.AppliedAt == nil) {
+				t.Errorf("%s: %d_%s is %s with applied_at %v", tt.name, m.Version, m.Name, m.State, m.AppliedAt)
+			}
+		}
+		if got := strings.Join(states, " "); got != tt.states {
+			t.Errorf("%s: states %q, want %q", tt.name, got, tt.states)
+		}
+
+		err := checkIntegrity(migrations)
+		if tt.integrity == "" && err != nil {
+			t.Errorf("%s: checkIntegrity: %v", tt.name, err)
+		}
+		if tt.integrity != "" && (err == nil || !strings.Contains(err.Error(), tt.integrity)) {
+			t.Errorf("%s: checkIntegrity = %v, want an error containing %q", tt.name, err, tt.integrity)
+		}
+	}
+}
+
+func TestRepositoryMigrations(t *testing.T) {
+	migrations, err := readMigrationFiles("../../migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range migrations {
+		if m.Version != int64(i+1) {
+			t.Errorf("migration %d_%s: want version %d, the series must have no gaps", m.Version, m.Name, i+1)
+		}
+	}
+}
+
+func TestBaselineMigrations(t *testing.T) {
+	migrations, err := readMigrationFiles("../../migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseline := baselineMigrations(migrations)
+	if len(baseline) != int(baselineVersion) {
+		t.Fatalf("baseline has %d migrations, want %d", len(baseline), baselineVersion)
+	}
+	if last := baseline[len(baseline)-1]; last.Name != "audit_logs" {
+		t.Errorf("baseline ends at %d_%s, want 10_audit_logs", last.Version, last.Name)
+	}
+}
@@ -4,8 +4,6 @@ import (
     "database/sql"
     "fmt"
     "os"
-    "path/filepath"
-    "sort"
     "time"
 
     _ "github.com/lib/pq"
@@ -44,36 +42,6 @@ func Connect() (*DB, error) {
     return &DB{db}, nil
 }
 
-func (db *DB) RunMigrations(migrationsPath string) error {
-    files, err := os.ReadDir(migrationsPath)
-    if err != nil {
-        return fmt.Errorf("failed to read migrations directory: %w", err)
-    }
-
-    var sqlFiles []string
-    for _, file := range files {
-        if !file.IsDir() && filepath.Ext(file.Name()) == ".sql" {
-            sqlFiles = append(sqlFiles, file.Name())
-        }
-    }
-    sort.Strings(sqlFiles)
-
-    for _, file := range sqlFiles {
-        content, err := os.ReadFile(filepath.Join(migrationsPath, file))
-        if err != nil {
-            return fmt.Errorf("failed to read migration %s: %w", file, err)
-        }
-
-        if _, err := db.Exec(string(content)); err != nil {
-            return fmt.Errorf("failed to execute migration %s: %w", file, err)
-        }
-
-        fmt.Printf("Migration executed: %s\n", file)
-    }
-
-    return nil
-}
-
 func getEnv(key, defaultValue string) string {
     if value := os.Getenv(key); value != "" {
         return value
@@ -0,0 +1,200 @@
+// Package license signs the license documents cache servers run on. A
+// license is a JWT signed with Ed25519 (EdDSA), so an agent holding only the
+// platform's public key can verify it offline; the signing key is dedicated
+// to licenses and unrelated to the secret behind user sessions.
+package license
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Issuer is the iss claim of every license
+const Issuer = "isp-saas-platform"
+
+// ErrNoSigningKey is returned by FromEnv when no signing key is configured
+var ErrNoSigningKey = errors.New("LICENSE_SIGNING_KEY is not set")
+
+// Limits are the capacity limits the license grants; nil means unlimited
+type Limits struct {
+	CacheSizeGB        *int `json:"cache_size_gb"`
+	BandwidthLimitMbps *int `json:"bandwidth_limit_mbps"`
+	MaxConnections     *int `json:"max_connections"`
+}
+
+// Claims is the signed license document
+type Claims struct {
+	LicenseKey string   `json:"license_key"`
+	ISPID      int      `json:"isp_id"`
+	HWID       string   `json:"hw_id"`
+	Modules    []string `json:"modules"`
+	Limits     Limits   `json:"limits"`
+	// When the license expires. The token itself stays valid until the end
+	// of the grace period after it, its exp.
+	LicenseExpiresAt *jwt.NumericDate `json:"license_expires_at"`
+	jwt.RegisteredClaims
+}
+
+// Signer signs licenses with an Ed25519 private key
+type Signer struct {
+	key ed25519.PrivateKey
+	id  string
+}
+
+func NewSigner(key ed25519.PrivateKey) *Signer {
+	return &Signer{key: key, id: KeyID(key.Public().(ed25519.PublicKey))}
+}
+
+// Generate creates a signer with a new random key
+func Generate() (*Signer, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return NewSigner(key), nil
+}
+
+// FromEnv loads the signing key from LICENSE_SIGNING_KEY, or from the file
+// named by LICENSE_SIGNING_KEY_FILE. See ParsePrivateKey for the formats.
+func FromEnv() (*Signer, error) {
+	value := os.Getenv("LICENSE_SIGNING_KEY")
+	if path := os.Getenv("LICENSE_SIGNING_KEY_FILE"); value == "" && path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		value = string(b)
+	}
+	if value == "" {
+		return nil, ErrNoSigningKey
+	}
+
+	key, err := ParsePrivateKey(value)
+	if err != nil {
+		return nil, err
+	}
+	return NewSigner(key), nil
+}
+
+// KeyID identifies a public key: the first 8 bytes of its SHA-256, in hex.
+// Licenses name the key that signed them in their kid header.
+func KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+func (s *Signer) KeyID() string {
+	return s.id
+}
+
+func (s *Signer) PublicKey() ed25519.PublicKey {
+	return s.key.Public().(ed25519.PublicKey)
+}
+
+// PublicKeyPEM is the public key as a PKIX "PUBLIC KEY" PEM block
+func (s *Signer) PublicKeyPEM() string {
+	der, _ := x509.MarshalPKIXPublicKey(s.PublicKey())
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// PrivateKeyBase64 is the base64 of the key's 32-byte seed, the form
+// LICENSE_SIGNING_KEY takes
+func (s *Signer) PrivateKeyBase64() string {
+	return base64.StdEncoding.EncodeToString(s.key.Seed())
+}
+
+// Sign issues c as a license token. The subject is the license key; the
+// license expires at expiresAt and the token at the end of the grace period.
+func (s *Signer) Sign(c Claims, issuedAt, expiresAt time.Time, grace time.Duration) (string, error) {
+	c.Issuer = Issuer
+	c.Subject = c.LicenseKey
+	c.IssuedAt = jwt.NewNumericDate(issuedAt)
+	c.LicenseExpiresAt = jwt.NewNumericDate(expiresAt)
+	c.ExpiresAt = jwt.NewNumericDate(expiresAt.Add(grace))
+
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, &c)
+	token.Header["kid"] = s.id
+	return token.SignedString(s.key)
+}
+
+// Verify checks a license token against pub and returns its claims. Only
+// unexpired EdDSA tokens from this platform are accepted.
+func Verify(token string, pub ed25519.PublicKey) (*Claims, error) {
+	var c Claims
+	_, err := jwt.ParseWithClaims(token, &c, func(*jwt.Token) (interface{}, error) {
+		return pub, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}), jwt.WithIssuer(Issuer), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Current reports whether token was signed with this signer's key and
+// carries c, the license as it stands now, with the same expiry and grace
+// period. A license that is not current must be signed again.
+func (s *Signer) Current(token string, c Claims, expiresAt time.Time, grace time.Duration) bool {
+	var got Claims
+	t, _, err := jwt.NewParser().ParseUnverified(token, &got)
+	if err != nil || t.Method != jwt.SigningMethodEdDSA || t.Header["kid"] != s.id {
+		return false
+	}
+	if !sameTime(got.LicenseExpiresAt, expiresAt) || !sameTime(got.ExpiresAt, expiresAt.Add(grace)) {
+		return false
+	}
+	got.RegisteredClaims, c.RegisteredClaims = jwt.RegisteredClaims{}, jwt.RegisteredClaims{}
+	got.LicenseExpiresAt, c.LicenseExpiresAt = nil, nil
+	return reflect.DeepEqual(got, c)
+}
+
+// sameTime compares a token date with t at the second precision of tokens
+func sameTime(d *jwt.NumericDate, t time.Time) bool {
+	return d != nil && d.Unix() == t.Unix()
+}
+
+// ParsePrivateKey reads an Ed25519 private key given as a PKCS#8 PEM block,
+// or as base64 of the 32-byte seed or the 64-byte private key
+func ParsePrivateKey(s string) (ed25519.PrivateKey, error) {
+	s = strings.TrimSpace(s)
+	if block, _ := pem.Decode([]byte(s)); block != nil {
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		ed, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("license signing key is not an Ed25519 key")
+		}
+		return ed, nil
+	}
+
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("license signing key is neither PEM nor base64: %w", err)
+	}
+	switch len(b) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(b), nil
+	case ed25519.PrivateKeySize:
+		// The second half is the public key, which must match the seed
+		key := ed25519.NewKeyFromSeed(b[:ed25519.SeedSize])
+		if !key.Equal(ed25519.PrivateKey(b)) {
+			return nil, errors.New("license signing key is corrupt")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("license signing key has %d bytes, want %d or %d", len(b), ed25519.SeedSize, ed25519.PrivateKeySize)
+}
@@ -0,0 +1,147 @@
+package license
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func testClaims() Claims {
+	cache := 500
+	return Claims{
+		LicenseKey: "ISP-0123456789abcdef01234567",
+		ISPID:      7,
+		HWID:       "hw-1",
+		Modules:    []string{"cache", "https"},
+		Limits:     Limits{CacheSizeGB: &cache},
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	s, err := Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	token, err := s.Sign(testClaims(), now, now.Add(time.Hour), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Verify(token, s.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ISPID != 7 || c.HWID != "hw-1" || c.Subject != c.LicenseKey || len(c.Modules) != 2 || *c.Limits.CacheSizeGB != 500 {
+		t.Fatalf("unexpected claims %+v", c)
+	}
+	if c.Limits.MaxConnections != nil {
+		t.Fatal("unset limits should stay unlimited")
+	}
+}
+
+func TestCurrent(t *testing.T) {
+	s, _ := Generate()
+	other, _ := Generate()
+	now := time.Now()
+	expires := now.Add(time.Hour)
+	grace := 7 * 24 * time.Hour
+	token, _ := s.Sign(testClaims(), now, expires, grace)
+
+	if !s.Current(token, testClaims(), expires, grace) {
+		t.Fatal("freshly signed token is not current")
+	}
+	if other.Current(token, testClaims(), expires, grace) {
+		t.Fatal("token signed with another key is current")
+	}
+	if s.Current(token, testClaims(), expires.Add(24*time.Hour), grace) {
+		t.Fatal("token with the old expiry is current")
+	}
+	if s.Current(token, testClaims(), expires, 0) {
+		t.Fatal("token with the old grace period is current")
+	}
+	moved := testClaims()
+	moved.HWID = "hw-2"
+	if s.Current(token, moved, expires, grace) {
+		t.Fatal("token with the old hardware id is current")
+	}
+	limited := testClaims()
+	conns := 100
+	limited.Limits.MaxConnections = &conns
+	if s.Current(token, limited, expires, grace) {
+		t.Fatal("token with the old limits is current")
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	s, _ := Generate()
+	other, _ := Generate()
+	now := time.Now()
+	token, _ := s.Sign(testClaims(), now, now.Add(time.Hour), 0)
+
+	if _, err := Verify(token, other.PublicKey()); err == nil {
+		t.Fatal("token verified with another key")
+	}
+
+	parts := strings.Split(token, ".")
+	forged := testClaims()
+	forged.HWID = "hw-2"
+	forgedToken, _ := s.Sign(forged, now, now.Add(time.Hour), 0)
+	parts[1] = strings.Split(forgedToken, ".")[1]
+	if _, err := Verify(strings.Join(parts, "."), s.PublicKey()); err == nil {
+		t.Fatal("token with a swapped payload verified")
+	}
+
+	expired, _ := s.Sign(testClaims(), now.Add(-2*time.Hour), now.Add(-time.Hour), 0)
+	if _, err := Verify(expired, s.PublicKey()); err == nil {
+		t.Fatal("expired token verified")
+	}
+	inGrace, _ := s.Sign(testClaims(), now.Add(-2*time.Hour), now.Add(-time.Hour), 2*time.Hour)
+	if c, err := Verify(inGrace, s.PublicKey()); err != nil || c.LicenseExpiresAt.Unix() != now.Add(-time.Hour).Unix() {
+		t.Fatalf("token in its grace period: %v", err)
+	}
+
+	// A symmetric token must not pass, whatever key it was made with
+	hs, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"iss": Issuer, "exp": now.Add(time.Hour).Unix()}).
+		SignedString([]byte(s.PublicKey()))
+	if _, err := Verify(hs, s.PublicKey()); err == nil {
+		t.Fatal("HS256 token verified")
+	}
+	if s.Current(hs, testClaims(), now.Add(time.Hour), 0) {
+		t.Fatal("HS256 token is current")
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	s, _ := Generate()
+	seed := s.key.Seed()
+	der, _ := x509.MarshalPKCS8PrivateKey(s.key)
+
+	for name, value := range map[string]string{
+		"pem":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"seed": s.PrivateKeyBase64(),
+		"key":  base64.StdEncoding.EncodeToString(s.key),
+	} {
+		key, err := ParsePrivateKey(value)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !key.Equal(s.key) {
+			t.Fatalf("%s: parsed a different key", name)
+		}
+	}
+
+	corrupt := append(append([]byte{}, seed...), make([]byte, ed25519.PublicKeySize)...)
+	for _, value := range []string{"not a key", base64.StdEncoding.EncodeToString([]byte("short")),
+		base64.StdEncoding.EncodeToString(corrupt)} {
+		if _, err := ParsePrivateKey(value); err == nil {
+			t.Fatalf("ParsePrivateKey(%q) succeeded", value)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package mailer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// Mailer delivers transactional email such as password resets
+type Mailer interface {
+	Send(msg Message) error
+}
+
+var ErrUnknownDriver = errors.New("unknown MAIL_DRIVER, use smtp or log")
+
+// New picks a mailer from MAIL_DRIVER ("smtp" or "log"). The log driver is
+// the default so development and tests never send real mail; any other
+// value is rejected rather than silently logging mail in production.
+func New() (Mailer, error) {
+	from := getEnv("MAIL_FROM", "no-reply@ispsaas.com")
+
+	switch driver := getEnv("MAIL_DRIVER", "log"); driver {
+	case "smtp":
+		return &SMTPMailer{
+			Host:     getEnv("SMTP_HOST", "localhost"),
+			Port:     getEnv("SMTP_PORT", "587"),
+			Username: getEnv("SMTP_USER", ""),
+			Password: getEnv("SMTP_PASSWORD", ""),
+			From:     from,
+		}, nil
+	case "log":
+		return &LogMailer{Path: getEnv("MAIL_LOG_FILE", "")}, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownDriver, driver)
+	}
+}
+
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	headers := []string{
+		"From: " + m.From,
+		"To: " + msg.To,
+		"Subject: " + msg.Subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+	}
+	body := strings.Join(headers, "\r\n") + "\r\n\r\n" + msg.Body
+
+	if err := smtp.SendMail(m.Host+":"+m.Port, auth, m.From, []string{msg.To}, []byte(body)); err != nil {
+		return fmt.Errorf("failed to send mail to %s: %w", msg.To, err)
+	}
+	return nil
+}
+
+// LogMailer appends messages as JSON lines to Path, or to stdout when Path
+// is empty. Tests can set MaxSent to also keep the latest messages in Sent.
+type LogMailer struct {
+	Path string
+	// How many of the latest messages Sent keeps; none by default, so a
+	// long-running server does not hold every message in memory
+	MaxSent int
+
+	mu   sync.Mutex
+	Sent []Message
+}
+
+func (m *LogMailer) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.MaxSent > 0 {
+		if len(m.Sent) >= m.MaxSent {
+			m.Sent = append(m.Sent[:0], m.Sent[len(m.Sent)-m.MaxSent+1:]...)
+		}
+		m.Sent = append(m.Sent, msg)
+	}
+
+	line, _ := json.Marshal(map[string]interface{}{
+		"time":     time.Now().Format(time.RFC3339),
+		"mail":     msg,
+		"delivery": "log",
+	})
+
+	if m.Path == "" {
+		fmt.Fprintln(os.Stdout, string(line))
+		return nil
+	}
+
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open mail log: %w", err)
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintln(f, string(line))
+	return err
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,137 @@
+package payments
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+const stripeEvent = `{"id":"evt_1","type":"checkout.session.completed","data":{"object":{
+	"id":"cs_1","payment_intent":"pi_1","payment_status":"paid","amount_total":2599,"currency":"USD",
+	"client_reference_id":"42","metadata":{"invoice_id":"42"}}}}`
+
+func stripeHeader(secret, payload string, at time.Time) http.Header {
+	ts := fmt.Sprint(at.Unix())
+	h := http.Header{}
+	h.Set("Stripe-Signature", "t="+ts+",v1="+sign(secret, []byte(ts+"."+payload)))
+	return h
+}
+
+func TestStripeWebhookSignature(t *testing.T) {
+	now := time.Unix(1_800_000_000, 0)
+	s := NewStripe("sk_test", "whsec_test")
+	s.now = func() time.Time { return now }
+
+	tests := []struct {
+		name   string
+		header http.Header
+		ok     bool
+	}{
+		{"valid", stripeHeader("whsec_test", stripeEvent, now), true},
+		{"wrong secret", stripeHeader("whsec_other", stripeEvent, now), false},
+		{"too old", stripeHeader("whsec_test", stripeEvent, now.Add(-10*time.Minute)), false},
+		{"missing", http.Header{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.ParseWebhook([]byte(stripeEvent), tt.header)
+			if (err == nil) != tt.ok {
+				t.Fatalf("ParseWebhook error = %v, want ok=%v", err, tt.ok)
+			}
+		})
+	}
+
+	tampered := stripeEvent[:len(stripeEvent)-2] + " }"
+	if _, err := s.ParseWebhook([]byte(tampered), stripeHeader("whsec_test", stripeEvent, now)); err != ErrInvalidSignature {
+		t.Fatalf("tampered payload: got %v, want ErrInvalidSignature", err)
+	}
+}
+
+func TestStripeWebhookEvent(t *testing.T) {
+	now := time.Now()
+	s := NewStripe("sk_test", "whsec_test")
+
+	evt, err := s.ParseWebhook([]byte(stripeEvent), stripeHeader("whsec_test", stripeEvent, now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evt.Type != EventPaymentSucceeded || evt.InvoiceID != 42 || evt.Amount != 2599 ||
+		evt.Currency != "usd" || evt.TransactionID != "pi_1" || evt.ID != "evt_1" {
+		t.Fatalf("unexpected event: %+v", evt)
+	}
+
+	intent := `{"id":"evt_2","type":"payment_intent.succeeded","data":{"object":{"id":"pi_1","amount":2599}}}`
+	evt, err = s.ParseWebhook([]byte(intent), stripeHeader("whsec_test", intent, now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evt.Type != EventIgnored {
+		t.Fatalf("payment_intent events must be ignored, got %q", evt.Type)
+	}
+}
+
+func TestStripeCheckoutSession(t *testing.T) {
+	var form url.Values
+	var keys []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/checkout/sessions" || r.Header.Get("Authorization") != "Bearer sk_test" {
+			http.Error(w, `{"error":{"message":"bad request"}}`, http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		form, _ = url.ParseQuery(string(body))
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		fmt.Fprint(w, `{"id":"cs_1","url":"https://checkout.example/cs_1","expires_at":1800000000}`)
+	}))
+	defer srv.Close()
+
+	s := NewStripe("sk_test", "whsec_test")
+	s.BaseURL = srv.URL
+
+	req := CheckoutRequest{
+		InvoiceID: 42, InvoiceNumber: "INV-2026-000042", Description: "Invoice INV-2026-000042",
+		Amount: 2599, Currency: "usd", SuccessURL: "https://app/ok", CancelURL: "https://app/cancel",
+	}
+	session, err := s.CreateCheckoutSession(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.ID != "cs_1" || session.URL != "https://checkout.example/cs_1" {
+		t.Fatalf("unexpected session: %+v", session)
+	}
+	if form.Get("metadata[invoice_id]") != "42" || form.Get("line_items[0][price_data][unit_amount]") != "2599" {
+		t.Fatalf("unexpected checkout form: %v", form)
+	}
+
+	// The same checkout is retried under the same key; another payer for the
+	// same invoice and amount must not collide with it
+	s.CreateCheckoutSession(context.Background(), req)
+	req.CustomerEmail = "billing@isp.example"
+	s.CreateCheckoutSession(context.Background(), req)
+	if len(keys) != 3 || keys[0] == "" || keys[1] != keys[0] || keys[2] == keys[0] {
+		t.Fatalf("unexpected idempotency keys: %q", keys)
+	}
+}
+
+func TestFakeProviderRoundTrip(t *testing.T) {
+	f := NewFake("fake_secret", "http://localhost:8080")
+
+	payload, header := f.SignedEvent(7, 1999, "usd")
+	evt, err := f.ParseWebhook(payload, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evt.Type != EventPaymentSucceeded || evt.InvoiceID != 7 || evt.Amount != 1999 || evt.TransactionID == "" {
+		t.Fatalf("unexpected event: %+v", evt)
+	}
+
+	other := NewFake("other_secret", "")
+	if _, err := other.ParseWebhook(payload, header); err != ErrInvalidSignature {
+		t.Fatalf("got %v, want ErrInvalidSignature", err)
+	}
+}
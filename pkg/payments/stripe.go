@@ -0,0 +1,198 @@
+package payments
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stripeSignatureTolerance bounds how old a signed webhook may be, which
+// limits replays of captured requests
+const stripeSignatureTolerance = 5 * time.Minute
+
+// Stripe implements Provider against the Stripe API (or anything speaking
+// the same protocol, via BaseURL)
+type Stripe struct {
+	SecretKey     string
+	WebhookSecret string
+	BaseURL       string
+	Client        *http.Client
+
+	now func() time.Time
+}
+
+func NewStripe(secretKey, webhookSecret string) *Stripe {
+	return &Stripe{
+		SecretKey:     secretKey,
+		WebhookSecret: webhookSecret,
+		BaseURL:       "https://api.stripe.com",
+		Client:        &http.Client{Timeout: 15 * time.Second},
+		now:           time.Now,
+	}
+}
+
+func (s *Stripe) Name() string { return "stripe" }
+
+// CreateCheckoutSession opens a one-off Checkout payment. The invoice id is
+// stored in the session metadata so the completion webhook can be matched.
+func (s *Stripe) CreateCheckoutSession(ctx context.Context, req CheckoutRequest) (*CheckoutSession, error) {
+	invoiceID := strconv.Itoa(req.InvoiceID)
+	form := url.Values{
+		"mode":                 {"payment"},
+		"success_url":          {req.SuccessURL},
+		"cancel_url":           {req.CancelURL},
+		"client_reference_id":  {invoiceID},
+		"metadata[invoice_id]": {invoiceID},
+		"payment_intent_data[metadata][invoice_id]":                         {invoiceID},
+		"line_items[0][quantity]":                                           {"1"},
+		"line_items[0][price_data][currency]":                               {req.Currency},
+		"line_items[0][price_data][unit_amount]":                            {strconv.FormatInt(req.Amount, 10)},
+		"line_items[0][price_data][product_data][name]":                     {req.Description},
+		"line_items[0][price_data][product_data][metadata][invoice_number]": {req.InvoiceNumber},
+	}
+	if req.CustomerEmail != "" {
+		form.Set("customer_email", req.CustomerEmail)
+	}
+
+	body := form.Encode()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, s.BaseURL+"/v1/checkout/sessions", strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+s.SecretKey)
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// Retrying the same checkout reuses the session instead of opening a second
+	// one. Stripe rejects a reused key whose parameters differ, so the key
+	// covers all of them: another payer or return URL gets its own session.
+	sum := sha256.Sum256([]byte(body))
+	httpReq.Header.Set("Idempotency-Key", fmt.Sprintf("checkout-%s-%x", invoiceID, sum[:16]))
+
+	resp, err := s.Client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("stripe: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("stripe: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.Unmarshal(respBody, &apiErr)
+		return nil, fmt.Errorf("stripe: checkout session failed (%d): %s", resp.StatusCode, apiErr.Error.Message)
+	}
+
+	var session struct {
+		ID        string `json:"id"`
+		URL       string `json:"url"`
+		ExpiresAt int64  `json:"expires_at"`
+	}
+	if err := json.Unmarshal(respBody, &session); err != nil {
+		return nil, fmt.Errorf("stripe: invalid checkout response: %w", err)
+	}
+	return &CheckoutSession{ID: session.ID, URL: session.URL, ExpiresAt: time.Unix(session.ExpiresAt, 0)}, nil
+}
+
+// ParseWebhook checks the Stripe-Signature header ("t=<unix>,v1=<hex>"), an
+// HMAC-SHA256 of "<t>.<payload>" with the endpoint's signing secret
+func (s *Stripe) ParseWebhook(payload []byte, header http.Header) (*Event, error) {
+	if err := s.verify(payload, header.Get("Stripe-Signature")); err != nil {
+		return nil, err
+	}
+
+	var evt struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Data struct {
+			Object struct {
+				ID                string            `json:"id"`
+				PaymentIntent     string            `json:"payment_intent"`
+				PaymentStatus     string            `json:"payment_status"`
+				AmountTotal       int64             `json:"amount_total"`
+				Currency          string            `json:"currency"`
+				ClientReferenceID string            `json:"client_reference_id"`
+				Metadata          map[string]string `json:"metadata"`
+			} `json:"object"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &evt); err != nil || evt.ID == "" {
+		return nil, ErrInvalidPayload
+	}
+
+	obj := evt.Data.Object
+	event := &Event{
+		ID:            evt.ID,
+		Type:          EventIgnored,
+		RawType:       evt.Type,
+		Amount:        obj.AmountTotal,
+		Currency:      strings.ToLower(obj.Currency),
+		TransactionID: obj.PaymentIntent,
+		Payload:       payload,
+	}
+	if event.TransactionID == "" {
+		event.TransactionID = obj.ID
+	}
+
+	ref := obj.Metadata["invoice_id"]
+	if ref == "" {
+		ref = obj.ClientReferenceID
+	}
+	event.InvoiceID, _ = strconv.Atoi(ref)
+
+	// Only Checkout events are acted on; the matching payment_intent events
+	// describe the same money and would be counted twice
+	switch evt.Type {
+	case "checkout.session.completed":
+		// Delayed methods (bank debits) complete later with async_payment_succeeded
+		if obj.PaymentStatus == "paid" {
+			event.Type = EventPaymentSucceeded
+		}
+	case "checkout.session.async_payment_succeeded":
+		event.Type = EventPaymentSucceeded
+	case "checkout.session.async_payment_failed":
+		event.Type = EventPaymentFailed
+	}
+	return event, nil
+}
+
+func (s *Stripe) verify(payload []byte, header string) error {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return ErrInvalidSignature
+	}
+	if age := s.now().Sub(time.Unix(ts, 0)); age > stripeSignatureTolerance || age < -stripeSignatureTolerance {
+		return ErrInvalidSignature
+	}
+
+	expected := sign(s.WebhookSecret, []byte(timestamp+"."+string(payload)))
+	for _, sig := range signatures {
+		if validSignature(expected, sig) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
@@ -0,0 +1,50 @@
+package pdf
+
+import (
+	"bytes"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// Image is a raster image embedded once and drawn on any page
+type Image struct {
+	id            int
+	width, height int
+	data          []byte
+}
+
+// Size is the image's size in pixels
+func (img *Image) Size() (width, height int) {
+	return img.width, img.height
+}
+
+// AddImage embeds a PNG, JPEG or GIF image. Transparent pixels are blended
+// onto white.
+func (d *Document) AddImage(data []byte) (*Image, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	b := src.Bounds()
+	rgb := make([]byte, 0, b.Dx()*b.Dy()*3)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := src.At(x, y).RGBA()
+			// Colors are alpha-premultiplied, so blending onto white adds the
+			// white showing through
+			white := 0xffff - a
+			rgb = append(rgb, byte((r+white)>>8), byte((g+white)>>8), byte((bl+white)>>8))
+		}
+	}
+
+	compressed, err := deflate(rgb)
+	if err != nil {
+		return nil, err
+	}
+	img := &Image{id: len(d.images) + 1, width: b.Dx(), height: b.Dy(), data: compressed}
+	d.images = append(d.images, img)
+	return img, nil
+}
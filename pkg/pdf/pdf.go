@@ -0,0 +1,238 @@
+// Package pdf writes simple PDF documents: text in the standard Helvetica
+// fonts, filled rectangles, lines and raster images. It needs no font files;
+// text is encoded as WinAnsi (Windows-1252), so characters outside it are
+// printed as '?'.
+//
+// Coordinates are in points from the top-left corner of the page, with y
+// growing downwards. Text is positioned by its baseline.
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A4 portrait, in points
+const (
+	PageWidth  = 595.28
+	PageHeight = 841.89
+)
+
+type Font int
+
+const (
+	Helvetica Font = iota
+	HelveticaBold
+)
+
+var fontNames = [...]string{"Helvetica", "Helvetica-Bold"}
+
+// Color is an RGB color
+type Color struct{ R, G, B uint8 }
+
+var (
+	Black = Color{0, 0, 0}
+	White = Color{255, 255, 255}
+)
+
+// Document is a PDF being built. The zero value is not usable; call New.
+type Document struct {
+	Title   string
+	Author  string
+	Created time.Time
+
+	pages  []*Page
+	images []*Image
+}
+
+func New() *Document {
+	return &Document{Created: time.Now()}
+}
+
+// Page is one page of a document
+type Page struct {
+	content bytes.Buffer
+}
+
+func (d *Document) AddPage() *Page {
+	p := &Page{}
+	d.pages = append(d.pages, p)
+	return p
+}
+
+// PageCount is the number of pages added so far
+func (d *Document) PageCount() int {
+	return len(d.pages)
+}
+
+// Text draws s with its baseline starting at x, y
+func (p *Page) Text(x, y float64, f Font, size float64, c Color, s string) {
+	fmt.Fprintf(&p.content, "BT /F%d %s Tf %s rg %s %s Td (%s) Tj ET\n",
+		int(f)+1, num(size), c.operands(), num(x), num(PageHeight-y), escape(encodeWinAnsi(s)))
+}
+
+// TextRight draws s so that it ends at x
+func (p *Page) TextRight(x, y float64, f Font, size float64, c Color, s string) {
+	p.Text(x-TextWidth(f, size, s), y, f, size, c, s)
+}
+
+// Rect fills a rectangle whose top-left corner is x, y
+func (p *Page) Rect(x, y, w, h float64, fill Color) {
+	fmt.Fprintf(&p.content, "%s rg %s %s %s %s re f\n", fill.operands(), num(x), num(PageHeight-y-h), num(w), num(h))
+}
+
+// Line strokes a line from x1, y1 to x2, y2
+func (p *Page) Line(x1, y1, x2, y2, width float64, c Color) {
+	fmt.Fprintf(&p.content, "%s w %s RG %s %s m %s %s l S\n", num(width), c.operands(),
+		num(x1), num(PageHeight-y1), num(x2), num(PageHeight-y2))
+}
+
+// Image draws img scaled to w by h with its top-left corner at x, y
+func (p *Page) Image(img *Image, x, y, w, h float64) {
+	fmt.Fprintf(&p.content, "q %s 0 0 %s %s %s cm /Im%d Do Q\n", num(w), num(h), num(x), num(PageHeight-y-h), img.id)
+}
+
+// WriteTo writes the finished document to w
+func (d *Document) WriteTo(w io.Writer) (int64, error) {
+	var out bytes.Buffer
+	var offsets []int
+
+	// Objects are numbered in the order they are written: catalog, page tree,
+	// fonts, images, then each page and its content stream, then the info
+	// dictionary
+	begin := func() int {
+		offsets = append(offsets, out.Len())
+		n := len(offsets)
+		fmt.Fprintf(&out, "%d 0 obj\n", n)
+		return n
+	}
+	end := func() { out.WriteString("endobj\n") }
+	stream := func(dict string, data []byte) {
+		fmt.Fprintf(&out, "<< %s /Length %d >>\nstream\n", dict, len(data))
+		out.Write(data)
+		out.WriteString("\nendstream\n")
+	}
+
+	const fontsFirst, pagesObj = 3, 2
+	imagesFirst := fontsFirst + len(fontNames)
+	pagesFirst := imagesFirst + len(d.images)
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	begin()
+	fmt.Fprintf(&out, "<< /Type /Catalog /Pages %d 0 R >>\n", pagesObj)
+	end()
+
+	begin()
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", pagesFirst+2*i)
+	}
+	fmt.Fprintf(&out, "<< /Type /Pages /Kids [%s] /Count %d >>\n", strings.Join(kids, " "), len(d.pages))
+	end()
+
+	var fonts strings.Builder
+	for i, name := range fontNames {
+		begin()
+		fmt.Fprintf(&out, "<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>\n", name)
+		end()
+		fmt.Fprintf(&fonts, "/F%d %d 0 R ", i+1, fontsFirst+i)
+	}
+
+	var xobjects strings.Builder
+	for i, img := range d.images {
+		begin()
+		stream(fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /FlateDecode",
+			img.width, img.height), img.data)
+		end()
+		fmt.Fprintf(&xobjects, "/Im%d %d 0 R ", img.id, imagesFirst+i)
+	}
+	resources := "/Font << " + fonts.String() + ">>"
+	if xobjects.Len() > 0 {
+		resources += " /XObject << " + xobjects.String() + ">>"
+	}
+
+	for _, p := range d.pages {
+		n := begin()
+		fmt.Fprintf(&out, "<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %s %s] /Resources << %s >> /Contents %d 0 R >>\n",
+			pagesObj, num(PageWidth), num(PageHeight), resources, n+1)
+		end()
+
+		content, err := deflate(p.content.Bytes())
+		if err != nil {
+			return 0, err
+		}
+		begin()
+		stream("/Filter /FlateDecode", content)
+		end()
+	}
+
+	info := begin()
+	fmt.Fprintf(&out, "<< /Title (%s) /Author (%s) /Producer (isp-saas pdf) /CreationDate (D:%s) >>\n",
+		escape(encodeWinAnsi(d.Title)), escape(encodeWinAnsi(d.Author)), d.Created.UTC().Format("20060102150405Z"))
+	end()
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, info, xref)
+
+	return out.WriteTo(w)
+}
+
+// Bytes renders the document
+func (d *Document) Bytes() ([]byte, error) {
+	var b bytes.Buffer
+	_, err := d.WriteTo(&b)
+	return b.Bytes(), err
+}
+
+func (c Color) operands() string {
+	return num(float64(c.R)/255) + " " + num(float64(c.G)/255) + " " + num(float64(c.B)/255)
+}
+
+// num formats a coordinate with at most two decimals
+func num(v float64) string {
+	s := strconv.FormatFloat(v, 'f', 2, 64)
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	if s == "" || s == "-" || s == "-0" {
+		return "0"
+	}
+	return s
+}
+
+// escape makes b safe inside a PDF literal string
+func escape(b []byte) string {
+	var s strings.Builder
+	for _, c := range b {
+		switch {
+		case c == '(' || c == ')' || c == '\\':
+			s.WriteByte('\\')
+			s.WriteByte(c)
+		case c < 32 || c > 126:
+			fmt.Fprintf(&s, "\\%03o", c)
+		default:
+			s.WriteByte(c)
+		}
+	}
+	return s.String()
+}
+
+func deflate(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	zw := zlib.NewWriter(&b)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
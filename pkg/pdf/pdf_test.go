@@ -0,0 +1,142 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDocumentStructure(t *testing.T) {
+	d := New()
+	d.Title = "Invoice (test)"
+	for i := 0; i < 2; i++ {
+		p := d.AddPage()
+		p.Text(40, 60, HelveticaBold, 18, Black, "Page "+strconv.Itoa(i+1))
+		p.Rect(40, 80, 100, 20, Color{59, 130, 246})
+		p.Line(40, 110, 200, 110, 0.5, Black)
+	}
+
+	out, err := d.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(out, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(out, []byte("%%EOF\n")) {
+		t.Fatalf("missing header or trailer")
+	}
+
+	m := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(out)
+	if m == nil {
+		t.Fatal("no startxref")
+	}
+	xref, _ := strconv.Atoi(string(m[1]))
+	if !bytes.HasPrefix(out[xref:], []byte("xref\n")) {
+		t.Fatalf("startxref %d does not point at the xref table", xref)
+	}
+
+	// Every xref entry points at the object it numbers
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(out[xref:], -1)
+	if len(entries) != 1+1+2+2*2+1 {
+		t.Fatalf("got %d objects, want catalog, pages, 2 fonts, 2 pages with contents and info", len(entries))
+	}
+	for i, e := range entries {
+		off, _ := strconv.Atoi(string(e[1]))
+		if want := fmt.Sprintf("%d 0 obj\n", i+1); !bytes.HasPrefix(out[off:], []byte(want)) {
+			t.Fatalf("xref entry %d points at %q", i+1, out[off:off+10])
+		}
+	}
+
+	if !bytes.Contains(out, []byte("/Count 2")) || !bytes.Contains(out, []byte(`/Title (Invoice \(test\))`)) {
+		t.Fatal("page tree or info dictionary is wrong")
+	}
+}
+
+func TestPageContent(t *testing.T) {
+	d := New()
+	d.AddPage().Text(10, 20, Helvetica, 10, Black, `Cañón (50%) \ café €5 日本`)
+	out, _ := d.Bytes()
+
+	start := bytes.Index(out, []byte("stream\n")) + len("stream\n")
+	end := bytes.Index(out[start:], []byte("\nendstream"))
+	zr, err := zlib.NewReader(bytes.NewReader(out[start : start+end]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(zr)
+
+	want := `BT /F1 10 Tf 0 0 0 rg 10 821.89 Td (Ca\361\363n \(50%\) \\ caf\351 \2005 ??) Tj ET`
+	if !strings.Contains(string(content), want) {
+		t.Fatalf("content stream:\n%s\nwant it to contain:\n%s", content, want)
+	}
+}
+
+func TestTextWidth(t *testing.T) {
+	if got := TextWidth(Helvetica, 10, "Total"); got != 22.23 {
+		// T 611 + o 556 + t 278 + a 556 + l 222
+		t.Fatalf("TextWidth(Total) = %v, want 22.23", got)
+	}
+	if TextWidth(HelveticaBold, 10, "Total") <= TextWidth(Helvetica, 10, "Total") {
+		t.Fatal("bold text should be wider")
+	}
+	if TextWidth(Helvetica, 10, "é") != TextWidth(Helvetica, 10, "e") {
+		t.Fatal("accented letters should be as wide as their base letter")
+	}
+	if len(latin1Base) != 64 {
+		t.Fatalf("latin1Base has %d entries, want 64", len(latin1Base))
+	}
+}
+
+func TestWrap(t *testing.T) {
+	lines := Wrap(Helvetica, 10, 100, "Cache storage overage for the billing period 2026-10-01 to 2026-10-31")
+	if len(lines) < 2 {
+		t.Fatalf("expected several lines, got %q", lines)
+	}
+	for _, l := range lines {
+		if TextWidth(Helvetica, 10, l) > 100 {
+			t.Fatalf("line %q is wider than 100pt", l)
+		}
+	}
+
+	long := Wrap(Helvetica, 10, 30, strings.Repeat("W", 20))
+	if strings.Join(long, "") != strings.Repeat("W", 20) {
+		t.Fatalf("splitting a long word lost characters: %q", long)
+	}
+	if got := Wrap(Helvetica, 10, 1, "W"); len(got) != 1 || got[0] != "W" {
+		t.Fatalf("a glyph wider than the line should stand alone, got %q", got)
+	}
+}
+
+func TestAddImage(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	src.Set(0, 0, color.NRGBA{255, 0, 0, 255})
+	src.Set(1, 0, color.NRGBA{0, 0, 0, 0})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+
+	d := New()
+	img, err := d.AddImage(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, h := img.Size(); w != 2 || h != 1 {
+		t.Fatalf("size = %dx%d, want 2x1", w, h)
+	}
+	zr, _ := zlib.NewReader(bytes.NewReader(img.data))
+	pixels, _ := io.ReadAll(zr)
+	if !bytes.Equal(pixels, []byte{255, 0, 0, 255, 255, 255}) {
+		t.Fatalf("pixels = %v, want red then white for the transparent pixel", pixels)
+	}
+
+	if _, err := d.AddImage([]byte("not an image")); err == nil {
+		t.Fatal("expected an error for invalid image data")
+	}
+}
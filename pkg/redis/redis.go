@@ -65,8 +65,28 @@ func (r *RedisClient) Get(key string) (string, error) {
     return r.client.Get(ctx, key).Result()
 }
 
-func (r *RedisClient) Delete(key string) error {
-    return r.client.Del(ctx, key).Err()
+func (r *RedisClient) Delete(keys ...string) error {
+    return r.client.Del(ctx, keys...).Err()
+}
+
+// SetNX sets key only if it does not exist yet and reports whether it did
+func (r *RedisClient) SetNX(key string, value interface{}, expiration time.Duration) (bool, error) {
+    return r.client.SetNX(ctx, key, value, expiration).Result()
+}
+
+// deleteIfEqual removes a key only while it still holds the given value
+var deleteIfEqual = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+    return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// DeleteIfEqual deletes key if its value is still value, so a lock holder
+// never releases a lock that expired and was taken by someone else
+func (r *RedisClient) DeleteIfEqual(key, value string) (bool, error) {
+    n, err := deleteIfEqual.Run(ctx, r.client, []string{key}, value).Int()
+    return n > 0, err
 }
 
 func getEnv(key, defaultValue string) string {
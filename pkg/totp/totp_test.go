@@ -0,0 +1,120 @@
+package totp
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+// The RFC 6238 SHA-1 seed, "12345678901234567890" in ASCII, as base32
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeRFC6238(t *testing.T) {
+	// Appendix B lists 8-digit codes; 6-digit codes are their last six digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatalf("Code at %d: %v", tt.unix, err)
+		}
+		if got != tt.want {
+			t.Errorf("Code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+
+	if got, err := Code(" gezdgnbvgy3tqojqgezdgnbvgy3tqojq ", Step(time.Unix(59, 0))); err != nil || got != "287082" {
+		t.Errorf("lowercase secret: got %s, %v", got, err)
+	}
+	if _, err := Code("not base32!", 1); err == nil {
+		t.Error("Code with an invalid secret succeeded, want error")
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+	code := func(s int64) string {
+		c, err := Code(rfcSecret, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		code     string
+		skew     int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", code(step), 1, step, true},
+		{"previous step", code(step - 1), 1, step - 1, true},
+		{"next step", code(step + 1), 1, step + 1, true},
+		{"two steps behind", code(step - 2), 1, 0, false},
+		{"two steps ahead", code(step + 2), 1, 0, false},
+		{"previous step without skew", code(step - 1), 0, 0, false},
+		{"current step without skew", code(step), 0, step, true},
+		{"two steps behind, skew 2", code(step - 2), 2, step - 2, true},
+		{"spaces", "050 471", 1, step, true},
+		{"too short", "05047", 1, 0, false},
+		{"too long", "0504710", 1, 0, false},
+		{"wrong code", "000000", 1, 0, false},
+	}
+	for _, tt := range tests {
+		gotStep, ok := Validate(rfcSecret, tt.code, now, tt.skew)
+		if ok != tt.wantOK || gotStep != tt.wantStep {
+			t.Errorf("%s: Validate = %d, %v; want %d, %v", tt.name, gotStep, ok, tt.wantStep, tt.wantOK)
+		}
+	}
+
+	// The step boundary: 29 seconds into a step the previous one is still
+	// within the window, the one before it is not
+	edge := time.Unix((step+1)*Period-1, 0)
+	if _, ok := Validate(rfcSecret, code(step-1), edge, 1); !ok {
+		t.Error("previous step rejected at the end of the current step")
+	}
+	if _, ok := Validate(rfcSecret, code(step-1), edge.Add(time.Second), 1); ok {
+		t.Error("code two steps old accepted")
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret) != 32 {
+		t.Errorf("secret %q has %d characters, want 32", secret, len(secret))
+	}
+	c, err := Code(secret, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Validate(secret, c, time.Unix(Period, 0), 0); !ok {
+		t.Error("code for a generated secret does not validate")
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	u, err := url.Parse(ProvisioningURI("ISP SaaS", "ops@isp.example", rfcSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/ISP SaaS:ops@isp.example" ||
+		q.Get("secret") != rfcSecret || q.Get("issuer") != "ISP SaaS" || q.Get("algorithm") != "SHA1" ||
+		q.Get("digits") != "6" || q.Get("period") != "30" {
+		t.Fatalf("unexpected provisioning URI: %s", u)
+	}
+}
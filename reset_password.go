@@ -1,12 +0,0 @@
-package main
-
-import (
-    "fmt"
-    "golang.org/x/crypto/bcrypt"
-)
-
-func main() {
-    password := "Admin123456"
-    hash, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-    fmt.Println(string(hash))
-}